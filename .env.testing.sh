@@ -8,3 +8,50 @@ export PORT=8080
 
 export DEBUG=1
 export SECRET_KEY="TEST!@#TEST"
+export SECRET_KEY_ID="default"
+export JWT_KEYS=""
+export JWT_SIGNING_KEY=""
+export JWT_ISSUER="http://127.0.0.1:8080"
+export JWT_AUDIENCE=""
+export ACCESS_TOKEN_TTL="15m"
+export REFRESH_TOKEN_TTL="720h"
+export REVOCATION_CACHE_TTL="30s"
+
+export MAILER="log"
+export MAILER_DIR=""
+export SMTP_ADDR=""
+export SMTP_USERNAME=""
+export SMTP_PASSWORD=""
+export MAIL_FROM="noreply@localhost"
+export PASSWORD_RESET_URL="http://localhost:3000/password/reset"
+export EMAIL_VERIFY_URL="http://localhost:8080/verify-email"
+export EMAIL_CHANGE_URL="http://localhost:8080/email/change/confirm"
+export REQUIRE_VERIFIED_EMAIL=false
+export TOTP_ISSUER="webdeveloppro"
+export WEBAUTHN_RP_ID="localhost"
+export WEBAUTHN_ORIGINS="http://localhost:3000"
+export OAUTH_PROVIDERS=""
+export OAUTH_FRONTEND_URL="http://localhost:3000/oauth/callback"
+export OIDC_LOGIN_URL="http://localhost:3000/authorize"
+export ID_TOKEN_KEY=""
+export LOGIN_LOCK_THRESHOLD=5
+export LOGIN_LOCK_DURATION="1m"
+export LOGIN_IP_THRESHOLD=20
+export LOGIN_FAILURE_WINDOW="15m"
+export TRUSTED_PROXIES=""
+export RATE_LIMIT_STORE="memory"
+export RATE_LIMITS=""
+export INVITATION_URL="http://localhost:3000/invitations/accept"
+export PASSWORD_MIN_LENGTH=4
+export TENANTS=""
+export SESSION_COOKIES=false
+export SESSION_TTL="24h"
+export SESSION_COOKIE_DOMAIN=""
+export SESSION_COOKIE_SECURE=true
+export SESSION_SAME_SITE="lax"
+export MAGIC_LINK_URL="http://localhost:8080/login/magic"
+export MAGIC_LINK_TTL="15m"
+export MAGIC_LINK_SAME_DEVICE=false
+export PASSWORD_HASHER="bcrypt"
+export BCRYPT_COST=10
+export LEGACY_PLAINTEXT_PASSWORDS=false
@@ -1,8 +1,14 @@
 package main
 
 import (
+	"flag"
+	"fmt"
 	"log"
+	"net/http"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/jackc/pgx"
 	u "github.com/webdeveloppro/user/pkg/user"
@@ -48,6 +54,512 @@ func main() {
 
 	storage := u.NewPostgres(pg)
 
-	app, _ := u.NewApp(storage)
+	config := u.DefaultConfig()
+	if hasher := os.Getenv("PASSWORD_HASHER"); hasher != "" {
+		config.PasswordHasher = hasher
+	}
+
+	if cost := os.Getenv("BCRYPT_COST"); cost != "" {
+		config.BcryptCost, err = strconv.Atoi(cost)
+		if err != nil {
+			log.Fatalf("Wrong BCRYPT_COST value %v", err)
+		}
+	}
+
+	if legacy := os.Getenv("LEGACY_PLAINTEXT_PASSWORDS"); legacy != "" {
+		config.LegacyPlaintextPasswords, err = strconv.ParseBool(legacy)
+		if err != nil {
+			log.Fatalf("Wrong LEGACY_PLAINTEXT_PASSWORDS value %v", err)
+		}
+	}
+
+	config.Keys, err = loadKeys()
+	if err != nil {
+		log.Fatalf("Unable to load signing keys %v", err)
+	}
+	config.SigningKey = os.Getenv("JWT_SIGNING_KEY")
+	config.Issuer = os.Getenv("JWT_ISSUER")
+	config.Audience = os.Getenv("JWT_AUDIENCE")
+
+	if ttl := os.Getenv("ACCESS_TOKEN_TTL"); ttl != "" {
+		config.AccessTokenTTL, err = time.ParseDuration(ttl)
+		if err != nil {
+			log.Fatalf("Wrong ACCESS_TOKEN_TTL value %v", err)
+		}
+	}
+
+	if ttl := os.Getenv("REFRESH_TOKEN_TTL"); ttl != "" {
+		config.RefreshTokenTTL, err = time.ParseDuration(ttl)
+		if err != nil {
+			log.Fatalf("Wrong REFRESH_TOKEN_TTL value %v", err)
+		}
+	}
+
+	if ttl := os.Getenv("REVOCATION_CACHE_TTL"); ttl != "" {
+		config.RevocationCacheTTL, err = time.ParseDuration(ttl)
+		if err != nil {
+			log.Fatalf("Wrong REVOCATION_CACHE_TTL value %v", err)
+		}
+	}
+
+	config.Mailer, err = loadMailer()
+	if err != nil {
+		log.Fatalf("Unable to setup mailer %v", err)
+	}
+
+	if link := os.Getenv("PASSWORD_RESET_URL"); link != "" {
+		config.PasswordResetURL = link
+	}
+
+	if link := os.Getenv("EMAIL_VERIFY_URL"); link != "" {
+		config.EmailVerifyURL = link
+	}
+
+	if link := os.Getenv("EMAIL_CHANGE_URL"); link != "" {
+		config.EmailChangeURL = link
+	}
+
+	if issuer := os.Getenv("TOTP_ISSUER"); issuer != "" {
+		config.TOTPIssuer = issuer
+	}
+
+	if rpID := os.Getenv("WEBAUTHN_RP_ID"); rpID != "" {
+		config.WebAuthnRPID = rpID
+	}
+
+	if origins := os.Getenv("WEBAUTHN_ORIGINS"); origins != "" {
+		config.WebAuthnOrigins = strings.Split(origins, ",")
+	}
+
+	if required := os.Getenv("REQUIRE_VERIFIED_EMAIL"); required != "" {
+		config.RequireVerifiedEmail, err = strconv.ParseBool(required)
+		if err != nil {
+			log.Fatalf("Wrong REQUIRE_VERIFIED_EMAIL value %v", err)
+		}
+	}
+
+	if threshold := os.Getenv("LOGIN_LOCK_THRESHOLD"); threshold != "" {
+		config.LoginLockThreshold, err = strconv.Atoi(threshold)
+		if err != nil {
+			log.Fatalf("Wrong LOGIN_LOCK_THRESHOLD value %v", err)
+		}
+	}
+
+	if lock := os.Getenv("LOGIN_LOCK_DURATION"); lock != "" {
+		config.LoginLockDuration, err = time.ParseDuration(lock)
+		if err != nil {
+			log.Fatalf("Wrong LOGIN_LOCK_DURATION value %v", err)
+		}
+	}
+
+	if threshold := os.Getenv("LOGIN_IP_THRESHOLD"); threshold != "" {
+		config.LoginIPThreshold, err = strconv.Atoi(threshold)
+		if err != nil {
+			log.Fatalf("Wrong LOGIN_IP_THRESHOLD value %v", err)
+		}
+	}
+
+	if window := os.Getenv("LOGIN_FAILURE_WINDOW"); window != "" {
+		config.LoginFailureWindow, err = time.ParseDuration(window)
+		if err != nil {
+			log.Fatalf("Wrong LOGIN_FAILURE_WINDOW value %v", err)
+		}
+	}
+
+	if proxies := os.Getenv("TRUSTED_PROXIES"); proxies != "" {
+		config.TrustedProxies = strings.Split(proxies, ",")
+	}
+
+	if err := loadRateLimits(config.RateLimits); err != nil {
+		log.Fatalf("Wrong RATE_LIMITS value %v", err)
+	}
+
+	switch os.Getenv("RATE_LIMIT_STORE") {
+	case "", "memory":
+	case "postgres":
+		config.RateLimitStore = storage
+	default:
+		log.Fatalf("Unknown RATE_LIMIT_STORE %q, expected memory or postgres", os.Getenv("RATE_LIMIT_STORE"))
+	}
+	go deleteExpired(storage, config.RateLimitStore != nil, config.ClockSkew)
+
+	config.OAuthProviders = loadOAuthProviders()
+	if link := os.Getenv("OAUTH_FRONTEND_URL"); link != "" {
+		config.OAuthFrontendURL = link
+	}
+
+	if link := os.Getenv("OIDC_LOGIN_URL"); link != "" {
+		config.OIDCLoginURL = link
+	}
+	config.IDTokenKey = os.Getenv("ID_TOKEN_KEY")
+
+	if link := os.Getenv("INVITATION_URL"); link != "" {
+		config.InvitationURL = link
+	}
+
+	if length := os.Getenv("PASSWORD_MIN_LENGTH"); length != "" {
+		config.PasswordPolicy.MinLength, err = strconv.Atoi(length)
+		if err != nil {
+			log.Fatalf("Wrong PASSWORD_MIN_LENGTH value %v", err)
+		}
+	}
+
+	config.Tenants, err = loadTenants()
+	if err != nil {
+		log.Fatalf("Unable to load tenants %v", err)
+	}
+
+	if sessions := os.Getenv("SESSION_COOKIES"); sessions != "" {
+		config.SessionCookies, err = strconv.ParseBool(sessions)
+		if err != nil {
+			log.Fatalf("Wrong SESSION_COOKIES value %v", err)
+		}
+	}
+
+	if ttl := os.Getenv("SESSION_TTL"); ttl != "" {
+		config.SessionTTL, err = time.ParseDuration(ttl)
+		if err != nil {
+			log.Fatalf("Wrong SESSION_TTL value %v", err)
+		}
+	}
+
+	config.SessionCookieDomain = os.Getenv("SESSION_COOKIE_DOMAIN")
+	if secure := os.Getenv("SESSION_COOKIE_SECURE"); secure != "" {
+		config.SessionCookieSecure, err = strconv.ParseBool(secure)
+		if err != nil {
+			log.Fatalf("Wrong SESSION_COOKIE_SECURE value %v", err)
+		}
+	}
+
+	switch sameSite := os.Getenv("SESSION_SAME_SITE"); sameSite {
+	case "":
+	case "lax":
+		config.SessionSameSite = http.SameSiteLaxMode
+	case "strict":
+		config.SessionSameSite = http.SameSiteStrictMode
+	case "none":
+		config.SessionSameSite = http.SameSiteNoneMode
+	default:
+		log.Fatalf("Wrong SESSION_SAME_SITE value %s, expected lax, strict or none", sameSite)
+	}
+
+	if link := os.Getenv("MAGIC_LINK_URL"); link != "" {
+		config.MagicLinkURL = link
+	}
+
+	if ttl := os.Getenv("MAGIC_LINK_TTL"); ttl != "" {
+		config.MagicLinkTTL, err = time.ParseDuration(ttl)
+		if err != nil {
+			log.Fatalf("Wrong MAGIC_LINK_TTL value %v", err)
+		}
+	}
+
+	if sameDevice := os.Getenv("MAGIC_LINK_SAME_DEVICE"); sameDevice != "" {
+		config.MagicLinkSameDevice, err = strconv.ParseBool(sameDevice)
+		if err != nil {
+			log.Fatalf("Wrong MAGIC_LINK_SAME_DEVICE value %v", err)
+		}
+	}
+
+	app, err := u.NewAppWithConfig(storage, config)
+	if err != nil {
+		log.Fatalf("Unable to create application %v", err)
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "register-client" {
+		registerClient(&app, os.Args[2:])
+		return
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "register-service-client" {
+		registerServiceClient(&app, os.Args[2:])
+		return
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "create-role" {
+		createRole(&app, os.Args[2:])
+		return
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "assign-role" {
+		assignRole(&app, os.Args[2:])
+		return
+	}
+
 	app.Run(os.Getenv("HOST") + ":" + os.Getenv("PORT"))
 }
+
+// loadKeys read SECRET_KEY and JWT_KEYS env
+// JWT_KEYS is comma separated list of kid=path, where path is PEM private key or file with HMAC secret
+func loadKeys() ([]u.KeyConfig, error) {
+	var keys []u.KeyConfig
+
+	if secret := os.Getenv("SECRET_KEY"); secret != "" {
+		kid := os.Getenv("SECRET_KEY_ID")
+		if kid == "" {
+			kid = "default"
+		}
+		keys = append(keys, u.KeyConfig{ID: kid, Secret: []byte(secret)})
+	}
+
+	more, err := parseKeys("JWT_KEYS")
+	return append(keys, more...), err
+}
+
+// parseKeys read env with comma separated list of kid=path
+func parseKeys(env string) ([]u.KeyConfig, error) {
+	var keys []u.KeyConfig
+
+	for _, item := range strings.Split(os.Getenv(env), ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+
+		parts := strings.SplitN(item, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("wrong %s item %q, expected kid=path", env, item)
+		}
+
+		k, err := u.LoadKeyConfig(parts[0], parts[1])
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, k)
+	}
+
+	return keys, nil
+}
+
+// loadTenants read TENANTS env, comma separated list of id=host host..., like acme=acme.com www.acme.com
+// every tenant can override settings with TENANT_<ID>_JWT_KEYS, _JWT_SIGNING_KEY, _ACCESS_TOKEN_TTL,
+// _REFRESH_TOKEN_TTL and _PASSWORD_MIN_LENGTH
+func loadTenants() ([]u.Tenant, error) {
+	var tenants []u.Tenant
+
+	for _, item := range strings.Split(os.Getenv("TENANTS"), ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+
+		parts := strings.SplitN(item, "=", 2)
+		t := u.Tenant{ID: strings.TrimSpace(parts[0])}
+		if len(parts) == 2 {
+			t.Hosts = strings.Fields(parts[1])
+		}
+
+		prefix := "TENANT_" + strings.ToUpper(t.ID) + "_"
+		var err error
+		if t.Keys, err = parseKeys(prefix + "JWT_KEYS"); err != nil {
+			return nil, err
+		}
+		t.SigningKey = os.Getenv(prefix + "JWT_SIGNING_KEY")
+
+		durations := map[string]*time.Duration{
+			"ACCESS_TOKEN_TTL":  &t.AccessTokenTTL,
+			"REFRESH_TOKEN_TTL": &t.RefreshTokenTTL,
+		}
+		for name, to := range durations {
+			if val := os.Getenv(prefix + name); val != "" {
+				if *to, err = time.ParseDuration(val); err != nil {
+					return nil, fmt.Errorf("wrong %s%s value %v", prefix, name, err)
+				}
+			}
+		}
+
+		if val := os.Getenv(prefix + "PASSWORD_MIN_LENGTH"); val != "" {
+			if t.PasswordPolicy.MinLength, err = strconv.Atoi(val); err != nil {
+				return nil, fmt.Errorf("wrong %sPASSWORD_MIN_LENGTH value %v", prefix, err)
+			}
+		}
+
+		tenants = append(tenants, t)
+	}
+
+	return tenants, nil
+}
+
+// registerClient add OpenID Connect client and print its credentials
+//
+//	user register-client [-public] name redirect_uri...
+func registerClient(app *u.App, args []string) {
+	fs := flag.NewFlagSet("register-client", flag.ExitOnError)
+	public := fs.Bool("public", false, "client without secret, like SPA or mobile app, it must use PKCE")
+	fs.Parse(args)
+
+	if fs.NArg() < 2 {
+		log.Fatal("Usage: register-client [-public] name redirect_uri...")
+	}
+
+	c := &u.Client{Name: fs.Arg(0), RedirectURIs: fs.Args()[1:]}
+	secret, err := app.RegisterClient(c, !*public)
+	if err != nil {
+		log.Fatalf("Unable to register client %v", err)
+	}
+
+	fmt.Printf("client_id=%s\n", c.ID)
+	if secret != "" {
+		fmt.Printf("client_secret=%s\n", secret)
+	}
+}
+
+// registerServiceClient add service client for client_credentials grant and print its credentials
+//
+//	user register-service-client name scope...
+func registerServiceClient(app *u.App, args []string) {
+	if len(args) < 1 {
+		log.Fatal("Usage: register-service-client name scope...")
+	}
+
+	c := &u.ServiceClient{Name: args[0], Scopes: args[1:]}
+	secret, err := app.RegisterServiceClient(c)
+	if err != nil {
+		log.Fatalf("Unable to register service client %v", err)
+	}
+
+	fmt.Printf("client_id=%s\nclient_secret=%s\n", c.ID, secret)
+}
+
+// createRole add role with permissions
+//
+//	user create-role name permission...
+func createRole(app *u.App, args []string) {
+	if len(args) < 1 {
+		log.Fatal("Usage: create-role name permission...")
+	}
+
+	if err := app.CreateRole(&u.Role{Name: args[0], Permissions: args[1:]}); err != nil {
+		log.Fatalf("Unable to create role %v", err)
+	}
+}
+
+// assignRole give role to user with email, tenant is default one when omitted
+//
+//	user assign-role email role [tenant]
+func assignRole(app *u.App, args []string) {
+	if len(args) != 2 && len(args) != 3 {
+		log.Fatal("Usage: assign-role email role [tenant]")
+	}
+
+	user := u.User{Email: args[0]}
+	if len(args) == 3 {
+		user.Tenant = args[2]
+	}
+	if err := app.Storage.GetUserByEmail(&user); err != nil {
+		log.Fatalf("Unable to find user %v", err)
+	}
+
+	if err := app.Storage.AssignRole(user.ID, args[1]); err != nil {
+		log.Fatalf("Unable to assign role %v", err)
+	}
+}
+
+// loadOAuthProviders read OAUTH_PROVIDERS env, comma separated list of provider names
+// every provider is configured with OAUTH_<NAME>_ISSUER, _CLIENT_ID, _CLIENT_SECRET and _REDIRECT_URL
+func loadOAuthProviders() map[string]u.OAuthProvider {
+	providers := map[string]u.OAuthProvider{}
+
+	for _, name := range strings.Split(os.Getenv("OAUTH_PROVIDERS"), ",") {
+		if name = strings.TrimSpace(name); name == "" {
+			continue
+		}
+
+		prefix := "OAUTH_" + strings.ToUpper(name) + "_"
+		providers[name] = u.OAuthProvider{
+			Issuer:       os.Getenv(prefix + "ISSUER"),
+			ClientID:     os.Getenv(prefix + "CLIENT_ID"),
+			ClientSecret: os.Getenv(prefix + "CLIENT_SECRET"),
+			RedirectURL:  os.Getenv(prefix + "REDIRECT_URL"),
+		}
+	}
+
+	return providers
+}
+
+// loadRateLimits read RATE_LIMITS env and change limits in place, it is comma separated
+// list of name=limit/period[/by], like register=10/1h/ip. Limit 0 turn limit off
+func loadRateLimits(limits map[string]u.RateLimit) error {
+	for _, item := range strings.Split(os.Getenv("RATE_LIMITS"), ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+
+		parts := strings.SplitN(item, "=", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("wrong item %q, expected name=limit/period[/by]", item)
+		}
+
+		values := strings.Split(parts[1], "/")
+		if len(values) == 1 && values[0] == "0" {
+			delete(limits, parts[0])
+			continue
+		}
+		if len(values) < 2 || len(values) > 3 {
+			return fmt.Errorf("wrong item %q, expected name=limit/period[/by]", item)
+		}
+
+		l := u.RateLimit{By: u.RateLimitByIP}
+		var err error
+		if l.Limit, err = strconv.Atoi(values[0]); err != nil {
+			return fmt.Errorf("wrong limit in %q: %v", item, err)
+		}
+		if l.Period, err = time.ParseDuration(values[1]); err != nil {
+			return fmt.Errorf("wrong period in %q: %v", item, err)
+		}
+		if len(values) == 3 {
+			l.By = values[2]
+		}
+		if l.By != u.RateLimitByIP && l.By != u.RateLimitByUser && l.By != u.RateLimitByRoute {
+			return fmt.Errorf("wrong key in %q, expected ip, user or route", item)
+		}
+		limits[parts[0]] = l
+	}
+	return nil
+}
+
+// deleteExpired remove expired tokens and rate limit buckets which are full again from time to time,
+// tokens are kept for clock skew longer as they are still accepted within it
+func deleteExpired(storage *u.PGStorage, rateLimits bool, skew time.Duration) {
+	for range time.Tick(10 * time.Minute) {
+		if rateLimits {
+			if err := storage.DeleteFullRateLimits(); err != nil {
+				log.Printf("Unable to delete rate limits %v", err)
+			}
+		}
+
+		before := time.Now().Add(-skew)
+		if err := storage.DeleteExpiredRevokedTokens(before); err != nil {
+			log.Printf("Unable to delete expired revoked tokens %v", err)
+		}
+		if err := storage.DeleteExpiredRefreshTokens(before); err != nil {
+			log.Printf("Unable to delete expired refresh tokens %v", err)
+		}
+		if err := storage.DeleteExpiredActionTokens(before); err != nil {
+			log.Printf("Unable to delete expired action tokens %v", err)
+		}
+	}
+}
+
+// loadMailer read MAILER env, it could be log, file or smtp.
+// Log mailer write links with tokens to logs, so without DEBUG it has to be chosen explicitly
+func loadMailer() (u.Mailer, error) {
+	switch os.Getenv("MAILER") {
+	case "":
+		if debug, _ := strconv.ParseBool(os.Getenv("DEBUG")); !debug {
+			return nil, fmt.Errorf("MAILER is not set, use MAILER=log to write emails to logs")
+		}
+		return u.LogMailer{}, nil
+	case "log":
+		return u.LogMailer{}, nil
+	case "file":
+		return u.FileMailer{Dir: os.Getenv("MAILER_DIR")}, nil
+	case "smtp":
+		return u.SMTPMailer{
+			Addr:     os.Getenv("SMTP_ADDR"),
+			Username: os.Getenv("SMTP_USERNAME"),
+			Password: os.Getenv("SMTP_PASSWORD"),
+			From:     os.Getenv("MAIL_FROM"),
+		}, nil
+	}
+
+	return nil, fmt.Errorf("unknown MAILER %q, expected log, file or smtp", os.Getenv("MAILER"))
+}
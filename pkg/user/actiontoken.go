@@ -0,0 +1,103 @@
+package user
+
+import (
+	"log"
+	"net/url"
+	"time"
+
+	"github.com/jackc/pgx"
+	"github.com/pkg/errors"
+)
+
+// Action token purposes
+const (
+	PurposePasswordReset = "password_reset"
+	PurposeEmailVerify   = "email_verify"
+	PurposeEmailChange   = "email_change"
+	PurposeMFAChallenge  = "mfa_challenge"
+	PurposeMagicLink     = "magic_link"
+)
+
+// ErrActionTokenUsed returned by storage when action token was already used
+var ErrActionTokenUsed = errors.New("user: action token already used")
+
+// ErrActionTokenInvalid returned when action token is unknown, expired or used
+var ErrActionTokenInvalid = errors.New("user: action token is invalid or expired")
+
+// ActionToken is single-use, time-limited token we send to users by email
+// to confirm some action, like password reset. Only sha256 hash of token is stored
+type ActionToken struct {
+	ID        int
+	UserID    int
+	Purpose   string
+	TokenHash string
+	// Data is purpose specific payload
+	Data      string
+	CreatedAt time.Time
+	ExpiresAt time.Time
+	UsedAt    *time.Time
+}
+
+// newActionToken create and store action token for user
+func (a *App) newActionToken(u *User, purpose, data string, ttl time.Duration) (string, error) {
+	token, err := randomString(32)
+	if err != nil {
+		return "", err
+	}
+
+	at := ActionToken{
+		UserID:    u.ID,
+		Purpose:   purpose,
+		TokenHash: hashToken(token),
+		Data:      data,
+		ExpiresAt: time.Now().Add(ttl),
+	}
+
+	if err := a.Storage.CreateActionToken(&at); err != nil {
+		return "", errors.Wrapf(err, "user: cannot store %s token", purpose)
+	}
+
+	return token, nil
+}
+
+// useActionToken check token and mark it used, so it can't be used again
+func (a *App) useActionToken(token, purpose string) (*ActionToken, error) {
+	if token == "" {
+		return nil, ErrActionTokenInvalid
+	}
+
+	at := ActionToken{TokenHash: hashToken(token)}
+	if err := a.Storage.GetActionToken(&at); err != nil {
+		if err != pgx.ErrNoRows {
+			return nil, err
+		}
+		return nil, ErrActionTokenInvalid
+	}
+
+	if at.Purpose != purpose || at.UsedAt != nil || time.Now().After(at.ExpiresAt) {
+		return nil, ErrActionTokenInvalid
+	}
+
+	if err := a.Storage.UseActionToken(&at); err != nil {
+		if err == ErrActionTokenUsed {
+			return nil, ErrActionTokenInvalid
+		}
+		return nil, err
+	}
+
+	return &at, nil
+}
+
+// actionLink add token to base url as query parameter
+func actionLink(base, token string) string {
+	u, err := url.Parse(base)
+	if err != nil {
+		log.Printf("wrong action link base url %s: %v", base, err)
+		return base + "?token=" + url.QueryEscape(token)
+	}
+
+	q := u.Query()
+	q.Set("token", token)
+	u.RawQuery = q.Encode()
+	return u.String()
+}
@@ -0,0 +1,375 @@
+package user
+
+import (
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/jackc/pgx"
+	v "github.com/webdeveloppro/validating"
+)
+
+// User statuses used by admin list filter
+const (
+	StatusActive   = "active"
+	StatusDisabled = "disabled"
+)
+
+// Audit log actions written by admin endpoints
+const (
+	AuditUserUpdate        = "user.update"
+	AuditUserDisable       = "user.disable"
+	AuditUserEnable        = "user.enable"
+	AuditUserPasswordReset = "user.password_reset"
+	AuditUserDelete        = "user.delete"
+)
+
+const (
+	adminUsersLimit    = 50
+	adminUsersMaxLimit = 100
+)
+
+// UserFilter limit users returned by Storage.GetUsers, zero fields are not used
+// Users are ordered by id, After is id of last user from previous page
+type UserFilter struct {
+	// Tenant is always used, admins see only users of own tenant
+	Tenant        string
+	Email         string
+	CreatedAfter  *time.Time
+	CreatedBefore *time.Time
+	Status        string
+	After         int
+	Limit         int
+}
+
+// AuditLog is record of action done by admin, Details hold action specific data
+type AuditLog struct {
+	ID        int                    `json:"id"`
+	ActorID   int                    `json:"actor_id"`
+	Action    string                 `json:"action"`
+	TargetID  int                    `json:"target_id"`
+	Details   map[string]interface{} `json:"details"`
+	IP        string                 `json:"ip"`
+	CreatedAt time.Time              `json:"created_at"`
+}
+
+// AdminUser is user data returned by admin endpoints
+type AdminUser struct {
+	Profile
+	Status      string     `json:"status"`
+	DisabledAt  *time.Time `json:"disabled_at"`
+	LockedUntil *time.Time `json:"locked_until"`
+	MFAEnabled  bool       `json:"mfa_enabled"`
+	Roles       []string   `json:"roles"`
+}
+
+// AdminUser return user data for admin endpoints
+func (u *User) AdminUser() AdminUser {
+	au := AdminUser{
+		Profile:     u.Profile(),
+		Status:      StatusActive,
+		DisabledAt:  u.DisabledAt,
+		LockedUntil: u.LockedUntil,
+		MFAEnabled:  u.TOTPEnabledAt != nil,
+		Roles:       u.Roles,
+	}
+	if u.DisabledAt != nil {
+		au.Status = StatusDisabled
+	}
+	if au.Roles == nil {
+		au.Roles = []string{}
+	}
+	return au
+}
+
+// remoteIP return client address of request without port
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// audit write admin action to audit log, action is done already so we only log errors
+func (a *App) audit(r *http.Request, action string, target *User, details map[string]interface{}) {
+	actor, _ := UserFromContext(r.Context())
+	if details == nil {
+		details = map[string]interface{}{}
+	}
+
+	entry := AuditLog{
+		ActorID:  actor.ID,
+		Action:   action,
+		TargetID: target.ID,
+		Details:  details,
+		IP:       remoteIP(r),
+	}
+	if err := a.Storage.CreateAuditLog(&entry); err != nil {
+		log.Printf("cannot write audit log %s by user %d for user %d: %v", action, actor.ID, target.ID, err)
+	}
+}
+
+// adminTarget load user from {id} route variable, it respond with error and return nil if user is not found
+func (a *App) adminTarget(w http.ResponseWriter, r *http.Request) *User {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		respondWithError(w, r, http.StatusNotFound, "user does not exist")
+		return nil
+	}
+
+	u := User{ID: id}
+	err = a.Storage.GetUserByID(&u)
+	if err == nil && u.Tenant != TenantFromContext(r.Context()) {
+		err = pgx.ErrNoRows
+	}
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			respondWithError(w, r, http.StatusNotFound, "user does not exist")
+			return nil
+		}
+		log.Printf("cannot load user %d: %v", id, err)
+		respondWithError(w, r, http.StatusInternalServerError, "cannot load user, please try again in few minutes")
+		return nil
+	}
+	return &u
+}
+
+// notSelf refuse admin actions which would lock admin out of own account
+func notSelf(w http.ResponseWriter, r *http.Request, target *User) bool {
+	if actor, _ := UserFromContext(r.Context()); actor.ID == target.ID {
+		respondWithError(w, r, http.StatusBadRequest, "you cannot do this with your own account")
+		return false
+	}
+	return true
+}
+
+// adminListUsers return page of users matching query filters
+//
+//	GET /admin/users?email=gmail&status=active&created_after=2018-01-01T00:00:00Z&limit=50&cursor=120
+func (a *App) adminListUsers(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	f := UserFilter{Tenant: TenantFromContext(r.Context()), Email: q.Get("email"), Status: q.Get("status"), Limit: adminUsersLimit}
+	errs := v.Errors{}
+
+	if f.Status != "" && f.Status != StatusActive && f.Status != StatusDisabled {
+		errs.Extend(v.NewErrors("status", v.ErrInvalid, "should be active or disabled"))
+	}
+
+	times := []struct {
+		name string
+		to   **time.Time
+	}{
+		{"created_after", &f.CreatedAfter},
+		{"created_before", &f.CreatedBefore},
+	}
+	for _, t := range times {
+		if val := q.Get(t.name); val != "" {
+			parsed, err := time.Parse(time.RFC3339, val)
+			if err != nil {
+				errs.Extend(v.NewErrors(t.name, v.ErrInvalid, "should be RFC 3339 time"))
+				continue
+			}
+			*t.to = &parsed
+		}
+	}
+
+	if val := q.Get("limit"); val != "" {
+		limit, err := strconv.Atoi(val)
+		if err != nil || limit < 1 || limit > adminUsersMaxLimit {
+			errs.Extend(v.NewErrors("limit", v.ErrInvalid, "should be number between 1 and 100"))
+		}
+		f.Limit = limit
+	}
+
+	if val := q.Get("cursor"); val != "" {
+		after, err := strconv.Atoi(val)
+		if err != nil || after < 0 {
+			errs.Extend(v.NewErrors("cursor", v.ErrInvalid, "is invalid"))
+		}
+		f.After = after
+	}
+
+	if len(errs) > 0 {
+		respondWithJSON(w, r, http.StatusBadRequest, errs.JSONErrors())
+		return
+	}
+
+	users, err := a.Storage.GetUsers(&f)
+	if err != nil {
+		log.Printf("cannot load users: %v", err)
+		respondWithError(w, r, http.StatusInternalServerError, "cannot load users, please try again in few minutes")
+		return
+	}
+
+	res := struct {
+		Users      []AdminUser `json:"users"`
+		NextCursor string      `json:"next_cursor,omitempty"`
+	}{Users: []AdminUser{}}
+	for i := range users {
+		res.Users = append(res.Users, users[i].AdminUser())
+	}
+	if len(users) == f.Limit {
+		res.NextCursor = strconv.Itoa(users[len(users)-1].ID)
+	}
+
+	respondWithJSON(w, r, http.StatusOK, res)
+}
+
+// adminGetUser return user by id
+func (a *App) adminGetUser(w http.ResponseWriter, r *http.Request) {
+	u := a.adminTarget(w, r)
+	if u == nil {
+		return
+	}
+	respondWithJSON(w, r, http.StatusOK, u.AdminUser())
+}
+
+// adminUpdateUser change email and profile fields present in body
+// email set by admin is treated as verified
+func (a *App) adminUpdateUser(w http.ResponseWriter, r *http.Request) {
+	u := a.adminTarget(w, r)
+	if u == nil {
+		return
+	}
+
+	var req struct {
+		ProfilePatch
+		Email *string `json:"email"`
+	}
+
+	if r.Body == nil {
+		respondWithJSON(w, r, http.StatusBadRequest, []string{})
+		return
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondWithJSON(w, r, http.StatusBadRequest, []string{})
+		return
+	}
+
+	before := u.Profile()
+	req.ProfilePatch.Apply(u)
+	errs := u.ValidateProfile()
+
+	emailChanged := req.Email != nil && *req.Email != u.Email
+	if emailChanged {
+		u.Email = *req.Email
+		errs.Extend(v.Validate(v.Schema{
+			v.F("email", &u.Email): emailValidator(),
+		}))
+	}
+
+	if len(errs) > 0 {
+		respondWithJSON(w, r, http.StatusBadRequest, errs.JSONErrors())
+		return
+	}
+
+	if emailChanged {
+		if err := a.Storage.UpdateEmail(u); err != nil {
+			if err == ErrEmailExists {
+				respondWithJSON(w, r, http.StatusBadRequest, v.NewErrors("email", v.ErrInvalid, "email is already used").JSONErrors())
+				return
+			}
+			log.Printf("cannot update email for user %d: %v", u.ID, err)
+			respondWithError(w, r, http.StatusInternalServerError, "cannot update user, please try again in few minutes")
+			return
+		}
+	}
+
+	if err := a.Storage.UpdateProfile(u); err != nil {
+		log.Printf("cannot update profile for user %d: %v", u.ID, err)
+		respondWithError(w, r, http.StatusInternalServerError, "cannot update user, please try again in few minutes")
+		return
+	}
+
+	a.audit(r, AuditUserUpdate, u, map[string]interface{}{"before": before, "after": u.Profile()})
+	respondWithJSON(w, r, http.StatusOK, u.AdminUser())
+}
+
+// adminDisableUser disable account and revoke all its tokens
+func (a *App) adminDisableUser(w http.ResponseWriter, r *http.Request) {
+	a.adminSetDisabled(w, r, true)
+}
+
+// adminEnableUser let disabled user login again, it also remove lock after failed logins
+func (a *App) adminEnableUser(w http.ResponseWriter, r *http.Request) {
+	a.adminSetDisabled(w, r, false)
+}
+
+func (a *App) adminSetDisabled(w http.ResponseWriter, r *http.Request, disabled bool) {
+	u := a.adminTarget(w, r)
+	if u == nil || !notSelf(w, r, u) {
+		return
+	}
+
+	if err := a.Storage.SetUserDisabled(u, disabled); err != nil {
+		log.Printf("cannot change disabled state of user %d: %v", u.ID, err)
+		respondWithError(w, r, http.StatusInternalServerError, "cannot update user, please try again in few minutes")
+		return
+	}
+
+	action := AuditUserEnable
+	if !disabled {
+		if err := a.Storage.ResetLoginFailures(u); err != nil {
+			log.Printf("cannot reset failed logins for user %d: %v", u.ID, err)
+		}
+	} else {
+		action = AuditUserDisable
+		if err := a.Revocations.RevokeUser(u); err != nil {
+			log.Printf("cannot revoke tokens of disabled user %d: %v", u.ID, err)
+		}
+	}
+
+	a.audit(r, action, u, nil)
+	respondWithJSON(w, r, http.StatusOK, u.AdminUser())
+}
+
+// adminResetPassword remove user password, revoke all tokens and send password reset link
+// user can login again only after choosing new password, tokens are refused until then
+// whatever login method is used
+func (a *App) adminResetPassword(w http.ResponseWriter, r *http.Request) {
+	u := a.adminTarget(w, r)
+	if u == nil || !notSelf(w, r, u) {
+		return
+	}
+
+	if err := a.Storage.RequirePasswordReset(u); err != nil {
+		log.Printf("cannot remove password of user %d: %v", u.ID, err)
+		respondWithError(w, r, http.StatusInternalServerError, "cannot reset password, please try again in few minutes")
+		return
+	}
+
+	if err := a.Revocations.RevokeUser(u); err != nil {
+		log.Printf("cannot revoke tokens of user %d after password reset: %v", u.ID, err)
+	}
+
+	a.sendPasswordReset(u)
+	a.audit(r, AuditUserPasswordReset, u, nil)
+	respondWithJSON(w, r, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// adminDeleteUser delete user with all data
+func (a *App) adminDeleteUser(w http.ResponseWriter, r *http.Request) {
+	u := a.adminTarget(w, r)
+	if u == nil || !notSelf(w, r, u) {
+		return
+	}
+
+	if err := a.Storage.DeleteUser(u); err != nil {
+		if err == pgx.ErrNoRows {
+			respondWithError(w, r, http.StatusNotFound, "user does not exist")
+			return
+		}
+		log.Printf("cannot delete user %d: %v", u.ID, err)
+		respondWithError(w, r, http.StatusInternalServerError, "cannot delete user, please try again in few minutes")
+		return
+	}
+
+	a.audit(r, AuditUserDelete, u, map[string]interface{}{"email": u.Email})
+	respondWithJSON(w, r, http.StatusOK, map[string]string{"status": "ok"})
+}
@@ -0,0 +1,222 @@
+package user
+
+import (
+	"testing"
+	"time"
+)
+
+// setUpAdmin return app where exist@user.com is admin and bob@user.com is user 2, and admin token
+func setUpAdmin(t *testing.T) (*App, string) {
+	a := setUpRoles(t)
+	a.Storage.AssignRole(1, "admin")
+
+	a.Storage.(*FakeStorage).users = map[int]*User{
+		2: {ID: 2, Email: "bob@user.com", Password: existPassword, FirstName: "Bob", CreatedAt: time.Now()},
+	}
+
+	token, _ := loginTokens(t, a)
+	return a, token
+}
+
+func loginBob(a *App) int {
+	code, _ := jsonRequest(a, "POST", "/login", "", "", map[string]string{"email": "bob@user.com", "password": "123123"}, nil)
+	return code
+}
+
+func TestAdminRequiresPermission(t *testing.T) {
+	a := setUpRoles(t)
+	token, _ := loginTokens(t, a)
+
+	if code, _ := jsonRequest(a, "GET", "/admin/users", "", token, nil, nil); code != 403 {
+		t.Errorf("Expected user without permission to be refused, got %d", code)
+	}
+
+	a.Storage.AssignRole(1, "support")
+	token, _ = loginTokens(t, a)
+	if code, _ := jsonRequest(a, "GET", "/admin/users", "", token, nil, nil); code != 200 {
+		t.Errorf("Expected users:read to list users, got %d", code)
+	}
+	if code, _ := jsonRequest(a, "POST", "/admin/users/2/disable", "", token, nil, nil); code != 403 {
+		t.Errorf("Expected users:read to be refused for changes, got %d", code)
+	}
+}
+
+func TestAdminListUsers(t *testing.T) {
+	a, token := setUpAdmin(t)
+
+	tests := []struct {
+		name   string
+		query  string
+		code   int
+		emails []string
+		cursor interface{}
+	}{
+		{"All", "", 200, []string{"exist@user.com", "bob@user.com"}, nil},
+		{"Email", "?email=BOB", 200, []string{"bob@user.com"}, nil},
+		{"Status", "?status=disabled", 200, []string{}, nil},
+		{"First page", "?limit=1", 200, []string{"exist@user.com"}, "1"},
+		{"Next page", "?limit=1&cursor=1", 200, []string{"bob@user.com"}, "2"},
+		{"Created after", "?created_after=2000-01-01T00:00:00Z", 200, []string{"bob@user.com"}, nil},
+		{"Wrong status", "?status=deleted", 400, nil, nil},
+		{"Wrong limit", "?limit=1000", 400, nil, nil},
+	}
+
+	for _, test := range tests {
+		var res map[string]interface{}
+		code, _ := jsonRequest(a, "GET", "/admin/users"+test.query, "", token, nil, &res)
+		if code != test.code {
+			t.Errorf("%s: expected %d, got %d %v", test.name, test.code, code, res)
+			continue
+		}
+		if test.emails == nil {
+			continue
+		}
+
+		users, _ := res["users"].([]interface{})
+		emails := []string{}
+		for _, u := range users {
+			emails = append(emails, u.(map[string]interface{})["email"].(string))
+		}
+		if len(emails) != len(test.emails) || res["next_cursor"] != test.cursor {
+			t.Errorf("%s: expected %v %v, got %v %v", test.name, test.emails, test.cursor, emails, res["next_cursor"])
+			continue
+		}
+		for i := range emails {
+			if emails[i] != test.emails[i] {
+				t.Errorf("%s: expected %v, got %v", test.name, test.emails, emails)
+			}
+		}
+	}
+}
+
+func TestAdminGetUser(t *testing.T) {
+	a, token := setUpAdmin(t)
+
+	var res map[string]interface{}
+	code, _ := jsonRequest(a, "GET", "/admin/users/1", "", token, nil, &res)
+	if code != 200 || res["email"] != "exist@user.com" || res["status"] != "active" || len(res["roles"].([]interface{})) != 1 {
+		t.Errorf("Expected admin user data, got %d %v", code, res)
+	}
+
+	if code, _ := jsonRequest(a, "GET", "/admin/users/99", "", token, nil, nil); code != 404 {
+		t.Errorf("Expected unknown user to return 404, got %d", code)
+	}
+}
+
+func TestAdminUpdateUser(t *testing.T) {
+	a, token := setUpAdmin(t)
+
+	var res map[string]interface{}
+	code, _ := jsonRequest(a, "PATCH", "/admin/users/2", "", token, map[string]string{"email": "robert@user.com", "first_name": "Robert"}, &res)
+	if code != 200 || res["email"] != "robert@user.com" || res["first_name"] != "Robert" || res["email_verified"] != true {
+		t.Fatalf("Expected updated user, got %d %v", code, res)
+	}
+
+	if code, _ := jsonRequest(a, "PATCH", "/admin/users/2", "", token, map[string]string{"email": "exist@user.com"}, nil); code != 400 {
+		t.Errorf("Expected used email to be refused, got %d", code)
+	}
+	if code, _ := jsonRequest(a, "PATCH", "/admin/users/2", "", token, map[string]string{"timezone": "Mars/Olympus"}, nil); code != 400 {
+		t.Errorf("Expected invalid profile to be refused, got %d", code)
+	}
+
+	log := a.Storage.(*FakeStorage).auditLog
+	if len(log) != 1 || log[0].Action != AuditUserUpdate || log[0].ActorID != 1 || log[0].TargetID != 2 {
+		t.Errorf("Expected update in audit log, got %+v", log)
+	}
+}
+
+func TestAdminDisableUser(t *testing.T) {
+	a, token := setUpAdmin(t)
+
+	bob := User{ID: 2, Email: "bob@user.com"}
+	bobToken, _ := bob.GetToken(a.Tokens)
+
+	var disabled, enabled map[string]interface{}
+	if code, body := jsonRequest(a, "POST", "/admin/users/2/disable", "", token, nil, &disabled); code != 200 || disabled["status"] != "disabled" {
+		t.Fatalf("Expected disabled user, got %d %s", code, body)
+	}
+	if code := profileCode(a, "Bearer "+bobToken); code != 401 && code != 403 {
+		t.Errorf("Expected token of disabled user to be refused, got %d", code)
+	}
+	if code := loginBob(a); code != 403 {
+		t.Errorf("Expected disabled user login to be refused, got %d", code)
+	}
+
+	if code, body := jsonRequest(a, "POST", "/admin/users/2/enable", "", token, nil, &enabled); code != 200 || enabled["status"] != "active" {
+		t.Fatalf("Expected enabled user, got %d %s", code, body)
+	}
+	if code := loginBob(a); code != 200 {
+		t.Errorf("Expected enabled user to login, got %d", code)
+	}
+
+	if code, _ := jsonRequest(a, "POST", "/admin/users/1/disable", "", token, nil, nil); code != 400 {
+		t.Errorf("Expected admin to not disable own account, got %d", code)
+	}
+
+	log := a.Storage.(*FakeStorage).auditLog
+	if len(log) != 2 || log[0].Action != AuditUserDisable || log[1].Action != AuditUserEnable {
+		t.Errorf("Expected disable and enable in audit log, got %+v", log)
+	}
+}
+
+func TestAdminResetPassword(t *testing.T) {
+	a, token := setUpAdmin(t)
+
+	if code, _ := jsonRequest(a, "POST", "/admin/users/2/reset-password", "", token, nil, nil); code != 200 {
+		t.Fatalf("Expected password reset, got %d", code)
+	}
+	if code := loginBob(a); code != 400 {
+		t.Errorf("Expected login with old password to fail, got %d", code)
+	}
+
+	reset := mailedToken(t, a, "bob@user.com")
+	if code, body := jsonRequest(a, "POST", "/password/reset", "", "", map[string]string{"token": reset, "password": "new-password"}, nil); code != 200 {
+		t.Errorf("Expected reset link to work, got %d %s", code, body)
+	}
+}
+
+func TestAdminResetPasswordMagicLink(t *testing.T) {
+	a, token := setUpAdmin(t)
+
+	if code, _ := jsonRequest(a, "POST", "/admin/users/2/reset-password", "", token, nil, nil); code != 200 {
+		t.Fatalf("Expected password reset, got %d", code)
+	}
+	reset := mailedToken(t, a, "bob@user.com")
+
+	magicLogin := func() int {
+		sessionRequest(a, "POST", "/login/magic", nil, "", map[string]string{"email": "bob@user.com"})
+		m, _ := a.Config.Mailer.(*MemoryMailer).Last("bob@user.com")
+		match := tokenInMagicLink.FindStringSubmatch(m.Body)
+		if match == nil {
+			t.Fatalf("Expected login link in mail, got: %s", m.Body)
+		}
+		return sessionRequest(a, "GET", "/login/magic/"+match[1], nil, "", nil).Code
+	}
+
+	if code := magicLogin(); code != 403 {
+		t.Errorf("Expected magic link login to be refused until password is chosen, got %d", code)
+	}
+
+	if code, body := jsonRequest(a, "POST", "/password/reset", "", "", map[string]string{"token": reset, "password": "new-password"}, nil); code != 200 {
+		t.Fatalf("Expected reset link to work, got %d %s", code, body)
+	}
+	if code := magicLogin(); code != 200 {
+		t.Errorf("Expected magic link login after new password is chosen, got %d", code)
+	}
+}
+
+func TestAdminDeleteUser(t *testing.T) {
+	a, token := setUpAdmin(t)
+
+	if code, _ := jsonRequest(a, "DELETE", "/admin/users/2", "", token, nil, nil); code != 200 {
+		t.Fatalf("Expected user to be deleted")
+	}
+	if code, _ := jsonRequest(a, "GET", "/admin/users/2", "", token, nil, nil); code != 404 {
+		t.Errorf("Expected deleted user to be gone, got %d", code)
+	}
+
+	log := a.Storage.(*FakeStorage).auditLog
+	if len(log) != 1 || log[0].Action != AuditUserDelete || log[0].Details["email"] != "bob@user.com" {
+		t.Errorf("Expected delete in audit log, got %+v", log)
+	}
+}
@@ -0,0 +1,227 @@
+package user
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/jackc/pgx"
+	v "github.com/webdeveloppro/validating"
+)
+
+// AMRAPIKey is put into amr claim of requests authenticated with API key
+const AMRAPIKey = "apikey"
+
+const (
+	// apiKeyPrefix start every key, so leaked keys are easy to find by secret scanners
+	apiKeyPrefix = "uk_"
+	// apiKeyLastUsedInterval is how often last_used_at is written, to not update row on every request
+	apiKeyLastUsedInterval = time.Minute
+)
+
+// ErrAPIKeyInvalid returned for unknown, revoked or expired API keys
+var ErrAPIKeyInvalid = &TokenError{http.StatusUnauthorized, "api key is invalid"}
+
+// APIKey let scripts authenticate as user without interactive login
+// Key look like uk_<prefix>_<secret>, prefix is stored to find key, secret only as hash
+type APIKey struct {
+	ID         int        `json:"id"`
+	UserID     int        `json:"-"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"`
+	KeyHash    string     `json:"-"`
+	Scopes     []string   `json:"scopes"`
+	ExpiresAt  *time.Time `json:"expires_at"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	RevokedAt  *time.Time `json:"-"`
+}
+
+// newAPIKey return key string, its prefix and hash of the secret part
+func newAPIKey() (string, string, string, error) {
+	b := make([]byte, 6)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", "", err
+	}
+	prefix := hex.EncodeToString(b)
+
+	secret, err := randomString(32)
+	if err != nil {
+		return "", "", "", err
+	}
+	return apiKeyPrefix + prefix + "_" + secret, prefix, hashToken(secret), nil
+}
+
+// apiKeyFromRequest return key from "Authorization: ApiKey <key>" header
+func apiKeyFromRequest(r *http.Request) (string, bool) {
+	auth := strings.TrimSpace(r.Header.Get("Authorization"))
+	if len(auth) > 7 && strings.EqualFold(auth[:7], "ApiKey ") {
+		return strings.TrimSpace(auth[7:]), true
+	}
+	return "", false
+}
+
+// parseAPIKey find key by prefix and check secret, expiry and revocation
+func (a *App) parseAPIKey(key string) (*APIKey, error) {
+	parts := strings.SplitN(key, "_", 3)
+	if len(parts) != 3 || parts[0]+"_" != apiKeyPrefix {
+		return nil, ErrAPIKeyInvalid
+	}
+
+	k := APIKey{Prefix: parts[1]}
+	if err := a.Storage.GetAPIKeyByPrefix(&k); err != nil {
+		if err == pgx.ErrNoRows {
+			return nil, ErrAPIKeyInvalid
+		}
+		log.Printf("cannot load api key %s: %v", parts[1], err)
+		return nil, ErrTokenUnchecked
+	}
+
+	if subtle.ConstantTimeCompare([]byte(hashToken(parts[2])), []byte(k.KeyHash)) != 1 ||
+		k.RevokedAt != nil || (k.ExpiresAt != nil && time.Now().After(*k.ExpiresAt)) {
+		return nil, ErrAPIKeyInvalid
+	}
+
+	if k.LastUsedAt == nil || time.Since(*k.LastUsedAt) > apiKeyLastUsedInterval {
+		if err := a.Storage.UpdateAPIKeyLastUsed(&k); err != nil {
+			log.Printf("cannot update last use of api key %d: %v", k.ID, err)
+		}
+	}
+	return &k, nil
+}
+
+// apiKeyClaims return claims handlers see for request authenticated with API key
+func apiKeyClaims(u *User, k *APIKey) *Claims {
+	c := &Claims{
+		Subject:       strconv.Itoa(u.ID),
+		IssuedAt:      k.CreatedAt.Unix(),
+		Email:         u.Email,
+		EmailVerified: u.EmailVerifiedAt != nil,
+		FirstName:     u.FirstName,
+		LastName:      u.LastName,
+		Version:       u.TokenVersion,
+		Roles:         u.Roles,
+		Permissions:   u.Permissions,
+		OrgID:         u.OrgID,
+		OrgRole:       u.OrgRole,
+		Tenant:        u.Tenant,
+		AMR:           []string{AMRAPIKey},
+		Scope:         strings.Join(k.Scopes, " "),
+	}
+	if k.ExpiresAt != nil {
+		c.ExpiresAt = k.ExpiresAt.Unix()
+	}
+	return c
+}
+
+// createAPIKey create key for current user, key is returned only here
+func (a *App) createAPIKey(w http.ResponseWriter, r *http.Request) {
+	u, _ := UserFromContext(r.Context())
+
+	var req struct {
+		Name      string     `json:"name"`
+		Scopes    []string   `json:"scopes"`
+		ExpiresAt *time.Time `json:"expires_at"`
+	}
+
+	if r.Body == nil {
+		respondWithJSON(w, r, http.StatusBadRequest, []string{})
+		return
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondWithJSON(w, r, http.StatusBadRequest, []string{})
+		return
+	}
+
+	errs := v.Validate(v.Schema{
+		v.F("name", &req.Name): v.All(v.Nonzero("cannot be empty"), v.Len(1, 100, "length is not between 1 and 100")),
+	})
+
+	if len(req.Scopes) == 0 {
+		errs.Extend(v.NewErrors("scopes", v.ErrInvalid, "at least one scope is required"))
+	}
+	for _, s := range req.Scopes {
+		if s == "" || strings.ContainsAny(s, " \t\n\"\\") {
+			errs.Extend(v.NewErrors("scopes", v.ErrInvalid, "scope should not contain spaces or quotes"))
+			break
+		}
+	}
+
+	if req.ExpiresAt != nil && !req.ExpiresAt.After(time.Now()) {
+		errs.Extend(v.NewErrors("expires_at", v.ErrInvalid, "should be in future"))
+	}
+
+	if len(errs) > 0 {
+		respondWithJSON(w, r, http.StatusBadRequest, errs.JSONErrors())
+		return
+	}
+
+	key, prefix, hash, err := newAPIKey()
+	k := APIKey{
+		UserID:    u.ID,
+		Name:      req.Name,
+		Prefix:    prefix,
+		KeyHash:   hash,
+		Scopes:    req.Scopes,
+		ExpiresAt: req.ExpiresAt,
+	}
+	if err == nil {
+		err = a.Storage.CreateAPIKey(&k)
+	}
+	if err != nil {
+		log.Printf("cannot create api key for user %d: %v", u.ID, err)
+		respondWithError(w, r, http.StatusInternalServerError, "cannot create api key, please try again in few minutes")
+		return
+	}
+
+	respondWithJSON(w, r, http.StatusCreated, struct {
+		APIKey
+		Key string `json:"key"`
+	}{k, key})
+}
+
+// listAPIKeys return keys of current user which are not revoked
+func (a *App) listAPIKeys(w http.ResponseWriter, r *http.Request) {
+	u, _ := UserFromContext(r.Context())
+
+	keys, err := a.Storage.GetAPIKeys(u.ID)
+	if err != nil {
+		log.Printf("cannot load api keys of user %d: %v", u.ID, err)
+		respondWithError(w, r, http.StatusInternalServerError, "cannot load api keys, please try again in few minutes")
+		return
+	}
+
+	respondWithJSON(w, r, http.StatusOK, keys)
+}
+
+// revokeAPIKey revoke key of current user, it stop working immediately
+func (a *App) revokeAPIKey(w http.ResponseWriter, r *http.Request) {
+	u, _ := UserFromContext(r.Context())
+
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		respondWithError(w, r, http.StatusNotFound, "api key does not exist")
+		return
+	}
+
+	k := APIKey{ID: id, UserID: u.ID}
+	if err := a.Storage.RevokeAPIKey(&k); err != nil {
+		if err == pgx.ErrNoRows {
+			respondWithError(w, r, http.StatusNotFound, "api key does not exist")
+			return
+		}
+		log.Printf("cannot revoke api key %d: %v", id, err)
+		respondWithError(w, r, http.StatusInternalServerError, "cannot revoke api key, please try again in few minutes")
+		return
+	}
+
+	respondWithJSON(w, r, http.StatusOK, map[string]string{"status": "ok"})
+}
@@ -0,0 +1,159 @@
+package user
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// createKey create API key for logged in user and return it
+func createKey(t *testing.T, a *App, token string, data map[string]interface{}) (string, *APIKey) {
+	code, body := jsonRequest(a, "POST", "/api-keys", "", token, data, nil)
+
+	var res struct {
+		APIKey
+		Key string `json:"key"`
+	}
+	json.Unmarshal([]byte(body), &res)
+	if code != 201 || res.Key == "" {
+		t.Fatalf("Expected api key, got %d %s", code, body)
+	}
+	return res.Key, &res.APIKey
+}
+
+func TestCreateAPIKeyValidation(t *testing.T) {
+	a := SetUp(t)
+	token, _ := loginTokens(t, a)
+
+	tests := []struct {
+		name string
+		data map[string]interface{}
+	}{
+		{"No name", map[string]interface{}{"scopes": []string{"profile:read"}}},
+		{"No scopes", map[string]interface{}{"name": "ci"}},
+		{"Bad scope", map[string]interface{}{"name": "ci", "scopes": []string{"profile read"}}},
+		{"Expired", map[string]interface{}{"name": "ci", "scopes": []string{"profile:read"}, "expires_at": time.Now().Add(-time.Hour)}},
+	}
+
+	for _, test := range tests {
+		if code, body := jsonRequest(a, "POST", "/api-keys", "", token, test.data, nil); code != 400 {
+			t.Errorf("%s: expected 400, got %d %s", test.name, code, body)
+		}
+	}
+}
+
+func TestAPIKeyAuthentication(t *testing.T) {
+	a := SetUp(t)
+	token, _ := loginTokens(t, a)
+	key, k := createKey(t, a, token, map[string]interface{}{"name": "ci", "scopes": []string{"profile:read"}})
+
+	if !strings.HasPrefix(key, apiKeyPrefix+k.Prefix+"_") {
+		t.Errorf("Expected key with %s prefix, got %s", k.Prefix, key)
+	}
+
+	if code := profileCode(a, "ApiKey "+key); code != 200 {
+		t.Errorf("Expected api key to read profile, got %d", code)
+	}
+	if code := profileCode(a, "ApiKey "+key+"x"); code != 401 {
+		t.Errorf("Expected wrong api key to be refused, got %d", code)
+	}
+
+	b := new(bytes.Buffer)
+	json.NewEncoder(b).Encode(map[string]string{"first_name": "Bob"})
+	req, _ := http.NewRequest("PATCH", "/profile", b)
+	req.Header.Set("Authorization", "ApiKey "+key)
+	if response := executeRequest(a, req); response.Code != 403 {
+		t.Errorf("Expected api key without profile:write to be refused, got %d", response.Code)
+	}
+
+	// keys can't be managed with api key
+	req, _ = http.NewRequest("GET", "/api-keys", nil)
+	req.Header.Set("Authorization", "ApiKey "+key)
+	if response := executeRequest(a, req); response.Code != 403 {
+		t.Errorf("Expected api key to be refused by key management, got %d", response.Code)
+	}
+
+	if stored := a.Storage.(*FakeStorage).apiKeys[0]; stored.LastUsedAt == nil {
+		t.Errorf("Expected last use to be saved")
+	}
+}
+
+func TestAPIKeyExpired(t *testing.T) {
+	a := SetUp(t)
+	token, _ := loginTokens(t, a)
+	key, _ := createKey(t, a, token, map[string]interface{}{
+		"name":       "ci",
+		"scopes":     []string{"profile:read"},
+		"expires_at": time.Now().Add(time.Hour),
+	})
+
+	expired := time.Now().Add(-time.Minute)
+	a.Storage.(*FakeStorage).apiKeys[0].ExpiresAt = &expired
+	if code := profileCode(a, "ApiKey "+key); code != 401 {
+		t.Errorf("Expected expired api key to be refused, got %d", code)
+	}
+}
+
+func TestListAndRevokeAPIKey(t *testing.T) {
+	a := SetUp(t)
+	token, _ := loginTokens(t, a)
+	key, k := createKey(t, a, token, map[string]interface{}{"name": "ci", "scopes": []string{"profile:read"}})
+
+	req, _ := http.NewRequest("GET", "/api-keys", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	response := executeRequest(a, req)
+
+	var keys []map[string]interface{}
+	json.Unmarshal(response.Body.Bytes(), &keys)
+	if response.Code != 200 || len(keys) != 1 || keys[0]["name"] != "ci" || keys[0]["key"] != nil || keys[0]["key_hash"] != nil {
+		t.Fatalf("Expected key list without secrets, got %d %s", response.Code, response.Body.String())
+	}
+
+	req, _ = http.NewRequest("DELETE", "/api-keys/"+strconv.Itoa(k.ID), nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	checkResponseCode(t, 200, executeRequest(a, req), req)
+
+	if code := profileCode(a, "ApiKey "+key); code != 401 {
+		t.Errorf("Expected revoked api key to be refused, got %d", code)
+	}
+
+	req, _ = http.NewRequest("DELETE", "/api-keys/"+strconv.Itoa(k.ID), nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	checkResponseCode(t, 404, executeRequest(a, req), req)
+}
+
+func TestIntrospectAPIKey(t *testing.T) {
+	a, c, secret := setUpService(t)
+	token, _ := loginTokens(t, a)
+	key, _ := createKey(t, a, token, map[string]interface{}{"name": "ci", "scopes": []string{"profile:read"}})
+
+	code, res := postForm(a, "/oauth/introspect", c.ID, secret, url.Values{"token": {key}})
+	if code != 200 || res["active"] != true || res["token_type"] != "ApiKey" || res["scope"] != "profile:read" || res["exp"] != nil {
+		t.Errorf("Expected active api key, got %d %v", code, res)
+	}
+}
+
+func TestAPIKeyLogout(t *testing.T) {
+	a := SetUp(t)
+	u := &User{ID: 1, Email: "exist@user.com"}
+	c := apiKeyClaims(u, &APIKey{ID: 1, UserID: u.ID, CreatedAt: time.Now()})
+
+	req, _ := http.NewRequest("POST", "/logout", nil)
+	ctx := context.WithValue(req.Context(), userContextKey, u)
+	response := httptest.NewRecorder()
+	a.logout(response, req.WithContext(context.WithValue(ctx, claimsContextKey, c)))
+
+	if response.Code != 400 {
+		t.Errorf("Expected api key logout to be refused, got %d %s", response.Code, response.Body.String())
+	}
+	if revoked := a.Storage.(*FakeStorage).revokedTokens; len(revoked) != 0 {
+		t.Errorf("Expected no token revocation for api key, got %v", revoked)
+	}
+}
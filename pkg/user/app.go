@@ -1,11 +1,15 @@
 package user
 
 import (
+	"crypto/rand"
 	"encoding/json"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"regexp"
+	"strconv"
+	"time"
 
 	"github.com/jackc/pgx"
 
@@ -15,14 +19,92 @@ import (
 
 // App holding routers and DB connection
 type App struct {
-	Router  *mux.Router
-	Storage Storage
+	Router      *mux.Router
+	Storage     Storage
+	Config      Config
+	Passwords   *Passwords
+	Tokens      *Tokens
+	Revocations *Revocations
+
+	oauth      map[string]*oidcClient
+	loginGuard *loginGuard
+	tenants    map[string]*tenant
+	hosts      map[string]string
+	proxies    []*net.IPNet
 }
 
-// NewApp will create new App instance and setup storage connection
+// NewApp will create new App instance with default config and setup storage connection
 func NewApp(storage Storage) (a App, err error) {
+	return NewAppWithConfig(storage, DefaultConfig())
+}
+
+// NewAppWithConfig will create new App instance using provided config
+func NewAppWithConfig(storage Storage, c Config) (a App, err error) {
 	a = App{}
+	if c.Mailer == nil {
+		c.Mailer = LogMailer{}
+	}
+	if c.RateLimitStore == nil {
+		c.RateLimitStore = NewMemoryRateLimitStore()
+	}
+	a.Config = c
+	a.Passwords, err = NewPasswords(c.PasswordHasher, c.BcryptCost, c.Argon2)
+	if err != nil {
+		return a, err
+	}
+	a.Passwords.AllowPlaintext = c.LegacyPlaintextPasswords
+
+	keys := c.Keys
+	if len(keys) == 0 {
+		log.Print("No signing keys configured, using random secret, tokens will not survive restart")
+		secret := make([]byte, 32)
+		if _, err = rand.Read(secret); err != nil {
+			return a, err
+		}
+		keys = []KeyConfig{{ID: "ephemeral", Secret: secret}}
+	}
+
+	ks, err := NewKeySetFromConfig(keys, c.SigningKey)
+	if err != nil {
+		return a, err
+	}
+	if c.IDTokenKey != "" {
+		if k := ks.Key(c.IDTokenKey); k == nil || k.Method.Alg() != "RS256" {
+			return a, fmt.Errorf("user: ID token key %s should be RSA key", c.IDTokenKey)
+		}
+	}
+
+	a.Tokens = NewTokens(ks)
+	a.Tokens.Issuer = c.Issuer
+	a.Tokens.Audience = c.Audience
+	if c.AccessTokenTTL > 0 {
+		a.Tokens.TTL = c.AccessTokenTTL
+	}
+	if c.ClockSkew > 0 {
+		a.Tokens.Leeway = c.ClockSkew
+	}
+
+	a.Revocations = NewRevocations(storage, c.RevocationCacheTTL)
+	a.Tokens.Revocations = a.Revocations
+
+	a.tenants, a.hosts, err = newTenants(c, a.Tokens, a.Passwords.MaxBytes())
+	if err != nil {
+		return a, err
+	}
+
+	a.proxies, err = parseTrustedProxies(c.TrustedProxies)
+	if err != nil {
+		return a, err
+	}
+	a.loginGuard = newLoginGuard(c)
+
+	a.oauth = map[string]*oidcClient{}
+	for name, p := range c.OAuthProviders {
+		a.oauth[name] = newOIDCClient(name, p)
+	}
+
 	a.Router = mux.NewRouter()
+	a.Router.Use(a.RealIP, a.ResolveTenant)
 	a.initializeRoutes()
 	a.Storage = storage
 	return a, nil
@@ -40,12 +122,68 @@ func (a *App) Run(addr string) {
 
 // initializeRoutes - creates routers, runs automatically in Initialize
 func (a *App) initializeRoutes() {
-	a.Router.HandleFunc("/login", a.login).Methods("POST")
+	a.Router.Handle("/login", a.limited(a.login, "login")).Methods("POST")
 	a.Router.HandleFunc("/login", a.loginOptions).Methods("OPTIONS")
-	a.Router.HandleFunc("/register", a.register).Methods("POST")
+	a.Router.Handle("/login/mfa", a.limited(a.loginMFA, "login")).Methods("POST")
+	a.Router.Handle("/login/magic", a.limited(a.loginMagic, "login_magic")).Methods("POST")
+	a.Router.Handle("/login/magic/{token}", a.limited(a.loginMagicLink, "login")).Methods("GET")
+	a.Router.Handle("/register", a.limited(a.register, "register")).Methods("POST")
 	a.Router.HandleFunc("/register", a.registerOptions).Methods("OPTIONS")
-	a.Router.HandleFunc("/profile", a.profile).Methods("GET")
+	a.Router.Handle("/profile", a.authenticated(a.profile, "profile:read")).Methods("GET")
+	a.Router.Handle("/profile", a.authenticated(a.updateProfile, "profile:write")).Methods("PATCH")
 	a.Router.HandleFunc("/profile", a.profileOptions).Methods("OPTIONS")
+	a.Router.HandleFunc("/token/refresh", a.refreshToken).Methods("POST")
+	a.Router.Handle("/logout", a.authenticated(a.logout)).Methods("POST")
+	a.Router.Handle("/logout/all", a.authenticated(a.logoutAll)).Methods("POST")
+	a.Router.Handle("/sessions", a.authenticated(a.listSessions)).Methods("GET")
+	a.Router.Handle("/sessions/{id:[0-9]+}", a.authenticated(a.deleteSession)).Methods("DELETE")
+	a.Router.Handle("/password/forgot", a.limited(a.forgotPassword, "password_forgot")).Methods("POST")
+	a.Router.Handle("/password/reset", a.limited(a.resetPassword, "password_reset")).Methods("POST")
+	a.Router.Handle("/password/change", a.limitedUser(a.changePassword, "password_change")).Methods("POST")
+	a.Router.Handle("/email/change", a.limitedUser(a.changeEmail, "email_change")).Methods("POST")
+	a.Router.HandleFunc("/email/change/confirm", a.confirmEmailChange).Methods("GET", "POST")
+	a.Router.Handle("/mfa/totp/setup", a.authenticated(a.mfaTOTPSetup)).Methods("POST")
+	a.Router.Handle("/mfa/totp/confirm", a.authenticated(a.mfaTOTPConfirm)).Methods("POST")
+	a.Router.Handle("/webauthn/register/begin", a.authenticated(a.webauthnRegisterBegin)).Methods("POST")
+	a.Router.Handle("/webauthn/register/finish", a.authenticated(a.webauthnRegisterFinish)).Methods("POST")
+	a.Router.Handle("/webauthn/login/begin", a.limited(a.webauthnLoginBegin, "login")).Methods("POST")
+	a.Router.Handle("/webauthn/login/finish", a.limited(a.webauthnLoginFinish, "login")).Methods("POST")
+	a.Router.HandleFunc("/oauth/{provider}/start", a.oauthStart).Methods("GET")
+	a.Router.HandleFunc("/oauth/{provider}/callback", a.oauthCallback).Methods("GET")
+	a.Router.Handle("/api-keys", a.authenticated(a.createAPIKey)).Methods("POST")
+	a.Router.Handle("/api-keys", a.authenticated(a.listAPIKeys)).Methods("GET")
+	a.Router.Handle("/api-keys/{id}", a.authenticated(a.revokeAPIKey)).Methods("DELETE")
+	a.Router.Handle("/roles", a.permitted(a.listRoles, []string{"roles:read"}, "roles:read")).Methods("GET")
+	a.Router.Handle("/admin/users", a.permitted(a.adminListUsers, []string{"users:read"})).Methods("GET")
+	a.Router.Handle("/admin/users/{id}", a.permitted(a.adminGetUser, []string{"users:read"})).Methods("GET")
+	a.Router.Handle("/admin/users/{id}", a.permitted(a.adminUpdateUser, []string{"users:write"})).Methods("PATCH")
+	a.Router.Handle("/admin/users/{id}", a.permitted(a.adminDeleteUser, []string{"users:write"})).Methods("DELETE")
+	a.Router.Handle("/admin/users/{id}/disable", a.permitted(a.adminDisableUser, []string{"users:write"})).Methods("POST")
+	a.Router.Handle("/admin/users/{id}/enable", a.permitted(a.adminEnableUser, []string{"users:write"})).Methods("POST")
+	a.Router.Handle("/admin/users/{id}/reset-password", a.permitted(a.adminResetPassword, []string{"users:write"})).Methods("POST")
+	a.Router.Handle("/orgs", a.authenticated(a.createOrganization)).Methods("POST")
+	a.Router.Handle("/orgs", a.authenticated(a.listOrganizations)).Methods("GET")
+	a.Router.Handle("/orgs/switch", a.authenticated(a.switchOrganization)).Methods("POST")
+	a.Router.Handle("/orgs/{id}/members", a.authenticated(a.listMembers)).Methods("GET")
+	a.Router.Handle("/orgs/{id}/members/{user_id}", a.authenticated(a.updateMember)).Methods("PATCH")
+	a.Router.Handle("/orgs/{id}/members/{user_id}", a.authenticated(a.removeMember)).Methods("DELETE")
+	a.Router.Handle("/orgs/{id}/invitations", a.limitedUser(a.createInvitation, "invitation_create")).Methods("POST")
+	a.Router.Handle("/orgs/{id}/invitations", a.authenticated(a.listInvitations)).Methods("GET")
+	a.Router.Handle("/orgs/{id}/invitations/{invitation_id}", a.authenticated(a.revokeInvitation)).Methods("DELETE")
+	a.Router.Handle("/invitations/accept", a.authenticated(a.acceptInvitation)).Methods("POST")
+	a.Router.HandleFunc("/verify-email", a.verifyEmail).Methods("GET", "POST")
+	a.Router.Handle("/verify-email/resend", a.limited(a.resendEmailVerification, "verify_email_resend")).Methods("POST")
+	a.Router.HandleFunc("/.well-known/jwks.json", a.jwks).Methods("GET")
+	a.Router.HandleFunc("/.well-known/openid-configuration", a.openidConfiguration).Methods("GET")
+	a.Router.HandleFunc("/authorize", a.authorize).Methods("GET")
+	a.Router.Handle("/authorize", a.authenticated(a.approveAuthorize)).Methods("POST")
+	a.Router.HandleFunc("/token", a.token).Methods("POST")
+	a.Router.HandleFunc("/oauth/token", a.token).Methods("POST")
+	a.Router.HandleFunc("/oauth/introspect", a.introspect).Methods("POST")
+	a.Router.Handle("/userinfo", a.authenticated(a.userinfo, "openid", "profile:read")).Methods("GET", "POST")
+
+	// preflight of routes above without own options handler, it has to be registered last
+	a.Router.PathPrefix("/").HandlerFunc(a.preflightOptions).Methods("OPTIONS")
 }
 
 // login function return token in success
@@ -57,23 +195,13 @@ func (a *App) login(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		log.Fatalf("cannot decode signup body: %v", err)
 	}
+	t := a.tenant(r)
+	u.Tenant = t.ID
 
-	// do validation by funcValidator
-	emailValidator := v.FromFunc(func(field v.Field) v.Errors {
-		val := field.ValuePtr.(*string)
-		matched, err := regexp.MatchString("(^[a-zA-Z0-9_.+-]+@[a-zA-Z0-9-]+\\.[a-zA-Z0-9-.]+$)", *val)
-		if err != nil {
-			return v.NewErrors("email", v.ErrInvalid, fmt.Sprint(err))
-		}
-		if matched == false {
-			return v.NewErrors("email", v.ErrInvalid, "Wrong email")
-		}
-		return nil
-	})
-
+	// policy could become stricter after users chose passwords, so login check only max length
 	errs := v.Validate(v.Schema{
-		v.F("email", &u.Email):       v.All(v.Nonzero("cannot be empty"), v.Len(4, 120, "length is not between 4 and 120"), emailValidator),
-		v.F("password", &u.Password): v.All(v.Nonzero("cannot be empty"), v.Len(4, 120, "length is not between 8 and 120")),
+		v.F("email", &u.Email):       emailValidator(),
+		v.F("password", &u.Password): passwordValidator(PasswordPolicy{MinLength: 1, MaxLength: t.PasswordPolicy.MaxLength, MaxBytes: t.PasswordPolicy.MaxBytes}),
 	})
 
 	if len(errs) > 0 {
@@ -81,23 +209,78 @@ func (a *App) login(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	ip := remoteIP(r)
+	if wait := a.loginGuard.blocked(ip); wait > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(wait/time.Second)+1))
+		respondWithJSON(w, r, http.StatusTooManyRequests,
+			v.NewErrors("__error__", v.ErrInvalid, "too many failed login attempts, please try again later").JSONErrors())
+		return
+	}
+
+	// unknown and locked accounts get the same answer as wrong password,
+	// and password is hashed anyway so response time doesn't tell account exists
+	password := u.Password
 	if err := a.Storage.GetUserByEmail(&u); err != nil {
+		a.verifyDummy(password)
 		errs.Append(v.NewError("__error__", v.ErrInvalid, "email or password do not match"))
+	} else if a.accountLocked(&u) {
+		a.verifyDummy(password)
+		errs.Append(v.NewError("__error__", v.ErrInvalid, "email or password do not match"))
+	} else if ok, rehash, err := a.Passwords.Verify(password, u.Password); err != nil || !ok {
+		if err != nil {
+			log.Printf("cannot verify password for user %d: %v", u.ID, err)
+		}
+		a.loginFailed(&u)
+		errs.Append(v.NewError("__error__", v.ErrInvalid, "email or password do not match"))
+	} else if rehash {
+		a.rehashPassword(&u, password)
 	}
 
 	if len(errs) > 0 {
+		a.loginGuard.fail(ip)
 		respondWithJSON(w, r, http.StatusBadRequest, errs.JSONErrors())
 		return
 	}
 
-	t, err := u.GetToken()
+	a.loginSucceeded(&u)
+
+	if a.Config.RequireVerifiedEmail && u.EmailVerifiedAt == nil {
+		respondWithJSON(w, r, http.StatusForbidden,
+			v.NewErrors("__error__", v.ErrInvalid, "email address is not verified, please follow the link we sent you").JSONErrors())
+		return
+	}
+
+	if u.DisabledAt != nil {
+		respondWithJSON(w, r, http.StatusForbidden, v.NewErrors("__error__", v.ErrInvalid, "account is disabled").JSONErrors())
+		return
+	}
+
+	// second factor is checked by loginMFA
+	if u.TOTPEnabledAt != nil {
+		a.respondWithMFAChallenge(w, r, &u)
+		return
+	}
+
+	if err := a.Storage.UpdateLastLogin(&u); err != nil {
+		log.Printf("cannot update last login for user %d: %v", u.ID, err)
+	}
+
+	a.respondWithTokens(w, r, http.StatusOK, &u, "")
+}
+
+// rehashPassword replace outdated hash with one produced by current hasher
+// login should not fail because of it, so we only log errors
+func (a *App) rehashPassword(u *User, password string) {
+	hash, err := a.Passwords.Hash(password)
 	if err != nil {
-		errs.Append(v.NewError("__error__", v.ErrInvalid, fmt.Sprintf("%v", err)))
-		respondWithJSON(w, r, http.StatusBadRequest, errs.JSONErrors())
+		log.Printf("cannot rehash password for user %d: %v", u.ID, err)
 		return
 	}
 
-	respondWithJSON(w, r, http.StatusOK, map[string]string{"token": t})
+	u.Password = hash
+	if err := a.Storage.UpdatePassword(u); err != nil {
+		log.Printf("cannot update password for user %d: %v", u.ID, err)
+	}
 }
 
 // login options request
@@ -125,25 +308,17 @@ func (a *App) register(w http.ResponseWriter, r *http.Request) {
 		respondWithJSON(w, r, http.StatusBadRequest, []string{})
 		return
 	}
-
-	// do validation by funcValidator
-	emailValidator := v.FromFunc(func(field v.Field) v.Errors {
-		val := field.ValuePtr.(*string)
-		matched, err := regexp.MatchString("(^[a-zA-Z0-9_.+-]+@[a-zA-Z0-9-]+\\.[a-zA-Z0-9-.]+$)", *val)
-		if err != nil {
-			return v.NewErrors("email", v.ErrInvalid, fmt.Sprint(err))
-		}
-		if matched == false {
-			return v.NewErrors("email", v.ErrInvalid, "Wrong email")
-		}
-		return nil
-	})
+	t := a.tenant(r)
+	u.Tenant = t.ID
 
 	errs := v.Validate(v.Schema{
-		v.F("email", &u.Email):       v.All(v.Nonzero("cannot be empty"), v.Len(4, 120, "length is not between 4 and 120"), emailValidator),
-		v.F("password", &u.Password): v.All(v.Nonzero("cannot be empty"), v.Len(4, 120, "length is not between 8 and 120")),
+		v.F("email", &u.Email):       emailValidator(),
+		v.F("password", &u.Password): passwordValidator(t.PasswordPolicy),
 	})
 
+	// profile fields are optional on registration
+	errs.Extend(u.ValidateProfile())
+
 	// We don't want to make database query if we already know email is not valid
 	if errs.HasField("email") == false {
 		err = a.Storage.GetUserByEmail(&u)
@@ -159,23 +334,37 @@ func (a *App) register(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := a.Storage.CreateUser(&u); err != nil {
+	hash, err := a.Passwords.Hash(u.Password)
+	if err != nil {
+		respondWithJSON(w, r, http.StatusBadRequest, v.NewErrors("password", v.ErrInvalid, "cannot be used as password").JSONErrors())
+		return
+	}
+	u.Password = hash
+
+	if err := a.Storage.CreateUser(&u); err == ErrEmailExists {
+		// somebody registered same email after our check
+		errs.Extend(v.NewErrors("email", v.ErrInvalid, "email address already exists, do you want to reset password?"))
+	} else if err != nil {
 		errs.Extend(v.NewErrors("__error__", v.ErrInvalid, "cannot create user, please try again in few minutes"))
 		log.Fatalf("insert users errors: %+v", err)
 	}
 
 	if len(errs) > 0 {
 		respondWithJSON(w, r, http.StatusBadRequest, errs.JSONErrors())
-	} else {
-		t, err := u.GetToken()
-		if err != nil {
-			errs.Extend(v.NewErrors("__errors", v.ErrInvalid, fmt.Sprintf("%v", err)))
-			respondWithJSON(w, r, http.StatusBadRequest, errs.JSONErrors())
-			return
-		}
-		res := map[string]string{"token": t}
-		respondWithJSON(w, r, http.StatusCreated, res)
+		return
+	}
+
+	a.sendEmailVerification(&u)
+
+	// user can't login until email is verified, so there is no point to issue tokens
+	if a.Config.RequireVerifiedEmail {
+		respondWithJSON(w, r, http.StatusCreated, map[string]string{
+			"status": "we sent verification link to your email address",
+		})
+		return
 	}
+
+	a.respondWithTokens(w, r, http.StatusCreated, &u, "")
 }
 
 // register options function - for frontend validation rules
@@ -188,35 +377,99 @@ func (a *App) registerOptions(w http.ResponseWriter, r *http.Request) {
 
 // profile function, return user data in success
 func (a *App) profile(w http.ResponseWriter, r *http.Request) {
+	u, _ := UserFromContext(r.Context())
 
-	u := User{}
-	token := r.Header.Get("Authorization")
-	if token == "" {
-		respondWithError(w, r, http.StatusUnauthorized, "Authorization")
+	respondWithJSON(w, r, http.StatusOK, u.Profile())
+	return
+}
+
+// updateProfile function, change only fields present in body and return updated profile
+func (a *App) updateProfile(w http.ResponseWriter, r *http.Request) {
+	u, _ := UserFromContext(r.Context())
+
+	var patch ProfilePatch
+	if r.Body == nil {
+		respondWithJSON(w, r, http.StatusBadRequest, []string{})
 		return
 	}
 
-	res, err := u.InvalidToken(token)
-	if err != nil {
-		respondWithError(w, r, http.StatusForbidden, fmt.Sprintf("%v", err))
+	if err := json.NewDecoder(r.Body).Decode(&patch); err != nil {
+		respondWithJSON(w, r, http.StatusBadRequest, []string{})
 		return
 	}
 
-	if res == false {
-		respondWithError(w, r, http.StatusForbidden, "invalid token")
+	// validate user with applied changes, so unchanged fields are checked either
+	updated := *u
+	patch.Apply(&updated)
+
+	if errs := updated.ValidateProfile(); len(errs) > 0 {
+		respondWithJSON(w, r, http.StatusBadRequest, errs.JSONErrors())
 		return
 	}
 
-	respondWithJSON(w, r, http.StatusOK, map[string]interface{}{"email": u.Email, "first_name": "", "last_name": ""})
-	return
+	if err := a.Storage.UpdateProfile(&updated); err != nil {
+		log.Printf("cannot update profile for user %d: %v", u.ID, err)
+		respondWithJSON(w, r, http.StatusInternalServerError,
+			v.NewErrors("__error__", v.ErrInvalid, "cannot update profile, please try again in few minutes").JSONErrors())
+		return
+	}
+
+	respondWithJSON(w, r, http.StatusOK, updated.Profile())
 }
 
-// register options function - for frontend validation rules
+// profile options function - for frontend validation rules
 func (a *App) profileOptions(w http.ResponseWriter, r *http.Request) {
 	respondWithJSON(w, r, 200, map[string]map[string]string{
-		"email":    map[string]string{"type": "string", "required": "1", "minLength": "4", "maxLength": "255"},
-		"password": map[string]string{"type": "password", "required": "1", "minLength": "8", "maxLength": "255"},
+		"first_name":   map[string]string{"type": "string", "maxLength": "100"},
+		"last_name":    map[string]string{"type": "string", "maxLength": "100"},
+		"display_name": map[string]string{"type": "string", "maxLength": "100"},
+		"avatar_url":   map[string]string{"type": "url", "maxLength": "255"},
+		"locale":       map[string]string{"type": "string", "maxLength": "35"},
+		"timezone":     map[string]string{"type": "string", "maxLength": "64"},
+	})
+}
+
+// preflight options request
+// browser send it before cross-origin JSON requests, CORS headers are all it need
+func (a *App) preflightOptions(w http.ResponseWriter, r *http.Request) {
+	respondWithJSON(w, r, 200, map[string]string{})
+}
+
+// jwks function, return public keys so other services can verify our tokens
+func (a *App) jwks(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	respondWithJSON(w, r, http.StatusOK, a.tenant(r).tokens.Keys.JWKS())
+}
+
+// truncate cut string to n characters, multi-byte characters are never split
+// so result still fit varchar(n) columns
+func truncate(s string, n int) string {
+	count := 0
+	for i := range s {
+		if count == n {
+			return s[:i]
+		}
+		count++
+	}
+	return s
+}
+
+// emailValidator check email is not empty and looks like email
+func emailValidator() v.Validator {
+	// do validation by funcValidator
+	format := v.FromFunc(func(field v.Field) v.Errors {
+		val := field.ValuePtr.(*string)
+		matched, err := regexp.MatchString("(^[a-zA-Z0-9_.+-]+@[a-zA-Z0-9-]+\\.[a-zA-Z0-9-.]+$)", *val)
+		if err != nil {
+			return v.NewErrors(field.Name, v.ErrInvalid, fmt.Sprint(err))
+		}
+		if matched == false {
+			return v.NewErrors(field.Name, v.ErrInvalid, "Wrong email")
+		}
+		return nil
 	})
+
+	return v.All(v.Nonzero("cannot be empty"), v.Len(4, 120, "length is not between 4 and 120"), format)
 }
 
 // respondWithError return error code and message
@@ -234,9 +487,9 @@ func respondWithJSON(w http.ResponseWriter, r *http.Request, code int, payload i
 
 	if origin := r.Header.Get("Origin"); origin != "" {
 		w.Header().Set("Access-Control-Allow-Origin", origin)
-		w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, DELETE")
+		w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, PATCH, DELETE")
 		w.Header().Set("Access-Control-Allow-Headers",
-			"Accept, Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization, X-REAL")
+			"Accept, Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization, X-REAL, "+TenantHeader)
 		w.Header().Set("Content-Type", "application/json")
 	}
 
@@ -0,0 +1,206 @@
+package user
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/jackc/pgx"
+	v "github.com/webdeveloppro/validating"
+)
+
+// checkCurrentPassword return validation errors if password do not match user password
+func (a *App) checkCurrentPassword(u *User, password string) v.Errors {
+	if password == "" {
+		return v.NewErrors("current_password", v.ErrInvalid, "cannot be empty")
+	}
+
+	ok, _, err := a.Passwords.Verify(password, u.Password)
+	if err != nil {
+		log.Printf("cannot verify password for user %d: %v", u.ID, err)
+	}
+	if !ok {
+		return v.NewErrors("current_password", v.ErrInvalid, "password do not match")
+	}
+	return nil
+}
+
+// changePassword set new password for logged in user
+// all other tokens are revoked, so response contain new tokens for current client
+func (a *App) changePassword(w http.ResponseWriter, r *http.Request) {
+	u, _ := UserFromContext(r.Context())
+
+	var req struct {
+		CurrentPassword string `json:"current_password"`
+		Password        string `json:"password"`
+	}
+
+	if r.Body == nil {
+		respondWithJSON(w, r, http.StatusBadRequest, []string{})
+		return
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondWithJSON(w, r, http.StatusBadRequest, []string{})
+		return
+	}
+
+	errs := v.Validate(v.Schema{
+		v.F("password", &req.Password): passwordValidator(a.tenant(r).PasswordPolicy),
+	})
+	errs.Extend(a.checkCurrentPassword(u, req.CurrentPassword))
+
+	if len(errs) > 0 {
+		respondWithJSON(w, r, http.StatusBadRequest, errs.JSONErrors())
+		return
+	}
+
+	hash, err := a.Passwords.Hash(req.Password)
+	if err != nil {
+		respondWithJSON(w, r, http.StatusBadRequest, v.NewErrors("password", v.ErrInvalid, "cannot be used as password").JSONErrors())
+		return
+	}
+
+	u.Password = hash
+	if err := a.Storage.UpdatePassword(u); err != nil {
+		log.Printf("cannot update password for user %d: %v", u.ID, err)
+		respondWithJSON(w, r, http.StatusInternalServerError,
+			v.NewErrors("__error__", v.ErrInvalid, "cannot change password, please try again in few minutes").JSONErrors())
+		return
+	}
+
+	if err := a.Revocations.RevokeUser(u); err != nil {
+		log.Printf("cannot revoke tokens of user %d after password change: %v", u.ID, err)
+	}
+
+	a.notify(u.Email, "Your password was changed",
+		"Password for your account was just changed.\n\n"+
+			"If it was not you, please reset your password and contact support.")
+
+	a.respondWithTokens(w, r, http.StatusOK, u, "")
+}
+
+// changeEmail send confirmation link to new email, address is changed only after link is followed
+func (a *App) changeEmail(w http.ResponseWriter, r *http.Request) {
+	u, _ := UserFromContext(r.Context())
+
+	var req struct {
+		CurrentPassword string `json:"current_password"`
+		Email           string `json:"email"`
+	}
+
+	if r.Body == nil {
+		respondWithJSON(w, r, http.StatusBadRequest, []string{})
+		return
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondWithJSON(w, r, http.StatusBadRequest, []string{})
+		return
+	}
+
+	errs := v.Validate(v.Schema{
+		v.F("email", &req.Email): emailValidator(),
+	})
+	errs.Extend(a.checkCurrentPassword(u, req.CurrentPassword))
+
+	if errs.HasField("email") == false {
+		other := User{Email: req.Email, Tenant: u.Tenant}
+		err := a.Storage.GetUserByEmail(&other)
+		if err == nil {
+			errs.Extend(v.NewErrors("email", v.ErrInvalid, "email address already exists"))
+		} else if err != pgx.ErrNoRows {
+			log.Printf("cannot check email %s for user %d: %v", req.Email, u.ID, err)
+			respondWithJSON(w, r, http.StatusInternalServerError,
+				v.NewErrors("__error__", v.ErrInvalid, "cannot change email, please try again in few minutes").JSONErrors())
+			return
+		}
+	}
+
+	if len(errs) > 0 {
+		respondWithJSON(w, r, http.StatusBadRequest, errs.JSONErrors())
+		return
+	}
+
+	token, err := a.newActionToken(u, PurposeEmailChange, req.Email, a.Config.EmailChangeTTL)
+	if err != nil {
+		log.Printf("cannot create email change token for user %d: %v", u.ID, err)
+		respondWithJSON(w, r, http.StatusInternalServerError,
+			v.NewErrors("__error__", v.ErrInvalid, "cannot change email, please try again in few minutes").JSONErrors())
+		return
+	}
+
+	err = a.Config.Mailer.Send(Message{
+		To:      req.Email,
+		Subject: "Confirm your new email address",
+		Body: fmt.Sprintf("Somebody asked to use this address for account %s.\n\n"+
+			"Follow the link to confirm it, it is valid for %s:\n%s\n\n"+
+			"If it was not you, just ignore this email.",
+			u.Email, a.Config.EmailChangeTTL, actionLink(a.Config.EmailChangeURL, token)),
+	})
+	if err != nil {
+		log.Printf("cannot send email change confirmation to user %d: %v", u.ID, err)
+		respondWithJSON(w, r, http.StatusInternalServerError,
+			v.NewErrors("__error__", v.ErrInvalid, "cannot change email, please try again in few minutes").JSONErrors())
+		return
+	}
+
+	respondWithJSON(w, r, http.StatusOK, map[string]string{
+		"status": "we sent confirmation link to new email address",
+	})
+}
+
+// confirmEmailChange swap user email with token from GET query or POST body
+func (a *App) confirmEmailChange(w http.ResponseWriter, r *http.Request) {
+	token := r.URL.Query().Get("token")
+
+	if r.Method == "POST" && r.Body != nil {
+		var req struct {
+			Token string `json:"token"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err == nil && req.Token != "" {
+			token = req.Token
+		}
+	}
+
+	at, err := a.useActionToken(token, PurposeEmailChange)
+	if err != nil {
+		if err != ErrActionTokenInvalid {
+			log.Printf("cannot use email change token: %v", err)
+		}
+		respondWithJSON(w, r, http.StatusBadRequest, v.NewErrors("token", v.ErrInvalid, "confirmation link is invalid or expired").JSONErrors())
+		return
+	}
+
+	u := User{ID: at.UserID}
+	if err := a.Storage.GetUserByID(&u); err != nil {
+		respondWithJSON(w, r, http.StatusBadRequest, v.NewErrors("token", v.ErrInvalid, "confirmation link is invalid or expired").JSONErrors())
+		return
+	}
+
+	old := u.Email
+	u.Email = at.Data
+	if err := a.Storage.UpdateEmail(&u); err == ErrEmailExists {
+		respondWithJSON(w, r, http.StatusBadRequest, v.NewErrors("email", v.ErrInvalid, "email address already exists").JSONErrors())
+		return
+	} else if err != nil {
+		log.Printf("cannot update email for user %d: %v", u.ID, err)
+		respondWithJSON(w, r, http.StatusInternalServerError,
+			v.NewErrors("__error__", v.ErrInvalid, "cannot change email, please try again in few minutes").JSONErrors())
+		return
+	}
+
+	a.notify(old, "Your email address was changed",
+		fmt.Sprintf("Email address of your account was changed to %s.\n\n"+
+			"If it was not you, please contact support.", u.Email))
+
+	respondWithJSON(w, r, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// notify send informational mail, errors are only logged
+func (a *App) notify(to, subject, body string) {
+	if err := a.Config.Mailer.Send(Message{To: to, Subject: subject, Body: body}); err != nil {
+		log.Printf("cannot send %q to %s: %v", subject, to, err)
+	}
+}
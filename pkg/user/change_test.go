@@ -0,0 +1,120 @@
+package user
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+func TestChangePassword(t *testing.T) {
+	a := SetUp(t)
+
+	token, refresh := loginTokens(t, a)
+
+	tests := []struct {
+		name string
+		data map[string]string
+		body string
+		code int
+	}{
+		{"Empty current password", map[string]string{"password": "new password"}, `{"current_password":["cannot be empty"]}`, 400},
+		{"Wrong current password", map[string]string{"current_password": "wrong", "password": "new password"}, `{"current_password":["password do not match"]}`, 400},
+		{"Empty new password", map[string]string{"current_password": "123123"}, `{"password":["cannot be empty"]}`, 400},
+	}
+
+	for _, test := range tests {
+		code, body := jsonRequest(a, "POST", "/password/change", "", token, test.data, nil)
+		if code != test.code || body != test.body {
+			t.Errorf("%s: expected %d %s, got %d %s", test.name, test.code, test.body, code, body)
+		}
+	}
+
+	code, body := jsonRequest(a, "POST", "/password/change", "", token, map[string]string{"current_password": "123123", "password": "new password"}, nil)
+	if code != 200 {
+		t.Fatalf("Expected password change to succeed, got %d %s", code, body)
+	}
+
+	// old tokens are revoked, new ones are returned
+	if code := profileCode(a, token); code != 401 {
+		t.Errorf("Expected old token to be revoked, got %d", code)
+	}
+	if code, _ := doRefresh(a, refresh); code != 401 {
+		t.Errorf("Expected old refresh token to be revoked, got %d", code)
+	}
+
+	var res map[string]interface{}
+	json.Unmarshal([]byte(body), &res)
+	if code := profileCode(a, res["token"].(string)); code != 200 {
+		t.Errorf("Expected new token to work, got %d", code)
+	}
+
+	if _, ok := a.Config.Mailer.(*MemoryMailer).Last("exist@user.com"); !ok {
+		t.Errorf("Expected password change notification")
+	}
+
+	if code, body := jsonRequest(a, "POST", "/login", "", "", map[string]string{"email": "exist@user.com", "password": "new password"}, nil); code != 200 {
+		t.Errorf("Expected login with new password, got %d %s", code, body)
+	}
+}
+
+func TestChangeEmail(t *testing.T) {
+	a := SetUp(t)
+
+	token, _ := loginTokens(t, a)
+
+	tests := []struct {
+		name string
+		data map[string]string
+		body string
+		code int
+	}{
+		{"Wrong current password", map[string]string{"current_password": "wrong", "email": "new@user.com"}, `{"current_password":["password do not match"]}`, 400},
+		{"Wrong email", map[string]string{"current_password": "123123", "email": "wrong"}, `{"email":["Wrong email"]}`, 400},
+		{"Existing email", map[string]string{"current_password": "123123", "email": "exist@user.com"}, `{"email":["email address already exists"]}`, 400},
+		{"Storage error", map[string]string{"current_password": "123123", "email": "other@user.com"}, `{"__error__":["cannot change email, please try again in few minutes"]}`, 500},
+		{"Success", map[string]string{"current_password": "123123", "email": "new@user.com"}, `{"status":"we sent confirmation link to new email address"}`, 200},
+	}
+
+	for _, test := range tests {
+		code, body := jsonRequest(a, "POST", "/email/change", "", token, test.data, nil)
+		if code != test.code || body != test.body {
+			t.Errorf("%s: expected %d %s, got %d %s", test.name, test.code, test.body, code, body)
+		}
+	}
+
+	confirm := mailedToken(t, a, "new@user.com")
+
+	req, _ := http.NewRequest("GET", "/email/change/confirm?token="+confirm, nil)
+	response := executeRequest(a, req)
+	if response.Code != 200 {
+		t.Fatalf("Expected email change to succeed, got %d %s", response.Code, response.Body.String())
+	}
+
+	u := User{ID: 1}
+	a.Storage.GetUserByID(&u)
+	if u.Email != "new@user.com" || u.EmailVerifiedAt == nil {
+		t.Errorf("Expected verified new email, got %+v", u)
+	}
+
+	if _, ok := a.Config.Mailer.(*MemoryMailer).Last("exist@user.com"); !ok {
+		t.Errorf("Expected notification to old email")
+	}
+
+	if code, body := jsonRequest(a, "POST", "/email/change/confirm", "", "", map[string]string{"token": confirm}, nil); code != 400 || body != `{"token":["confirmation link is invalid or expired"]}` {
+		t.Errorf("Expected used token to be rejected, got %d %s", code, body)
+	}
+}
+
+func TestChangeEmailTaken(t *testing.T) {
+	a := SetUp(t)
+
+	// email was registered by somebody else after link was sent
+	token, err := a.newActionToken(&User{ID: 1}, PurposeEmailChange, "exist@user.com", a.Config.EmailChangeTTL)
+	if err != nil {
+		t.Fatalf("cannot create token: %v", err)
+	}
+
+	if code, body := jsonRequest(a, "POST", "/email/change/confirm", "", "", map[string]string{"token": token}, nil); code != 400 || body != `{"email":["email address already exists"]}` {
+		t.Errorf("Expected friendly unique email error, got %d %s", code, body)
+	}
+}
@@ -0,0 +1,162 @@
+package user
+
+import (
+	"net/http"
+	"time"
+)
+
+// Config holds application settings, main.go fill it from environment
+type Config struct {
+	// PasswordHasher is algorithm for new hashes, "bcrypt" or "argon2id"
+	PasswordHasher string
+	BcryptCost     int
+	Argon2         Argon2Params
+	PasswordPolicy PasswordPolicy
+	// LegacyPlaintextPasswords let users created before hashing was introduced
+	// login with plain text password from database, it is hashed on first login
+	LegacyPlaintextPasswords bool
+
+	// Keys used to sign and verify tokens, SigningKey is kid of key for new tokens
+	Keys       []KeyConfig
+	SigningKey string
+
+	// Issuer and Audience go to iss and aud claims and are required from incoming tokens
+	Issuer         string
+	Audience       string
+	AccessTokenTTL time.Duration
+	ClockSkew      time.Duration
+
+	// RefreshTokenTTL is lifetime of refresh token, every refresh start it again
+	RefreshTokenTTL time.Duration
+
+	// RevocationCacheTTL is how long other instances may accept token after logout
+	RevocationCacheTTL time.Duration
+
+	// Mailer deliver emails, messages are written to log if empty
+	Mailer Mailer
+	// PasswordResetURL is frontend page, reset token is added as token query parameter
+	PasswordResetURL string
+	PasswordResetTTL time.Duration
+
+	// EmailVerifyURL is page which verify email, token is added as token query parameter
+	EmailVerifyURL string
+	EmailVerifyTTL time.Duration
+	// EmailChangeURL is page which confirm new email, token is added as token query parameter
+	EmailChangeURL string
+	EmailChangeTTL time.Duration
+	// TOTPIssuer is shown in authenticator apps next to account email
+	TOTPIssuer string
+	// MFAChallengeTTL is time user have to enter second factor after password
+	MFAChallengeTTL time.Duration
+	// WebAuthnRPID is domain passkeys are bound to, WebAuthnOrigins are
+	// origins of pages allowed to use them, like https://example.com
+	WebAuthnRPID    string
+	WebAuthnRPName  string
+	WebAuthnOrigins []string
+	// WebAuthnTimeout is lifetime of registration and login challenges
+	WebAuthnTimeout time.Duration
+	// OAuthProviders are OpenID Connect providers for social login by name used in urls
+	OAuthProviders map[string]OAuthProvider
+	// OAuthFrontendURL is page which get tokens or error in url fragment after social login
+	OAuthFrontendURL string
+	OAuthStateTTL    time.Duration
+	// OIDCLoginURL is frontend page where user login and approve client,
+	// authorize request is added as query and page finish it with POST /authorize
+	OIDCLoginURL string
+	// AuthorizationCodeTTL is time client have to exchange code for tokens
+	AuthorizationCodeTTL time.Duration
+	// IDTokenKey is kid of RSA key for ID tokens, first RSA key of tenant is used if empty or
+	// tenant doesn't have it. Clients can't get ID tokens from tenant without RSA key
+	IDTokenKey string
+	IDTokenTTL time.Duration
+	// RequireVerifiedEmail refuse login until email is verified
+	RequireVerifiedEmail bool
+	// LoginLockThreshold is failed logins after which account is locked for LoginLockDuration,
+	// every next failure double the lock up to LoginLockMaxDuration. Zero disable lockout
+	LoginLockThreshold   int
+	LoginLockDuration    time.Duration
+	LoginLockMaxDuration time.Duration
+	// LoginIPThreshold is the same limit for failed logins from one client address.
+	// Counters of accounts and addresses are forgotten after LoginFailureWindow without failures
+	LoginIPThreshold   int
+	LoginFailureWindow time.Duration
+	// TrustedProxies are addresses or CIDR ranges of reverse proxies, client address
+	// is taken from X-Forwarded-For only for requests coming from them
+	TrustedProxies []string
+	// RateLimits are limits by route name, see App.RateLimit. RateLimitStore keep buckets,
+	// in memory if empty, use PGStorage when there are many instances
+	RateLimits     map[string]RateLimit
+	RateLimitStore RateLimitStore
+	// InvitationURL is frontend page which accept organization invitation,
+	// token is added as token query parameter
+	InvitationURL string
+	InvitationTTL time.Duration
+	// Tenants are products sharing deployment, every tenant has own users
+	Tenants []Tenant
+	// SessionCookies make login set HttpOnly session cookie instead of returning tokens,
+	// session expire after SessionTTL without requests. Tokens are still accepted
+	SessionCookies      bool
+	SessionTTL          time.Duration
+	SessionCookieDomain string
+	SessionCookieSecure bool
+	SessionSameSite     http.SameSite
+	// MagicLinkURL is page user open from passwordless login email, token is added as last path segment.
+	// MagicLinkSameDevice let only browser which requested link use it
+	MagicLinkURL        string
+	MagicLinkTTL        time.Duration
+	MagicLinkSameDevice bool
+}
+
+// DefaultConfig return settings used by NewApp
+func DefaultConfig() Config {
+	return Config{
+		PasswordHasher:       "bcrypt",
+		BcryptCost:           12,
+		Argon2:               DefaultArgon2Params,
+		PasswordPolicy:       PasswordPolicy{MinLength: 4, MaxLength: 120},
+		AccessTokenTTL:       15 * time.Minute,
+		ClockSkew:            time.Minute,
+		RefreshTokenTTL:      30 * 24 * time.Hour,
+		RevocationCacheTTL:   30 * time.Second,
+		PasswordResetURL:     "http://localhost:3000/password/reset",
+		PasswordResetTTL:     time.Hour,
+		EmailVerifyURL:       "http://localhost:8080/verify-email",
+		EmailVerifyTTL:       24 * time.Hour,
+		EmailChangeURL:       "http://localhost:8080/email/change/confirm",
+		EmailChangeTTL:       24 * time.Hour,
+		TOTPIssuer:           "webdeveloppro",
+		MFAChallengeTTL:      5 * time.Minute,
+		WebAuthnRPID:         "localhost",
+		WebAuthnRPName:       "webdeveloppro",
+		WebAuthnOrigins:      []string{"http://localhost:3000"},
+		WebAuthnTimeout:      5 * time.Minute,
+		OAuthFrontendURL:     "http://localhost:3000/oauth/callback",
+		OAuthStateTTL:        10 * time.Minute,
+		OIDCLoginURL:         "http://localhost:3000/authorize",
+		AuthorizationCodeTTL: time.Minute,
+		IDTokenTTL:           time.Hour,
+		LoginLockThreshold:   5,
+		LoginLockDuration:    time.Minute,
+		LoginLockMaxDuration: time.Hour,
+		LoginIPThreshold:     20,
+		LoginFailureWindow:   15 * time.Minute,
+		InvitationURL:        "http://localhost:3000/invitations/accept",
+		InvitationTTL:        7 * 24 * time.Hour,
+		SessionTTL:           24 * time.Hour,
+		SessionCookieSecure:  true,
+		SessionSameSite:      http.SameSiteLaxMode,
+		MagicLinkURL:         "http://localhost:8080/login/magic",
+		MagicLinkTTL:         15 * time.Minute,
+		RateLimits: map[string]RateLimit{
+			"login":               {Limit: 30, Period: time.Minute, By: RateLimitByIP},
+			"register":            {Limit: 10, Period: time.Hour, By: RateLimitByIP},
+			"password_forgot":     {Limit: 5, Period: time.Hour, By: RateLimitByIP},
+			"password_reset":      {Limit: 10, Period: time.Hour, By: RateLimitByIP},
+			"verify_email_resend": {Limit: 5, Period: time.Hour, By: RateLimitByIP},
+			"login_magic":         {Limit: 5, Period: time.Hour, By: RateLimitByIP},
+			"password_change":     {Limit: 10, Period: time.Hour, By: RateLimitByUser},
+			"email_change":        {Limit: 5, Period: time.Hour, By: RateLimitByUser},
+			"invitation_create":   {Limit: 50, Period: time.Hour, By: RateLimitByUser},
+		},
+	}
+}
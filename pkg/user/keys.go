@@ -0,0 +1,389 @@
+package user
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"sync"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/pkg/errors"
+)
+
+// KeyConfig describe one signing key, either HMAC secret or PEM encoded private key
+type KeyConfig struct {
+	ID            string
+	Secret        []byte
+	PrivateKeyPEM []byte
+}
+
+// LoadKeyConfig read key file, PEM files are treated as private keys
+// anything else as HMAC secret
+func LoadKeyConfig(id, path string) (KeyConfig, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return KeyConfig{}, errors.Wrapf(err, "user: cannot read key %s", id)
+	}
+
+	if block, _ := pem.Decode(b); block != nil {
+		return KeyConfig{ID: id, PrivateKeyPEM: b}, nil
+	}
+
+	return KeyConfig{ID: id, Secret: b}, nil
+}
+
+// Key used to sign and verify jwt tokens
+type Key struct {
+	ID        string
+	Method    jwt.SigningMethod
+	signKey   interface{}
+	verifyKey interface{}
+}
+
+// Sign claims with key, kid header will point to it
+func (k *Key) Sign(claims jwt.Claims) (string, error) {
+	token := jwt.NewWithClaims(k.Method, claims)
+	token.Header["kid"] = k.ID
+	return token.SignedString(k.signKey)
+}
+
+// NewHMACKey return HS256 key, secret is never published in jwks
+func NewHMACKey(id string, secret []byte) (*Key, error) {
+	if len(secret) == 0 {
+		return nil, fmt.Errorf("user: empty secret for key %s", id)
+	}
+
+	return &Key{
+		ID:        id,
+		Method:    jwt.SigningMethodHS256,
+		signKey:   secret,
+		verifyKey: secret,
+	}, nil
+}
+
+// NewPrivateKey parse PEM encoded RSA or EC private key,
+// RSA keys sign with RS256, EC keys with ES256/ES384/ES512 depending on curve
+func NewPrivateKey(id string, data []byte) (*Key, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("user: key %s is not PEM encoded", id)
+	}
+
+	var priv interface{}
+	var err error
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		priv, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		priv, err = x509.ParseECPrivateKey(block.Bytes)
+	default:
+		priv, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "user: cannot parse key %s", id)
+	}
+
+	switch k := priv.(type) {
+	case *rsa.PrivateKey:
+		return &Key{ID: id, Method: jwt.SigningMethodRS256, signKey: k, verifyKey: &k.PublicKey}, nil
+	case *ecdsa.PrivateKey:
+		var m jwt.SigningMethod
+		switch k.Curve {
+		case elliptic.P256():
+			m = jwt.SigningMethodES256
+		case elliptic.P384():
+			m = jwt.SigningMethodES384
+		case elliptic.P521():
+			m = jwt.SigningMethodES512
+		default:
+			return nil, fmt.Errorf("user: unsupported curve for key %s", id)
+		}
+		return &Key{ID: id, Method: m, signKey: k, verifyKey: &k.PublicKey}, nil
+	}
+
+	return nil, fmt.Errorf("user: unsupported key type %T for key %s", priv, id)
+}
+
+// NewKey build Key from config
+func NewKey(c KeyConfig) (*Key, error) {
+	if c.ID == "" {
+		return nil, fmt.Errorf("user: key id cannot be empty")
+	}
+	if len(c.PrivateKeyPEM) > 0 {
+		return NewPrivateKey(c.ID, c.PrivateKeyPEM)
+	}
+	return NewHMACKey(c.ID, c.Secret)
+}
+
+// JWK is public key in json web key format, RFC 7517
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+// JWKS is set of public keys published for other services
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+// PublicJWK return json web key for asymmetric keys, false for HMAC keys
+func (k *Key) PublicJWK() (JWK, bool) {
+	enc := base64.RawURLEncoding
+	switch pub := k.verifyKey.(type) {
+	case *rsa.PublicKey:
+		return JWK{
+			Kty: "RSA",
+			Kid: k.ID,
+			Use: "sig",
+			Alg: k.Method.Alg(),
+			N:   enc.EncodeToString(pub.N.Bytes()),
+			E:   enc.EncodeToString(big.NewInt(int64(pub.E)).Bytes()),
+		}, true
+	case *ecdsa.PublicKey:
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		return JWK{
+			Kty: "EC",
+			Kid: k.ID,
+			Use: "sig",
+			Alg: k.Method.Alg(),
+			Crv: pub.Curve.Params().Name,
+			X:   enc.EncodeToString(padBytes(pub.X.Bytes(), size)),
+			Y:   enc.EncodeToString(padBytes(pub.Y.Bytes(), size)),
+		}, true
+	}
+	return JWK{}, false
+}
+
+// PublicKey return rsa or ecdsa public key of json web key
+func (j JWK) PublicKey() (interface{}, error) {
+	enc := base64.RawURLEncoding
+	switch j.Kty {
+	case "RSA":
+		n, err := enc.DecodeString(j.N)
+		if err != nil {
+			return nil, errors.Wrapf(err, "user: wrong modulus of key %s", j.Kid)
+		}
+		e, err := enc.DecodeString(j.E)
+		if err != nil || len(e) == 0 || len(e) > 4 {
+			return nil, fmt.Errorf("user: wrong exponent of key %s", j.Kid)
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+
+	case "EC":
+		var curve elliptic.Curve
+		switch j.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("user: unsupported curve %s of key %s", j.Crv, j.Kid)
+		}
+
+		x, errX := enc.DecodeString(j.X)
+		y, errY := enc.DecodeString(j.Y)
+		if errX != nil || errY != nil {
+			return nil, fmt.Errorf("user: wrong point of key %s", j.Kid)
+		}
+
+		pub := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !curve.IsOnCurve(pub.X, pub.Y) {
+			return nil, fmt.Errorf("user: point of key %s is not on curve", j.Kid)
+		}
+		return pub, nil
+	}
+
+	return nil, fmt.Errorf("user: unsupported key type %s of key %s", j.Kty, j.Kid)
+}
+
+// padBytes left pad b with zeros to size
+func padBytes(b []byte, size int) []byte {
+	if len(b) >= size {
+		return b
+	}
+	p := make([]byte, size)
+	copy(p[size-len(b):], b)
+	return p
+}
+
+// KeySet hold active keys, one of them is used for signing
+// and all of them are accepted for verification, so keys can be rotated
+// by adding new key, switching signing key and removing old one later
+type KeySet struct {
+	mu      sync.RWMutex
+	keys    map[string]*Key
+	order   []string
+	signing string
+}
+
+// NewKeySet create key set, first key become signing key
+func NewKeySet(keys ...*Key) *KeySet {
+	ks := &KeySet{keys: map[string]*Key{}}
+	for _, k := range keys {
+		ks.Add(k)
+	}
+	return ks
+}
+
+// NewKeySetFromConfig build key set from config,
+// signing is kid of signing key, first key used if empty
+func NewKeySetFromConfig(keys []KeyConfig, signing string) (*KeySet, error) {
+	ks := NewKeySet()
+	for _, c := range keys {
+		k, err := NewKey(c)
+		if err != nil {
+			return nil, err
+		}
+		ks.Add(k)
+	}
+
+	if signing != "" {
+		if err := ks.SetSigning(signing); err != nil {
+			return nil, err
+		}
+	}
+
+	if ks.SigningKey() == nil {
+		return nil, fmt.Errorf("user: no signing keys configured")
+	}
+
+	return ks, nil
+}
+
+// Add key to set, key with same id will be replaced
+func (ks *KeySet) Add(k *Key) {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	if _, ok := ks.keys[k.ID]; !ok {
+		ks.order = append(ks.order, k.ID)
+	}
+	ks.keys[k.ID] = k
+	if ks.signing == "" {
+		ks.signing = k.ID
+	}
+}
+
+// Remove key from set, tokens signed with it will not be valid anymore
+func (ks *KeySet) Remove(id string) error {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	if id == ks.signing {
+		return fmt.Errorf("user: cannot remove signing key %s", id)
+	}
+
+	delete(ks.keys, id)
+	for i, kid := range ks.order {
+		if kid == id {
+			ks.order = append(ks.order[:i], ks.order[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+// SetSigning switch key used for new tokens
+func (ks *KeySet) SetSigning(id string) error {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	if _, ok := ks.keys[id]; !ok {
+		return fmt.Errorf("user: unknown signing key %s", id)
+	}
+	ks.signing = id
+	return nil
+}
+
+// SigningKey return key used for new tokens
+func (ks *KeySet) SigningKey() *Key {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+	return ks.keys[ks.signing]
+}
+
+// Sign claims with signing key, kid header will point to it
+func (ks *KeySet) Sign(claims jwt.Claims) (string, error) {
+	k := ks.SigningKey()
+	if k == nil {
+		return "", fmt.Errorf("user: no signing key")
+	}
+
+	return k.Sign(claims)
+}
+
+// Key return key by kid, nil if there is no such key
+func (ks *KeySet) Key(id string) *Key {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+	return ks.keys[id]
+}
+
+// KeyByAlg return key signing with alg, signing key is preferred, nil if there is none
+func (ks *KeySet) KeyByAlg(alg string) *Key {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+
+	if k := ks.keys[ks.signing]; k != nil && k.Method.Alg() == alg {
+		return k
+	}
+	for _, kid := range ks.order {
+		if k := ks.keys[kid]; k.Method.Alg() == alg {
+			return k
+		}
+	}
+	return nil
+}
+
+// Keyfunc find verification key by kid header for jwt.Parse,
+// tokens without kid are checked with signing key
+func (ks *KeySet) Keyfunc(token *jwt.Token) (interface{}, error) {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+
+	kid, _ := token.Header["kid"].(string)
+	if kid == "" {
+		kid = ks.signing
+	}
+
+	k, ok := ks.keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("Unknown signing key: %v", token.Header["kid"])
+	}
+
+	// Don't forget to validate the alg is what you expect:
+	if token.Method.Alg() != k.Method.Alg() {
+		return nil, fmt.Errorf("Unexpected signing method: %v", token.Header["alg"])
+	}
+
+	return k.verifyKey, nil
+}
+
+// JWKS return public keys of all asymmetric keys in set
+func (ks *KeySet) JWKS() JWKS {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+
+	set := JWKS{Keys: []JWK{}}
+	for _, kid := range ks.order {
+		if jwk, ok := ks.keys[kid].PublicJWK(); ok {
+			set.Keys = append(set.Keys, jwk)
+		}
+	}
+	return set
+}
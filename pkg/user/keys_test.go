@@ -0,0 +1,161 @@
+package user
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"testing"
+
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+func testRSAKeyPEM(t *testing.T) []byte {
+	k, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("cannot generate rsa key: %v", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(k)})
+}
+
+func testECKeyPEM(t *testing.T) []byte {
+	k, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("cannot generate ec key: %v", err)
+	}
+	b, _ := x509.MarshalECPrivateKey(k)
+	return pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: b})
+}
+
+func TestKeySetSignAndVerify(t *testing.T) {
+
+	tests := []KeyConfig{
+		{ID: "hs", Secret: []byte("secret")},
+		{ID: "rs", PrivateKeyPEM: testRSAKeyPEM(t)},
+		{ID: "es", PrivateKeyPEM: testECKeyPEM(t)},
+	}
+
+	for _, test := range tests {
+		ks, err := NewKeySetFromConfig([]KeyConfig{test}, "")
+		if err != nil {
+			t.Errorf("%s: cannot create key set: %v", test.ID, err)
+			continue
+		}
+
+		u := User{Email: "new@mail.com"}
+		tokens := NewTokens(ks)
+		token, err := u.GetToken(tokens)
+		if err != nil {
+			t.Errorf("%s: cannot sign: %v", test.ID, err)
+			continue
+		}
+
+		parsed, _ := jwt.Parse(token, ks.Keyfunc)
+		if parsed.Header["kid"] != test.ID {
+			t.Errorf("%s: expected kid header %s, got: %v", test.ID, test.ID, parsed.Header["kid"])
+		}
+
+		res := User{}
+		ok, err := res.InvalidToken(tokens, token)
+		if !ok || err != nil || res.Email != u.Email {
+			t.Errorf("%s: expected valid token, got ok: %t, err: %v, email: %s", test.ID, ok, err, res.Email)
+		}
+	}
+}
+
+func TestKeySetRotation(t *testing.T) {
+
+	ks, err := NewKeySetFromConfig([]KeyConfig{
+		{ID: "old", Secret: []byte("old secret")},
+		{ID: "new", PrivateKeyPEM: testECKeyPEM(t)},
+	}, "old")
+	if err != nil {
+		t.Fatalf("cannot create key set: %v", err)
+	}
+
+	tokens := NewTokens(ks)
+	u := User{Email: "new@mail.com"}
+	oldToken, _ := u.GetToken(tokens)
+
+	if err := ks.Remove("old"); err == nil {
+		t.Errorf("Expected error when removing signing key")
+	}
+
+	if err := ks.SetSigning("new"); err != nil {
+		t.Fatalf("cannot switch signing key: %v", err)
+	}
+
+	newToken, _ := u.GetToken(tokens)
+	for _, token := range []string{oldToken, newToken} {
+		if ok, err := u.InvalidToken(tokens, token); !ok || err != nil {
+			t.Errorf("Expected token to be valid during rotation, got ok: %t, err: %v", ok, err)
+		}
+	}
+
+	ks.Remove("old")
+	if ok, _ := u.InvalidToken(tokens, oldToken); ok {
+		t.Errorf("Expected token signed with removed key to be invalid")
+	}
+}
+
+func TestKeySetRejectAlgorithmMismatch(t *testing.T) {
+
+	ks, _ := NewKeySetFromConfig([]KeyConfig{{ID: "rs", PrivateKeyPEM: testRSAKeyPEM(t)}}, "")
+
+	// HS256 token signed with public key bytes must not pass as RS256 one
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"email": "new@mail.com"})
+	token.Header["kid"] = "rs"
+	forged, _ := token.SignedString([]byte("public key"))
+
+	u := User{}
+	if ok, err := u.InvalidToken(NewTokens(ks), forged); ok || err == nil {
+		t.Errorf("Expected forged token to be rejected, got ok: %t, err: %v", ok, err)
+	}
+}
+
+func TestJWKS(t *testing.T) {
+	t.Parallel()
+
+	c := testConfig()
+	c.Keys = append(c.Keys,
+		KeyConfig{ID: "rs", PrivateKeyPEM: testRSAKeyPEM(t)},
+		KeyConfig{ID: "es", PrivateKeyPEM: testECKeyPEM(t)},
+	)
+	a, err := NewAppWithConfig(&FakeStorage{}, c)
+	if err != nil {
+		t.Fatalf("cannot create app: %v", err)
+	}
+
+	req, _ := http.NewRequest("GET", "/.well-known/jwks.json", nil)
+	response := executeRequest(&a, req)
+	checkResponseCode(t, 200, response, req)
+
+	var set JWKS
+	if err := json.Unmarshal(response.Body.Bytes(), &set); err != nil {
+		t.Fatalf("cannot decode jwks: %v", err)
+	}
+
+	// HMAC secret must never be published
+	if len(set.Keys) != 2 {
+		t.Fatalf("Expected 2 public keys, got: %+v", set.Keys)
+	}
+
+	expected := []JWK{
+		{Kty: "RSA", Kid: "rs", Use: "sig", Alg: "RS256"},
+		{Kty: "EC", Kid: "es", Use: "sig", Alg: "ES256", Crv: "P-256"},
+	}
+	for i, e := range expected {
+		k := set.Keys[i]
+		if k.Kty != e.Kty || k.Kid != e.Kid || k.Use != e.Use || k.Alg != e.Alg || k.Crv != e.Crv {
+			t.Errorf("Expected key %+v, got: %+v", e, k)
+		}
+	}
+
+	if len(set.Keys[1].X) != 43 || len(set.Keys[1].Y) != 43 {
+		t.Errorf("Expected 32 bytes EC coordinates, got: %+v", set.Keys[1])
+	}
+}
@@ -0,0 +1,156 @@
+package user
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// loginFailures is failed login counter of one client address
+type loginFailures struct {
+	count       int
+	last        time.Time
+	lockedUntil time.Time
+}
+
+// loginGuard count failed logins per client address in memory,
+// per account counters are kept in users table so all instances see them
+type loginGuard struct {
+	threshold int
+	lockFor   time.Duration
+	maxLock   time.Duration
+	window    time.Duration
+	now       func() time.Time
+	mu        sync.Mutex
+	ips       map[string]*loginFailures
+	dummyOnce sync.Once
+	dummyHash string
+	dummyErr  error
+}
+
+func newLoginGuard(c Config) *loginGuard {
+	return &loginGuard{
+		threshold: c.LoginIPThreshold,
+		lockFor:   c.LoginLockDuration,
+		maxLock:   c.LoginLockMaxDuration,
+		window:    c.LoginFailureWindow,
+		now:       time.Now,
+		ips:       map[string]*loginFailures{},
+	}
+}
+
+// lockDuration return lock time after count failures, it double with every failure after threshold
+func lockDuration(count, threshold int, base, max time.Duration) time.Duration {
+	if threshold <= 0 || count < threshold {
+		return 0
+	}
+
+	shift := uint(count - threshold)
+	if shift > 30 {
+		return max
+	}
+	d := base << shift
+	if d <= 0 || d > max {
+		return max
+	}
+	return d
+}
+
+// blocked return how long client address should wait before next login attempt
+func (g *loginGuard) blocked(ip string) time.Duration {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	f, ok := g.ips[ip]
+	if !ok {
+		return 0
+	}
+	return f.lockedUntil.Sub(g.now())
+}
+
+// fail count failed login from client address and lock it after threshold,
+// counter is forgotten when there were no failures during window
+func (g *loginGuard) fail(ip string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	now := g.now()
+	f, ok := g.ips[ip]
+	if !ok || now.Sub(f.last) > g.window {
+		f = &loginFailures{}
+		g.ips[ip] = f
+	}
+	f.count++
+	f.last = now
+	if d := lockDuration(f.count, g.threshold, g.lockFor, g.maxLock); d > 0 {
+		f.lockedUntil = now.Add(d)
+	}
+
+	// forget old counters, so map doesn't grow forever
+	if len(g.ips) > 10000 {
+		for k, v := range g.ips {
+			if now.Sub(v.last) > g.window && now.After(v.lockedUntil) {
+				delete(g.ips, k)
+			}
+		}
+	}
+}
+
+// verifyDummy check password against hash of random password, it is used for
+// unknown and locked accounts so they take the same time to answer as real ones
+func (a *App) verifyDummy(password string) {
+	g := a.loginGuard
+	g.dummyOnce.Do(func() {
+		secret, err := randomString(16)
+		if err == nil {
+			g.dummyHash, err = a.Passwords.Hash(secret)
+		}
+		g.dummyErr = err
+	})
+
+	if g.dummyErr == nil {
+		a.Passwords.Verify(password, g.dummyHash)
+	}
+}
+
+// accountLocked tell if account is locked after too many failed logins
+func (a *App) accountLocked(u *User) bool {
+	return u.LockedUntil != nil && a.loginGuard.now().Before(*u.LockedUntil)
+}
+
+// loginFailed count failed password for account and lock it after threshold,
+// owner get email when account become locked. Old failures are forgotten after LoginFailureWindow
+func (a *App) loginFailed(u *User) {
+	if err := a.Storage.RecordLoginFailure(u, a.loginGuard.now(), a.Config.LoginFailureWindow); err != nil {
+		log.Printf("cannot record failed login for user %d: %v", u.ID, err)
+		return
+	}
+
+	d := lockDuration(u.FailedLoginCount, a.Config.LoginLockThreshold, a.Config.LoginLockDuration, a.Config.LoginLockMaxDuration)
+	if d == 0 {
+		return
+	}
+
+	until := a.loginGuard.now().Add(d)
+	u.LockedUntil = &until
+	if err := a.Storage.LockUser(u); err != nil {
+		log.Printf("cannot lock user %d: %v", u.ID, err)
+		return
+	}
+
+	a.notify(u.Email, "Your account is temporarily locked",
+		fmt.Sprintf("There were %d failed login attempts to your account, so we locked it for %s.\n\n"+
+			"If it was not you, somebody may be guessing your password, consider changing it after the lock ends.",
+			u.FailedLoginCount, d))
+}
+
+// loginSucceeded reset failed login counter of account
+func (a *App) loginSucceeded(u *User) {
+	if u.FailedLoginCount == 0 && u.LockedUntil == nil {
+		return
+	}
+	if err := a.Storage.ResetLoginFailures(u); err != nil {
+		log.Printf("cannot reset failed logins for user %d: %v", u.ID, err)
+	}
+}
@@ -0,0 +1,121 @@
+package user
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLockDuration(t *testing.T) {
+	tests := []struct {
+		count     int
+		threshold int
+		expected  time.Duration
+	}{
+		{4, 5, 0},
+		{5, 5, time.Minute},
+		{6, 5, 2 * time.Minute},
+		{8, 5, 8 * time.Minute},
+		{20, 5, time.Hour},
+		{100, 5, time.Hour},
+		{100, 0, 0},
+	}
+
+	for _, test := range tests {
+		if d := lockDuration(test.count, test.threshold, time.Minute, time.Hour); d != test.expected {
+			t.Errorf("%d failures with threshold %d: expected %s, got %s", test.count, test.threshold, test.expected, d)
+		}
+	}
+}
+
+func TestAccountLockout(t *testing.T) {
+	a := SetUp(t)
+	now := time.Now()
+	a.loginGuard.now = func() time.Time { return now }
+
+	wrong := map[string]string{"email": "exist@user.com", "password": "wrong-password"}
+	right := map[string]string{"email": "exist@user.com", "password": "123123"}
+
+	_, unknownBody := jsonRequest(a, "POST", "/login", "", "", map[string]string{"email": "new@user.com", "password": "wrong-password"}, nil)
+	for i := 0; i < 5; i++ {
+		if code, body := jsonRequest(a, "POST", "/login", "", "", wrong, nil); code != 400 || body != unknownBody {
+			t.Fatalf("Expected wrong password answer like unknown email, got %d %s", code, body)
+		}
+	}
+
+	if code, body := jsonRequest(a, "POST", "/login", "", "", right, nil); code != 400 || body != unknownBody {
+		t.Errorf("Expected locked account to answer like wrong password, got %d %s", code, body)
+	}
+	if _, ok := a.Config.Mailer.(*MemoryMailer).Last("exist@user.com"); !ok {
+		t.Errorf("Expected lock notification")
+	}
+
+	now = now.Add(time.Minute + time.Second)
+	if code, body := jsonRequest(a, "POST", "/login", "", "", right, nil); code != 200 {
+		t.Fatalf("Expected login after lock ends, got %d %s", code, body)
+	}
+	if s := a.Storage.(*FakeStorage); s.failedLogins != 0 || s.lockedUntil != nil {
+		t.Errorf("Expected failed logins to be reset, got %d %v", s.failedLogins, s.lockedUntil)
+	}
+}
+
+func TestAccountLockoutBackoff(t *testing.T) {
+	a := SetUp(t)
+	now := time.Now()
+	a.loginGuard.now = func() time.Time { return now }
+
+	wrong := map[string]string{"email": "exist@user.com", "password": "wrong-password"}
+	for i := 0; i < 5; i++ {
+		jsonRequest(a, "POST", "/login", "", "", wrong, nil)
+	}
+
+	// one more failure after lock ends double the lock
+	now = now.Add(time.Minute + time.Second)
+	jsonRequest(a, "POST", "/login", "", "", wrong, nil)
+
+	s := a.Storage.(*FakeStorage)
+	if s.lockedUntil == nil || !s.lockedUntil.Equal(now.Add(2*time.Minute)) {
+		t.Errorf("Expected lock for 2 minutes, got %v", s.lockedUntil)
+	}
+}
+
+func TestLoginIPLockout(t *testing.T) {
+	c := testConfig()
+	c.LoginIPThreshold = 3
+	app, err := NewAppWithConfig(&FakeStorage{}, c)
+	if err != nil {
+		t.Fatalf("cannot create app: %v", err)
+	}
+	a := &app
+
+	for i := 0; i < 3; i++ {
+		jsonRequest(a, "POST", "/login", "", "", map[string]string{"email": "new@user.com", "password": "wrong-password"}, nil)
+	}
+
+	code, body := jsonRequest(a, "POST", "/login", "", "", map[string]string{"email": "exist@user.com", "password": "123123"}, nil)
+	if code != 429 {
+		t.Errorf("Expected client address to be locked, got %d %s", code, body)
+	}
+
+	if wait := a.loginGuard.blocked(""); wait <= 0 || wait > time.Minute {
+		t.Errorf("Expected one minute lock, got %s", wait)
+	}
+}
+
+func TestAccountLockoutWindow(t *testing.T) {
+	a := SetUp(t)
+	now := time.Now()
+	a.loginGuard.now = func() time.Time { return now }
+
+	wrong := map[string]string{"email": "exist@user.com", "password": "wrong-password"}
+	for i := 0; i < 4; i++ {
+		jsonRequest(a, "POST", "/login", "", "", wrong, nil)
+	}
+
+	// old typos are forgotten after window
+	now = now.Add(a.Config.LoginFailureWindow + time.Second)
+	jsonRequest(a, "POST", "/login", "", "", wrong, nil)
+
+	if s := a.Storage.(*FakeStorage); s.failedLogins != 1 || s.lockedUntil != nil {
+		t.Errorf("Expected failed logins to start again, got %d %v", s.failedLogins, s.lockedUntil)
+	}
+}
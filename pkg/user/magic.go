@@ -0,0 +1,168 @@
+package user
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/jackc/pgx"
+	v "github.com/webdeveloppro/validating"
+)
+
+// MagicLinkCookie bind magic link to browser which requested it when MagicLinkSameDevice is set
+const MagicLinkCookie = "magic_link"
+
+// magicLink add token to base url as last path segment
+func magicLink(base, token string) string {
+	return strings.TrimSuffix(base, "/") + "/" + token
+}
+
+// setMagicLinkCookie send device cookie, empty value remove it.
+// It has to be Lax, strict cookies are not sent when link is opened from email
+func (a *App) setMagicLinkCookie(w http.ResponseWriter, value string) {
+	maxAge := int(a.Config.MagicLinkTTL / time.Second)
+	if value == "" {
+		maxAge = -1
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     MagicLinkCookie,
+		Value:    value,
+		Path:     "/login/magic",
+		Domain:   a.Config.SessionCookieDomain,
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   a.Config.SessionCookieSecure,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// loginMagic mail single-use login link if account exists
+// response is the same for unknown emails, so it can't be used to find accounts
+func (a *App) loginMagic(w http.ResponseWriter, r *http.Request) {
+	u := User{}
+
+	if r.Body == nil {
+		respondWithJSON(w, r, http.StatusBadRequest, []string{})
+		return
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&u); err != nil {
+		respondWithJSON(w, r, http.StatusBadRequest, []string{})
+		return
+	}
+
+	errs := v.Validate(v.Schema{
+		v.F("email", &u.Email): emailValidator(),
+	})
+
+	if len(errs) > 0 {
+		respondWithJSON(w, r, http.StatusBadRequest, errs.JSONErrors())
+		return
+	}
+
+	// device cookie is set for unknown emails too
+	device := ""
+	if a.Config.MagicLinkSameDevice {
+		secret, err := randomString(32)
+		if err != nil {
+			log.Printf("cannot create magic link device secret: %v", err)
+			respondWithError(w, r, http.StatusInternalServerError, "cannot send login link, please try again in few minutes")
+			return
+		}
+		a.setMagicLinkCookie(w, secret)
+		device = hashToken(secret)
+	}
+
+	u.Tenant = TenantFromContext(r.Context())
+	err := a.Storage.GetUserByEmail(&u)
+	if err == nil && u.DisabledAt == nil {
+		a.sendMagicLink(&u, device)
+	} else if err != nil && err != pgx.ErrNoRows {
+		log.Printf("cannot get user %s for magic link: %v", u.Email, err)
+	}
+
+	respondWithJSON(w, r, http.StatusOK, map[string]string{
+		"status": "if account with such email exists, we sent login link to it",
+	})
+}
+
+// sendMagicLink create login token and mail link to user,
+// token keep hash of device secret when link is bound to browser
+func (a *App) sendMagicLink(u *User, device string) {
+	token, err := a.newActionToken(u, PurposeMagicLink, device, a.Config.MagicLinkTTL)
+	if err != nil {
+		log.Printf("cannot create magic link token for user %d: %v", u.ID, err)
+		return
+	}
+
+	a.notify(u.Email, "Your login link",
+		fmt.Sprintf("Follow the link to login, it is valid for %s and can be used once:\n%s\n\n"+
+			"If it was not you, just ignore this email.",
+			a.Config.MagicLinkTTL, magicLink(a.Config.MagicLinkURL, token)))
+}
+
+// loginMagicLink exchange token from magic link for the same tokens password login return
+func (a *App) loginMagicLink(w http.ResponseWriter, r *http.Request) {
+	token := mux.Vars(r)["token"]
+	invalid := v.NewErrors("token", v.ErrInvalid, "login link is invalid or expired").JSONErrors()
+
+	// device is checked before token is used, so opening link somewhere else doesn't burn it
+	at := ActionToken{TokenHash: hashToken(token)}
+	if err := a.Storage.GetActionToken(&at); err == nil && at.Purpose == PurposeMagicLink && at.Data != "" {
+		cookie, err := r.Cookie(MagicLinkCookie)
+		if err != nil || subtle.ConstantTimeCompare([]byte(hashToken(cookie.Value)), []byte(at.Data)) != 1 {
+			respondWithJSON(w, r, http.StatusBadRequest,
+				v.NewErrors("token", v.ErrInvalid, "login link should be opened in the browser it was requested from").JSONErrors())
+			return
+		}
+	}
+
+	used, err := a.useActionToken(token, PurposeMagicLink)
+	if err != nil {
+		if err != ErrActionTokenInvalid {
+			log.Printf("cannot use magic link token: %v", err)
+		}
+		respondWithJSON(w, r, http.StatusBadRequest, invalid)
+		return
+	}
+
+	u := User{ID: used.UserID}
+	if err := a.Storage.GetUserByID(&u); err != nil || u.Tenant != TenantFromContext(r.Context()) {
+		respondWithJSON(w, r, http.StatusBadRequest, invalid)
+		return
+	}
+
+	if used.Data != "" {
+		a.setMagicLinkCookie(w, "")
+	}
+
+	if u.DisabledAt != nil {
+		respondWithJSON(w, r, http.StatusForbidden, v.NewErrors("__error__", v.ErrInvalid, "account is disabled").JSONErrors())
+		return
+	}
+
+	// following link prove user own email address
+	if u.EmailVerifiedAt == nil {
+		if err := a.Storage.SetEmailVerified(&u); err != nil {
+			log.Printf("cannot set email verified for user %d: %v", u.ID, err)
+		}
+	}
+
+	u.AMR = []string{AMREmail}
+	if u.TOTPEnabledAt != nil {
+		a.respondWithMFAChallenge(w, r, &u)
+		return
+	}
+
+	if err := a.Storage.UpdateLastLogin(&u); err != nil {
+		log.Printf("cannot update last login for user %d: %v", u.ID, err)
+	}
+
+	a.respondWithTokens(w, r, http.StatusOK, &u, "")
+}
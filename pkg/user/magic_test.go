@@ -0,0 +1,94 @@
+package user
+
+import (
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"testing"
+)
+
+var tokenInMagicLink = regexp.MustCompile(`/login/magic/([A-Za-z0-9_-]+)`)
+
+// requestMagicLink ask link for exist@user.com and return token mailed in it and response cookies
+func requestMagicLink(t *testing.T, a *App) (string, []*http.Cookie) {
+	response := sessionRequest(a, "POST", "/login/magic", nil, "", map[string]string{"email": "exist@user.com"})
+	if response.Code != 200 {
+		t.Fatalf("Expected login link to be sent, got %d %s", response.Code, response.Body.String())
+	}
+
+	m, ok := a.Config.Mailer.(*MemoryMailer).Last("exist@user.com")
+	if !ok {
+		t.Fatalf("Expected mail to exist@user.com")
+	}
+	match := tokenInMagicLink.FindStringSubmatch(m.Body)
+	if match == nil {
+		t.Fatalf("Expected login link in mail, got: %s", m.Body)
+	}
+	return match[1], response.Result().Cookies()
+}
+
+func TestMagicLinkLogin(t *testing.T) {
+	a := SetUp(t)
+	token, _ := requestMagicLink(t, a)
+
+	response := sessionRequest(a, "GET", "/login/magic/"+token, nil, "", nil)
+	if response.Code != 200 {
+		t.Fatalf("Expected link to login, got %d %s", response.Code, response.Body.String())
+	}
+
+	var res map[string]interface{}
+	json.Unmarshal(response.Body.Bytes(), &res)
+	c, err := a.Tokens.Parse(res["token"].(string))
+	if err != nil || c.Email != "exist@user.com" || len(c.AMR) != 1 || c.AMR[0] != AMREmail {
+		t.Errorf("Expected token with email amr, got %+v %v", c, err)
+	}
+
+	if response := sessionRequest(a, "GET", "/login/magic/"+token, nil, "", nil); response.Code != 400 {
+		t.Errorf("Expected used link to be refused, got %d", response.Code)
+	}
+}
+
+func TestMagicLinkUnknownEmail(t *testing.T) {
+	a := SetUp(t)
+
+	response := sessionRequest(a, "POST", "/login/magic", nil, "", map[string]string{"email": "unknown@user.com"})
+	if response.Code != 200 {
+		t.Errorf("Expected the same answer for unknown email, got %d", response.Code)
+	}
+	if _, ok := a.Config.Mailer.(*MemoryMailer).Last("unknown@user.com"); ok {
+		t.Errorf("Expected no mail for unknown email")
+	}
+
+	// token for other action can't be used to login
+	jsonRequest(a, "POST", "/password/forgot", "", "", map[string]string{"email": "exist@user.com"}, nil)
+	if response := sessionRequest(a, "GET", "/login/magic/"+mailedToken(t, a, "exist@user.com"), nil, "", nil); response.Code != 400 {
+		t.Errorf("Expected password reset token to be refused, got %d", response.Code)
+	}
+}
+
+func TestMagicLinkSameDevice(t *testing.T) {
+	t.Parallel()
+	c := testConfig()
+	c.MagicLinkSameDevice = true
+	app, err := NewAppWithConfig(&FakeStorage{}, c)
+	if err != nil {
+		t.Fatalf("cannot create app: %v", err)
+	}
+	a := &app
+
+	token, cookies := requestMagicLink(t, a)
+	if len(cookies) != 1 || cookies[0].Name != MagicLinkCookie || !cookies[0].HttpOnly {
+		t.Fatalf("Expected HttpOnly device cookie, got %v", cookies)
+	}
+
+	other := []*http.Cookie{{Name: MagicLinkCookie, Value: "other"}}
+	for _, c := range [][]*http.Cookie{nil, other} {
+		if response := sessionRequest(a, "GET", "/login/magic/"+token, c, "", nil); response.Code != 400 {
+			t.Errorf("Expected link opened in other browser to be refused, got %d", response.Code)
+		}
+	}
+
+	if response := sessionRequest(a, "GET", "/login/magic/"+token, cookies, "", nil); response.Code != 200 {
+		t.Errorf("Expected link to login in the same browser, got %d %s", response.Code, response.Body.String())
+	}
+}
@@ -0,0 +1,132 @@
+package user
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/smtp"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Message is email we send to users
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// ErrMailHeader returned when recipient or subject contain line break, it would let
+// text put there, like organization name, add own headers to message
+var ErrMailHeader = errors.New("user: mail header cannot contain line break")
+
+// checkHeaders refuse message which headers can't be written as they are
+func checkHeaders(m Message) error {
+	if strings.ContainsAny(m.To+m.Subject, "\r\n") {
+		return ErrMailHeader
+	}
+	return nil
+}
+
+// Mailer deliver messages to users
+type Mailer interface {
+	Send(m Message) error
+}
+
+// LogMailer write messages to log, useful for local development
+type LogMailer struct{}
+
+// Send write message to log
+func (LogMailer) Send(m Message) error {
+	log.Printf("mail to: %s, subject: %s\n%s", m.To, m.Subject, m.Body)
+	return nil
+}
+
+// MemoryMailer keep messages in memory, used in tests
+type MemoryMailer struct {
+	mu       sync.Mutex
+	messages []Message
+}
+
+// Send store message
+func (mm *MemoryMailer) Send(m Message) error {
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+	mm.messages = append(mm.messages, m)
+	return nil
+}
+
+// Messages return all sent messages
+func (mm *MemoryMailer) Messages() []Message {
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+	return append([]Message(nil), mm.messages...)
+}
+
+// Last return last message sent to address
+func (mm *MemoryMailer) Last(to string) (Message, bool) {
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+	for i := len(mm.messages) - 1; i >= 0; i-- {
+		if mm.messages[i].To == to {
+			return mm.messages[i], true
+		}
+	}
+	return Message{}, false
+}
+
+// FileMailer write every message into separate file in Dir
+type FileMailer struct {
+	Dir string
+}
+
+// Send write message to <Dir>/<unix nano>-<to>.eml
+func (fm FileMailer) Send(m Message) error {
+	if err := checkHeaders(m); err != nil {
+		return err
+	}
+
+	name := fmt.Sprintf("%d-%s.eml", time.Now().UnixNano(), strings.Replace(m.To, string(filepath.Separator), "_", -1))
+	data := fmt.Sprintf("To: %s\r\nSubject: %s\r\n\r\n%s", m.To, m.Subject, m.Body)
+
+	if err := ioutil.WriteFile(filepath.Join(fm.Dir, name), []byte(data), 0600); err != nil {
+		return errors.Wrapf(err, "user: cannot write mail to %s", fm.Dir)
+	}
+	return nil
+}
+
+// SMTPMailer send messages through smtp server
+type SMTPMailer struct {
+	Addr     string
+	Username string
+	Password string
+	From     string
+}
+
+// Send message with smtp, auth is used only if Username is set
+func (sm SMTPMailer) Send(m Message) error {
+	if err := checkHeaders(m); err != nil {
+		return err
+	}
+
+	var auth smtp.Auth
+	if sm.Username != "" {
+		host := sm.Addr
+		if i := strings.LastIndex(host, ":"); i > 0 {
+			host = host[:i]
+		}
+		auth = smtp.PlainAuth("", sm.Username, sm.Password, host)
+	}
+
+	data := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\nContent-Type: text/plain; charset=UTF-8\r\n\r\n%s",
+		sm.From, m.To, m.Subject, m.Body)
+
+	if err := smtp.SendMail(sm.Addr, auth, sm.From, []string{m.To}, []byte(data)); err != nil {
+		return errors.Wrapf(err, "user: cannot send mail to %s", m.To)
+	}
+	return nil
+}
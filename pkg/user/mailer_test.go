@@ -0,0 +1,26 @@
+package user
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestFileMailerHeaders(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mails")
+	if err != nil {
+		t.Fatalf("cannot create dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	fm := FileMailer{Dir: dir}
+
+	if err := fm.Send(Message{To: "bob@user.com", Subject: "Hi\r\nBcc: victim@user.com", Body: "hello"}); err != ErrMailHeader {
+		t.Errorf("Expected subject with line break to be refused, got %v", err)
+	}
+	if err := fm.Send(Message{To: "bob@user.com", Subject: "Hi", Body: "hello\r\nthere"}); err != nil {
+		t.Errorf("Expected message to be written, got %v", err)
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 1 {
+		t.Errorf("Expected one mail file, got %d", len(files))
+	}
+}
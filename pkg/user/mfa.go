@@ -0,0 +1,303 @@
+package user
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx"
+	"github.com/pquerna/otp/totp"
+	v "github.com/webdeveloppro/validating"
+)
+
+// Authentication methods we put into amr claim, see RFC 8176.
+// AMREmail is not in RFC, it is login with link sent by email
+const (
+	AMRPassword = "pwd"
+	AMROTP      = "otp"
+	AMRMFA      = "mfa"
+	AMREmail    = "email"
+)
+
+const (
+	// totpPeriod is totp time step in seconds
+	totpPeriod = 30
+	// recoveryCodesCount is number of recovery codes generated on mfa setup
+	recoveryCodesCount = 10
+	// mfaMaxAttempts is number of wrong codes after which user have to enter password again
+	mfaMaxAttempts = 5
+)
+
+// mfaTOTPSetup generate new totp secret and return it with otpauth uri for qr code
+// secret is not used for login until it is confirmed with code
+func (a *App) mfaTOTPSetup(w http.ResponseWriter, r *http.Request) {
+	u, _ := UserFromContext(r.Context())
+
+	if u.TOTPEnabledAt != nil {
+		respondWithError(w, r, http.StatusBadRequest, "two-factor authentication is already enabled")
+		return
+	}
+
+	key, err := totp.Generate(totp.GenerateOpts{
+		Issuer:      a.Config.TOTPIssuer,
+		AccountName: u.Email,
+	})
+	if err != nil {
+		log.Printf("cannot generate totp secret for user %d: %v", u.ID, err)
+		respondWithError(w, r, http.StatusInternalServerError, "cannot setup two-factor authentication, please try again in few minutes")
+		return
+	}
+
+	u.TOTPSecret = key.Secret()
+	if err := a.Storage.SetTOTPSecret(u); err != nil {
+		log.Printf("cannot store totp secret for user %d: %v", u.ID, err)
+		respondWithError(w, r, http.StatusInternalServerError, "cannot setup two-factor authentication, please try again in few minutes")
+		return
+	}
+
+	respondWithJSON(w, r, http.StatusOK, map[string]string{
+		"secret":      key.Secret(),
+		"otpauth_uri": key.URL(),
+	})
+}
+
+// mfaTOTPConfirm enable totp after user entered first code from authenticator app
+// recovery codes are returned only here, we keep just their hashes
+func (a *App) mfaTOTPConfirm(w http.ResponseWriter, r *http.Request) {
+	u, _ := UserFromContext(r.Context())
+
+	var req struct {
+		Code string `json:"code"`
+	}
+
+	if r.Body == nil {
+		respondWithJSON(w, r, http.StatusBadRequest, []string{})
+		return
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondWithJSON(w, r, http.StatusBadRequest, []string{})
+		return
+	}
+
+	if u.TOTPEnabledAt != nil {
+		respondWithError(w, r, http.StatusBadRequest, "two-factor authentication is already enabled")
+		return
+	}
+
+	if u.TOTPSecret == "" {
+		respondWithError(w, r, http.StatusBadRequest, "two-factor authentication is not set up")
+		return
+	}
+
+	ok, err := a.checkTOTP(u, req.Code)
+	if err != nil {
+		log.Printf("cannot check totp code for user %d: %v", u.ID, err)
+		respondWithError(w, r, http.StatusInternalServerError, "cannot setup two-factor authentication, please try again in few minutes")
+		return
+	}
+	if !ok {
+		respondWithJSON(w, r, http.StatusBadRequest, v.NewErrors("code", v.ErrInvalid, "code do not match").JSONErrors())
+		return
+	}
+
+	codes, hashes, err := newRecoveryCodes(recoveryCodesCount)
+	if err == nil {
+		err = a.Storage.EnableTOTP(u, hashes)
+	}
+	if err != nil {
+		log.Printf("cannot enable totp for user %d: %v", u.ID, err)
+		respondWithError(w, r, http.StatusInternalServerError, "cannot setup two-factor authentication, please try again in few minutes")
+		return
+	}
+
+	respondWithJSON(w, r, http.StatusOK, map[string][]string{"recovery_codes": codes})
+}
+
+// newMFAChallenge create challenge token, it remember number of wrong codes
+// and authentication methods of first factor as "<attempts>|<amr>"
+func (a *App) newMFAChallenge(u *User, attempts int, ttl time.Duration) (string, error) {
+	amr := u.AMR
+	if len(amr) == 0 {
+		amr = []string{AMRPassword}
+	}
+	return a.newActionToken(u, PurposeMFAChallenge, strconv.Itoa(attempts)+"|"+strings.Join(amr, ","), ttl)
+}
+
+// parseMFAChallenge return attempts and first factor amr stored by newMFAChallenge
+func parseMFAChallenge(data string) (int, []string) {
+	parts := strings.SplitN(data, "|", 2)
+	attempts, _ := strconv.Atoi(parts[0])
+	if len(parts) < 2 || parts[1] == "" {
+		return attempts, []string{AMRPassword}
+	}
+	return attempts, strings.Split(parts[1], ",")
+}
+
+// respondWithMFAChallenge is called by login when first factor is correct but second factor is needed
+func (a *App) respondWithMFAChallenge(w http.ResponseWriter, r *http.Request, u *User) {
+	token, err := a.newMFAChallenge(u, 0, a.Config.MFAChallengeTTL)
+	if err != nil {
+		log.Printf("cannot create mfa challenge for user %d: %v", u.ID, err)
+		respondWithError(w, r, http.StatusInternalServerError, "cannot login, please try again in few minutes")
+		return
+	}
+
+	respondWithJSON(w, r, http.StatusOK, map[string]interface{}{
+		"mfa_required": true,
+		"mfa_token":    token,
+	})
+}
+
+// loginMFA finish login with totp or recovery code and mfa_token returned by login
+// challenge is single use, after wrong code new mfa_token is returned until mfaMaxAttempts
+func (a *App) loginMFA(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		MFAToken     string `json:"mfa_token"`
+		Code         string `json:"code"`
+		RecoveryCode string `json:"recovery_code"`
+	}
+
+	if r.Body == nil {
+		respondWithJSON(w, r, http.StatusBadRequest, []string{})
+		return
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondWithJSON(w, r, http.StatusBadRequest, []string{})
+		return
+	}
+
+	if req.Code == "" && req.RecoveryCode == "" {
+		respondWithJSON(w, r, http.StatusBadRequest, v.NewErrors("code", v.ErrInvalid, "cannot be empty").JSONErrors())
+		return
+	}
+
+	at, err := a.useActionToken(req.MFAToken, PurposeMFAChallenge)
+	if err != nil {
+		if err != ErrActionTokenInvalid {
+			log.Printf("cannot use mfa challenge: %v", err)
+		}
+		respondWithJSON(w, r, http.StatusUnauthorized,
+			v.NewErrors("mfa_token", v.ErrInvalid, "login session is invalid or expired, please login again").JSONErrors())
+		return
+	}
+
+	u := User{ID: at.UserID}
+	if err := a.Storage.GetUserByID(&u); err != nil || u.TOTPEnabledAt == nil {
+		respondWithJSON(w, r, http.StatusUnauthorized,
+			v.NewErrors("mfa_token", v.ErrInvalid, "login session is invalid or expired, please login again").JSONErrors())
+		return
+	}
+
+	var ok bool
+	if req.Code != "" {
+		ok, err = a.checkTOTP(&u, req.Code)
+	} else {
+		ok, err = a.checkRecoveryCode(&u, req.RecoveryCode)
+	}
+	if err != nil {
+		log.Printf("cannot check second factor for user %d: %v", u.ID, err)
+		respondWithError(w, r, http.StatusInternalServerError, "cannot login, please try again in few minutes")
+		return
+	}
+
+	attempts, amr := parseMFAChallenge(at.Data)
+	u.AMR = amr
+
+	if !ok {
+		attempts++
+		if attempts >= mfaMaxAttempts {
+			respondWithJSON(w, r, http.StatusUnauthorized,
+				v.NewErrors("mfa_token", v.ErrInvalid, "too many wrong codes, please login again").JSONErrors())
+			return
+		}
+
+		token, err := a.newMFAChallenge(&u, attempts, time.Until(at.ExpiresAt))
+		if err != nil {
+			log.Printf("cannot create mfa challenge for user %d: %v", u.ID, err)
+			respondWithError(w, r, http.StatusInternalServerError, "cannot login, please try again in few minutes")
+			return
+		}
+
+		respondWithJSON(w, r, http.StatusBadRequest, map[string]interface{}{
+			"code":      []string{"code do not match"},
+			"mfa_token": token,
+		})
+		return
+	}
+
+	if err := a.Storage.UpdateLastLogin(&u); err != nil {
+		log.Printf("cannot update last login for user %d: %v", u.ID, err)
+	}
+
+	u.AMR = append(u.AMR, AMROTP, AMRMFA)
+	a.respondWithTokens(w, r, http.StatusOK, &u, "")
+}
+
+// checkTOTP validate code for current, previous and next time step
+// code can be used only once, so it can't be replayed by somebody watching the screen
+func (a *App) checkTOTP(u *User, code string) (bool, error) {
+	code = strings.TrimSpace(code)
+	now := time.Now()
+
+	for _, step := range []int64{0, -1, 1} {
+		t := now.Add(time.Duration(step*totpPeriod) * time.Second)
+		expected, err := totp.GenerateCode(u.TOTPSecret, t)
+		if err != nil {
+			return false, err
+		}
+
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			err := a.Storage.UseTOTPCounter(u, t.Unix()/totpPeriod)
+			if err == ErrTOTPCodeUsed {
+				return false, nil
+			}
+			return err == nil, err
+		}
+	}
+
+	return false, nil
+}
+
+// checkRecoveryCode mark recovery code as used if user have it
+func (a *App) checkRecoveryCode(u *User, code string) (bool, error) {
+	err := a.Storage.UseRecoveryCode(u, hashToken(normalizeRecoveryCode(code)))
+	if err == pgx.ErrNoRows {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// newRecoveryCodes return n codes like "abcd-efgh" and their hashes
+func newRecoveryCodes(n int) ([]string, []string, error) {
+	codes := make([]string, n)
+	hashes := make([]string, n)
+	enc := base32.StdEncoding.WithPadding(base32.NoPadding)
+
+	for i := range codes {
+		b := make([]byte, 5)
+		if _, err := rand.Read(b); err != nil {
+			return nil, nil, err
+		}
+
+		code := strings.ToLower(enc.EncodeToString(b))
+		codes[i] = code[:4] + "-" + code[4:]
+		hashes[i] = hashToken(code)
+	}
+
+	return codes, hashes, nil
+}
+
+// normalizeRecoveryCode remove dashes and spaces users type in codes
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToLower(code)
+	code = strings.Replace(code, "-", "", -1)
+	return strings.Replace(code, " ", "", -1)
+}
@@ -0,0 +1,161 @@
+package user
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pquerna/otp/totp"
+)
+
+// enableTOTP run setup and confirm for exist@user.com, return secret and recovery codes
+func enableTOTP(t *testing.T, a *App) (string, []string) {
+	token, _ := loginTokens(t, a)
+
+	code, body := jsonRequest(a, "POST", "/mfa/totp/setup", "", token, nil, nil)
+	if code != 200 {
+		t.Fatalf("Expected totp setup to succeed, got %d %s", code, body)
+	}
+
+	var setup map[string]string
+	json.Unmarshal([]byte(body), &setup)
+	if !strings.HasPrefix(setup["otpauth_uri"], "otpauth://totp/") || !strings.Contains(setup["otpauth_uri"], "secret="+setup["secret"]) {
+		t.Fatalf("Expected otpauth uri with secret, got %+v", setup)
+	}
+
+	if code, body := jsonRequest(a, "POST", "/mfa/totp/confirm", "", token, map[string]string{"code": "000000"}, nil); code != 400 || body != `{"code":["code do not match"]}` {
+		t.Errorf("Expected wrong code to be rejected, got %d %s", code, body)
+	}
+
+	otp, _ := totp.GenerateCode(setup["secret"], time.Now())
+	code, body = jsonRequest(a, "POST", "/mfa/totp/confirm", "", token, map[string]string{"code": otp}, nil)
+	if code != 200 {
+		t.Fatalf("Expected totp confirm to succeed, got %d %s", code, body)
+	}
+
+	var res map[string][]string
+	json.Unmarshal([]byte(body), &res)
+	if len(res["recovery_codes"]) != recoveryCodesCount {
+		t.Fatalf("Expected %d recovery codes, got %+v", recoveryCodesCount, res)
+	}
+
+	if code, _ := jsonRequest(a, "POST", "/mfa/totp/setup", "", token, nil, nil); code != 400 {
+		t.Errorf("Expected second setup to be refused, got %d", code)
+	}
+
+	return setup["secret"], res["recovery_codes"]
+}
+
+// mfaChallenge login with password and return mfa_token
+func mfaChallenge(t *testing.T, a *App) string {
+	code, body := jsonRequest(a, "POST", "/login", "", "", map[string]string{"email": "exist@user.com", "password": "123123"}, nil)
+
+	var res map[string]interface{}
+	json.Unmarshal([]byte(body), &res)
+	if code != 200 || res["mfa_required"] != true || res["token"] != nil {
+		t.Fatalf("Expected mfa challenge instead of token, got %d %s", code, body)
+	}
+	return res["mfa_token"].(string)
+}
+
+func checkAMR(t *testing.T, a *App, body string, expected []string) {
+	var res map[string]interface{}
+	json.Unmarshal([]byte(body), &res)
+
+	token, _ := res["token"].(string)
+	c, err := a.Tokens.Parse(token)
+	if err != nil {
+		t.Fatalf("Expected valid token, got error: %v, body: %s", err, body)
+	}
+	if !reflect.DeepEqual(c.AMR, expected) {
+		t.Errorf("Expected amr %v, got %v", expected, c.AMR)
+	}
+}
+
+func TestLoginTOTP(t *testing.T) {
+	a := SetUp(t)
+
+	secret, _ := enableTOTP(t, a)
+	challenge := mfaChallenge(t, a)
+
+	// wrong code return new challenge, old one is used
+	code, body := jsonRequest(a, "POST", "/login/mfa", "", "", map[string]string{"mfa_token": challenge, "code": "000000"}, nil)
+	var res map[string]interface{}
+	json.Unmarshal([]byte(body), &res)
+	if code != 400 || res["mfa_token"] == nil {
+		t.Fatalf("Expected wrong code to return new challenge, got %d %s", code, body)
+	}
+
+	// code from confirm was used already, so take one for next time step
+	otp, _ := totp.GenerateCode(secret, time.Now().Add(totpPeriod*time.Second))
+	if code, body := jsonRequest(a, "POST", "/login/mfa", "", "", map[string]string{"mfa_token": challenge, "code": otp}, nil); code != 401 {
+		t.Errorf("Expected used challenge to be rejected, got %d %s", code, body)
+	}
+
+	code, body = jsonRequest(a, "POST", "/login/mfa", "", "", map[string]string{"mfa_token": res["mfa_token"].(string), "code": otp}, nil)
+	if code != 200 {
+		t.Fatalf("Expected mfa login to succeed, got %d %s", code, body)
+	}
+	checkAMR(t, a, body, []string{AMRPassword, AMROTP, AMRMFA})
+
+	// amr is kept on refresh
+	json.Unmarshal([]byte(body), &res)
+	_, refreshed := doRefresh(a, res["refresh_token"].(string))
+	b, _ := json.Marshal(refreshed)
+	checkAMR(t, a, string(b), []string{AMRPassword, AMROTP, AMRMFA})
+
+	// same code can't be used twice
+	if code, body := jsonRequest(a, "POST", "/login/mfa", "", "", map[string]string{"mfa_token": mfaChallenge(t, a), "code": otp}, nil); code != 400 {
+		t.Errorf("Expected replayed code to be rejected, got %d %s", code, body)
+	}
+}
+
+func TestLoginRecoveryCode(t *testing.T) {
+	a := SetUp(t)
+
+	_, codes := enableTOTP(t, a)
+
+	code, body := jsonRequest(a, "POST", "/login/mfa", "", "", map[string]string{"mfa_token": mfaChallenge(t, a), "recovery_code": strings.ToUpper(codes[0])}, nil)
+	if code != 200 {
+		t.Fatalf("Expected recovery code login to succeed, got %d %s", code, body)
+	}
+	checkAMR(t, a, body, []string{AMRPassword, AMROTP, AMRMFA})
+
+	if code, body := jsonRequest(a, "POST", "/login/mfa", "", "", map[string]string{"mfa_token": mfaChallenge(t, a), "recovery_code": codes[0]}, nil); code != 400 {
+		t.Errorf("Expected used recovery code to be rejected, got %d %s", code, body)
+	}
+}
+
+func TestLoginMFAAttempts(t *testing.T) {
+	a := SetUp(t)
+
+	enableTOTP(t, a)
+	challenge := mfaChallenge(t, a)
+
+	for i := 1; i < mfaMaxAttempts; i++ {
+		code, body := jsonRequest(a, "POST", "/login/mfa", "", "", map[string]string{"mfa_token": challenge, "code": "000000"}, nil)
+		var res map[string]interface{}
+		json.Unmarshal([]byte(body), &res)
+		if code != 400 {
+			t.Fatalf("Attempt %d: expected 400, got %d %s", i, code, body)
+		}
+		challenge = res["mfa_token"].(string)
+	}
+
+	code, body := jsonRequest(a, "POST", "/login/mfa", "", "", map[string]string{"mfa_token": challenge, "code": "000000"}, nil)
+	if code != 401 || body != `{"mfa_token":["too many wrong codes, please login again"]}` {
+		t.Errorf("Expected login to be restarted, got %d %s", code, body)
+	}
+}
+
+func TestLoginWithoutMFA(t *testing.T) {
+	a := SetUp(t)
+
+	code, body := jsonRequest(a, "POST", "/login", "", "", map[string]string{"email": "exist@user.com", "password": "123123"}, nil)
+	if code != 200 {
+		t.Fatalf("Expected login to succeed, got %d %s", code, body)
+	}
+	checkAMR(t, a, body, []string{AMRPassword})
+}
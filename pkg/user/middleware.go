@@ -0,0 +1,161 @@
+package user
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/jackc/pgx"
+)
+
+type contextKey int
+
+const (
+	userContextKey contextKey = iota
+	claimsContextKey
+	tenantContextKey
+	sessionContextKey
+)
+
+// UserFromContext return user authenticated by Authenticate middleware
+func UserFromContext(ctx context.Context) (*User, bool) {
+	u, ok := ctx.Value(userContextKey).(*User)
+	return u, ok
+}
+
+// ClaimsFromContext return claims of token authenticated by Authenticate middleware
+func ClaimsFromContext(ctx context.Context) (*Claims, bool) {
+	c, ok := ctx.Value(claimsContextKey).(*Claims)
+	return c, ok
+}
+
+// tokenFromRequest return token from Authorization header,
+// Bearer prefix is optional to keep old clients working
+func tokenFromRequest(r *http.Request) string {
+	token := strings.TrimSpace(r.Header.Get("Authorization"))
+	if len(token) > 7 && strings.EqualFold(token[:7], "Bearer ") {
+		token = strings.TrimSpace(token[7:])
+	}
+	return token
+}
+
+// Authenticate is gorilla/mux middleware which require valid token, API key or session cookie,
+// load owner from storage and put it into request context
+//
+//	a.Router.Handle("/orders", a.Authenticate(ordersHandler)).Methods("GET")
+func (a *App) Authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var c *Claims
+		var key *APIKey
+		var s *Session
+		var err error
+
+		if apiKey, ok := apiKeyFromRequest(r); ok {
+			key, err = a.parseAPIKey(apiKey)
+		} else if token := tokenFromRequest(r); token != "" {
+			c, err = a.tenant(r).tokens.Parse(token)
+		} else if _, cerr := r.Cookie(SessionCookie); cerr == nil && a.Config.SessionCookies {
+			s, err = a.sessionFromRequest(w, r)
+		} else {
+			respondWithError(w, r, http.StatusUnauthorized, "Authorization")
+			return
+		}
+		if err != nil {
+			respondWithError(w, r, tokenErrorStatus(err), err.Error())
+			return
+		}
+
+		u := &User{}
+		if key != nil {
+			u.ID = key.UserID
+		} else if s != nil {
+			u.ID = s.UserID
+		} else if c.Service() {
+			respondWithError(w, r, http.StatusForbidden, "service token cannot be used here")
+			return
+		} else if u.ID, err = strconv.Atoi(c.Subject); err != nil {
+			respondWithError(w, r, http.StatusUnauthorized, ErrTokenMalformed.Error())
+			return
+		}
+
+		// users of other tenants do not exist here, even when tenants share keys
+		err = a.Storage.GetUserByID(u)
+		if err == nil && u.Tenant != TenantFromContext(r.Context()) {
+			err = pgx.ErrNoRows
+		}
+		if err != nil {
+			if err != pgx.ErrNoRows {
+				log.Printf("cannot load user %d: %v", u.ID, err)
+				respondWithError(w, r, http.StatusInternalServerError, "cannot load user, please try again in few minutes")
+				return
+			}
+			respondWithError(w, r, http.StatusUnauthorized, "user does not exist")
+			return
+		}
+
+		if u.DisabledAt != nil {
+			respondWithError(w, r, http.StatusForbidden, "account is disabled")
+			return
+		}
+
+		if key != nil {
+			c = apiKeyClaims(u, key)
+		} else if s != nil {
+			u.SessionID = s.ID
+		} else if c.SessionID != "" {
+			u.SessionID, _ = strconv.Atoi(c.SessionID)
+		}
+
+		ctx := context.WithValue(r.Context(), userContextKey, u)
+		if s != nil {
+			// logout everywhere and password change end sessions as well as tokens
+			if s.TokenVersion != u.TokenVersion {
+				respondWithError(w, r, ErrSessionInvalid.Status, ErrSessionInvalid.Error())
+				return
+			}
+			if c, err = u.newClaims(a.tenantByID(u.Tenant).tokens); err != nil {
+				log.Printf("cannot create claims for session of user %d: %v", u.ID, err)
+				respondWithError(w, r, http.StatusInternalServerError, "cannot load user, please try again in few minutes")
+				return
+			}
+			c.AMR = s.AMR
+			ctx = context.WithValue(ctx, sessionContextKey, s)
+		}
+		ctx = context.WithValue(ctx, claimsContextKey, c)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// RequireScope is middleware which let through only tokens having one of scopes,
+// it should be used after Authenticate. Tokens from our own login have no scope and can do everything
+func RequireScope(next http.Handler, scopes ...string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, ok := ClaimsFromContext(r.Context())
+		if !ok {
+			respondWithError(w, r, http.StatusUnauthorized, "Authorization")
+			return
+		}
+
+		if c.Scope != "" {
+			allowed := false
+			for _, s := range scopes {
+				allowed = allowed || hasScope(c.Scope, s)
+			}
+			if !allowed {
+				w.Header().Set("WWW-Authenticate", `Bearer error="insufficient_scope", scope="`+strings.Join(scopes, " ")+`"`)
+				respondWithError(w, r, http.StatusForbidden, "token scope does not allow this request")
+				return
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// authenticated wrap handler function with Authenticate middleware,
+// tokens with scope and API keys are accepted only if they have one of scopes
+func (a *App) authenticated(h http.HandlerFunc, scopes ...string) http.Handler {
+	return a.Authenticate(RequireScope(h, scopes...))
+}
@@ -0,0 +1,50 @@
+package user
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestAuthenticateContext(t *testing.T) {
+	a := SetUp(t)
+
+	var got *User
+	var claims *Claims
+	a.Router.Handle("/orders", a.Authenticate(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got, _ = UserFromContext(r.Context())
+		claims, _ = ClaimsFromContext(r.Context())
+		w.WriteHeader(http.StatusNoContent)
+	}))).Methods("GET")
+
+	u := User{ID: 1, Email: "exist@user.com"}
+	token, _ := u.GetToken(a.Tokens)
+
+	req, _ := http.NewRequest("GET", "/orders", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	response := executeRequest(a, req)
+
+	if response.Code != http.StatusNoContent {
+		t.Fatalf("Expected protected handler to be called, got %d: %s", response.Code, response.Body.String())
+	}
+
+	if got == nil || got.ID != 1 || got.Email != "exist@user.com" {
+		t.Errorf("Expected user from storage in context, got: %+v", got)
+	}
+
+	if claims == nil || claims.Subject != "1" {
+		t.Errorf("Expected token claims in context, got: %+v", claims)
+	}
+
+	req, _ = http.NewRequest("GET", "/orders", nil)
+	response = executeRequest(a, req)
+	if response.Code != http.StatusUnauthorized {
+		t.Errorf("Expected request without token to be rejected, got: %d", response.Code)
+	}
+}
+
+func TestUserFromEmptyContext(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/", nil)
+	if u, ok := UserFromContext(req.Context()); ok || u != nil {
+		t.Errorf("Expected no user in context, got: %+v", u)
+	}
+}
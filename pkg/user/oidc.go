@@ -0,0 +1,628 @@
+package user
+
+import (
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/gorilla/mux"
+	"github.com/jackc/pgx"
+	"github.com/pkg/errors"
+)
+
+// AMRFederated is put into amr claim for logins through OpenID Connect provider
+const AMRFederated = "fed"
+
+// oauthStateCookie keep state in browser which started login, so callback
+// can't be replayed in other browser (login CSRF)
+const oauthStateCookie = "oauth_state"
+
+// oidcKeysRefresh is minimal time between JWKS fetches when unknown kid is seen
+const oidcKeysRefresh = time.Minute
+
+// Errors of social login, they are passed to frontend as error in url fragment
+var (
+	ErrOAuthState            = errors.New("invalid_state")
+	ErrOAuthToken            = errors.New("invalid_token")
+	ErrOAuthEmailRequired    = errors.New("email_required")
+	ErrOAuthEmailNotVerified = errors.New("email_not_verified")
+)
+
+// OAuthProvider is OpenID Connect provider users can login with, like Google
+// AuthURL, TokenURL and JWKSURL are discovered from Issuer when empty
+type OAuthProvider struct {
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	// RedirectURL is our /oauth/{provider}/callback url registered at provider
+	RedirectURL string
+	Scopes      []string
+
+	AuthURL  string
+	TokenURL string
+	JWKSURL  string
+}
+
+// OAuthState is one social login attempt, created on start and used on callback
+// Only hash of state is stored, nonce and code verifier never leave the server
+type OAuthState struct {
+	ID           int
+	Provider     string
+	StateHash    string
+	Nonce        string
+	CodeVerifier string
+	// Tenant is tenant of start request, callback url is shared by tenants
+	Tenant    string
+	CreatedAt time.Time
+	ExpiresAt time.Time
+}
+
+// Identity link provider account to user
+type Identity struct {
+	ID        int
+	Tenant    string
+	UserID    int
+	Provider  string
+	Subject   string
+	Email     string
+	CreatedAt time.Time
+}
+
+// oidcBool accept email_verified as bool or string, some providers send "true"
+type oidcBool bool
+
+func (b *oidcBool) UnmarshalJSON(data []byte) error {
+	s := strings.Trim(string(data), `"`)
+	*b = oidcBool(s == "true")
+	return nil
+}
+
+// oidcClaims are claims of ID token we care about
+type oidcClaims struct {
+	Issuer          string   `json:"iss"`
+	Subject         string   `json:"sub"`
+	Audience        Audience `json:"aud"`
+	AuthorizedParty string   `json:"azp"`
+	ExpiresAt       int64    `json:"exp"`
+	IssuedAt        int64    `json:"iat"`
+	Nonce           string   `json:"nonce"`
+	Email           string   `json:"email"`
+	EmailVerified   oidcBool `json:"email_verified"`
+	GivenName       string   `json:"given_name"`
+	FamilyName      string   `json:"family_name"`
+	Picture         string   `json:"picture"`
+	Locale          string   `json:"locale"`
+}
+
+// Valid is required by jwt.Claims, validation happen in oidcClient.verify
+func (c *oidcClaims) Valid() error {
+	return nil
+}
+
+// oidcClient talk to one provider, discovered endpoints and keys are cached
+type oidcClient struct {
+	OAuthProvider
+	name   string
+	client *http.Client
+
+	mu          sync.Mutex
+	keys        map[string]interface{}
+	keysFetched time.Time
+}
+
+func newOIDCClient(name string, p OAuthProvider) *oidcClient {
+	if len(p.Scopes) == 0 {
+		p.Scopes = []string{"openid", "email", "profile"}
+	}
+	return &oidcClient{
+		OAuthProvider: p,
+		name:          name,
+		client:        &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// getJSON fetch url and decode json response into v
+func (c *oidcClient) getJSON(u string, v interface{}) error {
+	resp, err := c.client.Get(u)
+	if err != nil {
+		return errors.Wrapf(err, "user: cannot fetch %s", u)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("user: %s returned %s", u, resp.Status)
+	}
+	return errors.Wrapf(json.NewDecoder(resp.Body).Decode(v), "user: cannot decode %s", u)
+}
+
+// discover fill missing endpoints from provider configuration
+func (c *oidcClient) discover() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.AuthURL != "" && c.TokenURL != "" && c.JWKSURL != "" {
+		return nil
+	}
+
+	var conf struct {
+		Issuer   string `json:"issuer"`
+		AuthURL  string `json:"authorization_endpoint"`
+		TokenURL string `json:"token_endpoint"`
+		JWKSURL  string `json:"jwks_uri"`
+	}
+	if err := c.getJSON(strings.TrimRight(c.Issuer, "/")+"/.well-known/openid-configuration", &conf); err != nil {
+		return err
+	}
+
+	if conf.Issuer != c.Issuer {
+		return fmt.Errorf("user: provider %s issuer %s do not match %s", c.name, conf.Issuer, c.Issuer)
+	}
+
+	c.AuthURL, c.TokenURL, c.JWKSURL = conf.AuthURL, conf.TokenURL, conf.JWKSURL
+	return nil
+}
+
+// keyfunc find provider key for ID token, keys are fetched again when unknown kid is seen
+func (c *oidcClient) keyfunc(token *jwt.Token) (interface{}, error) {
+	switch token.Method.(type) {
+	case *jwt.SigningMethodRSA, *jwt.SigningMethodECDSA:
+	default:
+		return nil, fmt.Errorf("Unexpected signing method: %v", token.Header["alg"])
+	}
+
+	kid, _ := token.Header["kid"].(string)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key, ok := c.keys[kid]
+	if !ok && time.Since(c.keysFetched) > oidcKeysRefresh {
+		if err := c.fetchKeys(); err != nil {
+			return nil, err
+		}
+		key, ok = c.keys[kid]
+	}
+
+	// provider with single key may not set kid
+	if !ok && kid == "" && len(c.keys) == 1 {
+		for _, k := range c.keys {
+			key, ok = k, true
+		}
+	}
+	if !ok {
+		return nil, fmt.Errorf("Unknown signing key: %v", kid)
+	}
+
+	switch key.(type) {
+	case *rsa.PublicKey:
+		if _, ok := token.Method.(*jwt.SigningMethodRSA); ok {
+			return key, nil
+		}
+	case *ecdsa.PublicKey:
+		if _, ok := token.Method.(*jwt.SigningMethodECDSA); ok {
+			return key, nil
+		}
+	}
+	return nil, fmt.Errorf("Unexpected signing method: %v", token.Header["alg"])
+}
+
+// fetchKeys download provider JWKS, c.mu must be held
+func (c *oidcClient) fetchKeys() error {
+	var set JWKS
+	if err := c.getJSON(c.JWKSURL, &set); err != nil {
+		return err
+	}
+
+	keys := map[string]interface{}{}
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		key, err := jwk.PublicKey()
+		if err != nil {
+			log.Printf("skip key of provider %s: %v", c.name, err)
+			continue
+		}
+		keys[jwk.Kid] = key
+	}
+
+	c.keys = keys
+	c.keysFetched = time.Now()
+	return nil
+}
+
+// authURL return url of provider login page
+func (c *oidcClient) authURL(state, nonce, verifier string) string {
+	challenge := sha256.Sum256([]byte(verifier))
+
+	q := url.Values{}
+	q.Set("response_type", "code")
+	q.Set("client_id", c.ClientID)
+	q.Set("redirect_uri", c.RedirectURL)
+	q.Set("scope", strings.Join(c.Scopes, " "))
+	q.Set("state", state)
+	q.Set("nonce", nonce)
+	q.Set("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:]))
+	q.Set("code_challenge_method", "S256")
+
+	sep := "?"
+	if strings.Contains(c.AuthURL, "?") {
+		sep = "&"
+	}
+	return c.AuthURL + sep + q.Encode()
+}
+
+// exchange trade authorization code for ID token
+func (c *oidcClient) exchange(code, verifier string) (string, error) {
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", c.RedirectURL)
+	form.Set("code_verifier", verifier)
+
+	req, err := http.NewRequest("POST", c.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(c.ClientID), url.QueryEscape(c.ClientSecret))
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return "", errors.Wrapf(err, "user: cannot exchange code with %s", c.name)
+	}
+	defer resp.Body.Close()
+
+	var res struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return "", errors.Wrapf(err, "user: cannot decode token response of %s", c.name)
+	}
+
+	if resp.StatusCode != http.StatusOK || res.IDToken == "" {
+		return "", fmt.Errorf("user: %s token endpoint returned %s: %s %s", c.name, resp.Status, res.Error, res.ErrorDescription)
+	}
+	return res.IDToken, nil
+}
+
+// verify check ID token signature, issuer, audience, lifetime and nonce
+func (c *oidcClient) verify(idToken, nonce string, leeway time.Duration) (*oidcClaims, error) {
+	claims := &oidcClaims{}
+	parser := &jwt.Parser{SkipClaimsValidation: true}
+	if _, err := parser.ParseWithClaims(idToken, claims, c.keyfunc); err != nil {
+		return nil, errors.Wrapf(ErrOAuthToken, "signature: %v", err)
+	}
+
+	now := time.Now().Unix()
+	skew := int64(leeway / time.Second)
+
+	switch {
+	case claims.Issuer != c.Issuer:
+		return nil, errors.Wrapf(ErrOAuthToken, "issuer %s", claims.Issuer)
+	case !claims.Audience.Contains(c.ClientID):
+		return nil, errors.Wrapf(ErrOAuthToken, "audience %v", claims.Audience)
+	case len(claims.Audience) > 1 && claims.AuthorizedParty != c.ClientID:
+		return nil, errors.Wrapf(ErrOAuthToken, "authorized party %s", claims.AuthorizedParty)
+	case claims.ExpiresAt == 0 || now > claims.ExpiresAt+skew:
+		return nil, errors.Wrapf(ErrOAuthToken, "expired")
+	case now+skew < claims.IssuedAt:
+		return nil, errors.Wrapf(ErrOAuthToken, "issued in future")
+	case subtle.ConstantTimeCompare([]byte(claims.Nonce), []byte(nonce)) != 1:
+		return nil, errors.Wrapf(ErrOAuthToken, "nonce do not match")
+	case claims.Subject == "":
+		return nil, errors.Wrapf(ErrOAuthToken, "no subject")
+	}
+
+	return claims, nil
+}
+
+// oauthStart redirect browser to provider login page
+func (a *App) oauthStart(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["provider"]
+	c, ok := a.oauth[name]
+	if !ok {
+		respondWithError(w, r, http.StatusNotFound, "unknown provider")
+		return
+	}
+
+	if err := c.discover(); err != nil {
+		log.Printf("cannot discover provider %s: %v", name, err)
+		respondWithError(w, r, http.StatusBadGateway, "provider is not available, please try again in few minutes")
+		return
+	}
+
+	var state, nonce, verifier string
+	var err error
+	if state, err = randomString(32); err == nil {
+		if nonce, err = randomString(32); err == nil {
+			verifier, err = randomString(32)
+		}
+	}
+
+	if err == nil {
+		err = a.Storage.CreateOAuthState(&OAuthState{
+			Provider:     name,
+			StateHash:    hashToken(state),
+			Nonce:        nonce,
+			CodeVerifier: verifier,
+			Tenant:       TenantFromContext(r.Context()),
+			ExpiresAt:    time.Now().Add(a.Config.OAuthStateTTL),
+		})
+	}
+
+	if err != nil {
+		log.Printf("cannot start %s login: %v", name, err)
+		respondWithError(w, r, http.StatusInternalServerError, "cannot login, please try again in few minutes")
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     oauthStateCookie,
+		Value:    state,
+		Path:     "/oauth/",
+		MaxAge:   int(a.Config.OAuthStateTTL / time.Second),
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	http.Redirect(w, r, c.authURL(state, nonce, verifier), http.StatusFound)
+}
+
+// oauthCallback finish social login and redirect to frontend with tokens in url fragment
+func (a *App) oauthCallback(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["provider"]
+	c, ok := a.oauth[name]
+	if !ok {
+		respondWithError(w, r, http.StatusNotFound, "unknown provider")
+		return
+	}
+
+	// state cookie is needed only once
+	http.SetCookie(w, &http.Cookie{Name: oauthStateCookie, Path: "/oauth/", MaxAge: -1})
+
+	q := r.URL.Query()
+	if e := q.Get("error"); e != "" {
+		a.oauthRedirect(w, r, url.Values{"error": {e}, "error_description": {q.Get("error_description")}})
+		return
+	}
+
+	st, err := a.useOAuthState(r, name)
+	if err != nil {
+		a.oauthFail(w, r, name, err)
+		return
+	}
+
+	idToken, err := c.exchange(q.Get("code"), st.CodeVerifier)
+	if err != nil {
+		a.oauthFail(w, r, name, errors.Wrapf(ErrOAuthToken, "%v", err))
+		return
+	}
+
+	claims, err := c.verify(idToken, st.Nonce, a.Tokens.Leeway)
+	if err != nil {
+		a.oauthFail(w, r, name, err)
+		return
+	}
+
+	u, err := a.oauthUser(st.Tenant, name, claims)
+	if err != nil {
+		a.oauthFail(w, r, name, err)
+		return
+	}
+
+	if a.Config.RequireVerifiedEmail && u.EmailVerifiedAt == nil {
+		a.oauthFail(w, r, name, ErrOAuthEmailNotVerified)
+		return
+	}
+
+	u.AMR = []string{AMRFederated}
+
+	// second factor is checked by loginMFA
+	if u.TOTPEnabledAt != nil {
+		token, err := a.newMFAChallenge(u, 0, a.Config.MFAChallengeTTL)
+		if err != nil {
+			a.oauthFail(w, r, name, err)
+			return
+		}
+		a.oauthRedirect(w, r, url.Values{"mfa_required": {"true"}, "mfa_token": {token}})
+		return
+	}
+
+	if err := a.Storage.UpdateLastLogin(u); err != nil {
+		log.Printf("cannot update last login for user %d: %v", u.ID, err)
+	}
+
+	// in session mode frontend read CSRF token from cookie
+	if a.Config.SessionCookies {
+		if u.DisabledAt != nil {
+			a.oauthFail(w, r, name, ErrUserDisabled)
+			return
+		}
+		if u.PasswordResetAt != nil {
+			a.oauthFail(w, r, name, ErrPasswordResetRequired)
+			return
+		}
+		s, token, csrf, err := a.newSession(r, u)
+		if err != nil {
+			a.oauthFail(w, r, name, err)
+			return
+		}
+		a.setSessionCookies(w, token, csrf, s.ExpiresAt)
+		a.oauthRedirect(w, r, url.Values{"status": {"ok"}})
+		return
+	}
+
+	t, rt, err := a.issueTokens(r, u, "")
+	if err != nil {
+		a.oauthFail(w, r, name, err)
+		return
+	}
+
+	a.oauthRedirect(w, r, url.Values{
+		"token":         {t},
+		"refresh_token": {rt},
+		"token_type":    {"Bearer"},
+		"expires_in":    {fmt.Sprint(int(a.tenantByID(u.Tenant).tokens.TTL / time.Second))},
+	})
+}
+
+// useOAuthState check state against cookie and consume it
+func (a *App) useOAuthState(r *http.Request, provider string) (*OAuthState, error) {
+	state := r.URL.Query().Get("state")
+	cookie, err := r.Cookie(oauthStateCookie)
+	if err != nil || state == "" || subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(state)) != 1 {
+		return nil, errors.Wrapf(ErrOAuthState, "state do not match cookie")
+	}
+
+	st := OAuthState{StateHash: hashToken(state)}
+	if err := a.Storage.UseOAuthState(&st); err != nil {
+		if err == pgx.ErrNoRows {
+			return nil, errors.Wrapf(ErrOAuthState, "state is unknown or used")
+		}
+		return nil, err
+	}
+
+	if st.Provider != provider || time.Now().After(st.ExpiresAt) {
+		return nil, errors.Wrapf(ErrOAuthState, "state is expired")
+	}
+	return &st, nil
+}
+
+// oauthUser find user linked to provider account, link user with the same
+// verified email or create new one
+func (a *App) oauthUser(tenant, provider string, c *oidcClaims) (*User, error) {
+	id := Identity{Tenant: tenant, Provider: provider, Subject: c.Subject}
+	err := a.Storage.GetIdentity(&id)
+	if err == nil {
+		u := &User{ID: id.UserID}
+		return u, a.Storage.GetUserByID(u)
+	}
+	if err != pgx.ErrNoRows {
+		return nil, err
+	}
+
+	if c.Email == "" {
+		return nil, ErrOAuthEmailRequired
+	}
+
+	u := &User{Email: c.Email, Tenant: tenant}
+	err = a.Storage.GetUserByEmail(u)
+	switch {
+	case err == nil:
+		// we can't trust provider which do not verify emails to prove account ownership
+		if !c.EmailVerified {
+			return nil, ErrOAuthEmailNotVerified
+		}
+
+		// somebody could register this email before real owner,
+		// so we drop password and sessions of unverified account before linking
+		if u.EmailVerifiedAt == nil {
+			if err := a.takeOverUnverified(u); err != nil {
+				return nil, err
+			}
+		}
+
+	case err == pgx.ErrNoRows:
+		u = a.oauthNewUser(c)
+		u.Tenant = tenant
+		if err := a.Storage.CreateUser(u); err != nil {
+			return nil, err
+		}
+		if c.EmailVerified {
+			if err := a.Storage.SetEmailVerified(u); err != nil {
+				return nil, err
+			}
+		}
+
+	default:
+		return nil, err
+	}
+
+	id = Identity{Tenant: tenant, UserID: u.ID, Provider: provider, Subject: c.Subject, Email: c.Email}
+	if err := a.Storage.CreateIdentity(&id); err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+// takeOverUnverified give unverified account to owner of email proven by provider
+func (a *App) takeOverUnverified(u *User) error {
+	u.Password = ""
+	if err := a.Storage.UpdatePassword(u); err != nil {
+		return err
+	}
+	if err := a.Storage.SetEmailVerified(u); err != nil {
+		return err
+	}
+	return a.Revocations.RevokeUser(u)
+}
+
+// oauthNewUser return user filled from provider claims, fields which do not
+// pass our profile validation are skipped. Password is empty, so it can be set with reset
+func (a *App) oauthNewUser(c *oidcClaims) *User {
+	u := &User{Email: c.Email}
+
+	fields := []struct {
+		value string
+		dst   *string
+	}{
+		{c.GivenName, &u.FirstName},
+		{c.FamilyName, &u.LastName},
+		{c.Picture, &u.AvatarURL},
+		{c.Locale, &u.Locale},
+	}
+	for _, f := range fields {
+		*f.dst = f.value
+		if len(u.ValidateProfile()) > 0 {
+			*f.dst = ""
+		}
+	}
+	return u
+}
+
+// oauthFail log error and redirect to frontend with error code
+func (a *App) oauthFail(w http.ResponseWriter, r *http.Request, provider string, err error) {
+	log.Printf("%s login failed: %v", provider, err)
+
+	code := "server_error"
+	switch cause := errors.Cause(err); cause {
+	case ErrOAuthState, ErrOAuthToken, ErrOAuthEmailRequired, ErrOAuthEmailNotVerified:
+		code = cause.Error()
+	}
+	a.oauthRedirect(w, r, url.Values{"error": {code}})
+}
+
+// oauthRedirect send browser to frontend with values in url fragment,
+// fragment is not sent to servers so tokens don't end up in logs
+func (a *App) oauthRedirect(w http.ResponseWriter, r *http.Request, values url.Values) {
+	if a.Config.OAuthFrontendURL == "" {
+		code := http.StatusOK
+		if values.Get("error") != "" {
+			code = http.StatusBadRequest
+		}
+		res := map[string]string{}
+		for k := range values {
+			res[k] = values.Get(k)
+		}
+		respondWithJSON(w, r, code, res)
+		return
+	}
+
+	http.Redirect(w, r, a.Config.OAuthFrontendURL+"#"+values.Encode(), http.StatusFound)
+}
@@ -0,0 +1,302 @@
+package user
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+// fakeProvider is in-process OpenID Connect provider
+type fakeProvider struct {
+	*httptest.Server
+	key *rsa.PrivateKey
+
+	mu     sync.Mutex
+	grants map[string]fakeGrant
+}
+
+type fakeGrant struct {
+	challenge string
+	claims    jwt.MapClaims
+}
+
+func newFakeProvider(t *testing.T) *fakeProvider {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("cannot generate key: %v", err)
+	}
+
+	fp := &fakeProvider{key: key, grants: map[string]fakeGrant{}}
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 fp.URL,
+			"authorization_endpoint": fp.URL + "/authorize",
+			"token_endpoint":         fp.URL + "/token",
+			"jwks_uri":               fp.URL + "/jwks",
+		})
+	})
+
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		jwk := JWK{
+			Kty: "RSA",
+			Kid: "fake",
+			Use: "sig",
+			Alg: "RS256",
+			N:   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			E:   "AQAB",
+		}
+		json.NewEncoder(w).Encode(JWKS{Keys: []JWK{jwk}})
+	})
+
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		id, secret, _ := r.BasicAuth()
+		r.ParseForm()
+
+		fp.mu.Lock()
+		grant, ok := fp.grants[r.Form.Get("code")]
+		delete(fp.grants, r.Form.Get("code"))
+		fp.mu.Unlock()
+
+		verifier := sha256.Sum256([]byte(r.Form.Get("code_verifier")))
+		if !ok || id != "client" || secret != "secret" || grant.challenge != base64.RawURLEncoding.EncodeToString(verifier[:]) {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+			return
+		}
+
+		token := jwt.NewWithClaims(jwt.SigningMethodRS256, grant.claims)
+		token.Header["kid"] = "fake"
+		idToken, _ := token.SignedString(key)
+		json.NewEncoder(w).Encode(map[string]string{"access_token": "at", "token_type": "Bearer", "id_token": idToken})
+	})
+
+	fp.Server = httptest.NewServer(mux)
+	return fp
+}
+
+// authorize do what provider login page do - remember request and return code
+// claims override default ID token claims
+func (fp *fakeProvider) authorize(t *testing.T, authURL string, claims jwt.MapClaims) string {
+	u, err := url.Parse(authURL)
+	if err != nil || !strings.HasPrefix(authURL, fp.URL+"/authorize") {
+		t.Fatalf("Expected redirect to provider, got %s", authURL)
+	}
+	q := u.Query()
+
+	if q.Get("code_challenge_method") != "S256" || q.Get("client_id") != "client" || q.Get("response_type") != "code" {
+		t.Fatalf("Expected code flow with PKCE, got %s", authURL)
+	}
+
+	c := jwt.MapClaims{
+		"iss":            fp.URL,
+		"aud":            "client",
+		"sub":            "subject-1",
+		"exp":            time.Now().Add(time.Hour).Unix(),
+		"iat":            time.Now().Unix(),
+		"nonce":          q.Get("nonce"),
+		"email":          "new@user.com",
+		"email_verified": true,
+		"given_name":     "John",
+		"picture":        "not an url",
+	}
+	for k, v := range claims {
+		c[k] = v
+	}
+
+	code, _ := randomString(16)
+	fp.mu.Lock()
+	fp.grants[code] = fakeGrant{challenge: q.Get("code_challenge"), claims: c}
+	fp.mu.Unlock()
+	return code
+}
+
+func setUpOAuth(t *testing.T) (*App, *fakeProvider) {
+	t.Parallel()
+
+	fp := newFakeProvider(t)
+	t.Cleanup(fp.Close)
+
+	c := testConfig()
+	c.OAuthProviders = map[string]OAuthProvider{
+		"fake": {
+			Issuer:       fp.URL,
+			ClientID:     "client",
+			ClientSecret: "secret",
+			RedirectURL:  "http://localhost:8080/oauth/fake/callback",
+		},
+	}
+	c.Tenants = []Tenant{{ID: "acme", Hosts: []string{"acme.test"}}}
+	a, err := NewAppWithConfig(&FakeStorage{}, c)
+	if err != nil {
+		t.Fatalf("cannot create app: %v", err)
+	}
+	return &a, fp
+}
+
+// oauthLogin run whole social login and return values from frontend url fragment
+func oauthLogin(t *testing.T, a *App, fp *fakeProvider, claims jwt.MapClaims) url.Values {
+	req, _ := http.NewRequest("GET", "/oauth/fake/start", nil)
+	response := executeRequest(a, req)
+	if response.Code != http.StatusFound {
+		t.Fatalf("Expected redirect to provider, got %d %s", response.Code, response.Body.String())
+	}
+
+	authURL := response.Header().Get("Location")
+	code := fp.authorize(t, authURL, claims)
+	u, _ := url.Parse(authURL)
+
+	req, _ = http.NewRequest("GET", "/oauth/fake/callback?"+url.Values{"code": {code}, "state": {u.Query().Get("state")}}.Encode(), nil)
+	for _, c := range response.Result().Cookies() {
+		req.AddCookie(c)
+	}
+	response = executeRequest(a, req)
+
+	location := response.Header().Get("Location")
+	if response.Code != http.StatusFound || !strings.HasPrefix(location, a.Config.OAuthFrontendURL+"#") {
+		t.Fatalf("Expected redirect to frontend, got %d %s", response.Code, location)
+	}
+
+	values, _ := url.ParseQuery(strings.SplitN(location, "#", 2)[1])
+	return values
+}
+
+func TestOAuthNewUser(t *testing.T) {
+	a, fp := setUpOAuth(t)
+	s := a.Storage.(*FakeStorage)
+
+	values := oauthLogin(t, a, fp, nil)
+	if values.Get("error") != "" {
+		t.Fatalf("Expected social login to succeed, got %v", values)
+	}
+
+	c, err := a.Tokens.Parse(values.Get("token"))
+	if err != nil || c.Email != "new@user.com" || !c.EmailVerified || c.FirstName != "John" || len(c.AMR) != 1 || c.AMR[0] != AMRFederated {
+		t.Errorf("Expected token of new verified user, got %+v, %v", c, err)
+	}
+
+	if len(s.identities) != 1 || s.identities[0].Subject != "subject-1" {
+		t.Errorf("Expected identity to be stored, got %+v", s.identities)
+	}
+
+	// second login use linked identity
+	values = oauthLogin(t, a, fp, nil)
+	if values.Get("token") == "" || len(s.identities) != 1 {
+		t.Errorf("Expected login by identity, got %v, identities %+v", values, s.identities)
+	}
+}
+
+func TestOAuthLinkVerified(t *testing.T) {
+	a, fp := setUpOAuth(t)
+	s := a.Storage.(*FakeStorage)
+	verified := time.Now()
+	s.emailVerified = &verified
+
+	values := oauthLogin(t, a, fp, jwt.MapClaims{"email": "exist@user.com"})
+	if values.Get("token") == "" {
+		t.Fatalf("Expected social login to succeed, got %v", values)
+	}
+
+	if len(s.identities) != 1 || s.identities[0].UserID != 1 {
+		t.Errorf("Expected identity linked to existing user, got %+v", s.identities)
+	}
+	if s.tokenVersion != 0 {
+		t.Errorf("Expected sessions of verified account to stay")
+	}
+}
+
+func TestOAuthLinkUnverified(t *testing.T) {
+	a, fp := setUpOAuth(t)
+	s := a.Storage.(*FakeStorage)
+
+	if values := oauthLogin(t, a, fp, jwt.MapClaims{"email": "exist@user.com", "email_verified": false}); values.Get("error") != "email_not_verified" {
+		t.Errorf("Expected unverified provider email to be refused, got %v", values)
+	}
+
+	// account registered by somebody else lose password and sessions
+	values := oauthLogin(t, a, fp, jwt.MapClaims{"email": "exist@user.com"})
+	if values.Get("token") == "" {
+		t.Fatalf("Expected social login to succeed, got %v", values)
+	}
+	if s.password != "" || s.tokenVersion != 1 || s.emailVerified == nil {
+		t.Errorf("Expected password and sessions to be dropped, got password %q, version %d", s.password, s.tokenVersion)
+	}
+}
+
+func TestOAuthTenant(t *testing.T) {
+	a, fp := setUpOAuth(t)
+
+	req, _ := http.NewRequest("GET", "/oauth/fake/start", nil)
+	req.Header.Set(TenantHeader, "acme")
+	response := executeRequest(a, req)
+	authURL := response.Header().Get("Location")
+	u, _ := url.Parse(authURL)
+	code := fp.authorize(t, authURL, nil)
+
+	// callback url is the same for all tenants, so tenant come from state
+	req, _ = http.NewRequest("GET", "/oauth/fake/callback?"+url.Values{"code": {code}, "state": {u.Query().Get("state")}}.Encode(), nil)
+	for _, c := range response.Result().Cookies() {
+		req.AddCookie(c)
+	}
+	location := executeRequest(a, req).Header().Get("Location")
+	values, _ := url.ParseQuery(strings.SplitN(location, "#", 2)[1])
+
+	c, err := a.tenantByID("acme").tokens.Parse(values.Get("token"))
+	if err != nil || c.Tenant != "acme" {
+		t.Errorf("Expected user of tenant from start request, got %+v, %v", c, err)
+	}
+	if s := a.Storage.(*FakeStorage); len(s.identities) != 1 || s.identities[0].Tenant != "acme" {
+		t.Errorf("Expected identity in tenant, got %+v", s.identities)
+	}
+}
+
+func TestOAuthInvalid(t *testing.T) {
+	a, fp := setUpOAuth(t)
+
+	tests := []struct {
+		name   string
+		claims jwt.MapClaims
+		error  string
+	}{
+		{"Wrong nonce", jwt.MapClaims{"nonce": "other"}, "invalid_token"},
+		{"Wrong audience", jwt.MapClaims{"aud": "other"}, "invalid_token"},
+		{"Wrong issuer", jwt.MapClaims{"iss": "https://evil.com"}, "invalid_token"},
+		{"Expired", jwt.MapClaims{"exp": time.Now().Add(-time.Hour).Unix()}, "invalid_token"},
+		{"No email", jwt.MapClaims{"email": ""}, "email_required"},
+	}
+
+	for _, test := range tests {
+		if values := oauthLogin(t, a, fp, test.claims); values.Get("error") != test.error {
+			t.Errorf("%s: expected %s, got %v", test.name, test.error, values)
+		}
+	}
+
+	// callback without state cookie
+	req, _ := http.NewRequest("GET", "/oauth/fake/start", nil)
+	authURL := executeRequest(a, req).Header().Get("Location")
+	u, _ := url.Parse(authURL)
+	code := fp.authorize(t, authURL, nil)
+
+	req, _ = http.NewRequest("GET", "/oauth/fake/callback?"+url.Values{"code": {code}, "state": {u.Query().Get("state")}}.Encode(), nil)
+	response := executeRequest(a, req)
+	if location := response.Header().Get("Location"); !strings.HasSuffix(location, "#error=invalid_state") {
+		t.Errorf("Expected invalid state, got %s", location)
+	}
+
+	req, _ = http.NewRequest("GET", "/oauth/unknown/start", nil)
+	if response := executeRequest(a, req); response.Code != 404 {
+		t.Errorf("Expected unknown provider to return 404, got %d", response.Code)
+	}
+}
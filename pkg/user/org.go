@@ -0,0 +1,552 @@
+package user
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/gorilla/mux"
+	"github.com/jackc/pgx"
+	v "github.com/webdeveloppro/validating"
+)
+
+// Roles of users inside organization, they are separate from global roles
+const (
+	OrgRoleOwner  = "owner"
+	OrgRoleAdmin  = "admin"
+	OrgRoleMember = "member"
+)
+
+// Organization is company workspace users belong to
+type Organization struct {
+	ID        int       `json:"id"`
+	Name      string    `json:"name"`
+	Tenant    string    `json:"-"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Membership link user with organization with role inside it
+type Membership struct {
+	OrgID     int       `json:"org_id"`
+	UserID    int       `json:"user_id"`
+	Role      string    `json:"role"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// OrganizationMembership is organization with role of current user in it
+type OrganizationMembership struct {
+	Organization
+	Role   string `json:"role"`
+	Active bool   `json:"active"`
+}
+
+// Member is organization member with user data
+type Member struct {
+	Membership
+	Email     string `json:"email"`
+	FirstName string `json:"first_name"`
+	LastName  string `json:"last_name"`
+}
+
+// Invitation let person with Email join organization with Role,
+// it is accepted with token we send by email, only hash of token is stored
+type Invitation struct {
+	ID         int        `json:"id"`
+	OrgID      int        `json:"org_id"`
+	Email      string     `json:"email"`
+	Role       string     `json:"role"`
+	TokenHash  string     `json:"-"`
+	InvitedBy  int        `json:"invited_by"`
+	ExpiresAt  time.Time  `json:"expires_at"`
+	CreatedAt  time.Time  `json:"created_at"`
+	AcceptedAt *time.Time `json:"-"`
+	RevokedAt  *time.Time `json:"-"`
+}
+
+// pending tell if invitation can still be accepted
+func (inv *Invitation) pending() bool {
+	return inv.AcceptedAt == nil && inv.RevokedAt == nil && time.Now().Before(inv.ExpiresAt)
+}
+
+// validOrgRole tell if role is known organization role
+func validOrgRole(role string) bool {
+	return role == OrgRoleOwner || role == OrgRoleAdmin || role == OrgRoleMember
+}
+
+// orgMember load membership of current user in organization from {id} route variable
+// and check its role, it respond with error and return nil if user can't do request
+func (a *App) orgMember(w http.ResponseWriter, r *http.Request, roles ...string) *Membership {
+	u, _ := UserFromContext(r.Context())
+
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		respondWithError(w, r, http.StatusNotFound, "organization does not exist")
+		return nil
+	}
+
+	m := Membership{OrgID: id, UserID: u.ID}
+	if err := a.Storage.GetMembership(&m); err != nil {
+		if err == pgx.ErrNoRows {
+			respondWithError(w, r, http.StatusNotFound, "organization does not exist")
+			return nil
+		}
+		log.Printf("cannot load membership of user %d in organization %d: %v", u.ID, id, err)
+		respondWithError(w, r, http.StatusInternalServerError, "cannot load organization, please try again in few minutes")
+		return nil
+	}
+
+	if len(roles) == 0 {
+		return &m
+	}
+	for _, role := range roles {
+		if m.Role == role {
+			return &m
+		}
+	}
+	respondWithError(w, r, http.StatusForbidden, "your role in organization does not allow this request")
+	return nil
+}
+
+// createOrganization create organization with current user as owner,
+// it become active organization if user has none
+func (a *App) createOrganization(w http.ResponseWriter, r *http.Request) {
+	u, _ := UserFromContext(r.Context())
+
+	o := Organization{}
+	if r.Body == nil {
+		respondWithJSON(w, r, http.StatusBadRequest, []string{})
+		return
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&o); err != nil {
+		respondWithJSON(w, r, http.StatusBadRequest, []string{})
+		return
+	}
+
+	// name go to subject of invitation mails, so it has to be single line
+	printable := v.FromFunc(func(field v.Field) v.Errors {
+		if strings.IndexFunc(*field.ValuePtr.(*string), unicode.IsControl) >= 0 {
+			return v.NewErrors(field.Name, v.ErrInvalid, "cannot contain control characters")
+		}
+		return nil
+	})
+
+	o.Name = strings.TrimSpace(o.Name)
+	errs := v.Validate(v.Schema{
+		v.F("name", &o.Name): v.All(v.Nonzero("cannot be empty"), v.Len(1, 100, "length is not between 1 and 100"), printable),
+	})
+
+	if len(errs) > 0 {
+		respondWithJSON(w, r, http.StatusBadRequest, errs.JSONErrors())
+		return
+	}
+
+	o.Tenant = u.Tenant
+	if err := a.Storage.CreateOrganization(&o, u.ID); err != nil {
+		log.Printf("cannot create organization for user %d: %v", u.ID, err)
+		respondWithError(w, r, http.StatusInternalServerError, "cannot create organization, please try again in few minutes")
+		return
+	}
+
+	if u.OrgID == 0 {
+		u.OrgID = o.ID
+		if err := a.Storage.SetActiveOrganization(u); err != nil {
+			log.Printf("cannot set active organization of user %d: %v", u.ID, err)
+		}
+	}
+
+	respondWithJSON(w, r, http.StatusCreated, OrganizationMembership{o, OrgRoleOwner, u.OrgID == o.ID})
+}
+
+// listOrganizations return organizations of current user with user role in them
+func (a *App) listOrganizations(w http.ResponseWriter, r *http.Request) {
+	u, _ := UserFromContext(r.Context())
+
+	orgs, err := a.Storage.GetOrganizations(u.ID)
+	if err != nil {
+		log.Printf("cannot load organizations of user %d: %v", u.ID, err)
+		respondWithError(w, r, http.StatusInternalServerError, "cannot load organizations, please try again in few minutes")
+		return
+	}
+
+	for i := range orgs {
+		orgs[i].Active = orgs[i].ID == u.OrgID
+	}
+	respondWithJSON(w, r, http.StatusOK, orgs)
+}
+
+// switchOrganization change active organization of current user and return new tokens with its org_id,
+// org_id 0 leave user without active organization
+func (a *App) switchOrganization(w http.ResponseWriter, r *http.Request) {
+	u, _ := UserFromContext(r.Context())
+	c, _ := ClaimsFromContext(r.Context())
+
+	var req struct {
+		OrgID int `json:"org_id"`
+	}
+
+	if r.Body == nil {
+		respondWithJSON(w, r, http.StatusBadRequest, []string{})
+		return
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondWithJSON(w, r, http.StatusBadRequest, []string{})
+		return
+	}
+
+	m := Membership{OrgID: req.OrgID, UserID: u.ID}
+	if req.OrgID != 0 {
+		if err := a.Storage.GetMembership(&m); err != nil {
+			if err == pgx.ErrNoRows {
+				respondWithJSON(w, r, http.StatusBadRequest, v.NewErrors("org_id", v.ErrInvalid, "you are not member of organization").JSONErrors())
+				return
+			}
+			log.Printf("cannot load membership of user %d in organization %d: %v", u.ID, req.OrgID, err)
+			respondWithError(w, r, http.StatusInternalServerError, "cannot switch organization, please try again in few minutes")
+			return
+		}
+	}
+
+	u.OrgID, u.OrgRole = m.OrgID, m.Role
+	if err := a.Storage.SetActiveOrganization(u); err != nil {
+		log.Printf("cannot set active organization of user %d: %v", u.ID, err)
+		respondWithError(w, r, http.StatusInternalServerError, "cannot switch organization, please try again in few minutes")
+		return
+	}
+
+	u.AMR = c.AMR
+	a.respondWithTokens(w, r, http.StatusOK, u, "")
+}
+
+// listMembers return members of organization, any member can see them
+func (a *App) listMembers(w http.ResponseWriter, r *http.Request) {
+	m := a.orgMember(w, r)
+	if m == nil {
+		return
+	}
+
+	members, err := a.Storage.GetMembers(m.OrgID)
+	if err != nil {
+		log.Printf("cannot load members of organization %d: %v", m.OrgID, err)
+		respondWithError(w, r, http.StatusInternalServerError, "cannot load members, please try again in few minutes")
+		return
+	}
+
+	respondWithJSON(w, r, http.StatusOK, members)
+}
+
+// targetMember load membership of user from {user_id} route variable in organization
+func (a *App) targetMember(w http.ResponseWriter, r *http.Request, orgID int) *Membership {
+	userID, err := strconv.Atoi(mux.Vars(r)["user_id"])
+	if err != nil {
+		respondWithError(w, r, http.StatusNotFound, "member does not exist")
+		return nil
+	}
+
+	m := Membership{OrgID: orgID, UserID: userID}
+	if err := a.Storage.GetMembership(&m); err != nil {
+		if err == pgx.ErrNoRows {
+			respondWithError(w, r, http.StatusNotFound, "member does not exist")
+			return nil
+		}
+		log.Printf("cannot load membership of user %d in organization %d: %v", userID, orgID, err)
+		respondWithError(w, r, http.StatusInternalServerError, "cannot load member, please try again in few minutes")
+		return nil
+	}
+	return &m
+}
+
+// lastOwner tell if membership is the only owner of organization,
+// organization can't be left without owner
+func (a *App) lastOwner(m *Membership) (bool, error) {
+	if m.Role != OrgRoleOwner {
+		return false, nil
+	}
+
+	members, err := a.Storage.GetMembers(m.OrgID)
+	if err != nil {
+		return false, err
+	}
+	for _, other := range members {
+		if other.Role == OrgRoleOwner && other.UserID != m.UserID {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// updateMember change role of member, only owners can make or change other owners
+func (a *App) updateMember(w http.ResponseWriter, r *http.Request) {
+	actor := a.orgMember(w, r, OrgRoleOwner, OrgRoleAdmin)
+	if actor == nil {
+		return
+	}
+	m := a.targetMember(w, r, actor.OrgID)
+	if m == nil {
+		return
+	}
+
+	var req struct {
+		Role string `json:"role"`
+	}
+
+	if r.Body == nil {
+		respondWithJSON(w, r, http.StatusBadRequest, []string{})
+		return
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondWithJSON(w, r, http.StatusBadRequest, []string{})
+		return
+	}
+
+	if !validOrgRole(req.Role) {
+		respondWithJSON(w, r, http.StatusBadRequest, v.NewErrors("role", v.ErrInvalid, "should be owner, admin or member").JSONErrors())
+		return
+	}
+
+	if actor.Role != OrgRoleOwner && (req.Role == OrgRoleOwner || m.Role == OrgRoleOwner) {
+		respondWithError(w, r, http.StatusForbidden, "only owners can change owners")
+		return
+	}
+
+	if last, err := a.lastOwner(m); err != nil || (last && req.Role != OrgRoleOwner) {
+		if err != nil {
+			log.Printf("cannot check owners of organization %d: %v", m.OrgID, err)
+			respondWithError(w, r, http.StatusInternalServerError, "cannot update member, please try again in few minutes")
+			return
+		}
+		respondWithError(w, r, http.StatusBadRequest, "organization should have at least one owner")
+		return
+	}
+
+	m.Role = req.Role
+	if err := a.Storage.UpdateMembership(m); err != nil {
+		log.Printf("cannot update membership of user %d in organization %d: %v", m.UserID, m.OrgID, err)
+		respondWithError(w, r, http.StatusInternalServerError, "cannot update member, please try again in few minutes")
+		return
+	}
+
+	respondWithJSON(w, r, http.StatusOK, m)
+}
+
+// removeMember remove user from organization, owners and admins can remove others
+// and every member can leave. Only owners can remove owners
+func (a *App) removeMember(w http.ResponseWriter, r *http.Request) {
+	actor := a.orgMember(w, r)
+	if actor == nil {
+		return
+	}
+	m := a.targetMember(w, r, actor.OrgID)
+	if m == nil {
+		return
+	}
+
+	if m.UserID != actor.UserID {
+		if actor.Role == OrgRoleMember || (m.Role == OrgRoleOwner && actor.Role != OrgRoleOwner) {
+			respondWithError(w, r, http.StatusForbidden, "your role in organization does not allow this request")
+			return
+		}
+	}
+
+	if last, err := a.lastOwner(m); err != nil || last {
+		if err != nil {
+			log.Printf("cannot check owners of organization %d: %v", m.OrgID, err)
+			respondWithError(w, r, http.StatusInternalServerError, "cannot remove member, please try again in few minutes")
+			return
+		}
+		respondWithError(w, r, http.StatusBadRequest, "organization should have at least one owner")
+		return
+	}
+
+	if err := a.Storage.DeleteMembership(m); err != nil && err != pgx.ErrNoRows {
+		log.Printf("cannot delete membership of user %d in organization %d: %v", m.UserID, m.OrgID, err)
+		respondWithError(w, r, http.StatusInternalServerError, "cannot remove member, please try again in few minutes")
+		return
+	}
+
+	respondWithJSON(w, r, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// createInvitation send invitation to join organization by email
+func (a *App) createInvitation(w http.ResponseWriter, r *http.Request) {
+	actor := a.orgMember(w, r, OrgRoleOwner, OrgRoleAdmin)
+	if actor == nil {
+		return
+	}
+
+	inv := Invitation{OrgID: actor.OrgID, InvitedBy: actor.UserID, Role: OrgRoleMember}
+	if r.Body == nil {
+		respondWithJSON(w, r, http.StatusBadRequest, []string{})
+		return
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&inv); err != nil {
+		respondWithJSON(w, r, http.StatusBadRequest, []string{})
+		return
+	}
+	inv.OrgID, inv.InvitedBy = actor.OrgID, actor.UserID
+
+	errs := v.Validate(v.Schema{
+		v.F("email", &inv.Email): emailValidator(),
+	})
+	if !validOrgRole(inv.Role) {
+		errs.Extend(v.NewErrors("role", v.ErrInvalid, "should be owner, admin or member"))
+	} else if inv.Role == OrgRoleOwner && actor.Role != OrgRoleOwner {
+		errs.Extend(v.NewErrors("role", v.ErrInvalid, "only owners can invite owners"))
+	}
+
+	if len(errs) > 0 {
+		respondWithJSON(w, r, http.StatusBadRequest, errs.JSONErrors())
+		return
+	}
+
+	o := Organization{ID: actor.OrgID}
+	token, err := randomString(32)
+	if err == nil {
+		err = a.Storage.GetOrganization(&o)
+	}
+	if err == nil {
+		inv.TokenHash = hashToken(token)
+		inv.ExpiresAt = time.Now().Add(a.Config.InvitationTTL)
+		err = a.Storage.CreateInvitation(&inv)
+	}
+	if err != nil {
+		log.Printf("cannot create invitation to organization %d: %v", actor.OrgID, err)
+		respondWithError(w, r, http.StatusInternalServerError, "cannot create invitation, please try again in few minutes")
+		return
+	}
+
+	a.notify(inv.Email, "You are invited to "+o.Name,
+		fmt.Sprintf("You are invited to join %s.\n\n"+
+			"Follow the link to accept invitation, it is valid for %s:\n%s",
+			o.Name, a.Config.InvitationTTL, actionLink(a.Config.InvitationURL, token)))
+
+	respondWithJSON(w, r, http.StatusCreated, inv)
+}
+
+// listInvitations return invitations of organization which can still be accepted
+func (a *App) listInvitations(w http.ResponseWriter, r *http.Request) {
+	actor := a.orgMember(w, r, OrgRoleOwner, OrgRoleAdmin)
+	if actor == nil {
+		return
+	}
+
+	invs, err := a.Storage.GetInvitations(actor.OrgID)
+	if err != nil {
+		log.Printf("cannot load invitations of organization %d: %v", actor.OrgID, err)
+		respondWithError(w, r, http.StatusInternalServerError, "cannot load invitations, please try again in few minutes")
+		return
+	}
+
+	respondWithJSON(w, r, http.StatusOK, invs)
+}
+
+// revokeInvitation revoke invitation which was not accepted yet
+func (a *App) revokeInvitation(w http.ResponseWriter, r *http.Request) {
+	actor := a.orgMember(w, r, OrgRoleOwner, OrgRoleAdmin)
+	if actor == nil {
+		return
+	}
+
+	id, err := strconv.Atoi(mux.Vars(r)["invitation_id"])
+	if err != nil {
+		respondWithError(w, r, http.StatusNotFound, "invitation does not exist")
+		return
+	}
+
+	inv := Invitation{ID: id, OrgID: actor.OrgID}
+	if err := a.Storage.RevokeInvitation(&inv); err != nil {
+		if err == pgx.ErrNoRows {
+			respondWithError(w, r, http.StatusNotFound, "invitation does not exist")
+			return
+		}
+		log.Printf("cannot revoke invitation %d: %v", id, err)
+		respondWithError(w, r, http.StatusInternalServerError, "cannot revoke invitation, please try again in few minutes")
+		return
+	}
+
+	respondWithJSON(w, r, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// acceptInvitation add current user to organization, invitation should be sent to user email
+func (a *App) acceptInvitation(w http.ResponseWriter, r *http.Request) {
+	u, _ := UserFromContext(r.Context())
+
+	var req struct {
+		Token string `json:"token"`
+	}
+
+	if r.Body == nil {
+		respondWithJSON(w, r, http.StatusBadRequest, []string{})
+		return
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondWithJSON(w, r, http.StatusBadRequest, []string{})
+		return
+	}
+
+	invalid := v.NewErrors("token", v.ErrInvalid, "invitation is invalid or expired").JSONErrors()
+	if req.Token == "" {
+		respondWithJSON(w, r, http.StatusBadRequest, invalid)
+		return
+	}
+
+	inv := Invitation{TokenHash: hashToken(req.Token)}
+	if err := a.Storage.GetInvitation(&inv); err != nil {
+		if err != pgx.ErrNoRows {
+			log.Printf("cannot load invitation: %v", err)
+		}
+		respondWithJSON(w, r, http.StatusBadRequest, invalid)
+		return
+	}
+
+	if !inv.pending() {
+		respondWithJSON(w, r, http.StatusBadRequest, invalid)
+		return
+	}
+
+	// the same email can belong to other user in other tenant
+	o := Organization{ID: inv.OrgID}
+	if err := a.Storage.GetOrganization(&o); err != nil {
+		log.Printf("cannot load organization %d: %v", inv.OrgID, err)
+		respondWithJSON(w, r, http.StatusBadRequest, invalid)
+		return
+	}
+
+	if !strings.EqualFold(inv.Email, u.Email) || o.Tenant != u.Tenant {
+		respondWithError(w, r, http.StatusForbidden, "invitation was sent to other email address")
+		return
+	}
+
+	// storage check invitation again, so it can't be accepted twice
+	if err := a.Storage.AcceptInvitation(&inv, u.ID); err != nil {
+		if err == pgx.ErrNoRows {
+			respondWithJSON(w, r, http.StatusBadRequest, invalid)
+			return
+		}
+		log.Printf("cannot accept invitation %d: %v", inv.ID, err)
+		respondWithError(w, r, http.StatusInternalServerError, "cannot accept invitation, please try again in few minutes")
+		return
+	}
+
+	if u.OrgID == 0 {
+		u.OrgID = inv.OrgID
+		if err := a.Storage.SetActiveOrganization(u); err != nil {
+			log.Printf("cannot set active organization of user %d: %v", u.ID, err)
+		}
+	}
+
+	m := Membership{OrgID: inv.OrgID, UserID: u.ID}
+	if err := a.Storage.GetMembership(&m); err != nil {
+		log.Printf("cannot load membership of user %d in organization %d: %v", u.ID, inv.OrgID, err)
+	}
+	respondWithJSON(w, r, http.StatusOK, m)
+}
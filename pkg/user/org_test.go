@@ -0,0 +1,190 @@
+package user
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+// setUpOrg create organization owned by exist@user.com, bob@user.com is not member yet
+func setUpOrg(t *testing.T) (*App, string) {
+	a := SetUp(t)
+	a.Storage.(*FakeStorage).users = map[int]*User{
+		2: {ID: 2, Email: "bob@user.com", Password: existPassword, FirstName: "Bob", CreatedAt: time.Now()},
+	}
+
+	token, _ := loginTokens(t, a)
+	var res map[string]interface{}
+	code, _ := jsonRequest(a, "POST", "/orgs", "", token, map[string]string{"name": "Acme"}, &res)
+	if code != 201 || res["role"] != OrgRoleOwner || res["active"] != true {
+		t.Fatalf("Expected organization to be created, got %d %v", code, res)
+	}
+	return a, token
+}
+
+// bobToken login as bob@user.com and return access token
+func bobToken(t *testing.T, a *App) string {
+	code, body := jsonRequest(a, "POST", "/login", "", "", map[string]string{"email": "bob@user.com", "password": "123123"}, nil)
+	if code != 200 {
+		t.Fatalf("Expected bob to login, got %d %s", code, body)
+	}
+
+	var res map[string]interface{}
+	json.Unmarshal([]byte(body), &res)
+	token, _ := res["token"].(string)
+	return token
+}
+
+// inviteBob invite bob@user.com to organization 1 and return token from mail
+func inviteBob(t *testing.T, a *App, token, role string) string {
+	code, body := jsonRequest(a, "POST", "/orgs/1/invitations", "", token, map[string]string{"email": "bob@user.com", "role": role}, nil)
+	if code != 201 {
+		t.Fatalf("Expected invitation to be created, got %d %s", code, body)
+	}
+	return mailedToken(t, a, "bob@user.com")
+}
+
+func TestOrganizationNameLineBreak(t *testing.T) {
+	a, token := setUpOrg(t)
+
+	var res map[string]interface{}
+	code, _ := jsonRequest(a, "POST", "/orgs", "", token, map[string]string{"name": "Acme\r\nBcc: victim@user.com"}, &res)
+	if code != 400 || res["name"] == nil {
+		t.Errorf("Expected name with line break to be refused, got %d %v", code, res)
+	}
+}
+
+func TestOrganizationClaims(t *testing.T) {
+	a, _ := setUpOrg(t)
+
+	token, _ := loginTokens(t, a)
+	c, err := a.Tokens.Parse(token)
+	if err != nil {
+		t.Fatalf("cannot parse token: %v", err)
+	}
+	if c.OrgID != 1 || c.OrgRole != OrgRoleOwner {
+		t.Errorf("Expected active organization in token, got %d %q", c.OrgID, c.OrgRole)
+	}
+
+	var res map[string]interface{}
+	code, _ := jsonRequest(a, "POST", "/orgs/switch", "", token, map[string]int{"org_id": 0}, &res)
+	if code != 200 {
+		t.Fatalf("Expected switch to succeed, got %d %v", code, res)
+	}
+	c, _ = a.Tokens.Parse(res["token"].(string))
+	if c.OrgID != 0 || c.OrgRole != "" {
+		t.Errorf("Expected no organization in token, got %d %q", c.OrgID, c.OrgRole)
+	}
+
+	if code, _ := jsonRequest(a, "POST", "/orgs/switch", "", token, map[string]int{"org_id": 2}, nil); code != 400 {
+		t.Errorf("Expected switch to foreign organization to be refused, got %d", code)
+	}
+}
+
+func TestOrganizationInvitation(t *testing.T) {
+	a, token := setUpOrg(t)
+	invitation := inviteBob(t, a, token, OrgRoleMember)
+	bob := bobToken(t, a)
+
+	if code, _ := jsonRequest(a, "GET", "/orgs/1/members", "", bob, nil, nil); code != 404 {
+		t.Errorf("Expected organization to be hidden from non member, got %d", code)
+	}
+
+	// exist@user.com can't accept invitation sent to bob
+	if code, _ := jsonRequest(a, "POST", "/invitations/accept", "", token, map[string]string{"token": invitation}, nil); code != 403 {
+		t.Errorf("Expected invitation for other email to be refused, got %d", code)
+	}
+
+	var res map[string]interface{}
+	code, _ := jsonRequest(a, "POST", "/invitations/accept", "", bob, map[string]string{"token": invitation}, &res)
+	if code != 200 || res["role"] != OrgRoleMember {
+		t.Fatalf("Expected invitation to be accepted, got %d %v", code, res)
+	}
+
+	if code, _ := jsonRequest(a, "POST", "/invitations/accept", "", bob, map[string]string{"token": invitation}, nil); code != 400 {
+		t.Errorf("Expected invitation to be accepted only once, got %d", code)
+	}
+
+	c, _ := a.Tokens.Parse(bobToken(t, a))
+	if c.OrgID != 1 || c.OrgRole != OrgRoleMember {
+		t.Errorf("Expected invited organization to become active, got %d %q", c.OrgID, c.OrgRole)
+	}
+
+	var members []interface{}
+	if code, body := jsonRequest(a, "GET", "/orgs/1/members", "", bob, nil, &members); code != 200 || len(members) != 2 {
+		t.Errorf("Expected member to see 2 members, got %d %s", code, body)
+	}
+}
+
+func TestOrganizationInvitationRevokeAndExpire(t *testing.T) {
+	a, token := setUpOrg(t)
+	bob := bobToken(t, a)
+
+	invitation := inviteBob(t, a, token, OrgRoleAdmin)
+	if code, _ := jsonRequest(a, "DELETE", "/orgs/1/invitations/1", "", token, nil, nil); code != 200 {
+		t.Errorf("Expected invitation to be revoked, got %d", code)
+	}
+	if code, _ := jsonRequest(a, "DELETE", "/orgs/1/invitations/1", "", token, nil, nil); code != 404 {
+		t.Errorf("Expected revoked invitation to be gone, got %d", code)
+	}
+	if code, _ := jsonRequest(a, "POST", "/invitations/accept", "", bob, map[string]string{"token": invitation}, nil); code != 400 {
+		t.Errorf("Expected revoked invitation to be refused, got %d", code)
+	}
+
+	invitation = inviteBob(t, a, token, OrgRoleMember)
+	a.Storage.(*FakeStorage).invitations[1].ExpiresAt = time.Now().Add(-time.Minute)
+	if code, _ := jsonRequest(a, "POST", "/invitations/accept", "", bob, map[string]string{"token": invitation}, nil); code != 400 {
+		t.Errorf("Expected expired invitation to be refused, got %d", code)
+	}
+
+	var pending []interface{}
+	if code, body := jsonRequest(a, "GET", "/orgs/1/invitations", "", token, nil, &pending); code != 200 || len(pending) != 0 {
+		t.Errorf("Expected no pending invitations, got %d %s", code, body)
+	}
+}
+
+func TestOrganizationMemberRoles(t *testing.T) {
+	a, token := setUpOrg(t)
+	inviteBob(t, a, token, OrgRoleMember)
+	bob := bobToken(t, a)
+	jsonRequest(a, "POST", "/invitations/accept", "", bob, map[string]string{"token": mailedToken(t, a, "bob@user.com")}, nil)
+
+	tests := []struct {
+		name   string
+		method string
+		url    string
+		token  string
+		role   string
+		code   int
+	}{
+		{"Member cannot invite", "POST", "/orgs/1/invitations", bob, OrgRoleMember, 403},
+		{"Member cannot change roles", "PATCH", "/orgs/1/members/1", bob, OrgRoleMember, 403},
+		{"Member cannot remove others", "DELETE", "/orgs/1/members/1", bob, "", 403},
+		{"Last owner cannot step down", "PATCH", "/orgs/1/members/1", token, OrgRoleAdmin, 400},
+		{"Last owner cannot leave", "DELETE", "/orgs/1/members/1", token, "", 400},
+		{"Unknown role", "PATCH", "/orgs/1/members/2", token, "boss", 400},
+		{"Owner promote admin", "PATCH", "/orgs/1/members/2", token, OrgRoleAdmin, 200},
+		{"Admin cannot demote owner", "PATCH", "/orgs/1/members/1", bob, OrgRoleMember, 403},
+		{"Admin cannot make owner", "PATCH", "/orgs/1/members/2", bob, OrgRoleOwner, 403},
+		{"Unknown member", "PATCH", "/orgs/1/members/3", token, OrgRoleMember, 404},
+		{"Member can leave", "DELETE", "/orgs/1/members/2", bob, "", 200},
+	}
+
+	for _, test := range tests {
+		var body interface{}
+		if test.method == "PATCH" || test.method == "POST" {
+			body = map[string]string{"role": test.role, "email": "new@user.com"}
+		}
+		if code, got := jsonRequest(a, test.method, test.url, "", test.token, body, nil); code != test.code {
+			t.Errorf("%s: expected %d, got %d %s", test.name, test.code, code, got)
+		}
+	}
+
+	var orgs []interface{}
+	if code, body := jsonRequest(a, "GET", "/orgs", "", bob, nil, &orgs); code != 200 || len(orgs) != 0 {
+		t.Errorf("Expected bob to have no organizations, got %d %s", code, body)
+	}
+	if code, body := jsonRequest(a, "GET", "/orgs/1/members", "", bob, nil, nil); code != 404 {
+		t.Errorf("Expected removed member to lose access, got %d %s", code, body)
+	}
+}
@@ -0,0 +1,303 @@
+package user
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+	v "github.com/webdeveloppro/validating"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// ErrUnknownHash returned when stored hash is malformed or in format we can't recognize
+var ErrUnknownHash = errors.New("user: unknown password hash format")
+
+// Hasher can hash passwords and verify them against encoded hashes
+// Encoded hashes are self-describing, so we can always tell which algorithm
+// and which parameters were used to produce them
+type Hasher interface {
+	// Name of algorithm, used in config
+	Name() string
+	// Hash return encoded hash for password
+	Hash(password string) (string, error)
+	// Match tell if encoded hash was produced by this hasher
+	Match(encoded string) bool
+	// Verify compare password with encoded hash
+	Verify(password, encoded string) (bool, error)
+	// NeedsRehash return true if encoded hash use outdated parameters
+	NeedsRehash(encoded string) bool
+}
+
+// Passwords hold current hasher and all hashers we can verify with.
+// AllowPlaintext let rows created before hashing was introduced match plain text passwords
+type Passwords struct {
+	AllowPlaintext bool
+
+	current Hasher
+	known   []Hasher
+}
+
+// NewPasswords will create Passwords with hasher selected by name,
+// all other supported algorithms remain available for verification
+func NewPasswords(name string, bcryptCost int, params Argon2Params) (*Passwords, error) {
+	bc := NewBcryptHasher(bcryptCost)
+	ar := NewArgon2Hasher(params)
+
+	p := &Passwords{known: []Hasher{bc, ar}}
+	switch name {
+	case "", bc.Name():
+		p.current = bc
+	case ar.Name():
+		p.current = ar
+	default:
+		return nil, fmt.Errorf("user: unsupported password hasher %q", name)
+	}
+
+	return p, nil
+}
+
+// bcryptMaxBytes is password length after which bcrypt refuse to hash
+const bcryptMaxBytes = 72
+
+// MaxBytes return longest password current hasher accept, zero if there is no limit
+func (p *Passwords) MaxBytes() int {
+	if p.current.Name() == "bcrypt" {
+		return bcryptMaxBytes
+	}
+	return 0
+}
+
+// passwordSizeValidator refuse passwords longer than hasher accept, multi-byte characters
+// could make password too long even within length limit. Zero maxBytes is no limit
+func passwordSizeValidator(maxBytes int) v.Validator {
+	return v.FromFunc(func(field v.Field) v.Errors {
+		if maxBytes > 0 && len(*field.ValuePtr.(*string)) > maxBytes {
+			return v.NewErrors(field.Name, v.ErrInvalid, "is too long")
+		}
+		return nil
+	})
+}
+
+// Hash password with current hasher
+func (p *Passwords) Hash(password string) (string, error) {
+	return p.current.Hash(password)
+}
+
+// Verify password against encoded hash, second value tells if hash
+// should be replaced with a fresh one produced by current hasher
+func (p *Passwords) Verify(password, encoded string) (ok bool, rehash bool, err error) {
+
+	for _, h := range p.known {
+		if !h.Match(encoded) {
+			continue
+		}
+
+		ok, err = h.Verify(password, encoded)
+		if err != nil || !ok {
+			return false, false, err
+		}
+
+		rehash = h.Name() != p.current.Name() || h.NeedsRehash(encoded)
+		return true, rehash, nil
+	}
+
+	// anything starting with $ is hash, comparing it as is would let stored hash work as password
+	if strings.HasPrefix(encoded, "$") {
+		return false, false, ErrUnknownHash
+	}
+
+	// Rows created before hashing was introduced hold plain text passwords
+	if !p.AllowPlaintext {
+		return false, false, nil
+	}
+	ok = encoded != "" && subtle.ConstantTimeCompare([]byte(password), []byte(encoded)) == 1
+	return ok, ok, nil
+}
+
+// BcryptHasher hash passwords with bcrypt
+type BcryptHasher struct {
+	cost int
+}
+
+// NewBcryptHasher return bcrypt hasher, cost out of allowed range replaced with default one
+func NewBcryptHasher(cost int) *BcryptHasher {
+	if cost < bcrypt.MinCost || cost > bcrypt.MaxCost {
+		cost = bcrypt.DefaultCost
+	}
+	return &BcryptHasher{cost: cost}
+}
+
+// Name of algorithm
+func (h *BcryptHasher) Name() string {
+	return "bcrypt"
+}
+
+// Hash return bcrypt hash in modular crypt format, $2a$<cost>$<salt+hash>
+func (h *BcryptHasher) Hash(password string) (string, error) {
+	b, err := bcrypt.GenerateFromPassword([]byte(password), h.cost)
+	if err != nil {
+		return "", errors.Wrapf(err, "user: cannot hash password")
+	}
+	return string(b), nil
+}
+
+// Match encoded hash prefix
+func (h *BcryptHasher) Match(encoded string) bool {
+	return strings.HasPrefix(encoded, "$2a$") ||
+		strings.HasPrefix(encoded, "$2b$") ||
+		strings.HasPrefix(encoded, "$2y$")
+}
+
+// Verify password with bcrypt
+func (h *BcryptHasher) Verify(password, encoded string) (bool, error) {
+	err := bcrypt.CompareHashAndPassword([]byte(encoded), []byte(password))
+	if err == bcrypt.ErrMismatchedHashAndPassword {
+		return false, nil
+	}
+	if err != nil {
+		return false, errors.Wrapf(err, "user: cannot verify password")
+	}
+	return true, nil
+}
+
+// NeedsRehash return true if hash cost differ from configured one
+func (h *BcryptHasher) NeedsRehash(encoded string) bool {
+	cost, err := bcrypt.Cost([]byte(encoded))
+	return err != nil || cost != h.cost
+}
+
+// Argon2Params tune argon2id hashing
+type Argon2Params struct {
+	Memory  uint32 // in KiB
+	Time    uint32
+	Threads uint8
+	SaltLen uint32
+	KeyLen  uint32
+}
+
+// DefaultArgon2Params are OWASP recommended values
+var DefaultArgon2Params = Argon2Params{
+	Memory:  64 * 1024,
+	Time:    3,
+	Threads: 2,
+	SaltLen: 16,
+	KeyLen:  32,
+}
+
+// Argon2Hasher hash passwords with argon2id
+type Argon2Hasher struct {
+	params Argon2Params
+}
+
+// NewArgon2Hasher return argon2id hasher, empty params replaced with default ones
+func NewArgon2Hasher(params Argon2Params) *Argon2Hasher {
+	if params.Memory == 0 {
+		params.Memory = DefaultArgon2Params.Memory
+	}
+	if params.Time == 0 {
+		params.Time = DefaultArgon2Params.Time
+	}
+	if params.Threads == 0 {
+		params.Threads = DefaultArgon2Params.Threads
+	}
+	if params.SaltLen == 0 {
+		params.SaltLen = DefaultArgon2Params.SaltLen
+	}
+	if params.KeyLen == 0 {
+		params.KeyLen = DefaultArgon2Params.KeyLen
+	}
+	return &Argon2Hasher{params: params}
+}
+
+// Name of algorithm
+func (h *Argon2Hasher) Name() string {
+	return "argon2id"
+}
+
+// Hash return argon2id hash in PHC string format
+// $argon2id$v=19$m=65536,t=3,p=2$<salt>$<hash>
+func (h *Argon2Hasher) Hash(password string) (string, error) {
+	salt := make([]byte, h.params.SaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", errors.Wrapf(err, "user: cannot generate salt")
+	}
+
+	key := argon2.IDKey([]byte(password), salt, h.params.Time, h.params.Memory, h.params.Threads, h.params.KeyLen)
+
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version,
+		h.params.Memory, h.params.Time, h.params.Threads,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	), nil
+}
+
+// Match encoded hash prefix
+func (h *Argon2Hasher) Match(encoded string) bool {
+	return strings.HasPrefix(encoded, "$argon2id$")
+}
+
+// Verify password with argon2id using parameters stored in encoded hash
+func (h *Argon2Hasher) Verify(password, encoded string) (bool, error) {
+	p, salt, key, err := decodeArgon2(encoded)
+	if err != nil {
+		return false, err
+	}
+
+	other := argon2.IDKey([]byte(password), salt, p.Time, p.Memory, p.Threads, uint32(len(key)))
+	return subtle.ConstantTimeCompare(key, other) == 1, nil
+}
+
+// NeedsRehash return true if hash parameters differ from configured ones
+func (h *Argon2Hasher) NeedsRehash(encoded string) bool {
+	p, salt, key, err := decodeArgon2(encoded)
+	if err != nil {
+		return true
+	}
+
+	return p.Memory != h.params.Memory ||
+		p.Time != h.params.Time ||
+		p.Threads != h.params.Threads ||
+		uint32(len(salt)) != h.params.SaltLen ||
+		uint32(len(key)) != h.params.KeyLen
+}
+
+// decodeArgon2 parse PHC string into parameters, salt and key
+func decodeArgon2(encoded string) (p Argon2Params, salt, key []byte, err error) {
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 {
+		return p, nil, nil, ErrUnknownHash
+	}
+
+	var version int
+	if _, err = fmt.Sscanf(parts[2], "v=%d", &version); err != nil {
+		return p, nil, nil, ErrUnknownHash
+	}
+	if version != argon2.Version {
+		return p, nil, nil, fmt.Errorf("user: unsupported argon2 version %d", version)
+	}
+
+	if _, err = fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &p.Memory, &p.Time, &p.Threads); err != nil {
+		return p, nil, nil, ErrUnknownHash
+	}
+
+	if salt, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil {
+		return p, nil, nil, ErrUnknownHash
+	}
+	if key, err = base64.RawStdEncoding.DecodeString(parts[5]); err != nil {
+		return p, nil, nil, ErrUnknownHash
+	}
+
+	// argon2 panic on zero time or threads and empty key would match anything
+	if p.Time == 0 || p.Threads == 0 || len(key) == 0 {
+		return p, nil, nil, ErrUnknownHash
+	}
+
+	p.SaltLen = uint32(len(salt))
+	p.KeyLen = uint32(len(key))
+	return p, salt, key, nil
+}
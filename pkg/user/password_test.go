@@ -0,0 +1,138 @@
+package user
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+var testArgon2Params = Argon2Params{Memory: 1024, Time: 1, Threads: 1}
+
+func TestPasswordsHash(t *testing.T) {
+
+	tests := []struct {
+		hasher string
+		prefix string
+	}{
+		{"", "$2a$04$"},
+		{"bcrypt", "$2a$04$"},
+		{"argon2id", "$argon2id$v=19$m=1024,t=1,p=1$"},
+	}
+
+	for _, test := range tests {
+		p, err := NewPasswords(test.hasher, bcrypt.MinCost, testArgon2Params)
+		if err != nil {
+			t.Errorf("%s: cannot create passwords: %v", test.hasher, err)
+			continue
+		}
+
+		hash, err := p.Hash("123123")
+		if err != nil {
+			t.Errorf("%s: cannot hash: %v", test.hasher, err)
+			continue
+		}
+
+		if !strings.HasPrefix(hash, test.prefix) {
+			t.Errorf("%s: expected hash with prefix %s, got: %s", test.hasher, test.prefix, hash)
+		}
+
+		ok, rehash, err := p.Verify("123123", hash)
+		if err != nil || !ok || rehash {
+			t.Errorf("%s: expected valid hash without rehash, got ok: %t, rehash: %t, err: %v", test.hasher, ok, rehash, err)
+		}
+
+		ok, _, err = p.Verify("bad password", hash)
+		if err != nil || ok {
+			t.Errorf("%s: expected wrong password to fail, got ok: %t, err: %v", test.hasher, ok, err)
+		}
+	}
+}
+
+func TestPasswordsUnknownHasher(t *testing.T) {
+	if _, err := NewPasswords("md5", 0, Argon2Params{}); err == nil {
+		t.Errorf("Expected error for unknown hasher")
+	}
+}
+
+func TestPasswordsRehash(t *testing.T) {
+
+	oldBcrypt, _ := NewBcryptHasher(bcrypt.MinCost).Hash("123123")
+	oldArgon2, _ := NewArgon2Hasher(Argon2Params{Memory: 512, Time: 1, Threads: 1}).Hash("123123")
+	curArgon2, _ := NewArgon2Hasher(testArgon2Params).Hash("123123")
+
+	p, _ := NewPasswords("argon2id", bcrypt.MinCost+1, testArgon2Params)
+	p.AllowPlaintext = true
+
+	tests := []struct {
+		name    string
+		encoded string
+		ok      bool
+		rehash  bool
+	}{
+		{"Plain text legacy row", "123123", true, true},
+		{"Plain text legacy row, wrong password", "321321", false, false},
+		{"Empty password", "", false, false},
+		{"Other algorithm", oldBcrypt, true, true},
+		{"Outdated parameters", oldArgon2, true, true},
+		{"Current parameters", curArgon2, true, false},
+	}
+
+	for _, test := range tests {
+		ok, rehash, err := p.Verify("123123", test.encoded)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+		}
+		if ok != test.ok || rehash != test.rehash {
+			t.Errorf("%s: expected ok: %t, rehash: %t, got ok: %t, rehash: %t", test.name, test.ok, test.rehash, ok, rehash)
+		}
+	}
+
+	// stored hash must not work as password even when it is in format we don't know
+	for _, encoded := range []string{"$unknown$hash", "$argon2i$v=19$m=1024,t=1,p=1$c2FsdHNhbHQ$a2V5a2V5", "$2x$04$hash"} {
+		if ok, _, err := p.Verify(encoded, encoded); ok || err != ErrUnknownHash {
+			t.Errorf("Expected %s to be refused as unknown hash, got ok: %t, err: %v", encoded, ok, err)
+		}
+	}
+
+	p.AllowPlaintext = false
+	if ok, _, err := p.Verify("123123", "123123"); ok || err != nil {
+		t.Errorf("Expected plain text password to be refused when not allowed, got ok: %t, err: %v", ok, err)
+	}
+
+	malformed := []string{
+		"$argon2id$v=19$m=1024,t=1,p=1$c2FsdHNhbHQ$",
+		"$argon2id$v=19$m=1024,t=1,p=0$c2FsdHNhbHQ$a2V5a2V5",
+		"$argon2id$v=19$m=1024,t=0,p=1$c2FsdHNhbHQ$a2V5a2V5",
+	}
+	for _, encoded := range malformed {
+		if ok, _, err := p.Verify("123123", encoded); ok || err != ErrUnknownHash {
+			t.Errorf("Expected %s to be refused as malformed, got ok: %t, err: %v", encoded, ok, err)
+		}
+	}
+}
+
+func TestPasswordBcryptLimit(t *testing.T) {
+	a := SetUp(t)
+
+	tests := []struct {
+		name     string
+		password string
+		code     int
+	}{
+		{"Longer than bcrypt accept", strings.Repeat("a", 100), 400},
+		{"Multi-byte longer than bcrypt accept", strings.Repeat("é", 40), 400},
+		{"Bcrypt limit", strings.Repeat("a", 72), 201},
+	}
+
+	for _, test := range tests {
+		body, _ := json.Marshal(map[string]string{"email": "new@user.com", "password": test.password})
+		req, _ := http.NewRequest("POST", "/register", bytes.NewBuffer(body))
+		if response := executeRequest(a, req); response.Code != test.code {
+			t.Errorf("%s: expected %d, got %d %s", test.name, test.code, response.Code, response.Body.String())
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package user
+
+import (
+	"net/url"
+	"time"
+
+	v "github.com/webdeveloppro/validating"
+	"golang.org/x/text/language"
+)
+
+// Profile is public user data returned by profile endpoints
+type Profile struct {
+	ID            int       `json:"id"`
+	Email         string    `json:"email"`
+	EmailVerified bool      `json:"email_verified"`
+	FirstName     string    `json:"first_name"`
+	LastName      string    `json:"last_name"`
+	DisplayName   string    `json:"display_name"`
+	AvatarURL     string    `json:"avatar_url"`
+	Locale        string    `json:"locale"`
+	Timezone      string    `json:"timezone"`
+	CreatedAt     time.Time `json:"created_at"`
+	LastLogin     time.Time `json:"last_login"`
+}
+
+// Profile return public user data
+func (u *User) Profile() Profile {
+	return Profile{
+		ID:            u.ID,
+		Email:         u.Email,
+		EmailVerified: u.EmailVerifiedAt != nil,
+		FirstName:     u.FirstName,
+		LastName:      u.LastName,
+		DisplayName:   u.DisplayName,
+		AvatarURL:     u.AvatarURL,
+		Locale:        u.Locale,
+		Timezone:      u.Timezone,
+		CreatedAt:     u.CreatedAt,
+		LastLogin:     u.LastLogin,
+	}
+}
+
+// ProfilePatch hold profile fields to change, nil fields stay as is
+type ProfilePatch struct {
+	FirstName   *string `json:"first_name"`
+	LastName    *string `json:"last_name"`
+	DisplayName *string `json:"display_name"`
+	AvatarURL   *string `json:"avatar_url"`
+	Locale      *string `json:"locale"`
+	Timezone    *string `json:"timezone"`
+}
+
+// Apply change user fields present in patch
+func (p *ProfilePatch) Apply(u *User) {
+	fields := []struct {
+		from *string
+		to   *string
+	}{
+		{p.FirstName, &u.FirstName},
+		{p.LastName, &u.LastName},
+		{p.DisplayName, &u.DisplayName},
+		{p.AvatarURL, &u.AvatarURL},
+		{p.Locale, &u.Locale},
+		{p.Timezone, &u.Timezone},
+	}
+
+	for _, f := range fields {
+		if f.from != nil {
+			*f.to = *f.from
+		}
+	}
+}
+
+// ValidateProfile check profile fields, empty values are allowed
+func (u *User) ValidateProfile() v.Errors {
+	urlValidator := v.FromFunc(func(field v.Field) v.Errors {
+		val := field.ValuePtr.(*string)
+		if *val == "" {
+			return nil
+		}
+		parsed, err := url.Parse(*val)
+		if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+			return v.NewErrors(field.Name, v.ErrInvalid, "should be http or https url")
+		}
+		return nil
+	})
+
+	localeValidator := v.FromFunc(func(field v.Field) v.Errors {
+		val := field.ValuePtr.(*string)
+		if *val == "" {
+			return nil
+		}
+		if _, err := language.Parse(*val); err != nil {
+			return v.NewErrors(field.Name, v.ErrInvalid, "unknown locale")
+		}
+		return nil
+	})
+
+	timezoneValidator := v.FromFunc(func(field v.Field) v.Errors {
+		val := field.ValuePtr.(*string)
+		if *val == "" {
+			return nil
+		}
+		if _, err := time.LoadLocation(*val); err != nil || *val == "Local" {
+			return v.NewErrors(field.Name, v.ErrInvalid, "unknown timezone")
+		}
+		return nil
+	})
+
+	return v.Validate(v.Schema{
+		v.F("first_name", &u.FirstName):     v.Len(0, 100, "length is not between 0 and 100"),
+		v.F("last_name", &u.LastName):       v.Len(0, 100, "length is not between 0 and 100"),
+		v.F("display_name", &u.DisplayName): v.Len(0, 100, "length is not between 0 and 100"),
+		v.F("avatar_url", &u.AvatarURL):     v.All(v.Len(0, 255, "length is not between 0 and 255"), urlValidator),
+		v.F("locale", &u.Locale):            v.All(v.Len(0, 35, "length is not between 0 and 35"), localeValidator),
+		v.F("timezone", &u.Timezone):        v.All(v.Len(0, 64, "length is not between 0 and 64"), timezoneValidator),
+	})
+}
@@ -0,0 +1,66 @@
+package user
+
+import (
+	"bytes"
+	"net/http"
+	"testing"
+)
+
+func TestUpdateProfile(t *testing.T) {
+	a := SetUp(t)
+
+	u := User{ID: 1, Email: "exist@user.com"}
+	token, _ := u.GetToken(a.Tokens)
+
+	tests := []struct {
+		name string
+		data string
+		body string
+		code int
+	}{
+		{
+			name: "Wrong values",
+			data: `{"avatar_url":"ftp://example.com/a.png","locale":"not a locale!","timezone":"Mars/Olympus"}`,
+			body: `{"avatar_url":["should be http or https url"],"locale":["unknown locale"],"timezone":["unknown timezone"]}`,
+			code: 400,
+		},
+		{
+			name: "Too long name",
+			data: `{"first_name":"` + string(bytes.Repeat([]byte("a"), 101)) + `"}`,
+			body: `{"first_name":["length is not between 0 and 100"]}`,
+			code: 400,
+		},
+		{
+			name: "Update all fields",
+			data: `{"first_name":"John","last_name":"Doe","display_name":"johnny","avatar_url":"https://example.com/a.png","locale":"en-US","timezone":"Europe/Kiev"}`,
+			body: `{"id":1,"email":"exist@user.com","email_verified":false,"first_name":"John","last_name":"Doe","display_name":"johnny","avatar_url":"https://example.com/a.png","locale":"en-US","timezone":"Europe/Kiev","created_at":"0001-01-01T00:00:00Z","last_login":"0001-01-01T00:00:00Z"}`,
+			code: 200,
+		},
+		{
+			name: "Partial update keep other fields",
+			data: `{"display_name":"","locale":"uk"}`,
+			body: `{"id":1,"email":"exist@user.com","email_verified":false,"first_name":"John","last_name":"Doe","display_name":"","avatar_url":"https://example.com/a.png","locale":"uk","timezone":"Europe/Kiev","created_at":"0001-01-01T00:00:00Z","last_login":"0001-01-01T00:00:00Z"}`,
+			code: 200,
+		},
+	}
+
+	for _, test := range tests {
+		req, _ := http.NewRequest("PATCH", "/profile", bytes.NewBufferString(test.data))
+		req.Header.Set("Authorization", "Bearer "+token)
+		response := executeRequest(a, req)
+
+		checkResponseCode(t, test.code, response, req)
+
+		if body := response.Body.String(); body != test.body {
+			t.Errorf("%s, Expected '%s' but got '%s'", test.name, test.body, body)
+		}
+	}
+
+	req, _ := http.NewRequest("GET", "/profile", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	response := executeRequest(a, req)
+	expected := `{"id":1,"email":"exist@user.com","email_verified":false,"first_name":"John","last_name":"Doe","display_name":"","avatar_url":"https://example.com/a.png","locale":"uk","timezone":"Europe/Kiev","created_at":"0001-01-01T00:00:00Z","last_login":"0001-01-01T00:00:00Z"}`
+	if body := response.Body.String(); body != expected {
+		t.Errorf("Expected stored profile '%s' but got '%s'", expected, body)
+	}
+}
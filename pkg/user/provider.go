@@ -0,0 +1,593 @@
+package user
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/jackc/pgx"
+)
+
+// scopesSupported are scopes clients can ask for, openid is required
+var scopesSupported = []string{"openid", "email", "profile"}
+
+// Client is application which login users through us with OpenID Connect
+// Only hash of secret is stored, public clients like SPA have no secret and must use PKCE
+type Client struct {
+	ID           string
+	SecretHash   string
+	Name         string
+	RedirectURIs []string
+	CreatedAt    time.Time
+}
+
+// Public tell if client has no secret
+func (c *Client) Public() bool {
+	return c.SecretHash == ""
+}
+
+// AuthorizationCode is issued by /authorize and exchanged for tokens by /token
+// AMR is authentication methods of login, they go to ID token
+type AuthorizationCode struct {
+	ID            int
+	CodeHash      string
+	ClientID      string
+	UserID        int
+	RedirectURI   string
+	Scope         string
+	Nonce         string
+	CodeChallenge string
+	AMR           []string
+	CreatedAt     time.Time
+	ExpiresAt     time.Time
+}
+
+// OAuthError is error response of authorize and token endpoints, see RFC 6749
+type OAuthError struct {
+	Code        string `json:"error"`
+	Description string `json:"error_description,omitempty"`
+}
+
+func (e *OAuthError) Error() string {
+	return e.Code + ": " + e.Description
+}
+
+func oauthError(code, description string) *OAuthError {
+	return &OAuthError{Code: code, Description: description}
+}
+
+// UserInfo is OpenID Connect standard claims, fields are filled according to scope
+type UserInfo struct {
+	Subject       string `json:"sub"`
+	Email         string `json:"email,omitempty"`
+	EmailVerified *bool  `json:"email_verified,omitempty"`
+	Name          string `json:"name,omitempty"`
+	GivenName     string `json:"given_name,omitempty"`
+	FamilyName    string `json:"family_name,omitempty"`
+	Picture       string `json:"picture,omitempty"`
+	Locale        string `json:"locale,omitempty"`
+	Zoneinfo      string `json:"zoneinfo,omitempty"`
+}
+
+// UserInfo return claims of user allowed by scope
+func (u *User) UserInfo(scope string) UserInfo {
+	info := UserInfo{Subject: strconv.Itoa(u.ID)}
+
+	if hasScope(scope, "email") {
+		verified := u.EmailVerifiedAt != nil
+		info.Email = u.Email
+		info.EmailVerified = &verified
+	}
+
+	if hasScope(scope, "profile") {
+		info.Name = u.DisplayName
+		if info.Name == "" {
+			info.Name = strings.TrimSpace(u.FirstName + " " + u.LastName)
+		}
+		info.GivenName = u.FirstName
+		info.FamilyName = u.LastName
+		info.Picture = u.AvatarURL
+		info.Locale = u.Locale
+		info.Zoneinfo = u.Timezone
+	}
+	return info
+}
+
+// IDTokenClaims are claims of ID tokens we issue to clients
+type IDTokenClaims struct {
+	UserInfo
+	Issuer          string   `json:"iss"`
+	Audience        Audience `json:"aud"`
+	AuthorizedParty string   `json:"azp"`
+	ExpiresAt       int64    `json:"exp"`
+	IssuedAt        int64    `json:"iat"`
+	Nonce           string   `json:"nonce,omitempty"`
+	AMR             []string `json:"amr,omitempty"`
+	AccessTokenHash string   `json:"at_hash"`
+	TokenUse        string   `json:"token_use"`
+}
+
+// Valid is required by jwt.Claims, clients validate ID tokens themselves
+func (c *IDTokenClaims) Valid() error {
+	return nil
+}
+
+// hasScope tell if space separated scope list contain s
+func hasScope(scope, s string) bool {
+	for _, v := range strings.Fields(scope) {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// RegisterClient validate and store new client, secret is generated for confidential
+// clients and returned only here, we keep just its hash
+func (a *App) RegisterClient(c *Client, confidential bool) (string, error) {
+	if c.Name == "" {
+		return "", fmt.Errorf("user: client name cannot be empty")
+	}
+	if len(c.RedirectURIs) == 0 {
+		return "", fmt.Errorf("user: client needs at least one redirect uri")
+	}
+	for _, uri := range c.RedirectURIs {
+		u, err := url.Parse(uri)
+		if err != nil || u.Scheme == "" || u.Host == "" || u.Fragment != "" {
+			return "", fmt.Errorf("user: redirect uri %q should be absolute url without fragment", uri)
+		}
+	}
+
+	var err error
+	if c.ID, err = randomString(16); err != nil {
+		return "", err
+	}
+
+	var secret string
+	if confidential {
+		if secret, err = randomString(32); err != nil {
+			return "", err
+		}
+		c.SecretHash = hashToken(secret)
+	}
+
+	return secret, a.Storage.CreateClient(c)
+}
+
+// issuer return our issuer url, it is guessed from request when Config.Issuer is empty
+func (a *App) issuer(r *http.Request) string {
+	if a.Config.Issuer != "" {
+		return a.Config.Issuer
+	}
+
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host
+}
+
+// openidConfiguration return discovery document, see OpenID Connect Discovery 1.0
+func (a *App) openidConfiguration(w http.ResponseWriter, r *http.Request) {
+	iss := a.issuer(r)
+	base := strings.TrimRight(iss, "/")
+
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	respondWithJSON(w, r, http.StatusOK, map[string]interface{}{
+		"issuer":                                iss,
+		"authorization_endpoint":                base + "/authorize",
+		"token_endpoint":                        base + "/token",
+		"userinfo_endpoint":                     base + "/userinfo",
+		"introspection_endpoint":                base + "/oauth/introspect",
+		"jwks_uri":                              base + "/.well-known/jwks.json",
+		"scopes_supported":                      scopesSupported,
+		"response_types_supported":              []string{"code"},
+		"grant_types_supported":                 []string{"authorization_code", "client_credentials"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+		"token_endpoint_auth_methods_supported": []string{"client_secret_basic", "client_secret_post", "none"},
+		"code_challenge_methods_supported":      []string{"S256"},
+		"claims_supported": []string{"sub", "iss", "aud", "exp", "iat", "nonce", "amr", "email", "email_verified",
+			"name", "given_name", "family_name", "picture", "locale", "zoneinfo"},
+	})
+}
+
+// authorizeRequest is authorization request of client, see RFC 6749 section 4.1.1 and RFC 7636
+type authorizeRequest struct {
+	ClientID            string `json:"client_id"`
+	RedirectURI         string `json:"redirect_uri"`
+	ResponseType        string `json:"response_type"`
+	Scope               string `json:"scope"`
+	State               string `json:"state"`
+	Nonce               string `json:"nonce"`
+	CodeChallenge       string `json:"code_challenge"`
+	CodeChallengeMethod string `json:"code_challenge_method"`
+}
+
+func authorizeRequestFromQuery(q url.Values) authorizeRequest {
+	return authorizeRequest{
+		ClientID:            q.Get("client_id"),
+		RedirectURI:         q.Get("redirect_uri"),
+		ResponseType:        q.Get("response_type"),
+		Scope:               q.Get("scope"),
+		State:               q.Get("state"),
+		Nonce:               q.Get("nonce"),
+		CodeChallenge:       q.Get("code_challenge"),
+		CodeChallengeMethod: q.Get("code_challenge_method"),
+	}
+}
+
+// authorizeClient find client and check redirect uri, these errors are never sent
+// to redirect uri, otherwise we would be open redirector
+func (a *App) authorizeClient(req *authorizeRequest) (*Client, error) {
+	if req.ClientID == "" {
+		return nil, oauthError("invalid_request", "client_id cannot be empty")
+	}
+
+	c := Client{ID: req.ClientID}
+	if err := a.Storage.GetClient(&c); err != nil {
+		if err == pgx.ErrNoRows {
+			return nil, oauthError("invalid_request", "unknown client_id")
+		}
+		return nil, err
+	}
+
+	for _, uri := range c.RedirectURIs {
+		if uri == req.RedirectURI {
+			return &c, nil
+		}
+	}
+	return nil, oauthError("invalid_request", "redirect_uri is not registered for client")
+}
+
+// check validate rest of request and keep only scopes we support,
+// these errors are sent to client redirect uri
+func (req *authorizeRequest) check(c *Client) *OAuthError {
+	if req.ResponseType != "code" {
+		return oauthError("unsupported_response_type", "only code response_type is supported")
+	}
+
+	if !hasScope(req.Scope, "openid") {
+		return oauthError("invalid_scope", "openid scope is required")
+	}
+	var scopes []string
+	for _, s := range scopesSupported {
+		if hasScope(req.Scope, s) {
+			scopes = append(scopes, s)
+		}
+	}
+	req.Scope = strings.Join(scopes, " ")
+
+	if req.CodeChallenge == "" {
+		if c.Public() {
+			return oauthError("invalid_request", "code_challenge is required for public clients")
+		}
+	} else if req.CodeChallengeMethod != "S256" {
+		return oauthError("invalid_request", "only S256 code_challenge_method is supported")
+	}
+
+	return nil
+}
+
+// redirectURL return client redirect uri with values and state in query
+func (req *authorizeRequest) redirectURL(values url.Values) string {
+	if req.State != "" {
+		values.Set("state", req.State)
+	}
+
+	sep := "?"
+	if strings.Contains(req.RedirectURI, "?") {
+		sep = "&"
+	}
+	return req.RedirectURI + sep + values.Encode()
+}
+
+// respondWithOAuthError return OAuthError as json, other errors are logged
+func respondWithOAuthError(w http.ResponseWriter, r *http.Request, err error) {
+	oe, ok := err.(*OAuthError)
+	if !ok {
+		log.Printf("openid connect request failed: %v", err)
+		respondWithJSON(w, r, http.StatusInternalServerError, oauthError("server_error", "please try again in few minutes"))
+		return
+	}
+
+	code := http.StatusBadRequest
+	if oe.Code == "invalid_client" {
+		code = http.StatusUnauthorized
+		w.Header().Set("WWW-Authenticate", `Basic realm="token"`)
+	}
+	respondWithJSON(w, r, code, oe)
+}
+
+// authorize check authorization request and send browser to frontend login page,
+// page login user, ask for approval and finish request with approveAuthorize
+func (a *App) authorize(w http.ResponseWriter, r *http.Request) {
+	req := authorizeRequestFromQuery(r.URL.Query())
+
+	c, err := a.authorizeClient(&req)
+	if err != nil {
+		respondWithOAuthError(w, r, err)
+		return
+	}
+
+	if oe := req.check(c); oe != nil {
+		http.Redirect(w, r, req.redirectURL(url.Values{"error": {oe.Code}, "error_description": {oe.Description}}), http.StatusFound)
+		return
+	}
+
+	sep := "?"
+	if strings.Contains(a.Config.OIDCLoginURL, "?") {
+		sep = "&"
+	}
+	http.Redirect(w, r, a.Config.OIDCLoginURL+sep+r.URL.RawQuery, http.StatusFound)
+}
+
+// approveAuthorize is called by frontend with user token when user approved client,
+// it return url frontend should send browser to, with code or error
+func (a *App) approveAuthorize(w http.ResponseWriter, r *http.Request) {
+	u, _ := UserFromContext(r.Context())
+	claims, _ := ClaimsFromContext(r.Context())
+
+	var req authorizeRequest
+	if r.Body == nil {
+		respondWithOAuthError(w, r, oauthError("invalid_request", "body cannot be empty"))
+		return
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondWithOAuthError(w, r, oauthError("invalid_request", "body is not valid json"))
+		return
+	}
+
+	c, err := a.authorizeClient(&req)
+	if err != nil {
+		respondWithOAuthError(w, r, err)
+		return
+	}
+
+	if oe := req.check(c); oe != nil {
+		respondWithJSON(w, r, http.StatusOK, map[string]string{
+			"redirect_to": req.redirectURL(url.Values{"error": {oe.Code}, "error_description": {oe.Description}}),
+		})
+		return
+	}
+
+	code, err := randomString(32)
+	if err == nil {
+		err = a.Storage.CreateAuthorizationCode(&AuthorizationCode{
+			CodeHash:      hashToken(code),
+			ClientID:      c.ID,
+			UserID:        u.ID,
+			RedirectURI:   req.RedirectURI,
+			Scope:         req.Scope,
+			Nonce:         req.Nonce,
+			CodeChallenge: req.CodeChallenge,
+			AMR:           claims.AMR,
+			ExpiresAt:     time.Now().Add(a.Config.AuthorizationCodeTTL),
+		})
+	}
+	if err != nil {
+		respondWithOAuthError(w, r, err)
+		return
+	}
+
+	respondWithJSON(w, r, http.StatusOK, map[string]string{
+		"redirect_to": req.redirectURL(url.Values{"code": {code}}),
+	})
+}
+
+// token is token endpoint, it issue tokens for authorization_code and client_credentials grants
+func (a *App) token(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Pragma", "no-cache")
+
+	if err := r.ParseForm(); err != nil {
+		respondWithOAuthError(w, r, oauthError("invalid_request", "body should be form encoded"))
+		return
+	}
+
+	switch r.PostForm.Get("grant_type") {
+	case "authorization_code":
+		a.authorizationCodeGrant(w, r)
+	case "client_credentials":
+		a.clientCredentialsGrant(w, r)
+	default:
+		respondWithOAuthError(w, r, oauthError("unsupported_grant_type", "only authorization_code and client_credentials grant types are supported"))
+	}
+}
+
+// authorizationCodeGrant exchange authorization code for access and ID tokens, see RFC 6749 section 4.1.3
+func (a *App) authorizationCodeGrant(w http.ResponseWriter, r *http.Request) {
+	c, err := a.authenticateClient(r)
+	if err != nil {
+		respondWithOAuthError(w, r, err)
+		return
+	}
+
+	ac, err := a.useAuthorizationCode(c, r.PostForm)
+	if err != nil {
+		respondWithOAuthError(w, r, err)
+		return
+	}
+
+	u := User{ID: ac.UserID}
+	if err := a.Storage.GetUserByID(&u); err != nil {
+		if err == pgx.ErrNoRows {
+			err = oauthError("invalid_grant", "user does not exist")
+		}
+		respondWithOAuthError(w, r, err)
+		return
+	}
+	u.AMR = ac.AMR
+
+	res, err := a.clientTokens(r, &u, c, ac)
+	if err != nil {
+		respondWithOAuthError(w, r, err)
+		return
+	}
+	respondWithJSON(w, r, http.StatusOK, res)
+}
+
+// authenticateClient check client credentials from basic auth or form,
+// public clients send only client_id
+func (a *App) authenticateClient(r *http.Request) (*Client, error) {
+	id, secret, err := clientCredentials(r)
+	if err != nil {
+		return nil, err
+	}
+
+	c := Client{ID: id}
+	if err := a.Storage.GetClient(&c); err != nil {
+		if err == pgx.ErrNoRows {
+			return nil, oauthError("invalid_client", "client authentication failed")
+		}
+		return nil, err
+	}
+
+	if !c.Public() && subtle.ConstantTimeCompare([]byte(hashToken(secret)), []byte(c.SecretHash)) != 1 {
+		return nil, oauthError("invalid_client", "client authentication failed")
+	}
+	return &c, nil
+}
+
+// clientCredentials return client id and secret from basic auth or form
+func clientCredentials(r *http.Request) (string, string, error) {
+	id, secret, basic := r.BasicAuth()
+	if basic {
+		// RFC 6749 section 2.3.1 require credentials to be form encoded
+		id, _ = url.QueryUnescape(id)
+		secret, _ = url.QueryUnescape(secret)
+	} else {
+		id, secret = r.PostForm.Get("client_id"), r.PostForm.Get("client_secret")
+	}
+
+	if id == "" {
+		return "", "", oauthError("invalid_client", "client authentication is required")
+	}
+	return id, secret, nil
+}
+
+// useAuthorizationCode consume code and check it was issued to client with same redirect uri
+func (a *App) useAuthorizationCode(c *Client, form url.Values) (*AuthorizationCode, error) {
+	ac := AuthorizationCode{CodeHash: hashToken(form.Get("code"))}
+	if err := a.Storage.UseAuthorizationCode(&ac); err != nil {
+		if err == pgx.ErrNoRows {
+			return nil, oauthError("invalid_grant", "code is invalid or used")
+		}
+		return nil, err
+	}
+
+	switch {
+	case ac.ClientID != c.ID:
+		return nil, oauthError("invalid_grant", "code was issued to other client")
+	case time.Now().After(ac.ExpiresAt):
+		return nil, oauthError("invalid_grant", "code is expired")
+	case ac.RedirectURI != form.Get("redirect_uri"):
+		return nil, oauthError("invalid_grant", "redirect_uri do not match")
+	case !checkCodeVerifier(ac.CodeChallenge, form.Get("code_verifier")):
+		return nil, oauthError("invalid_grant", "code_verifier do not match")
+	}
+	return &ac, nil
+}
+
+// checkCodeVerifier compare S256 challenge with verifier, see RFC 7636
+func checkCodeVerifier(challenge, verifier string) bool {
+	if challenge == "" {
+		return verifier == ""
+	}
+	if len(verifier) < 43 || len(verifier) > 128 {
+		return false
+	}
+
+	sum := sha256.Sum256([]byte(verifier))
+	return subtle.ConstantTimeCompare([]byte(base64.RawURLEncoding.EncodeToString(sum[:])), []byte(challenge)) == 1
+}
+
+// clientTokens return token response with access token limited to code scope and ID token
+func (a *App) clientTokens(r *http.Request, u *User, c *Client, ac *AuthorizationCode) (map[string]interface{}, error) {
+	tokens := a.tenantByID(u.Tenant).tokens
+	claims, err := u.newClaims(tokens)
+	if err != nil {
+		return nil, err
+	}
+	claims.Scope = ac.Scope
+	claims.ClientID = c.ID
+
+	access, err := tokens.Sign(claims)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := a.idTokenKey(a.tenantByID(u.Tenant))
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	hash := sha256.Sum256([]byte(access))
+	idToken, err := key.Sign(&IDTokenClaims{
+		UserInfo:        u.UserInfo(ac.Scope),
+		Issuer:          a.issuer(r),
+		Audience:        Audience{c.ID},
+		AuthorizedParty: c.ID,
+		ExpiresAt:       now.Add(a.Config.IDTokenTTL).Unix(),
+		IssuedAt:        now.Unix(),
+		Nonce:           ac.Nonce,
+		AMR:             u.AMR,
+		AccessTokenHash: base64.RawURLEncoding.EncodeToString(hash[:len(hash)/2]),
+		TokenUse:        TokenUseID,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return map[string]interface{}{
+		"access_token": access,
+		"token_type":   "Bearer",
+		"expires_in":   int(tokens.TTL / time.Second),
+		"id_token":     idToken,
+		"scope":        ac.Scope,
+	}, nil
+}
+
+// idTokenKey return RSA key of tenant for ID tokens, clients expect RS256 even when we sign
+// access tokens with HMAC. IDTokenKey is used when tenant has it, first RSA key otherwise
+func (a *App) idTokenKey(t *tenant) (*Key, error) {
+	ks := t.tokens.Keys
+	if a.Config.IDTokenKey != "" {
+		if k := ks.Key(a.Config.IDTokenKey); k != nil {
+			if k.Method != jwt.SigningMethodRS256 {
+				return nil, fmt.Errorf("user: ID token key %s is not RSA key", a.Config.IDTokenKey)
+			}
+			return k, nil
+		}
+	}
+
+	if k := ks.KeyByAlg(jwt.SigningMethodRS256.Alg()); k != nil {
+		return k, nil
+	}
+	return nil, fmt.Errorf("user: no RSA key configured for ID tokens of tenant %q", t.ID)
+}
+
+// userinfo return claims of token owner allowed by token scope,
+// tokens from our own login have no scope and get all claims
+func (a *App) userinfo(w http.ResponseWriter, r *http.Request) {
+	u, _ := UserFromContext(r.Context())
+	c, _ := ClaimsFromContext(r.Context())
+
+	// API keys have their own scopes, not OpenID Connect ones
+	scope := c.Scope
+	if !hasScope(scope, "openid") {
+		scope = strings.Join(scopesSupported, " ")
+	}
+	respondWithJSON(w, r, http.StatusOK, u.UserInfo(scope))
+}
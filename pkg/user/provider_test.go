@@ -0,0 +1,313 @@
+package user
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+const (
+	testRedirectURI = "https://app.example.com/callback"
+	testVerifier    = "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+)
+
+func testChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// setUpProvider return app with registered confidential client and its secret
+func setUpProvider(t *testing.T) (*App, *Client, string) {
+	t.Parallel()
+
+	c := testConfig()
+	c.Keys = append(c.Keys, KeyConfig{ID: "rs", PrivateKeyPEM: testRSAKeyPEM(t)})
+	c.Issuer = "https://id.example.com"
+	c.OIDCLoginURL = "https://login.example.com/authorize"
+	app, err := NewAppWithConfig(&FakeStorage{}, c)
+	if err != nil {
+		t.Fatalf("cannot create app: %v", err)
+	}
+	a := &app
+
+	client := &Client{Name: "Example app", RedirectURIs: []string{testRedirectURI}}
+	secret, err := a.RegisterClient(client, true)
+	if err != nil {
+		t.Fatalf("cannot register client: %v", err)
+	}
+	return a, client, secret
+}
+
+func authorizeQuery(clientID string, override map[string]string) url.Values {
+	q := url.Values{
+		"client_id":             {clientID},
+		"redirect_uri":          {testRedirectURI},
+		"response_type":         {"code"},
+		"scope":                 {"openid email"},
+		"state":                 {"xyz"},
+		"nonce":                 {"n-0S6_WzA2Mj"},
+		"code_challenge":        {testChallenge(testVerifier)},
+		"code_challenge_method": {"S256"},
+	}
+	for k, v := range override {
+		q.Set(k, v)
+	}
+	return q
+}
+
+// approve finish authorize request as frontend do and return redirect url
+func approve(t *testing.T, a *App, q url.Values) *url.URL {
+	token, _ := loginTokens(t, a)
+
+	req := map[string]string{}
+	for k := range q {
+		req[k] = q.Get(k)
+	}
+
+	code, body := jsonRequest(a, "POST", "/authorize", "", token, req, nil)
+	var res struct {
+		RedirectTo string `json:"redirect_to"`
+	}
+	json.Unmarshal([]byte(body), &res)
+	if code != 200 || res.RedirectTo == "" {
+		t.Fatalf("Expected redirect url, got %d %s", code, body)
+	}
+
+	u, _ := url.Parse(res.RedirectTo)
+	return u
+}
+
+// postToken call token endpoint with form
+func postToken(a *App, id, secret string, form url.Values) (int, map[string]interface{}) {
+	return postForm(a, "/token", id, secret, form)
+}
+
+// postForm send form, client credentials are sent with basic auth if id is set
+func postForm(a *App, url, id, secret string, form url.Values) (int, map[string]interface{}) {
+	req, _ := http.NewRequest("POST", url, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if id != "" {
+		req.SetBasicAuth(id, secret)
+	}
+
+	rr := httptest.NewRecorder()
+	a.Router.ServeHTTP(rr, req)
+
+	var res map[string]interface{}
+	json.Unmarshal(rr.Body.Bytes(), &res)
+	return rr.Code, res
+}
+
+func codeForm(code string) url.Values {
+	return url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {testRedirectURI},
+		"code_verifier": {testVerifier},
+	}
+}
+
+func TestOpenIDConfiguration(t *testing.T) {
+	a, _, _ := setUpProvider(t)
+
+	req, _ := http.NewRequest("GET", "/.well-known/openid-configuration", nil)
+	response := executeRequest(a, req)
+
+	var conf map[string]interface{}
+	json.Unmarshal(response.Body.Bytes(), &conf)
+	if response.Code != 200 || conf["issuer"] != "https://id.example.com" || conf["token_endpoint"] != "https://id.example.com/token" {
+		t.Errorf("Expected discovery document, got %d %s", response.Code, response.Body.String())
+	}
+}
+
+func TestAuthorize(t *testing.T) {
+	a, c, _ := setUpProvider(t)
+
+	tests := []struct {
+		name     string
+		override map[string]string
+		code     int
+		location string
+	}{
+		{"Unknown client", map[string]string{"client_id": "unknown"}, 400, ""},
+		{"Wrong redirect", map[string]string{"redirect_uri": "https://evil.com/callback"}, 400, ""},
+		{"No openid scope", map[string]string{"scope": "email"}, 302, testRedirectURI + "?error=invalid_scope"},
+		{"Implicit flow", map[string]string{"response_type": "token"}, 302, testRedirectURI + "?error=unsupported_response_type"},
+		{"Plain challenge", map[string]string{"code_challenge_method": "plain"}, 302, testRedirectURI + "?error=invalid_request"},
+		{"Valid", nil, 302, "https://login.example.com/authorize?"},
+	}
+
+	for _, test := range tests {
+		req, _ := http.NewRequest("GET", "/authorize?"+authorizeQuery(c.ID, test.override).Encode(), nil)
+		response := executeRequest(a, req)
+		location := response.Header().Get("Location")
+
+		if response.Code != test.code || !strings.HasPrefix(location, test.location) {
+			t.Errorf("%s: expected %d %s, got %d %s", test.name, test.code, test.location, response.Code, location)
+		}
+	}
+
+	// public clients can't skip PKCE
+	public := &Client{Name: "SPA", RedirectURIs: []string{testRedirectURI}}
+	a.RegisterClient(public, false)
+
+	req, _ := http.NewRequest("GET", "/authorize?"+authorizeQuery(public.ID, map[string]string{"code_challenge": ""}).Encode(), nil)
+	if location := executeRequest(a, req).Header().Get("Location"); !strings.Contains(location, "error=invalid_request") {
+		t.Errorf("Expected public client without PKCE to be refused, got %s", location)
+	}
+}
+
+func TestAuthorizationCodeFlow(t *testing.T) {
+	a, c, secret := setUpProvider(t)
+
+	redirect := approve(t, a, authorizeQuery(c.ID, nil))
+	if redirect.Query().Get("state") != "xyz" || redirect.Query().Get("code") == "" {
+		t.Fatalf("Expected code and state, got %s", redirect)
+	}
+
+	code, res := postToken(a, c.ID, secret, codeForm(redirect.Query().Get("code")))
+	if code != 200 || res["scope"] != "openid email" {
+		t.Fatalf("Expected tokens, got %d %v", code, res)
+	}
+
+	idToken, _ := res["id_token"].(string)
+	claims := &IDTokenClaims{}
+	token, err := jwt.ParseWithClaims(idToken, claims, a.Tokens.Keys.Keyfunc)
+	if err != nil || token.Method.Alg() != "RS256" {
+		t.Fatalf("Expected RS256 ID token, got %v", err)
+	}
+	if !claims.Audience.Contains(c.ID) || claims.Nonce != "n-0S6_WzA2Mj" || claims.Email != "exist@user.com" || claims.Subject != "1" || claims.GivenName != "" {
+		t.Errorf("Expected ID token claims for client, got %+v", claims)
+	}
+
+	// ID token key is published for clients
+	if jwks := a.Tokens.Keys.JWKS(); len(jwks.Keys) != 1 || jwks.Keys[0].Kid != token.Header["kid"] {
+		t.Errorf("Expected ID token key in jwks, got %+v", jwks)
+	}
+
+	req, _ := http.NewRequest("GET", "/userinfo", nil)
+	req.Header.Set("Authorization", "Bearer "+res["access_token"].(string))
+	response := executeRequest(a, req)
+	if body := response.Body.String(); response.Code != 200 || body != `{"sub":"1","email":"exist@user.com","email_verified":false}` {
+		t.Errorf("Expected userinfo limited to email scope, got %d %s", response.Code, body)
+	}
+
+	// ID token is signed with key access tokens are checked with, but it is not access token
+	if code := profileCode(a, "Bearer "+idToken); code != 401 {
+		t.Errorf("Expected ID token to be refused as access token, got %d", code)
+	}
+}
+
+func TestAuthorizationCodeInvalid(t *testing.T) {
+	a, c, secret := setUpProvider(t)
+
+	other := &Client{Name: "Other app", RedirectURIs: []string{testRedirectURI}}
+	otherSecret, _ := a.RegisterClient(other, true)
+
+	tests := []struct {
+		name   string
+		id     string
+		secret string
+		modify func(url.Values)
+		code   int
+		error  string
+	}{
+		{"Wrong secret", c.ID, "wrong", func(url.Values) {}, 401, "invalid_client"},
+		{"Other client", other.ID, otherSecret, func(url.Values) {}, 400, "invalid_grant"},
+		{"Wrong verifier", c.ID, secret, func(f url.Values) { f.Set("code_verifier", strings.Repeat("a", 43)) }, 400, "invalid_grant"},
+		{"Wrong redirect", c.ID, secret, func(f url.Values) { f.Set("redirect_uri", "https://app.example.com/other") }, 400, "invalid_grant"},
+		{"Wrong grant", c.ID, secret, func(f url.Values) { f.Set("grant_type", "password") }, 400, "unsupported_grant_type"},
+	}
+
+	for _, test := range tests {
+		redirect := approve(t, a, authorizeQuery(c.ID, nil))
+		form := codeForm(redirect.Query().Get("code"))
+		test.modify(form)
+
+		if code, res := postToken(a, test.id, test.secret, form); code != test.code || res["error"] != test.error {
+			t.Errorf("%s: expected %d %s, got %d %v", test.name, test.code, test.error, code, res)
+		}
+	}
+
+	// code is single use
+	redirect := approve(t, a, authorizeQuery(c.ID, nil))
+	form := codeForm(redirect.Query().Get("code"))
+	postToken(a, c.ID, secret, form)
+	if code, res := postToken(a, c.ID, secret, form); code != 400 || res["error"] != "invalid_grant" {
+		t.Errorf("Expected used code to be refused, got %d %v", code, res)
+	}
+}
+
+func TestAuthorizationCodePublicClient(t *testing.T) {
+	a, _, _ := setUpProvider(t)
+
+	c := &Client{Name: "SPA", RedirectURIs: []string{testRedirectURI}}
+	if secret, err := a.RegisterClient(c, false); err != nil || secret != "" {
+		t.Fatalf("Expected public client without secret, got %q %v", secret, err)
+	}
+
+	redirect := approve(t, a, authorizeQuery(c.ID, map[string]string{"scope": "openid profile"}))
+	form := codeForm(redirect.Query().Get("code"))
+	form.Set("client_id", c.ID)
+
+	if code, res := postToken(a, "", "", form); code != 200 || res["id_token"] == nil {
+		t.Errorf("Expected public client to get tokens with PKCE, got %d %v", code, res)
+	}
+}
+
+func TestIDTokenKey(t *testing.T) {
+	a, _, _ := setUpProvider(t)
+	if k, err := a.idTokenKey(a.tenantByID("")); err != nil || k.ID != "rs" {
+		t.Errorf("Expected configured RSA key for ID tokens, got %+v %v", k, err)
+	}
+
+	a.Config.IDTokenKey = "test"
+	if _, err := a.idTokenKey(a.tenantByID("")); err == nil {
+		t.Errorf("Expected HMAC key to be refused for ID tokens")
+	}
+
+	app, err := NewAppWithConfig(&FakeStorage{}, testConfig())
+	if err != nil {
+		t.Fatalf("cannot create app: %v", err)
+	}
+	if _, err := app.idTokenKey(app.tenantByID("")); err == nil {
+		t.Errorf("Expected no ID token key without RSA key")
+	}
+}
+
+func TestIDTokenKeyPerTenant(t *testing.T) {
+	t.Parallel()
+	c := testConfig()
+	c.Keys = append(c.Keys, KeyConfig{ID: "rs", PrivateKeyPEM: testRSAKeyPEM(t)})
+	c.Tenants = []Tenant{
+		{ID: "acme", Keys: []KeyConfig{{ID: "acme", Secret: []byte("acme secret")}, {ID: "acme-rs", PrivateKeyPEM: testRSAKeyPEM(t)}}},
+		{ID: "beta", Keys: []KeyConfig{{ID: "beta", Secret: []byte("beta secret")}}},
+	}
+	app, err := NewAppWithConfig(&FakeStorage{}, c)
+	if err != nil {
+		t.Fatalf("cannot create app: %v", err)
+	}
+	a := &app
+
+	for tenant, kid := range map[string]string{"": "rs", "acme": "acme-rs"} {
+		k, err := a.idTokenKey(a.tenantByID(tenant))
+		if err != nil || k.ID != kid {
+			t.Errorf("%q: expected ID token key %s, got %+v %v", tenant, kid, k, err)
+			continue
+		}
+		if jwks := a.tenantByID(tenant).tokens.Keys.JWKS(); len(jwks.Keys) != 1 || jwks.Keys[0].Kid != kid {
+			t.Errorf("%q: expected ID token key in tenant jwks, got %+v", tenant, jwks)
+		}
+	}
+
+	if _, err := a.idTokenKey(a.tenantByID("beta")); err == nil {
+		t.Errorf("Expected tenant without RSA key to have no ID token key")
+	}
+}
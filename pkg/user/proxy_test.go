@@ -0,0 +1,54 @@
+package user
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRealIP(t *testing.T) {
+	t.Parallel()
+	c := testConfig()
+	c.TrustedProxies = []string{"10.0.0.0/8", "192.168.1.1"}
+	app, err := NewAppWithConfig(&FakeStorage{}, c)
+	if err != nil {
+		t.Fatalf("cannot create app: %v", err)
+	}
+	a := &app
+
+	tests := []struct {
+		name      string
+		addr      string
+		forwarded string
+		ip        string
+	}{
+		{"Direct client", "1.1.1.1:1234", "", "1.1.1.1"},
+		{"Spoofed header from client", "1.1.1.1:1234", "2.2.2.2", "1.1.1.1"},
+		{"Trusted proxy", "10.0.0.1:1234", "2.2.2.2", "2.2.2.2"},
+		{"Client header before proxy", "10.0.0.1:1234", "3.3.3.3, 2.2.2.2", "2.2.2.2"},
+		{"Chain of proxies", "192.168.1.1:1234", "2.2.2.2, 10.0.0.2", "2.2.2.2"},
+		{"Garbage in header", "10.0.0.1:1234", "unknown", "10.0.0.1"},
+	}
+
+	for _, test := range tests {
+		var got string
+		h := a.RealIP(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			got = remoteIP(r)
+		}))
+
+		req, _ := http.NewRequest("POST", "/login", nil)
+		req.RemoteAddr = test.addr
+		if test.forwarded != "" {
+			req.Header.Set("X-Forwarded-For", test.forwarded)
+		}
+		h.ServeHTTP(httptest.NewRecorder(), req)
+		if got != test.ip {
+			t.Errorf("%s: expected %s, got %s", test.name, test.ip, got)
+		}
+	}
+
+	c.TrustedProxies = []string{"10.0.0.0/33"}
+	if _, err := NewAppWithConfig(&FakeStorage{}, c); err == nil {
+		t.Errorf("Expected wrong proxy range to be refused")
+	}
+}
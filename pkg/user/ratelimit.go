@@ -0,0 +1,184 @@
+package user
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Rate limit keys, they tell whose requests share one bucket
+const (
+	RateLimitByIP    = "ip"
+	RateLimitByUser  = "user"
+	RateLimitByRoute = "route"
+)
+
+// RateLimit allow Limit requests per Period with token bucket,
+// so short bursts up to Limit are fine but average rate is kept
+type RateLimit struct {
+	Limit  int
+	Period time.Duration
+	// By is RateLimitByIP, RateLimitByUser or RateLimitByRoute,
+	// user limit fall back to ip for requests without user
+	By string
+}
+
+// RateLimitResult is state of bucket after request
+type RateLimitResult struct {
+	Allowed   bool
+	Limit     int
+	Remaining int
+	// Reset is time until bucket is full again, RetryAfter is time until next request is allowed
+	Reset      time.Duration
+	RetryAfter time.Duration
+}
+
+// RateLimitStore keep token buckets, MemoryRateLimitStore work for single instance
+// and PGStorage share buckets between instances
+type RateLimitStore interface {
+	TakeRateLimit(key string, l RateLimit, now time.Time) (RateLimitResult, error)
+}
+
+// rateBucket is token bucket, it is refilled lazily when request come
+type rateBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// take refill bucket for time passed since last request and take one token if there is one
+func (b *rateBucket) take(l RateLimit, now time.Time) RateLimitResult {
+	rate := float64(l.Limit) / l.Period.Seconds()
+	if b.updated.IsZero() {
+		b.tokens = float64(l.Limit)
+	} else if elapsed := now.Sub(b.updated).Seconds(); elapsed > 0 {
+		b.tokens = math.Min(float64(l.Limit), b.tokens+elapsed*rate)
+	}
+	b.updated = now
+
+	res := RateLimitResult{Limit: l.Limit}
+	if b.tokens >= 1 {
+		b.tokens--
+		res.Allowed = true
+	} else {
+		res.RetryAfter = time.Duration((1 - b.tokens) / rate * float64(time.Second))
+	}
+	res.Remaining = int(b.tokens)
+	res.Reset = time.Duration((float64(l.Limit) - b.tokens) / rate * float64(time.Second))
+	return res
+}
+
+// full tell when bucket will be full again, such bucket is the same as missing one
+func (b *rateBucket) full(l RateLimit) time.Time {
+	rate := float64(l.Limit) / l.Period.Seconds()
+	return b.updated.Add(time.Duration((float64(l.Limit) - b.tokens) / rate * float64(time.Second)))
+}
+
+// memoryBucket remember when bucket is full, so it can be forgotten
+type memoryBucket struct {
+	rateBucket
+	fullAt time.Time
+}
+
+// MemoryRateLimitStore keep buckets in process memory
+type MemoryRateLimitStore struct {
+	mu      sync.Mutex
+	buckets map[string]*memoryBucket
+}
+
+// NewMemoryRateLimitStore return empty store
+func NewMemoryRateLimitStore() *MemoryRateLimitStore {
+	return &MemoryRateLimitStore{buckets: map[string]*memoryBucket{}}
+}
+
+// TakeRateLimit take token from bucket with key
+func (s *MemoryRateLimitStore) TakeRateLimit(key string, l RateLimit, now time.Time) (RateLimitResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	b, ok := s.buckets[key]
+	if !ok {
+		// full buckets are forgotten, so map doesn't grow forever
+		if len(s.buckets) > 10000 {
+			for k, old := range s.buckets {
+				if now.After(old.fullAt) {
+					delete(s.buckets, k)
+				}
+			}
+		}
+		b = &memoryBucket{}
+		s.buckets[key] = b
+	}
+
+	res := b.take(l, now)
+	b.fullAt = b.full(l)
+	return res, nil
+}
+
+// rateLimitKey return bucket key of request for route name
+func rateLimitKey(r *http.Request, name string, l RateLimit) string {
+	switch l.By {
+	case RateLimitByRoute:
+		return name
+	case RateLimitByUser:
+		if u, ok := UserFromContext(r.Context()); ok {
+			return name + ":user:" + strconv.Itoa(u.ID)
+		}
+	}
+	return name + ":ip:" + remoteIP(r)
+}
+
+// seconds round duration up to whole seconds for headers
+func seconds(d time.Duration) string {
+	return strconv.Itoa(int(math.Ceil(d.Seconds())))
+}
+
+// RateLimit is middleware which limit requests with limit configured for route name in Config.RateLimits,
+// routes without configured limit are not limited. Store errors are logged and request is let through.
+// RateLimitByUser limit need user in context, so RateLimit has to go after Authenticate
+//
+//	a.Router.Handle("/register", a.RateLimit(registerHandler, "register")).Methods("POST")
+//	a.Router.Handle("/orders", a.Authenticate(a.RateLimit(ordersHandler, "orders"))).Methods("POST")
+func (a *App) RateLimit(next http.Handler, name string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		l, ok := a.Config.RateLimits[name]
+		if !ok || l.Limit <= 0 || l.Period <= 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		res, err := a.Config.RateLimitStore.TakeRateLimit(rateLimitKey(r, name, l), l, time.Now())
+		if err != nil {
+			log.Printf("cannot check rate limit %s: %v", name, err)
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Set("RateLimit-Policy", fmt.Sprintf("%d;w=%s", l.Limit, seconds(l.Period)))
+		w.Header().Set("RateLimit-Limit", strconv.Itoa(res.Limit))
+		w.Header().Set("RateLimit-Remaining", strconv.Itoa(res.Remaining))
+		w.Header().Set("RateLimit-Reset", seconds(res.Reset))
+
+		if !res.Allowed {
+			w.Header().Set("Retry-After", seconds(res.RetryAfter))
+			respondWithError(w, r, http.StatusTooManyRequests, "too many requests, please try again later")
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// limited wrap handler function with RateLimit middleware
+func (a *App) limited(h http.HandlerFunc, name string) http.Handler {
+	return a.RateLimit(h, name)
+}
+
+// limitedUser is authenticated route with RateLimit middleware, limit is checked
+// after authentication so RateLimitByUser limit has user to count requests of
+func (a *App) limitedUser(h http.HandlerFunc, name string, scopes ...string) http.Handler {
+	return a.Authenticate(a.RateLimit(RequireScope(h, scopes...), name))
+}
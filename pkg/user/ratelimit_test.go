@@ -0,0 +1,131 @@
+package user
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestRateBucket(t *testing.T) {
+	l := RateLimit{Limit: 2, Period: time.Minute}
+	s := NewMemoryRateLimitStore()
+	now := time.Now()
+
+	tests := []struct {
+		allowed    bool
+		remaining  int
+		retryAfter time.Duration
+	}{
+		{true, 1, 0},
+		{true, 0, 0},
+		{false, 0, 30 * time.Second},
+	}
+
+	for i, test := range tests {
+		res, _ := s.TakeRateLimit("key", l, now)
+		if res.Allowed != test.allowed || res.Remaining != test.remaining || res.RetryAfter != test.retryAfter {
+			t.Errorf("Request %d: expected %+v, got %+v", i, test, res)
+		}
+	}
+
+	if res, _ := s.TakeRateLimit("key", l, now.Add(30*time.Second)); !res.Allowed {
+		t.Errorf("Expected token to be refilled, got %+v", res)
+	}
+	if res, _ := s.TakeRateLimit("other", l, now); !res.Allowed || res.Remaining != 1 {
+		t.Errorf("Expected other key to have own bucket, got %+v", res)
+	}
+}
+
+func TestRateLimitKey(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "10.0.0.1:5123"
+
+	tests := []struct {
+		by       string
+		user     *User
+		expected string
+	}{
+		{RateLimitByIP, nil, "orders:ip:10.0.0.1"},
+		{RateLimitByUser, nil, "orders:ip:10.0.0.1"},
+		{RateLimitByUser, &User{ID: 7}, "orders:user:7"},
+		{RateLimitByRoute, &User{ID: 7}, "orders"},
+	}
+
+	for _, test := range tests {
+		r := req
+		if test.user != nil {
+			r = req.WithContext(context.WithValue(req.Context(), userContextKey, test.user))
+		}
+		if key := rateLimitKey(r, "orders", RateLimit{By: test.by}); key != test.expected {
+			t.Errorf("%s: expected %s, got %s", test.by, test.expected, key)
+		}
+	}
+}
+
+func TestRateLimitMiddleware(t *testing.T) {
+	c := testConfig()
+	c.RateLimits = map[string]RateLimit{"register": {Limit: 2, Period: time.Hour, By: RateLimitByIP}}
+	app, err := NewAppWithConfig(&FakeStorage{}, c)
+	if err != nil {
+		t.Fatalf("cannot create app: %v", err)
+	}
+	a := &app
+
+	register := func(ip string) *http.Response {
+		b := new(bytes.Buffer)
+		json.NewEncoder(b).Encode(User{Email: "exist@user.com", Password: "123123"})
+		req, _ := http.NewRequest("POST", "/register", b)
+		req.RemoteAddr = ip + ":1234"
+		return executeRequest(a, req).Result()
+	}
+
+	for i := 0; i < 2; i++ {
+		res := register("10.0.0.1")
+		if res.StatusCode == 429 || res.Header.Get("RateLimit-Limit") != "2" || res.Header.Get("RateLimit-Policy") != "2;w=3600" {
+			t.Fatalf("Expected request %d to pass with headers, got %d %v", i, res.StatusCode, res.Header)
+		}
+	}
+
+	res := register("10.0.0.1")
+	if res.StatusCode != 429 || res.Header.Get("Retry-After") != "1800" || res.Header.Get("RateLimit-Remaining") != "0" {
+		t.Errorf("Expected limited request, got %d %v", res.StatusCode, res.Header)
+	}
+
+	if res := register("10.0.0.2"); res.StatusCode == 429 {
+		t.Errorf("Expected other address to have own limit")
+	}
+
+	// routes without limit are not limited
+	req, _ := http.NewRequest("POST", "/login", bytes.NewBufferString(`{"email":"exist@user.com","password":"123123"}`))
+	if response := executeRequest(a, req); response.Header().Get("RateLimit-Limit") != "" {
+		t.Errorf("Expected login to not be limited, got %v", response.Header())
+	}
+}
+
+func TestRateLimitByUser(t *testing.T) {
+	c := testConfig()
+	c.RateLimits = map[string]RateLimit{"password_change": {Limit: 1, Period: time.Hour, By: RateLimitByUser}}
+	app, err := NewAppWithConfig(&FakeStorage{}, c)
+	if err != nil {
+		t.Fatalf("cannot create app: %v", err)
+	}
+	a := &app
+	token, _ := loginTokens(t, a)
+
+	change := func(ip string) int {
+		req, _ := http.NewRequest("POST", "/password/change", bytes.NewBufferString(`{}`))
+		req.RemoteAddr = ip + ":1234"
+		req.Header.Set("Authorization", "Bearer "+token)
+		return executeRequest(a, req).Code
+	}
+
+	if code := change("10.0.0.1"); code == 429 {
+		t.Fatalf("Expected first request to pass")
+	}
+	if code := change("10.0.0.2"); code != 429 {
+		t.Errorf("Expected user to be limited from other address too, got %d", code)
+	}
+}
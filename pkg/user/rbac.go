@@ -0,0 +1,92 @@
+package user
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Role is named set of permissions, users get permissions through roles
+// Permissions are plain strings like "users:write", we don't keep them in code
+type Role struct {
+	ID          int       `json:"id"`
+	Name        string    `json:"name"`
+	Description string    `json:"description"`
+	Permissions []string  `json:"permissions"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// HasPermission tell if token was issued to user with permission
+func (c *Claims) HasPermission(permission string) bool {
+	for _, p := range c.Permissions {
+		if p == permission {
+			return true
+		}
+	}
+	return false
+}
+
+// HasRole tell if token was issued to user with role
+func (c *Claims) HasRole(role string) bool {
+	for _, r := range c.Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// CreateRole store role with its permissions, missing permissions are created too
+func (a *App) CreateRole(r *Role) error {
+	if r.Name == "" || strings.ContainsAny(r.Name, " \t\n\"\\,") {
+		return fmt.Errorf("user: role name %q should not be empty or contain spaces, commas or quotes", r.Name)
+	}
+	for _, p := range r.Permissions {
+		if p == "" || strings.ContainsAny(p, " \t\n\"\\,") {
+			return fmt.Errorf("user: permission %q should not be empty or contain spaces, commas or quotes", p)
+		}
+	}
+	return a.Storage.CreateRole(r)
+}
+
+// RequirePermission middleware refuse request if token does not have all permissions
+// It should be used after Authenticate, permissions are checked from token claims only
+// so role changes take effect when user get new access token
+func RequirePermission(next http.Handler, permissions ...string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, ok := ClaimsFromContext(r.Context())
+		if !ok {
+			respondWithError(w, r, http.StatusUnauthorized, "Authorization")
+			return
+		}
+
+		for _, p := range permissions {
+			if !c.HasPermission(p) {
+				respondWithError(w, r, http.StatusForbidden, "you do not have permission for this request")
+				return
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// permitted wrap handler function with Authenticate and RequirePermission middlewares,
+// scoped tokens and API keys need one of scopes too
+func (a *App) permitted(h http.HandlerFunc, permissions []string, scopes ...string) http.Handler {
+	return a.Authenticate(RequireScope(RequirePermission(h, permissions...), scopes...))
+}
+
+// listRoles return all roles with their permissions
+func (a *App) listRoles(w http.ResponseWriter, r *http.Request) {
+	roles, err := a.Storage.GetRoles()
+	if err != nil {
+		log.Printf("cannot load roles: %v", err)
+		respondWithError(w, r, http.StatusInternalServerError, "cannot load roles, please try again in few minutes")
+		return
+	}
+
+	respondWithJSON(w, r, http.StatusOK, roles)
+}
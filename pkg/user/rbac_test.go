@@ -0,0 +1,107 @@
+package user
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+// setUpRoles return app where exist@user.com has admin role
+func setUpRoles(t *testing.T) *App {
+	a := SetUp(t)
+
+	if err := a.CreateRole(&Role{Name: "admin", Permissions: []string{"roles:read", "users:read", "users:write"}}); err != nil {
+		t.Fatalf("cannot create role: %v", err)
+	}
+	if err := a.CreateRole(&Role{Name: "support", Permissions: []string{"users:read"}}); err != nil {
+		t.Fatalf("cannot create role: %v", err)
+	}
+	return a
+}
+
+func TestCreateRoleValidation(t *testing.T) {
+	a := SetUp(t)
+
+	for _, r := range []*Role{{Name: ""}, {Name: "super admin"}, {Name: "admin", Permissions: []string{"users read"}}} {
+		if err := a.CreateRole(r); err == nil {
+			t.Errorf("Expected role %+v to be refused", r)
+		}
+	}
+}
+
+func TestRoleClaims(t *testing.T) {
+	a := setUpRoles(t)
+	a.Storage.AssignRole(1, "admin")
+	a.Storage.AssignRole(1, "support")
+
+	if err := a.Storage.AssignRole(1, "unknown"); err == nil {
+		t.Errorf("Expected unknown role to be refused")
+	}
+
+	token, _ := loginTokens(t, a)
+	claims, err := a.Tokens.Parse(token)
+	if err != nil {
+		t.Fatalf("cannot parse token: %v", err)
+	}
+
+	if !claims.HasRole("admin") || !claims.HasRole("support") || len(claims.Permissions) != 3 || !claims.HasPermission("users:write") {
+		t.Errorf("Expected roles and permissions in token, got %v %v", claims.Roles, claims.Permissions)
+	}
+
+	a.Storage.UnassignRole(1, "admin")
+	token, _ = loginTokens(t, a)
+	if claims, _ = a.Tokens.Parse(token); claims.HasRole("admin") || claims.HasPermission("users:write") {
+		t.Errorf("Expected unassigned role to be removed from new token, got %v %v", claims.Roles, claims.Permissions)
+	}
+}
+
+func TestRequirePermission(t *testing.T) {
+	a := setUpRoles(t)
+	a.Router.Handle("/users", a.Authenticate(RequirePermission(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}), "users:read", "users:write"))).Methods("GET")
+
+	tests := []struct {
+		name string
+		role string
+		code int
+	}{
+		{"No role", "", 403},
+		{"Missing permission", "support", 403},
+		{"All permissions", "admin", 204},
+	}
+
+	for _, test := range tests {
+		if test.role != "" {
+			a.Storage.AssignRole(1, test.role)
+		}
+		token, _ := loginTokens(t, a)
+
+		req, _ := http.NewRequest("GET", "/users", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		if response := executeRequest(a, req); response.Code != test.code {
+			t.Errorf("%s: expected %d, got %d", test.name, test.code, response.Code)
+		}
+	}
+}
+
+func TestListRoles(t *testing.T) {
+	a := setUpRoles(t)
+
+	token, _ := loginTokens(t, a)
+	req, _ := http.NewRequest("GET", "/roles", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	checkResponseCode(t, 403, executeRequest(a, req), req)
+
+	a.Storage.AssignRole(1, "admin")
+	token, _ = loginTokens(t, a)
+	req.Header.Set("Authorization", "Bearer "+token)
+	response := executeRequest(a, req)
+	checkResponseCode(t, 200, response, req)
+
+	var roles []Role
+	json.Unmarshal(response.Body.Bytes(), &roles)
+	if len(roles) != 2 || roles[0].Name != "admin" || len(roles[0].Permissions) != 3 {
+		t.Errorf("Expected roles with permissions, got %s", response.Body.String())
+	}
+}
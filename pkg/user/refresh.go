@@ -0,0 +1,221 @@
+package user
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/jackc/pgx"
+	"github.com/pkg/errors"
+	v "github.com/webdeveloppro/validating"
+)
+
+// ErrRefreshTokenUsed returned by storage when refresh token was already exchanged
+var ErrRefreshTokenUsed = errors.New("user: refresh token already used")
+
+// RefreshToken is opaque long-lived token used to get new access tokens
+// Only sha256 hash of token is stored, tokens from one login share FamilyID
+// so we can revoke all of them when reuse is detected
+type RefreshToken struct {
+	ID        int
+	UserID    int
+	FamilyID  string
+	TokenHash string
+	// AMR is authentication methods of login, copied to tokens issued on refresh
+	AMR       []string
+	SessionID int
+	CreatedAt time.Time
+	ExpiresAt time.Time
+	UsedAt    *time.Time
+	RevokedAt *time.Time
+}
+
+// hashToken return hex encoded sha256 of token
+// our tokens are random 32 bytes, so no need for slow hashing here
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// newRefreshToken create and store refresh token for user,
+// empty family start new one
+func (a *App) newRefreshToken(u *User, family string) (string, error) {
+	token, err := randomString(32)
+	if err != nil {
+		return "", err
+	}
+
+	if family == "" {
+		if family, err = randomString(16); err != nil {
+			return "", err
+		}
+	}
+
+	rt := RefreshToken{
+		UserID:    u.ID,
+		FamilyID:  family,
+		TokenHash: hashToken(token),
+		AMR:       u.AMR,
+		SessionID: u.SessionID,
+		ExpiresAt: time.Now().Add(a.tenantByID(u.Tenant).RefreshTokenTTL),
+	}
+
+	if err := a.Storage.CreateRefreshToken(&rt); err != nil {
+		return "", errors.Wrapf(err, "user: cannot store refresh token")
+	}
+
+	return token, nil
+}
+
+// issueTokens return access and refresh tokens for user, new session is recorded
+// for login from request unless user already has one
+func (a *App) issueTokens(r *http.Request, u *User, family string) (string, string, error) {
+	if u.SessionID == 0 && u.DisabledAt == nil {
+		s := Session{}
+		if err := a.createSession(r, u, &s, a.tenantByID(u.Tenant).RefreshTokenTTL); err != nil {
+			return "", "", errors.Wrapf(err, "user: cannot store session")
+		}
+	}
+
+	t, err := u.GetToken(a.tenantByID(u.Tenant).tokens)
+	if err != nil {
+		return "", "", err
+	}
+
+	rt, err := a.newRefreshToken(u, family)
+	if err != nil {
+		return "", "", err
+	}
+	return t, rt, nil
+}
+
+// respondWithTokens return access and refresh tokens for user, or session cookies in session mode
+func (a *App) respondWithTokens(w http.ResponseWriter, r *http.Request, code int, u *User, family string) {
+	if a.Config.SessionCookies {
+		a.respondWithSession(w, r, code, u)
+		return
+	}
+	a.respondWithTokenPair(w, r, code, u, family)
+}
+
+// respondWithTokenPair return access and refresh tokens for user in any mode
+func (a *App) respondWithTokenPair(w http.ResponseWriter, r *http.Request, code int, u *User, family string) {
+	t, rt, err := a.issueTokens(r, u, family)
+	if errors.Cause(err) == ErrUserDisabled {
+		respondWithJSON(w, r, http.StatusForbidden, v.NewErrors("__error__", v.ErrInvalid, "account is disabled").JSONErrors())
+		return
+	}
+	if errors.Cause(err) == ErrPasswordResetRequired {
+		respondWithJSON(w, r, http.StatusForbidden, v.NewErrors("__error__", v.ErrInvalid, passwordResetRequired).JSONErrors())
+		return
+	}
+	if err != nil {
+		log.Printf("cannot issue tokens for user %d: %v", u.ID, err)
+		respondWithJSON(w, r, http.StatusInternalServerError,
+			v.NewErrors("__error__", v.ErrInvalid, "cannot create token, please try again in few minutes").JSONErrors())
+		return
+	}
+
+	respondWithJSON(w, r, code, map[string]interface{}{
+		"token":         t,
+		"refresh_token": rt,
+		"token_type":    "Bearer",
+		"expires_in":    int(a.tenantByID(u.Tenant).tokens.TTL / time.Second),
+	})
+}
+
+// refreshToken exchange refresh token for new access and refresh tokens
+// every refresh token can be used only once, using it twice revoke whole family
+func (a *App) refreshToken(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+
+	if r.Body == nil {
+		respondWithError(w, r, http.StatusBadRequest, "refresh_token cannot be empty")
+		return
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.RefreshToken == "" {
+		respondWithError(w, r, http.StatusBadRequest, "refresh_token cannot be empty")
+		return
+	}
+
+	rt := RefreshToken{TokenHash: hashToken(req.RefreshToken)}
+	if err := a.Storage.GetRefreshToken(&rt); err != nil {
+		if err != pgx.ErrNoRows {
+			log.Printf("cannot get refresh token: %v", err)
+		}
+		respondWithError(w, r, http.StatusUnauthorized, "refresh token is invalid")
+		return
+	}
+
+	if rt.RevokedAt != nil {
+		respondWithError(w, r, http.StatusUnauthorized, "refresh token is revoked")
+		return
+	}
+
+	if rt.UsedAt != nil {
+		a.revokeRefreshFamily(&rt)
+		respondWithError(w, r, http.StatusUnauthorized, "refresh token is revoked")
+		return
+	}
+
+	if time.Now().After(rt.ExpiresAt) {
+		respondWithError(w, r, http.StatusUnauthorized, "refresh token is expired")
+		return
+	}
+
+	// Two requests with same token could pass checks above at the same time,
+	// storage mark token used atomically so only one of them wins
+	if err := a.Storage.UseRefreshToken(&rt); err != nil {
+		if err == ErrRefreshTokenUsed {
+			a.revokeRefreshFamily(&rt)
+			respondWithError(w, r, http.StatusUnauthorized, "refresh token is revoked")
+			return
+		}
+		log.Printf("cannot use refresh token %d: %v", rt.ID, err)
+		respondWithError(w, r, http.StatusInternalServerError, "cannot refresh token, please try again in few minutes")
+		return
+	}
+
+	u := User{ID: rt.UserID}
+	// refresh token can't be moved to other tenant
+	if err := a.Storage.GetUserByID(&u); err != nil || u.Tenant != TenantFromContext(r.Context()) {
+		respondWithError(w, r, http.StatusUnauthorized, "refresh token is invalid")
+		return
+	}
+
+	// tokens of revoked session can't be refreshed, others extend the session
+	if rt.SessionID != 0 {
+		s := Session{ID: rt.SessionID}
+		if err := a.Storage.GetSessionByID(&s); err != nil || s.RevokedAt != nil {
+			a.revokeRefreshFamily(&rt)
+			respondWithError(w, r, http.StatusUnauthorized, "refresh token is revoked")
+			return
+		}
+
+		s.LastSeenAt = time.Now()
+		s.ExpiresAt = s.LastSeenAt.Add(a.tenantByID(u.Tenant).RefreshTokenTTL)
+		if err := a.Storage.TouchSession(&s); err != nil {
+			log.Printf("cannot extend session %d: %v", s.ID, err)
+		}
+	}
+
+	u.AMR = rt.AMR
+	u.SessionID = rt.SessionID
+	// clients with refresh token use bearer tokens even in session mode
+	a.respondWithTokenPair(w, r, http.StatusOK, &u, rt.FamilyID)
+}
+
+// revokeRefreshFamily called when refresh token reuse is detected,
+// token was probably stolen so we revoke every token issued from the same login
+func (a *App) revokeRefreshFamily(rt *RefreshToken) {
+	log.Printf("refresh token reuse detected for user %d, revoking family %s", rt.UserID, rt.FamilyID)
+	if err := a.Storage.RevokeRefreshTokenFamily(rt.FamilyID); err != nil {
+		log.Printf("cannot revoke refresh token family %s: %v", rt.FamilyID, err)
+	}
+}
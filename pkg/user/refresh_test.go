@@ -0,0 +1,129 @@
+package user
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// loginTokens do login as exist@user.com and return access and refresh tokens
+func loginTokens(t *testing.T, a *App) (string, string) {
+	b := new(bytes.Buffer)
+	json.NewEncoder(b).Encode(User{Email: "exist@user.com", Password: "123123"})
+
+	req, _ := http.NewRequest("POST", "/login", b)
+	response := executeRequest(a, req)
+	checkResponseCode(t, 200, response, req)
+
+	var res map[string]interface{}
+	json.Unmarshal(response.Body.Bytes(), &res)
+	token, _ := res["token"].(string)
+	refresh, _ := res["refresh_token"].(string)
+	return token, refresh
+}
+
+func doRefresh(a *App, refresh string) (int, map[string]interface{}) {
+	b := new(bytes.Buffer)
+	json.NewEncoder(b).Encode(map[string]string{"refresh_token": refresh})
+
+	req, _ := http.NewRequest("POST", "/token/refresh", b)
+	response := executeRequest(a, req)
+
+	var res map[string]interface{}
+	json.Unmarshal(response.Body.Bytes(), &res)
+	return response.Code, res
+}
+
+func TestRefreshTokenRotation(t *testing.T) {
+	a := SetUp(t)
+
+	_, first := loginTokens(t, a)
+
+	code, res := doRefresh(a, first)
+	if code != 200 {
+		t.Fatalf("Expected refresh to succeed, got %d: %+v", code, res)
+	}
+
+	second, _ := res["refresh_token"].(string)
+	if second == "" || second == first {
+		t.Fatalf("Expected new refresh token, got: %+v", res)
+	}
+
+	token, _ := res["token"].(string)
+	if c, err := a.Tokens.Parse(token); err != nil || c.Email != "exist@user.com" {
+		t.Errorf("Expected valid access token for exist@user.com, got: %+v, err: %v", c, err)
+	}
+
+	if code, res = doRefresh(a, second); code != 200 {
+		t.Errorf("Expected rotated token to work, got %d: %+v", code, res)
+	}
+}
+
+func TestRefreshTokenReuse(t *testing.T) {
+	a := SetUp(t)
+
+	_, first := loginTokens(t, a)
+	_, other := loginTokens(t, a)
+
+	_, res := doRefresh(a, first)
+	second, _ := res["refresh_token"].(string)
+
+	// replaying first token revoke whole family, including second one
+	if code, res := doRefresh(a, first); code != 401 || res["error"] != "refresh token is revoked" {
+		t.Errorf("Expected reuse to be rejected, got %d: %+v", code, res)
+	}
+
+	if code, res := doRefresh(a, second); code != 401 {
+		t.Errorf("Expected token from revoked family to be rejected, got %d: %+v", code, res)
+	}
+
+	// tokens from other logins are not affected
+	if code, res := doRefresh(a, other); code != 200 {
+		t.Errorf("Expected token from other family to work, got %d: %+v", code, res)
+	}
+}
+
+func TestRefreshTokenInvalid(t *testing.T) {
+	a := SetUp(t)
+
+	_, refresh := loginTokens(t, a)
+	s := a.Storage.(*FakeStorage)
+	s.refreshTokens[hashToken(refresh)].ExpiresAt = time.Now().Add(-time.Minute)
+
+	tests := []struct {
+		name  string
+		token string
+		code  int
+		error string
+	}{
+		{"Empty token", "", 400, "refresh_token cannot be empty"},
+		{"Unknown token", "unknown", 401, "refresh token is invalid"},
+		{"Expired token", refresh, 401, "refresh token is expired"},
+	}
+
+	for _, test := range tests {
+		code, res := doRefresh(a, test.token)
+		if code != test.code || res["error"] != test.error {
+			t.Errorf("%s: expected %d %s, got %d: %+v", test.name, test.code, test.error, code, res)
+		}
+	}
+}
+
+func TestRefreshTokenInSessionMode(t *testing.T) {
+	t.Parallel()
+	c := testConfig()
+	app, err := NewAppWithConfig(&FakeStorage{}, c)
+	if err != nil {
+		t.Fatalf("cannot create app: %v", err)
+	}
+	a := &app
+	_, refresh := loginTokens(t, a)
+
+	a.Config.SessionCookies = true
+	code, res := doRefresh(a, refresh)
+	if code != 200 || res["token"] == nil || res["refresh_token"] == nil {
+		t.Errorf("Expected new token pair in session mode, got %d %v", code, res)
+	}
+}
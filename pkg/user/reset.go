@@ -0,0 +1,127 @@
+package user
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/jackc/pgx"
+	v "github.com/webdeveloppro/validating"
+)
+
+// forgotPassword send password reset link if account exists
+// response is the same for unknown emails, so it can't be used to find accounts
+func (a *App) forgotPassword(w http.ResponseWriter, r *http.Request) {
+	u := User{}
+
+	if r.Body == nil {
+		respondWithJSON(w, r, http.StatusBadRequest, []string{})
+		return
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&u); err != nil {
+		respondWithJSON(w, r, http.StatusBadRequest, []string{})
+		return
+	}
+
+	errs := v.Validate(v.Schema{
+		v.F("email", &u.Email): emailValidator(),
+	})
+
+	if len(errs) > 0 {
+		respondWithJSON(w, r, http.StatusBadRequest, errs.JSONErrors())
+		return
+	}
+
+	u.Tenant = TenantFromContext(r.Context())
+	err := a.Storage.GetUserByEmail(&u)
+	if err == nil {
+		a.sendPasswordReset(&u)
+	} else if err != pgx.ErrNoRows {
+		log.Printf("cannot get user %s for password reset: %v", u.Email, err)
+	}
+
+	respondWithJSON(w, r, http.StatusOK, map[string]string{
+		"status": "if account with such email exists, we sent password reset link to it",
+	})
+}
+
+// sendPasswordReset create reset token and mail link to user
+func (a *App) sendPasswordReset(u *User) {
+	token, err := a.newActionToken(u, PurposePasswordReset, "", a.Config.PasswordResetTTL)
+	if err != nil {
+		log.Printf("cannot create password reset token for user %d: %v", u.ID, err)
+		return
+	}
+
+	err = a.Config.Mailer.Send(Message{
+		To:      u.Email,
+		Subject: "Reset your password",
+		Body: fmt.Sprintf("Somebody requested password reset for your account.\n\n"+
+			"Follow the link to choose new password, it is valid for %s:\n%s\n\n"+
+			"If it was not you, just ignore this email.",
+			a.Config.PasswordResetTTL, actionLink(a.Config.PasswordResetURL, token)),
+	})
+	if err != nil {
+		log.Printf("cannot send password reset to user %d: %v", u.ID, err)
+	}
+}
+
+// resetPassword set new password using token from reset link
+// all user tokens and sessions are revoked after that
+func (a *App) resetPassword(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Token    string `json:"token"`
+		Password string `json:"password"`
+	}
+
+	if r.Body == nil {
+		respondWithJSON(w, r, http.StatusBadRequest, []string{})
+		return
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondWithJSON(w, r, http.StatusBadRequest, []string{})
+		return
+	}
+
+	errs := v.Validate(v.Schema{
+		v.F("token", &req.Token):       v.Nonzero("cannot be empty"),
+		v.F("password", &req.Password): passwordValidator(a.tenant(r).PasswordPolicy),
+	})
+
+	if len(errs) > 0 {
+		respondWithJSON(w, r, http.StatusBadRequest, errs.JSONErrors())
+		return
+	}
+
+	hash, err := a.Passwords.Hash(req.Password)
+	if err != nil {
+		respondWithJSON(w, r, http.StatusBadRequest, v.NewErrors("password", v.ErrInvalid, "cannot be used as password").JSONErrors())
+		return
+	}
+
+	at, err := a.useActionToken(req.Token, PurposePasswordReset)
+	if err != nil {
+		if err != ErrActionTokenInvalid {
+			log.Printf("cannot use password reset token: %v", err)
+		}
+		respondWithJSON(w, r, http.StatusBadRequest, v.NewErrors("token", v.ErrInvalid, "reset link is invalid or expired").JSONErrors())
+		return
+	}
+
+	u := User{ID: at.UserID, Password: hash}
+	if err := a.Storage.UpdatePassword(&u); err != nil {
+		log.Printf("cannot update password for user %d: %v", u.ID, err)
+		respondWithJSON(w, r, http.StatusInternalServerError,
+			v.NewErrors("__error__", v.ErrInvalid, "cannot change password, please try again in few minutes").JSONErrors())
+		return
+	}
+
+	if err := a.Revocations.RevokeUser(&u); err != nil {
+		log.Printf("cannot revoke tokens of user %d after password reset: %v", u.ID, err)
+	}
+
+	respondWithJSON(w, r, http.StatusOK, map[string]string{"status": "ok"})
+}
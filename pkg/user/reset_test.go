@@ -0,0 +1,99 @@
+package user
+
+import (
+	"regexp"
+	"testing"
+	"time"
+)
+
+var tokenInLink = regexp.MustCompile(`token=([A-Za-z0-9_-]+)`)
+
+// mailedToken return token from last link mailed to address
+func mailedToken(t *testing.T, a *App, to string) string {
+	m, ok := a.Config.Mailer.(*MemoryMailer).Last(to)
+	if !ok {
+		t.Fatalf("Expected mail to %s", to)
+	}
+
+	match := tokenInLink.FindStringSubmatch(m.Body)
+	if match == nil {
+		t.Fatalf("Expected link with token in mail, got: %s", m.Body)
+	}
+	return match[1]
+}
+
+func TestForgotPassword(t *testing.T) {
+	a := SetUp(t)
+	mailer := a.Config.Mailer.(*MemoryMailer)
+
+	tests := []struct {
+		name  string
+		email string
+		body  string
+		code  int
+		mails int
+	}{
+		{"Wrong email", "wrong", `{"email":["Wrong email"]}`, 400, 0},
+		{"Unknown email", "new@user.com", `{"status":"if account with such email exists, we sent password reset link to it"}`, 200, 0},
+		{"Existing email", "exist@user.com", `{"status":"if account with such email exists, we sent password reset link to it"}`, 200, 1},
+	}
+
+	for _, test := range tests {
+		code, body := jsonRequest(a, "POST", "/password/forgot", "", "", map[string]string{"email": test.email}, nil)
+		if code != test.code || body != test.body {
+			t.Errorf("%s: expected %d %s, got %d %s", test.name, test.code, test.body, code, body)
+		}
+		if len(mailer.Messages()) != test.mails {
+			t.Errorf("%s: expected %d mails, got: %+v", test.name, test.mails, mailer.Messages())
+		}
+	}
+}
+
+func TestResetPassword(t *testing.T) {
+	a := SetUp(t)
+
+	token, refresh := loginTokens(t, a)
+
+	jsonRequest(a, "POST", "/password/forgot", "", "", map[string]string{"email": "exist@user.com"}, nil)
+	reset := mailedToken(t, a, "exist@user.com")
+
+	if code, body := jsonRequest(a, "POST", "/password/reset", "", "", map[string]string{"token": reset, "password": ""}, nil); code != 400 || body != `{"password":["cannot be empty"]}` {
+		t.Errorf("Expected password validation error, got %d %s", code, body)
+	}
+
+	if code, body := jsonRequest(a, "POST", "/password/reset", "", "", map[string]string{"token": reset, "password": "new password"}, nil); code != 200 {
+		t.Fatalf("Expected password reset to succeed, got %d %s", code, body)
+	}
+
+	if code, body := jsonRequest(a, "POST", "/password/reset", "", "", map[string]string{"token": reset, "password": "other password"}, nil); code != 400 || body != `{"token":["reset link is invalid or expired"]}` {
+		t.Errorf("Expected reset token to be single use, got %d %s", code, body)
+	}
+
+	if code := profileCode(a, token); code != 401 {
+		t.Errorf("Expected old sessions to be revoked, got: %d", code)
+	}
+
+	if code, _ := doRefresh(a, refresh); code != 401 {
+		t.Errorf("Expected old refresh tokens to be revoked, got: %d", code)
+	}
+
+	if code, _ := jsonRequest(a, "POST", "/login", "", "", User{Email: "exist@user.com", Password: "123123"}, nil); code != 400 {
+		t.Errorf("Expected old password to stop working, got: %d", code)
+	}
+
+	if code, body := jsonRequest(a, "POST", "/login", "", "", User{Email: "exist@user.com", Password: "new password"}, nil); code != 200 {
+		t.Errorf("Expected login with new password, got %d %s", code, body)
+	}
+}
+
+func TestResetPasswordExpired(t *testing.T) {
+	a := SetUp(t)
+
+	jsonRequest(a, "POST", "/password/forgot", "", "", map[string]string{"email": "exist@user.com"}, nil)
+	reset := mailedToken(t, a, "exist@user.com")
+	a.Storage.(*FakeStorage).actionTokens[hashToken(reset)].ExpiresAt = time.Now().Add(-time.Minute)
+
+	if code, body := jsonRequest(a, "POST", "/password/reset", "", "", map[string]string{"token": reset, "password": "new password"}, nil); code != 400 {
+		t.Errorf("Expected expired token to be rejected, got %d %s", code, body)
+	}
+}
@@ -0,0 +1,315 @@
+package user
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx"
+)
+
+// revocationCacheSize is number of entries after which we sweep expired ones
+const revocationCacheSize = 10000
+
+// ErrTokenRevoked returned by Tokens.Parse for tokens revoked with logout
+var ErrTokenRevoked = &TokenError{http.StatusUnauthorized, "token is revoked"}
+
+// ErrTokenUnchecked returned when we can't reach storage to check revocation
+var ErrTokenUnchecked = &TokenError{http.StatusServiceUnavailable, "cannot check token, please try again in few minutes"}
+
+type revocationEntry struct {
+	revoked bool
+	version int
+	expires time.Time
+}
+
+// Revocations keep list of revoked tokens
+// Single token is revoked by jti, all user tokens by bumping user token
+// version - tokens carry version in ver claim and older ones are not valid anymore.
+// Session is revoked by its ID, tokens carry it in sid claim.
+// Answers from storage are cached for CacheTTL, so revocation made by this
+// instance is honoured immediately and by other instances after CacheTTL
+type Revocations struct {
+	Storage  Storage
+	CacheTTL time.Duration
+
+	mu       sync.Mutex
+	tokens   map[string]revocationEntry
+	users    map[int]revocationEntry
+	sessions map[int]revocationEntry
+	now      func() time.Time
+}
+
+// NewRevocations return revocation list backed by storage
+func NewRevocations(storage Storage, cacheTTL time.Duration) *Revocations {
+	return &Revocations{
+		Storage:  storage,
+		CacheTTL: cacheTTL,
+		tokens:   map[string]revocationEntry{},
+		users:    map[int]revocationEntry{},
+		sessions: map[int]revocationEntry{},
+		now:      time.Now,
+	}
+}
+
+// IsRevoked tell if token with claims was revoked
+// service tokens have no user, so they can be revoked only by jti
+func (rv *Revocations) IsRevoked(c *Claims) (bool, error) {
+	if !c.Service() {
+		userID, err := strconv.Atoi(c.Subject)
+		if err != nil {
+			return false, ErrTokenMalformed
+		}
+
+		version, err := rv.userTokenVersion(userID)
+		if err != nil {
+			return false, err
+		}
+		if c.Version < version {
+			return true, nil
+		}
+	}
+
+	if c.SessionID != "" {
+		sessionID, err := strconv.Atoi(c.SessionID)
+		if err != nil {
+			return false, ErrTokenMalformed
+		}
+
+		revoked, err := rv.sessionRevoked(sessionID)
+		if err != nil || revoked {
+			return revoked, err
+		}
+	}
+
+	if c.ID == "" {
+		return false, nil
+	}
+
+	return rv.tokenRevoked(c)
+}
+
+// RevokeToken revoke single token by jti
+func (rv *Revocations) RevokeToken(c *Claims) error {
+	userID, _ := strconv.Atoi(c.Subject)
+	if err := rv.Storage.RevokeToken(c.ID, userID, time.Unix(c.ExpiresAt, 0)); err != nil {
+		return err
+	}
+
+	rv.mu.Lock()
+	defer rv.mu.Unlock()
+	rv.tokens[c.ID] = revocationEntry{revoked: true, expires: time.Unix(c.ExpiresAt, 0)}
+	return nil
+}
+
+// RevokeUser revoke all tokens issued to user up to now
+func (rv *Revocations) RevokeUser(u *User) error {
+	if err := rv.Storage.RevokeUserTokens(u); err != nil {
+		return err
+	}
+
+	rv.mu.Lock()
+	defer rv.mu.Unlock()
+	rv.users[u.ID] = revocationEntry{version: u.TokenVersion, expires: rv.now().Add(rv.CacheTTL)}
+	return nil
+}
+
+// RevokeSession revoke session and all tokens issued for it
+func (rv *Revocations) RevokeSession(s *Session) error {
+	if err := rv.Storage.RevokeSession(s); err != nil {
+		return err
+	}
+
+	rv.mu.Lock()
+	defer rv.mu.Unlock()
+	rv.sessions[s.ID] = revocationEntry{revoked: true, expires: s.ExpiresAt}
+	return nil
+}
+
+// sessionRevoked look for session in cache, then in storage,
+// session which does not exist anymore is revoked
+func (rv *Revocations) sessionRevoked(sessionID int) (bool, error) {
+	now := rv.now()
+
+	rv.mu.Lock()
+	e, ok := rv.sessions[sessionID]
+	rv.mu.Unlock()
+	if ok && now.Before(e.expires) {
+		return e.revoked, nil
+	}
+
+	s := Session{ID: sessionID}
+	err := rv.Storage.GetSessionByID(&s)
+	if err != nil && err != pgx.ErrNoRows {
+		log.Printf("cannot check session %d revocation: %v", sessionID, err)
+		return false, ErrTokenUnchecked
+	}
+
+	// revoked session stay revoked until it expire
+	e = revocationEntry{revoked: err != nil || s.RevokedAt != nil, expires: now.Add(rv.CacheTTL)}
+	if e.revoked && s.ExpiresAt.After(e.expires) {
+		e.expires = s.ExpiresAt
+	}
+
+	rv.mu.Lock()
+	defer rv.mu.Unlock()
+	if len(rv.sessions) >= revocationCacheSize {
+		for k, v := range rv.sessions {
+			if !now.Before(v.expires) {
+				delete(rv.sessions, k)
+			}
+		}
+	}
+	rv.sessions[sessionID] = e
+	return e.revoked, nil
+}
+
+// tokenRevoked look for jti in cache, then in storage
+func (rv *Revocations) tokenRevoked(c *Claims) (bool, error) {
+	now := rv.now()
+
+	rv.mu.Lock()
+	e, ok := rv.tokens[c.ID]
+	rv.mu.Unlock()
+	if ok && now.Before(e.expires) {
+		return e.revoked, nil
+	}
+
+	revoked, err := rv.Storage.IsTokenRevoked(c.ID)
+	if err != nil {
+		log.Printf("cannot check token %s revocation: %v", c.ID, err)
+		return false, ErrTokenUnchecked
+	}
+
+	// revoked token stay revoked until it expire
+	e = revocationEntry{revoked: revoked, expires: now.Add(rv.CacheTTL)}
+	if revoked {
+		e.expires = time.Unix(c.ExpiresAt, 0)
+	}
+
+	rv.mu.Lock()
+	defer rv.mu.Unlock()
+	if len(rv.tokens) >= revocationCacheSize {
+		for k, v := range rv.tokens {
+			if !now.Before(v.expires) {
+				delete(rv.tokens, k)
+			}
+		}
+	}
+	rv.tokens[c.ID] = e
+	return revoked, nil
+}
+
+// userTokenVersion return current token version of user
+func (rv *Revocations) userTokenVersion(userID int) (int, error) {
+	now := rv.now()
+
+	rv.mu.Lock()
+	e, ok := rv.users[userID]
+	rv.mu.Unlock()
+	if ok && now.Before(e.expires) {
+		return e.version, nil
+	}
+
+	u := User{ID: userID}
+	if err := rv.Storage.GetTokenVersion(&u); err != nil {
+		log.Printf("cannot check user %d token version: %v", userID, err)
+		return 0, ErrTokenUnchecked
+	}
+
+	e = revocationEntry{version: u.TokenVersion, expires: now.Add(rv.CacheTTL)}
+
+	rv.mu.Lock()
+	defer rv.mu.Unlock()
+	if len(rv.users) >= revocationCacheSize {
+		for k, v := range rv.users {
+			if !now.Before(v.expires) {
+				delete(rv.users, k)
+			}
+		}
+	}
+	rv.users[userID] = e
+	return e.version, nil
+}
+
+// logout revoke token from Authorization header
+// and refresh token family if refresh_token is provided in body
+func (a *App) logout(w http.ResponseWriter, r *http.Request) {
+	u, _ := UserFromContext(r.Context())
+	c, _ := ClaimsFromContext(r.Context())
+
+	if s, ok := SessionFromContext(r.Context()); ok {
+		if err := a.endSession(w, s); err != nil {
+			log.Printf("cannot revoke session %d: %v", s.ID, err)
+			respondWithError(w, r, http.StatusInternalServerError, "cannot logout, please try again in few minutes")
+			return
+		}
+		respondWithJSON(w, r, http.StatusOK, map[string]string{"status": "ok"})
+		return
+	}
+
+	// API keys have no jti, they are revoked with DELETE /api-keys/{id}
+	if len(c.AMR) == 1 && c.AMR[0] == AMRAPIKey {
+		respondWithError(w, r, http.StatusBadRequest, "api key cannot logout, revoke the key instead")
+		return
+	}
+
+	if c.ID != "" {
+		if err := a.Revocations.RevokeToken(c); err != nil {
+			log.Printf("cannot revoke token %s: %v", c.ID, err)
+			respondWithError(w, r, http.StatusInternalServerError, "cannot logout, please try again in few minutes")
+			return
+		}
+	}
+
+	// login session end with its token
+	if u.SessionID != 0 {
+		s := Session{ID: u.SessionID}
+		if err := a.Storage.GetSessionByID(&s); err == nil && s.UserID == u.ID {
+			if err := a.Revocations.RevokeSession(&s); err != nil && err != pgx.ErrNoRows {
+				log.Printf("cannot revoke session %d: %v", s.ID, err)
+			}
+		}
+	}
+
+	var req struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	if r.Body != nil {
+		json.NewDecoder(r.Body).Decode(&req)
+	}
+
+	if req.RefreshToken != "" {
+		rt := RefreshToken{TokenHash: hashToken(req.RefreshToken)}
+		if err := a.Storage.GetRefreshToken(&rt); err == nil && rt.UserID == u.ID {
+			if err := a.Storage.RevokeRefreshTokenFamily(rt.FamilyID); err != nil {
+				log.Printf("cannot revoke refresh token family %s: %v", rt.FamilyID, err)
+			}
+		}
+	}
+
+	respondWithJSON(w, r, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// logoutAll revoke all tokens and refresh tokens of user
+func (a *App) logoutAll(w http.ResponseWriter, r *http.Request) {
+	u, _ := UserFromContext(r.Context())
+
+	if err := a.Revocations.RevokeUser(u); err != nil {
+		log.Printf("cannot revoke tokens of user %d: %v", u.ID, err)
+		respondWithError(w, r, http.StatusInternalServerError, "cannot logout, please try again in few minutes")
+		return
+	}
+
+	// other sessions end because token version changed, this one remove cookies too
+	if s, ok := SessionFromContext(r.Context()); ok {
+		if err := a.endSession(w, s); err != nil {
+			log.Printf("cannot revoke session %d: %v", s.ID, err)
+		}
+	}
+
+	respondWithJSON(w, r, http.StatusOK, map[string]string{"status": "ok"})
+}
@@ -0,0 +1,102 @@
+package user
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func profileCode(a *App, token string) int {
+	req, _ := http.NewRequest("GET", "/profile", nil)
+	req.Header.Set("Authorization", token)
+	return executeRequest(a, req).Code
+}
+
+func TestLogout(t *testing.T) {
+	a := SetUp(t)
+
+	token, refresh := loginTokens(t, a)
+	other, otherRefresh := loginTokens(t, a)
+
+	if code, body := jsonRequest(a, "POST", "/logout", "", token, map[string]string{"refresh_token": refresh}, nil); code != 200 {
+		t.Fatalf("Expected logout to succeed, got %d: %s", code, body)
+	}
+
+	if code := profileCode(a, token); code != 401 {
+		t.Errorf("Expected revoked token to be rejected, got: %d", code)
+	}
+
+	if code, _ := doRefresh(a, refresh); code != 401 {
+		t.Errorf("Expected refresh token to be revoked with logout, got: %d", code)
+	}
+
+	if code := profileCode(a, other); code != 200 {
+		t.Errorf("Expected other session to stay valid, got: %d", code)
+	}
+
+	if code, _ := doRefresh(a, otherRefresh); code != 200 {
+		t.Errorf("Expected other refresh token to stay valid, got: %d", code)
+	}
+
+	if code, body := jsonRequest(a, "POST", "/logout", "", token, nil, nil); code != 401 || body != `{"error":"token is revoked"}` {
+		t.Errorf("Expected second logout with same token to fail, got %d: %s", code, body)
+	}
+}
+
+func TestLogoutAll(t *testing.T) {
+	a := SetUp(t)
+
+	token, refresh := loginTokens(t, a)
+	other, _ := loginTokens(t, a)
+
+	if code, body := jsonRequest(a, "POST", "/logout/all", "", token, nil, nil); code != 200 {
+		t.Fatalf("Expected logout to succeed, got %d: %s", code, body)
+	}
+
+	for _, tok := range []string{token, other} {
+		if code := profileCode(a, tok); code != 401 {
+			t.Errorf("Expected all tokens to be revoked, got: %d", code)
+		}
+	}
+
+	if code, _ := doRefresh(a, refresh); code != 401 {
+		t.Errorf("Expected refresh tokens to be revoked, got: %d", code)
+	}
+
+	token, _ = loginTokens(t, a)
+	if code := profileCode(a, token); code != 200 {
+		t.Errorf("Expected new login to work after logout from all devices, got: %d", code)
+	}
+}
+
+func TestRevocationsCache(t *testing.T) {
+	s := &FakeStorage{}
+	now := time.Unix(1500000000, 0)
+
+	rv := NewRevocations(s, 30*time.Second)
+	rv.now = func() time.Time { return now }
+
+	c := &Claims{Subject: "1", ID: "jti", ExpiresAt: now.Add(time.Hour).Unix()}
+	if revoked, err := rv.IsRevoked(c); revoked || err != nil {
+		t.Fatalf("Expected token to be valid, got revoked: %t, err: %v", revoked, err)
+	}
+
+	// revoked by other instance, we don't know about it until cache expire
+	s.RevokeToken("jti", 1, now.Add(time.Hour))
+	if revoked, _ := rv.IsRevoked(c); revoked {
+		t.Errorf("Expected cached answer to be used")
+	}
+
+	now = now.Add(31 * time.Second)
+	if revoked, _ := rv.IsRevoked(c); !revoked {
+		t.Errorf("Expected token to be revoked after cache expire")
+	}
+
+	// revoked by this instance is seen immediately
+	c2 := &Claims{Subject: "1", ID: "jti2", ExpiresAt: now.Add(time.Hour).Unix()}
+	rv.IsRevoked(c2)
+	rv.RevokeToken(c2)
+	if revoked, _ := rv.IsRevoked(c2); !revoked {
+		t.Errorf("Expected token revoked by this instance to be seen immediately")
+	}
+}
@@ -0,0 +1,210 @@
+package user
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx"
+)
+
+// ServiceClient is machine identity of backend job or service, it get tokens
+// with client_credentials grant. Only hash of secret is stored
+type ServiceClient struct {
+	ID         string
+	SecretHash string
+	Name       string
+	// Scopes are scopes client is allowed to ask for
+	Scopes    []string
+	CreatedAt time.Time
+}
+
+// allowed tell if every scope in space separated list is allowed for client
+func (c *ServiceClient) allowed(scope string) bool {
+	allowed := strings.Join(c.Scopes, " ")
+	for _, s := range strings.Fields(scope) {
+		if !hasScope(allowed, s) {
+			return false
+		}
+	}
+	return true
+}
+
+// RegisterServiceClient store new service client and return its secret,
+// secret is shown only once, we keep just its hash
+func (a *App) RegisterServiceClient(c *ServiceClient) (string, error) {
+	if c.Name == "" {
+		return "", fmt.Errorf("user: service client name cannot be empty")
+	}
+	for _, s := range c.Scopes {
+		if s == "" || strings.ContainsAny(s, " \t\n\"\\") {
+			return "", fmt.Errorf("user: scope %q should not contain spaces or quotes", s)
+		}
+	}
+
+	var err error
+	if c.ID, err = randomString(16); err != nil {
+		return "", err
+	}
+
+	secret, err := randomString(32)
+	if err != nil {
+		return "", err
+	}
+	c.SecretHash = hashToken(secret)
+
+	return secret, a.Storage.CreateServiceClient(c)
+}
+
+// authenticateServiceClient check service client credentials from basic auth or form
+func (a *App) authenticateServiceClient(r *http.Request) (*ServiceClient, error) {
+	id, secret, err := clientCredentials(r)
+	if err != nil {
+		return nil, err
+	}
+
+	c := ServiceClient{ID: id}
+	if err := a.Storage.GetServiceClient(&c); err != nil {
+		if err == pgx.ErrNoRows {
+			return nil, oauthError("invalid_client", "client authentication failed")
+		}
+		return nil, err
+	}
+
+	if subtle.ConstantTimeCompare([]byte(hashToken(secret)), []byte(c.SecretHash)) != 1 {
+		return nil, oauthError("invalid_client", "client authentication failed")
+	}
+	return &c, nil
+}
+
+// clientCredentialsGrant issue token to service client, see RFC 6749 section 4.4
+// client get all allowed scopes when scope is not requested
+func (a *App) clientCredentialsGrant(w http.ResponseWriter, r *http.Request) {
+	c, err := a.authenticateServiceClient(r)
+	if err != nil {
+		respondWithOAuthError(w, r, err)
+		return
+	}
+
+	scope := strings.Join(strings.Fields(r.PostForm.Get("scope")), " ")
+	if scope == "" {
+		scope = strings.Join(c.Scopes, " ")
+	}
+	if !c.allowed(scope) {
+		respondWithOAuthError(w, r, oauthError("invalid_scope", "scope is not allowed for client"))
+		return
+	}
+
+	// token is signed with keys of tenant, so introspect on the same tenant can parse it
+	t := a.tenant(r)
+	claims, err := t.tokens.NewClaims(c.ID)
+	if err != nil {
+		respondWithOAuthError(w, r, err)
+		return
+	}
+	claims.ClientID = c.ID
+	claims.Scope = scope
+	claims.Tenant = t.ID
+
+	token, err := t.tokens.Sign(claims)
+	if err != nil {
+		respondWithOAuthError(w, r, err)
+		return
+	}
+
+	respondWithJSON(w, r, http.StatusOK, map[string]interface{}{
+		"access_token": token,
+		"token_type":   "Bearer",
+		"expires_in":   int(t.tokens.TTL / time.Second),
+		"scope":        scope,
+	})
+}
+
+// introspect tell service client if token or API key is active, see RFC 7662
+// tokens of deleted users and service clients are not active
+func (a *App) introspect(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+
+	if err := r.ParseForm(); err != nil {
+		respondWithOAuthError(w, r, oauthError("invalid_request", "body should be form encoded"))
+		return
+	}
+
+	if _, err := a.authenticateServiceClient(r); err != nil {
+		respondWithOAuthError(w, r, err)
+		return
+	}
+
+	inactive := map[string]bool{"active": false}
+
+	token := r.PostForm.Get("token")
+	tokenType := "Bearer"
+	var c *Claims
+	var err error
+	if strings.HasPrefix(token, apiKeyPrefix) {
+		tokenType = "ApiKey"
+		var k *APIKey
+		if k, err = a.parseAPIKey(token); err == nil {
+			c = apiKeyClaims(&User{ID: k.UserID}, k)
+		}
+	} else {
+		c, err = a.tenant(r).tokens.Parse(token)
+	}
+	if err != nil {
+		if tokenErrorStatus(err) == http.StatusServiceUnavailable {
+			respondWithOAuthError(w, r, err)
+			return
+		}
+		respondWithJSON(w, r, http.StatusOK, inactive)
+		return
+	}
+
+	res := map[string]interface{}{
+		"active":     true,
+		"token_type": tokenType,
+		"sub":        c.Subject,
+		"iat":        c.IssuedAt,
+	}
+	optional := map[string]interface{}{"iss": c.Issuer, "exp": c.ExpiresAt, "nbf": c.NotBefore, "jti": c.ID}
+	for k, v := range optional {
+		if v != "" && v != int64(0) {
+			res[k] = v
+		}
+	}
+	if len(c.Audience) > 0 {
+		res["aud"] = c.Audience
+	}
+	if c.Scope != "" {
+		res["scope"] = c.Scope
+	}
+	if c.ClientID != "" {
+		res["client_id"] = c.ClientID
+	}
+
+	// subject of user token is checked by Parse already
+	if c.Service() {
+		err = a.Storage.GetServiceClient(&ServiceClient{ID: c.ClientID})
+	} else {
+		u := User{}
+		u.ID, _ = strconv.Atoi(c.Subject)
+		err = a.Storage.GetUserByID(&u)
+		res["username"] = u.Email
+		if err == nil && u.DisabledAt != nil {
+			err = pgx.ErrNoRows
+		}
+	}
+
+	if err == pgx.ErrNoRows {
+		respondWithJSON(w, r, http.StatusOK, inactive)
+		return
+	}
+	if err != nil {
+		respondWithOAuthError(w, r, err)
+		return
+	}
+
+	respondWithJSON(w, r, http.StatusOK, res)
+}
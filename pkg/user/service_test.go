@@ -0,0 +1,93 @@
+package user
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func setUpService(t *testing.T) (*App, *ServiceClient, string) {
+	a := SetUp(t)
+
+	c := &ServiceClient{Name: "billing worker", Scopes: []string{"users:read", "users:write"}}
+	secret, err := a.RegisterServiceClient(c)
+	if err != nil {
+		t.Fatalf("cannot register service client: %v", err)
+	}
+	return a, c, secret
+}
+
+func serviceToken(t *testing.T, a *App, c *ServiceClient, secret string) string {
+	code, res := postToken(a, c.ID, secret, url.Values{"grant_type": {"client_credentials"}, "scope": {"users:read"}})
+	token, _ := res["access_token"].(string)
+	if code != 200 || token == "" {
+		t.Fatalf("Expected service token, got %d %v", code, res)
+	}
+	return token
+}
+
+func postIntrospect(a *App, id, secret, token string) (int, map[string]interface{}) {
+	return postForm(a, "/oauth/introspect", id, secret, url.Values{"token": {token}})
+}
+
+func TestClientCredentials(t *testing.T) {
+	a, c, secret := setUpService(t)
+
+	code, res := postForm(a, "/oauth/token", c.ID, secret, url.Values{"grant_type": {"client_credentials"}})
+	if code != 200 || res["scope"] != "users:read users:write" {
+		t.Fatalf("Expected token with all allowed scopes, got %d %v", code, res)
+	}
+
+	claims, err := a.Tokens.Parse(res["access_token"].(string))
+	if err != nil || claims.ClientID != c.ID || claims.Subject != c.ID || !claims.Service() {
+		t.Errorf("Expected service claims, got %+v, %v", claims, err)
+	}
+
+	tests := []struct {
+		name   string
+		secret string
+		scope  string
+		code   int
+		error  string
+	}{
+		{"Wrong secret", "wrong", "", 401, "invalid_client"},
+		{"Not allowed scope", secret, "users:read admin", 400, "invalid_scope"},
+	}
+
+	for _, test := range tests {
+		form := url.Values{"grant_type": {"client_credentials"}, "scope": {test.scope}}
+		if code, res := postForm(a, "/oauth/token", c.ID, test.secret, form); code != test.code || res["error"] != test.error {
+			t.Errorf("%s: expected %d %s, got %d %v", test.name, test.code, test.error, code, res)
+		}
+	}
+
+	// service token is not user token
+	req, _ := http.NewRequest("GET", "/profile", nil)
+	req.Header.Set("Authorization", "Bearer "+serviceToken(t, a, c, secret))
+	if response := executeRequest(a, req); response.Code != 403 {
+		t.Errorf("Expected service token to be refused by user endpoint, got %d", response.Code)
+	}
+}
+
+func TestIntrospect(t *testing.T) {
+	a, c, secret := setUpService(t)
+	userToken, _ := loginTokens(t, a)
+
+	code, res := postIntrospect(a, c.ID, secret, serviceToken(t, a, c, secret))
+	if code != 200 || res["active"] != true || res["client_id"] != c.ID || res["scope"] != "users:read" {
+		t.Errorf("Expected active service token, got %d %v", code, res)
+	}
+
+	code, res = postIntrospect(a, c.ID, secret, userToken)
+	if code != 200 || res["active"] != true || res["username"] != "exist@user.com" || res["sub"] != "1" {
+		t.Errorf("Expected active user token, got %d %v", code, res)
+	}
+
+	if code, res = postIntrospect(a, c.ID, secret, "garbage"); code != 200 || len(res) != 1 || res["active"] != false {
+		t.Errorf("Expected inactive token, got %d %v", code, res)
+	}
+
+	if code, res = postIntrospect(a, "", "", userToken); code != 401 || res["error"] != "invalid_client" {
+		t.Errorf("Expected introspection to require client authentication, got %d %v", code, res)
+	}
+}
@@ -0,0 +1,269 @@
+package user
+
+import (
+	"context"
+	"crypto/subtle"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/jackc/pgx"
+	v "github.com/webdeveloppro/validating"
+)
+
+// Cookies of session mode, CSRF cookie is readable by javascript
+// so SPA can copy it to X-CSRF-Token header
+const (
+	SessionCookie = "session"
+	CSRFCookie    = "csrf_token"
+	CSRFHeader    = "X-CSRF-Token"
+)
+
+// Errors of cookie sessions, Authenticate respond with them like with token errors
+var (
+	ErrSessionInvalid = &TokenError{http.StatusUnauthorized, "session is invalid or expired"}
+	ErrCSRF           = &TokenError{http.StatusForbidden, "csrf token is missing or invalid"}
+)
+
+// Session is login of user on some device. In session mode it is kept in HttpOnly cookie
+// and only hashes of session and CSRF tokens are stored, token logins have session
+// without hashes and their tokens carry its ID in sid claim.
+// Session is valid until TokenVersion of user change or it is revoked
+type Session struct {
+	ID           int        `json:"id"`
+	UserID       int        `json:"-"`
+	TokenHash    string     `json:"-"`
+	CSRFHash     string     `json:"-"`
+	TokenVersion int        `json:"-"`
+	AMR          []string   `json:"-"`
+	UserAgent    string     `json:"user_agent"`
+	IP           string     `json:"ip"`
+	CreatedAt    time.Time  `json:"created_at"`
+	LastSeenAt   time.Time  `json:"last_seen_at"`
+	ExpiresAt    time.Time  `json:"expires_at"`
+	RevokedAt    *time.Time `json:"-"`
+}
+
+// SessionFromContext return session which authenticated request,
+// it is not set for requests with token or API key
+func SessionFromContext(ctx context.Context) (*Session, bool) {
+	s, ok := ctx.Value(sessionContextKey).(*Session)
+	return s, ok
+}
+
+// setSessionCookies send session and CSRF cookies, empty values remove them
+func (a *App) setSessionCookies(w http.ResponseWriter, token, csrf string, expires time.Time) {
+	maxAge := int(time.Until(expires) / time.Second)
+	if token == "" {
+		maxAge = -1
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     SessionCookie,
+		Value:    token,
+		Path:     "/",
+		Domain:   a.Config.SessionCookieDomain,
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   a.Config.SessionCookieSecure,
+		SameSite: a.Config.SessionSameSite,
+	})
+	http.SetCookie(w, &http.Cookie{
+		Name:     CSRFCookie,
+		Value:    csrf,
+		Path:     "/",
+		Domain:   a.Config.SessionCookieDomain,
+		MaxAge:   maxAge,
+		Secure:   a.Config.SessionCookieSecure,
+		SameSite: a.Config.SessionSameSite,
+	})
+}
+
+// createSession fill session with user and device of request and store it,
+// user get ID of new session
+func (a *App) createSession(r *http.Request, u *User, s *Session, ttl time.Duration) error {
+	s.UserID = u.ID
+	s.TokenVersion = u.TokenVersion
+	s.AMR = u.AMR
+	s.UserAgent = truncate(r.UserAgent(), 255)
+	s.IP = remoteIP(r)
+	s.ExpiresAt = time.Now().Add(ttl)
+	if err := a.Storage.CreateSession(s); err != nil {
+		return err
+	}
+
+	u.SessionID = s.ID
+	return nil
+}
+
+// newSession create and store session for user, it return session and CSRF tokens
+func (a *App) newSession(r *http.Request, u *User) (*Session, string, string, error) {
+	token, err := randomString(32)
+	if err != nil {
+		return nil, "", "", err
+	}
+	csrf, err := randomString(32)
+	if err != nil {
+		return nil, "", "", err
+	}
+
+	s := Session{
+		TokenHash: hashToken(token),
+		CSRFHash:  hashToken(csrf),
+	}
+	if err := a.createSession(r, u, &s, a.Config.SessionTTL); err != nil {
+		return nil, "", "", err
+	}
+	return &s, token, csrf, nil
+}
+
+// respondWithSession login user with session cookies instead of tokens, it is used by
+// respondWithTokens in session mode. Request which already has session keep it
+func (a *App) respondWithSession(w http.ResponseWriter, r *http.Request, code int, u *User) {
+	if u.DisabledAt != nil {
+		respondWithJSON(w, r, http.StatusForbidden, v.NewErrors("__error__", v.ErrInvalid, "account is disabled").JSONErrors())
+		return
+	}
+	if u.PasswordResetAt != nil {
+		respondWithJSON(w, r, http.StatusForbidden, v.NewErrors("__error__", v.ErrInvalid, passwordResetRequired).JSONErrors())
+		return
+	}
+
+	if s, ok := SessionFromContext(r.Context()); ok && s.UserID == u.ID {
+		respondWithJSON(w, r, code, map[string]string{"status": "ok"})
+		return
+	}
+
+	s, token, csrf, err := a.newSession(r, u)
+	if err != nil {
+		log.Printf("cannot create session for user %d: %v", u.ID, err)
+		respondWithJSON(w, r, http.StatusInternalServerError,
+			v.NewErrors("__error__", v.ErrInvalid, "cannot create session, please try again in few minutes").JSONErrors())
+		return
+	}
+
+	a.setSessionCookies(w, token, csrf, s.ExpiresAt)
+	respondWithJSON(w, r, code, map[string]interface{}{
+		"status":     "ok",
+		"csrf_token": csrf,
+		"expires_in": int(a.Config.SessionTTL / time.Second),
+	})
+}
+
+// csrfSafe tell if method can't change anything, such requests do not need CSRF token
+func csrfSafe(method string) bool {
+	return method == "GET" || method == "HEAD" || method == "OPTIONS"
+}
+
+// sessionFromRequest load session from cookie, check CSRF token for unsafe methods
+// and extend session and its cookies when it was not used for a while
+func (a *App) sessionFromRequest(w http.ResponseWriter, r *http.Request) (*Session, error) {
+	cookie, err := r.Cookie(SessionCookie)
+	if err != nil || cookie.Value == "" {
+		return nil, ErrSessionInvalid
+	}
+
+	s := Session{TokenHash: hashToken(cookie.Value)}
+	if err := a.Storage.GetSession(&s); err != nil {
+		if err == pgx.ErrNoRows {
+			return nil, ErrSessionInvalid
+		}
+		log.Printf("cannot load session: %v", err)
+		return nil, ErrTokenUnchecked
+	}
+
+	now := time.Now()
+	if s.RevokedAt != nil || now.After(s.ExpiresAt) || s.TokenHash == "" {
+		return nil, ErrSessionInvalid
+	}
+
+	// double submit, header should match cookie and both should belong to session
+	if !csrfSafe(r.Method) {
+		header := r.Header.Get(CSRFHeader)
+		csrf, err := r.Cookie(CSRFCookie)
+		if header == "" || err != nil || subtle.ConstantTimeCompare([]byte(header), []byte(csrf.Value)) != 1 ||
+			subtle.ConstantTimeCompare([]byte(hashToken(header)), []byte(s.CSRFHash)) != 1 {
+			return nil, ErrCSRF
+		}
+	}
+
+	// sliding expiry, session is written at most once a minute
+	if now.Sub(s.LastSeenAt) > time.Minute {
+		s.LastSeenAt = now
+		s.ExpiresAt = now.Add(a.Config.SessionTTL)
+		if err := a.Storage.TouchSession(&s); err != nil {
+			log.Printf("cannot extend session %d: %v", s.ID, err)
+		} else if csrf, err := r.Cookie(CSRFCookie); err == nil {
+			a.setSessionCookies(w, cookie.Value, csrf.Value, s.ExpiresAt)
+		}
+	}
+
+	return &s, nil
+}
+
+// endSession revoke session of request and remove its cookies
+func (a *App) endSession(w http.ResponseWriter, s *Session) error {
+	if err := a.Revocations.RevokeSession(s); err != nil && err != pgx.ErrNoRows {
+		return err
+	}
+	a.setSessionCookies(w, "", "", time.Time{})
+	return nil
+}
+
+// listSessions return active sessions of user, session of request is marked as current
+func (a *App) listSessions(w http.ResponseWriter, r *http.Request) {
+	u, _ := UserFromContext(r.Context())
+
+	sessions, err := a.Storage.GetSessions(u.ID)
+	if err != nil {
+		log.Printf("cannot load sessions of user %d: %v", u.ID, err)
+		respondWithJSON(w, r, http.StatusInternalServerError,
+			v.NewErrors("__error__", v.ErrInvalid, "cannot load sessions, please try again in few minutes").JSONErrors())
+		return
+	}
+
+	type session struct {
+		Session
+		Current bool `json:"current"`
+	}
+	list := make([]session, 0, len(sessions))
+	for _, s := range sessions {
+		list = append(list, session{s, s.ID == u.SessionID})
+	}
+	respondWithJSON(w, r, http.StatusOK, list)
+}
+
+// deleteSession sign out user on other device, tokens of session stop working
+func (a *App) deleteSession(w http.ResponseWriter, r *http.Request) {
+	u, _ := UserFromContext(r.Context())
+
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		respondWithError(w, r, http.StatusNotFound, "session not found")
+		return
+	}
+
+	s := Session{ID: id}
+	if err := a.Storage.GetSessionByID(&s); err != nil || s.UserID != u.ID || s.RevokedAt != nil {
+		if err != nil && err != pgx.ErrNoRows {
+			log.Printf("cannot load session %d: %v", id, err)
+			respondWithError(w, r, http.StatusInternalServerError, "cannot load session, please try again in few minutes")
+			return
+		}
+		respondWithError(w, r, http.StatusNotFound, "session not found")
+		return
+	}
+
+	if err := a.Revocations.RevokeSession(&s); err != nil && err != pgx.ErrNoRows {
+		log.Printf("cannot revoke session %d: %v", s.ID, err)
+		respondWithError(w, r, http.StatusInternalServerError, "cannot sign out session, please try again in few minutes")
+		return
+	}
+
+	if current, ok := SessionFromContext(r.Context()); ok && current.ID == s.ID {
+		a.setSessionCookies(w, "", "", time.Time{})
+	}
+	respondWithJSON(w, r, http.StatusOK, map[string]string{"status": "ok"})
+}
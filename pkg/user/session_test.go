@@ -0,0 +1,245 @@
+package user
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+// sessionLogin do login in session mode and return session cookies and CSRF token
+func sessionLogin(t *testing.T) (*App, []*http.Cookie, string) {
+	t.Parallel()
+	c := testConfig()
+	c.SessionCookies = true
+	app, err := NewAppWithConfig(&FakeStorage{}, c)
+	if err != nil {
+		t.Fatalf("cannot create app: %v", err)
+	}
+	a := &app
+
+	response := sessionRequest(a, "POST", "/login", nil, "", map[string]string{"email": "exist@user.com", "password": "123123"})
+	if response.Code != 200 {
+		t.Fatalf("Expected login to succeed, got %d %s", response.Code, response.Body.String())
+	}
+
+	var res map[string]interface{}
+	json.Unmarshal(response.Body.Bytes(), &res)
+	if res["token"] != nil || res["csrf_token"] == nil {
+		t.Fatalf("Expected CSRF token instead of access token, got %v", res)
+	}
+	return a, response.Result().Cookies(), res["csrf_token"].(string)
+}
+
+// sessionRequest send request with cookies and CSRF header when it is not empty
+func sessionRequest(a *App, method, url string, cookies []*http.Cookie, csrf string, data interface{}) *httptest.ResponseRecorder {
+	b := new(bytes.Buffer)
+	if data != nil {
+		json.NewEncoder(b).Encode(data)
+	}
+
+	req, _ := http.NewRequest(method, url, b)
+	for _, c := range cookies {
+		req.AddCookie(c)
+	}
+	if csrf != "" {
+		req.Header.Set(CSRFHeader, csrf)
+	}
+	return executeRequest(a, req)
+}
+
+func TestSessionCookies(t *testing.T) {
+	_, cookies, csrf := sessionLogin(t)
+
+	byName := map[string]*http.Cookie{}
+	for _, c := range cookies {
+		byName[c.Name] = c
+	}
+
+	s, ok := byName[SessionCookie]
+	if !ok || !s.HttpOnly || !s.Secure || s.SameSite != http.SameSiteLaxMode || s.MaxAge <= 0 {
+		t.Errorf("Expected HttpOnly Secure SameSite session cookie, got %+v", s)
+	}
+	c, ok := byName[CSRFCookie]
+	if !ok || c.HttpOnly || c.Value != csrf {
+		t.Errorf("Expected CSRF cookie readable by javascript, got %+v", c)
+	}
+}
+
+func TestSessionCSRF(t *testing.T) {
+	a, cookies, csrf := sessionLogin(t)
+	profile := map[string]string{"first_name": "Session"}
+
+	tests := []struct {
+		name   string
+		method string
+		csrf   string
+		code   int
+	}{
+		{"Safe method", "GET", "", 200},
+		{"Missing header", "PATCH", "", 403},
+		{"Wrong header", "PATCH", "wrong", 403},
+		{"Valid header", "PATCH", csrf, 200},
+	}
+
+	for _, test := range tests {
+		if response := sessionRequest(a, test.method, "/profile", cookies, test.csrf, profile); response.Code != test.code {
+			t.Errorf("%s: expected %d, got %d %s", test.name, test.code, response.Code, response.Body.String())
+		}
+	}
+
+	// cookie from other session can't be paired with header
+	other := sessionRequest(a, "POST", "/login", nil, "", map[string]string{"email": "exist@user.com", "password": "123123"})
+	for _, c := range other.Result().Cookies() {
+		if c.Name == CSRFCookie {
+			cookies = []*http.Cookie{cookies[0], c}
+		}
+	}
+	if response := sessionRequest(a, "PATCH", "/profile", cookies, cookies[1].Value, profile); response.Code != 403 {
+		t.Errorf("Expected CSRF token of other session to be refused, got %d", response.Code)
+	}
+}
+
+func TestSessionSlidingExpiry(t *testing.T) {
+	a, cookies, _ := sessionLogin(t)
+	stored := a.Storage.(*FakeStorage).sessions[0]
+
+	stored.LastSeenAt = time.Now().Add(-time.Hour)
+	stored.ExpiresAt = time.Now().Add(time.Hour)
+	response := sessionRequest(a, "GET", "/profile", cookies, "", nil)
+	if response.Code != 200 {
+		t.Fatalf("Expected session to be valid, got %d", response.Code)
+	}
+	if stored.ExpiresAt.Before(time.Now().Add(23 * time.Hour)) {
+		t.Errorf("Expected session to be extended, expires at %v", stored.ExpiresAt)
+	}
+	if len(response.Result().Cookies()) != 2 {
+		t.Errorf("Expected cookies to be sent again, got %v", response.Result().Cookies())
+	}
+
+	stored.ExpiresAt = time.Now().Add(-time.Second)
+	if response := sessionRequest(a, "GET", "/profile", cookies, "", nil); response.Code != 401 {
+		t.Errorf("Expected expired session to be refused, got %d", response.Code)
+	}
+}
+
+func TestSessionLogout(t *testing.T) {
+	a, cookies, csrf := sessionLogin(t)
+
+	response := sessionRequest(a, "POST", "/logout", cookies, csrf, nil)
+	if response.Code != 200 {
+		t.Fatalf("Expected logout to succeed, got %d", response.Code)
+	}
+	for _, c := range response.Result().Cookies() {
+		if c.MaxAge >= 0 {
+			t.Errorf("Expected cookie %s to be removed, got %+v", c.Name, c)
+		}
+	}
+	if response := sessionRequest(a, "GET", "/profile", cookies, "", nil); response.Code != 401 {
+		t.Errorf("Expected revoked session to be refused, got %d", response.Code)
+	}
+}
+
+func TestSessionLogoutAll(t *testing.T) {
+	a, cookies, csrf := sessionLogin(t)
+	other := sessionRequest(a, "POST", "/login", nil, "", map[string]string{"email": "exist@user.com", "password": "123123"}).Result().Cookies()
+
+	if response := sessionRequest(a, "POST", "/logout/all", cookies, csrf, nil); response.Code != 200 {
+		t.Fatalf("Expected logout everywhere to succeed, got %d", response.Code)
+	}
+	if response := sessionRequest(a, "GET", "/profile", other, "", nil); response.Code != 401 {
+		t.Errorf("Expected other session to end, got %d", response.Code)
+	}
+}
+
+func TestSessionsList(t *testing.T) {
+	a := SetUp(t)
+	token, _ := loginTokens(t, a)
+	loginTokens(t, a)
+
+	c, err := a.Tokens.Parse(token)
+	if err != nil || c.SessionID == "" {
+		t.Fatalf("Expected token with sid claim, got %+v %v", c, err)
+	}
+
+	req, _ := http.NewRequest("GET", "/sessions", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	response := executeRequest(a, req)
+	checkResponseCode(t, 200, response, req)
+
+	var sessions []map[string]interface{}
+	json.Unmarshal(response.Body.Bytes(), &sessions)
+	if len(sessions) != 2 {
+		t.Fatalf("Expected 2 sessions, got %s", response.Body.String())
+	}
+	for _, s := range sessions {
+		current := fmt.Sprint(s["id"]) == c.SessionID
+		if s["current"] != current || s["created_at"] == nil || s["last_seen_at"] == nil {
+			t.Errorf("Expected session with device info and current flag %v, got %v", current, s)
+		}
+	}
+}
+
+func TestSessionsRevoke(t *testing.T) {
+	a := SetUp(t)
+	token, _ := loginTokens(t, a)
+	other, refresh := loginTokens(t, a)
+
+	c, _ := a.Tokens.Parse(other)
+	if code, body := jsonRequest(a, "DELETE", "/sessions/"+c.SessionID, "", token, nil, nil); code != 200 {
+		t.Fatalf("Expected session to be signed out, got %d %s", code, body)
+	}
+
+	if code, _ := jsonRequest(a, "GET", "/profile", "", other, nil, nil); code != 401 {
+		t.Errorf("Expected token of revoked session to be refused, got %d", code)
+	}
+	if code, _ := doRefresh(a, refresh); code != 401 {
+		t.Errorf("Expected refresh token of revoked session to be refused, got %d", code)
+	}
+	if code, _ := jsonRequest(a, "GET", "/profile", "", token, nil, nil); code != 200 {
+		t.Errorf("Expected other session to stay, got %d", code)
+	}
+	if code, _ := jsonRequest(a, "DELETE", "/sessions/"+c.SessionID, "", token, nil, nil); code != 404 {
+		t.Errorf("Expected revoked session to be gone, got %d", code)
+	}
+}
+
+func TestSessionsRefreshKeepSession(t *testing.T) {
+	a := SetUp(t)
+	token, refresh := loginTokens(t, a)
+
+	code, res := doRefresh(a, refresh)
+	if code != 200 {
+		t.Fatalf("Expected refresh to succeed, got %d %v", code, res)
+	}
+
+	before, _ := a.Tokens.Parse(token)
+	after, err := a.Tokens.Parse(res["token"].(string))
+	if err != nil || after.SessionID != before.SessionID {
+		t.Errorf("Expected refreshed token in session %s, got %+v %v", before.SessionID, after, err)
+	}
+	if n := len(a.Storage.(*FakeStorage).sessions); n != 1 {
+		t.Errorf("Expected refresh to keep session, got %d sessions", n)
+	}
+}
+
+func TestSessionsLongUserAgent(t *testing.T) {
+	a := SetUp(t)
+	ua := strings.Repeat("браузер ", 40)
+
+	req, _ := http.NewRequest("POST", "/login", strings.NewReader(`{"email":"exist@user.com","password":"123123"}`))
+	req.Header.Set("User-Agent", ua)
+	if response := executeRequest(a, req); response.Code != 200 {
+		t.Fatalf("Expected login to succeed, got %d %s", response.Code, response.Body.String())
+	}
+
+	s := a.Storage.(*FakeStorage).sessions[0]
+	if !utf8.ValidString(s.UserAgent) || utf8.RuneCountInString(s.UserAgent) != 255 || !strings.HasPrefix(ua, s.UserAgent) {
+		t.Errorf("Expected user agent cut to 255 characters, got %q", s.UserAgent)
+	}
+}
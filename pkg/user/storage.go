@@ -1,13 +1,151 @@
 package user
 
 import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
 	"github.com/jackc/pgx"
+	"github.com/pkg/errors"
 )
 
+// ErrEmailExists returned by storage when email is already used by other user
+var ErrEmailExists = errors.New("user: email address already exists")
+
+// ErrTOTPCodeUsed returned by storage when totp code was already used for login
+var ErrTOTPCodeUsed = errors.New("user: totp code already used")
+
+// uniqueViolation is postgresql error code for unique index violation
+const uniqueViolation = "23505"
+
+// emailError turn unique index violation into ErrEmailExists
+func emailError(err error) error {
+	if pgErr, ok := err.(pgx.PgError); ok && pgErr.Code == uniqueViolation {
+		return ErrEmailExists
+	}
+	return err
+}
+
 // Storage provider that can handle read/write operation to database/file/bytes
 type Storage interface {
 	GetUserByEmail(*User) error
 	CreateUser(*User) error
+	UpdatePassword(*User) error
+	RequirePasswordReset(*User) error
+	GetUserByID(*User) error
+	UpdateProfile(*User) error
+	UpdateLastLogin(*User) error
+	SetEmailVerified(*User) error
+	UpdateEmail(*User) error
+
+	CreateRefreshToken(*RefreshToken) error
+	GetRefreshToken(*RefreshToken) error
+	UseRefreshToken(*RefreshToken) error
+	RevokeRefreshTokenFamily(family string) error
+
+	RevokeToken(jti string, userID int, expiresAt time.Time) error
+	IsTokenRevoked(jti string) (bool, error)
+	RevokeUserTokens(*User) error
+	GetTokenVersion(*User) error
+
+	CreateActionToken(*ActionToken) error
+	GetActionToken(*ActionToken) error
+	UseActionToken(*ActionToken) error
+
+	SetTOTPSecret(*User) error
+	EnableTOTP(u *User, recoveryCodes []string) error
+	UseTOTPCounter(u *User, counter int64) error
+	UseRecoveryCode(u *User, codeHash string) error
+
+	CreateWebAuthnChallenge(*WebAuthnChallenge) error
+	UseWebAuthnChallenge(*WebAuthnChallenge) error
+	CreateWebAuthnCredential(*WebAuthnCredential) error
+	GetWebAuthnCredential(*WebAuthnCredential) error
+	GetWebAuthnCredentials(userID int) ([]WebAuthnCredential, error)
+	UpdateWebAuthnSignCount(*WebAuthnCredential) error
+
+	CreateOAuthState(*OAuthState) error
+	UseOAuthState(*OAuthState) error
+	GetIdentity(*Identity) error
+	CreateIdentity(*Identity) error
+
+	CreateClient(*Client) error
+	GetClient(*Client) error
+	CreateAuthorizationCode(*AuthorizationCode) error
+	UseAuthorizationCode(*AuthorizationCode) error
+
+	CreateServiceClient(*ServiceClient) error
+	GetServiceClient(*ServiceClient) error
+
+	CreateAPIKey(*APIKey) error
+	GetAPIKeyByPrefix(*APIKey) error
+	GetAPIKeys(userID int) ([]APIKey, error)
+	UpdateAPIKeyLastUsed(*APIKey) error
+	RevokeAPIKey(*APIKey) error
+
+	CreateRole(*Role) error
+	GetRoles() ([]Role, error)
+	GetUserRoles(*User) error
+	AssignRole(userID int, role string) error
+	UnassignRole(userID int, role string) error
+
+	GetUsers(*UserFilter) ([]User, error)
+	SetUserDisabled(u *User, disabled bool) error
+	DeleteUser(*User) error
+	CreateAuditLog(*AuditLog) error
+
+	RecordLoginFailure(u *User, at time.Time, window time.Duration) error
+	LockUser(*User) error
+	ResetLoginFailures(*User) error
+
+	CreateOrganization(o *Organization, ownerID int) error
+	GetOrganization(*Organization) error
+	GetOrganizations(userID int) ([]OrganizationMembership, error)
+	SetActiveOrganization(*User) error
+	GetMembership(*Membership) error
+	GetMembers(orgID int) ([]Member, error)
+	UpdateMembership(*Membership) error
+	DeleteMembership(*Membership) error
+	CreateInvitation(*Invitation) error
+	GetInvitation(*Invitation) error
+	GetInvitations(orgID int) ([]Invitation, error)
+	RevokeInvitation(*Invitation) error
+	AcceptInvitation(inv *Invitation, userID int) error
+
+	CreateSession(*Session) error
+	GetSession(*Session) error
+	GetSessionByID(*Session) error
+	GetSessions(userID int) ([]Session, error)
+	TouchSession(*Session) error
+	RevokeSession(*Session) error
+}
+
+// userColumns are users table columns read by userFields
+const userColumns = `id, email, password, first_name, last_name, display_name, avatar_url,
+	locale, timezone, created_at, last_login, token_version, email_verified_at, totp_secret, totp_enabled_at,
+	disabled_at, failed_login_count, locked_until, password_reset_at, tenant, ` + userOrgColumns + `, ` + userRolesColumns
+
+// userOrgColumns are active organization of users row and user role in it,
+// organization is ignored when user is not member anymore
+const userOrgColumns = `coalesce((SELECT m.org_id FROM memberships m WHERE m.user_id=users.id AND m.org_id=users.active_org_id), 0),
+	coalesce((SELECT m.role FROM memberships m WHERE m.user_id=users.id AND m.org_id=users.active_org_id), '')`
+
+// userRolesColumns are role and permission names of users row, they are read with user
+// so every token we issue carry current roles
+const userRolesColumns = `ARRAY(SELECT r.name FROM user_roles ur JOIN roles r ON r.id=ur.role_id
+		WHERE ur.user_id=users.id ORDER BY r.name),
+	ARRAY(SELECT DISTINCT p.name FROM user_roles ur JOIN role_permissions rp ON rp.role_id=ur.role_id
+		JOIN permissions p ON p.id=rp.permission_id WHERE ur.user_id=users.id ORDER BY p.name)`
+
+// userFields return pointers to User fields in userColumns order
+func userFields(u *User) []interface{} {
+	return []interface{}{
+		&u.ID, &u.Email, &u.Password, &u.FirstName, &u.LastName, &u.DisplayName, &u.AvatarURL,
+		&u.Locale, &u.Timezone, &u.CreatedAt, &u.LastLogin, &u.TokenVersion, &u.EmailVerifiedAt,
+		&u.TOTPSecret, &u.TOTPEnabledAt, &u.DisabledAt, &u.FailedLoginCount, &u.LockedUntil,
+		&u.PasswordResetAt, &u.Tenant, &u.OrgID, &u.OrgRole, &u.Roles, &u.Permissions,
+	}
 }
 
 // PGStorage provider that can handle read/write from database
@@ -24,22 +162,1188 @@ func NewPostgres(con *pgx.ConnPool) (pg *PGStorage) {
 	return pg
 }
 
-// CreateUser pull user from postgresql database
+// CreateUser insert user into postgresql database, Password should be already hashed
 func (pg *PGStorage) CreateUser(u *User) error {
 
-	err := pg.con.QueryRow("INSERT INTO users(email, password) VALUES($1, $2) RETURNING id",
+	err := pg.con.QueryRow(`INSERT INTO users(email, password, first_name, last_name, display_name, avatar_url, locale, timezone, tenant)
+		VALUES($1, $2, $3, $4, $5, $6, $7, $8, $9) RETURNING id, created_at, last_login`,
 		u.Email,
 		u.Password,
-	).Scan(&u.ID)
+		u.FirstName,
+		u.LastName,
+		u.DisplayName,
+		u.AvatarURL,
+		u.Locale,
+		u.Timezone,
+		u.Tenant,
+	).Scan(&u.ID, &u.CreatedAt, &u.LastLogin)
 
-	return err
+	return emailError(err)
 }
 
-// GetUserByEmail pull user from postgresql database
+// GetUserByEmail pull user of Tenant from postgresql database
+// Password field will hold encoded hash, use Passwords.Verify to check it
 func (pg *PGStorage) GetUserByEmail(u *User) (err error) {
-	err = pg.con.QueryRow("SELECT id, password FROM users WHERE email=$1 and password=$2",
-		u.Email, u.Password,
-	).Scan(&u.ID, &u.Password)
+	err = pg.con.QueryRow("SELECT "+userColumns+" FROM users WHERE email=$1 AND tenant=$2",
+		u.Email,
+		u.Tenant,
+	).Scan(userFields(u)...)
+
+	return err
+}
+
+// UpdatePassword store new password hash for user, it also end password reset required by admin
+func (pg *PGStorage) UpdatePassword(u *User) error {
+	_, err := pg.con.Exec("UPDATE users SET password=$1, password_reset_at=NULL WHERE id=$2",
+		u.Password,
+		u.ID,
+	)
+	if err == nil {
+		u.PasswordResetAt = nil
+	}
+
+	return err
+}
+
+// RequirePasswordReset remove user password and block login until new one is set with UpdatePassword
+func (pg *PGStorage) RequirePasswordReset(u *User) error {
+	err := pg.con.QueryRow("UPDATE users SET password='', password_reset_at=now() WHERE id=$1 RETURNING password_reset_at",
+		u.ID,
+	).Scan(&u.PasswordResetAt)
+	if err == nil {
+		u.Password = ""
+	}
+
+	return err
+}
+
+// GetUserByID pull user from postgresql database by id
+func (pg *PGStorage) GetUserByID(u *User) error {
+	return pg.con.QueryRow("SELECT "+userColumns+" FROM users WHERE id=$1",
+		u.ID,
+	).Scan(userFields(u)...)
+}
 
+// UpdateProfile store user profile fields
+func (pg *PGStorage) UpdateProfile(u *User) error {
+	_, err := pg.con.Exec(`UPDATE users SET first_name=$1, last_name=$2, display_name=$3,
+		avatar_url=$4, locale=$5, timezone=$6 WHERE id=$7`,
+		u.FirstName,
+		u.LastName,
+		u.DisplayName,
+		u.AvatarURL,
+		u.Locale,
+		u.Timezone,
+		u.ID,
+	)
 	return err
 }
+
+// SetEmailVerified mark user email as verified now
+func (pg *PGStorage) SetEmailVerified(u *User) error {
+	return pg.con.QueryRow("UPDATE users SET email_verified_at=current_timestamp WHERE id=$1 RETURNING email_verified_at",
+		u.ID,
+	).Scan(&u.EmailVerifiedAt)
+}
+
+// UpdateEmail set new email, it is confirmed by link so we mark it verified either
+func (pg *PGStorage) UpdateEmail(u *User) error {
+	err := pg.con.QueryRow("UPDATE users SET email=$2, email_verified_at=current_timestamp WHERE id=$1 RETURNING email_verified_at",
+		u.ID,
+		u.Email,
+	).Scan(&u.EmailVerifiedAt)
+
+	return emailError(err)
+}
+
+// UpdateLastLogin set last login time to now
+func (pg *PGStorage) UpdateLastLogin(u *User) error {
+	return pg.con.QueryRow("UPDATE users SET last_login=current_timestamp WHERE id=$1 RETURNING last_login",
+		u.ID,
+	).Scan(&u.LastLogin)
+}
+
+// CreateRefreshToken insert refresh token, only token hash is stored
+func (pg *PGStorage) CreateRefreshToken(rt *RefreshToken) error {
+	return pg.con.QueryRow(`INSERT INTO refresh_tokens(user_id, family_id, token_hash, amr, expires_at, session_id)
+		VALUES($1, $2, $3, $4, $5, NULLIF($6, 0)) RETURNING id, created_at`,
+		rt.UserID,
+		rt.FamilyID,
+		rt.TokenHash,
+		strings.Join(rt.AMR, ","),
+		rt.ExpiresAt,
+		rt.SessionID,
+	).Scan(&rt.ID, &rt.CreatedAt)
+}
+
+// GetRefreshToken pull refresh token by TokenHash
+func (pg *PGStorage) GetRefreshToken(rt *RefreshToken) error {
+	var amr string
+	err := pg.con.QueryRow(`SELECT id, user_id, family_id, amr, created_at, expires_at, used_at, revoked_at, coalesce(session_id, 0)
+		FROM refresh_tokens WHERE token_hash=$1`,
+		rt.TokenHash,
+	).Scan(&rt.ID, &rt.UserID, &rt.FamilyID, &amr, &rt.CreatedAt, &rt.ExpiresAt, &rt.UsedAt, &rt.RevokedAt, &rt.SessionID)
+	if err != nil {
+		return err
+	}
+
+	if amr != "" {
+		rt.AMR = strings.Split(amr, ",")
+	}
+	return nil
+}
+
+// UseRefreshToken mark refresh token as used,
+// return ErrRefreshTokenUsed if somebody did it before us
+func (pg *PGStorage) UseRefreshToken(rt *RefreshToken) error {
+	ct, err := pg.con.Exec(`UPDATE refresh_tokens SET used_at=current_timestamp
+		WHERE id=$1 AND used_at IS NULL AND revoked_at IS NULL`,
+		rt.ID,
+	)
+	if err != nil {
+		return err
+	}
+
+	if ct.RowsAffected() == 0 {
+		return ErrRefreshTokenUsed
+	}
+	return nil
+}
+
+// RevokeRefreshTokenFamily revoke all refresh tokens issued from one login
+func (pg *PGStorage) RevokeRefreshTokenFamily(family string) error {
+	_, err := pg.con.Exec(`UPDATE refresh_tokens SET revoked_at=current_timestamp
+		WHERE family_id=$1 AND revoked_at IS NULL`,
+		family,
+	)
+	return err
+}
+
+// DeleteExpiredRefreshTokens delete refresh tokens which expired before given time,
+// they can't be exchanged anymore, so reuse detection doesn't need them
+func (pg *PGStorage) DeleteExpiredRefreshTokens(before time.Time) error {
+	_, err := pg.con.Exec("DELETE FROM refresh_tokens WHERE expires_at < $1", before)
+	return err
+}
+
+// RevokeToken add token jti to revocation list, row is not needed after token expire
+func (pg *PGStorage) RevokeToken(jti string, userID int, expiresAt time.Time) error {
+	_, err := pg.con.Exec(`INSERT INTO revoked_tokens(jti, user_id, expires_at)
+		VALUES($1, $2, $3) ON CONFLICT (jti) DO NOTHING`,
+		jti,
+		userID,
+		expiresAt,
+	)
+	return err
+}
+
+// IsTokenRevoked check if jti is in revocation list
+func (pg *PGStorage) IsTokenRevoked(jti string) (revoked bool, err error) {
+	err = pg.con.QueryRow("SELECT EXISTS(SELECT 1 FROM revoked_tokens WHERE jti=$1)",
+		jti,
+	).Scan(&revoked)
+	return revoked, err
+}
+
+// DeleteExpiredRevokedTokens delete revocations of tokens which expired before given time
+func (pg *PGStorage) DeleteExpiredRevokedTokens(before time.Time) error {
+	_, err := pg.con.Exec("DELETE FROM revoked_tokens WHERE expires_at < $1", before)
+	return err
+}
+
+// RevokeUserTokens increase user token version and revoke all user refresh tokens
+func (pg *PGStorage) RevokeUserTokens(u *User) error {
+	tx, err := pg.con.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRow("UPDATE users SET token_version=token_version+1 WHERE id=$1 RETURNING token_version",
+		u.ID,
+	).Scan(&u.TokenVersion)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("UPDATE refresh_tokens SET revoked_at=current_timestamp WHERE user_id=$1 AND revoked_at IS NULL",
+		u.ID,
+	)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("UPDATE sessions SET revoked_at=current_timestamp WHERE user_id=$1 AND revoked_at IS NULL",
+		u.ID,
+	)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// GetTokenVersion pull user token version
+func (pg *PGStorage) GetTokenVersion(u *User) error {
+	return pg.con.QueryRow("SELECT token_version FROM users WHERE id=$1",
+		u.ID,
+	).Scan(&u.TokenVersion)
+}
+
+// CreateActionToken insert action token, only token hash is stored
+func (pg *PGStorage) CreateActionToken(at *ActionToken) error {
+	return pg.con.QueryRow(`INSERT INTO action_tokens(user_id, purpose, token_hash, data, expires_at)
+		VALUES($1, $2, $3, $4, $5) RETURNING id, created_at`,
+		at.UserID,
+		at.Purpose,
+		at.TokenHash,
+		at.Data,
+		at.ExpiresAt,
+	).Scan(&at.ID, &at.CreatedAt)
+}
+
+// GetActionToken pull action token by TokenHash
+func (pg *PGStorage) GetActionToken(at *ActionToken) error {
+	return pg.con.QueryRow(`SELECT id, user_id, purpose, data, created_at, expires_at, used_at
+		FROM action_tokens WHERE token_hash=$1`,
+		at.TokenHash,
+	).Scan(&at.ID, &at.UserID, &at.Purpose, &at.Data, &at.CreatedAt, &at.ExpiresAt, &at.UsedAt)
+}
+
+// UseActionToken mark action token as used,
+// return ErrActionTokenUsed if somebody did it before us
+func (pg *PGStorage) UseActionToken(at *ActionToken) error {
+	ct, err := pg.con.Exec("UPDATE action_tokens SET used_at=current_timestamp WHERE id=$1 AND used_at IS NULL",
+		at.ID,
+	)
+	if err != nil {
+		return err
+	}
+
+	if ct.RowsAffected() == 0 {
+		return ErrActionTokenUsed
+	}
+	return nil
+}
+
+// DeleteExpiredActionTokens delete action tokens which expired before given time
+func (pg *PGStorage) DeleteExpiredActionTokens(before time.Time) error {
+	_, err := pg.con.Exec("DELETE FROM action_tokens WHERE expires_at < $1", before)
+	return err
+}
+
+// SetTOTPSecret store new totp secret, it is not enabled until EnableTOTP
+func (pg *PGStorage) SetTOTPSecret(u *User) error {
+	_, err := pg.con.Exec("UPDATE users SET totp_secret=$2, totp_enabled_at=NULL, totp_last_counter=0 WHERE id=$1",
+		u.ID,
+		u.TOTPSecret,
+	)
+	return err
+}
+
+// EnableTOTP turn on totp and replace recovery codes with new ones
+func (pg *PGStorage) EnableTOTP(u *User, recoveryCodes []string) error {
+	tx, err := pg.con.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRow("UPDATE users SET totp_enabled_at=current_timestamp WHERE id=$1 RETURNING totp_enabled_at",
+		u.ID,
+	).Scan(&u.TOTPEnabledAt)
+	if err != nil {
+		return err
+	}
+
+	if _, err = tx.Exec("DELETE FROM recovery_codes WHERE user_id=$1", u.ID); err != nil {
+		return err
+	}
+
+	for _, code := range recoveryCodes {
+		if _, err = tx.Exec("INSERT INTO recovery_codes(user_id, code_hash) VALUES($1, $2)", u.ID, code); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// UseTOTPCounter remember last used totp time step,
+// return ErrTOTPCodeUsed if code for this or later step was used already
+func (pg *PGStorage) UseTOTPCounter(u *User, counter int64) error {
+	ct, err := pg.con.Exec("UPDATE users SET totp_last_counter=$2 WHERE id=$1 AND totp_last_counter < $2",
+		u.ID,
+		counter,
+	)
+	if err != nil {
+		return err
+	}
+
+	if ct.RowsAffected() == 0 {
+		return ErrTOTPCodeUsed
+	}
+	return nil
+}
+
+// UseRecoveryCode mark recovery code as used,
+// return pgx.ErrNoRows if there is no such unused code
+func (pg *PGStorage) UseRecoveryCode(u *User, codeHash string) error {
+	ct, err := pg.con.Exec(`UPDATE recovery_codes SET used_at=current_timestamp
+		WHERE user_id=$1 AND code_hash=$2 AND used_at IS NULL`,
+		u.ID,
+		codeHash,
+	)
+	if err != nil {
+		return err
+	}
+
+	if ct.RowsAffected() == 0 {
+		return pgx.ErrNoRows
+	}
+	return nil
+}
+
+// CreateWebAuthnChallenge insert challenge, only hash of it is stored.
+// Expired and used challenges are deleted first, so login begin can't grow the table
+func (pg *PGStorage) CreateWebAuthnChallenge(c *WebAuthnChallenge) error {
+	_, err := pg.con.Exec("DELETE FROM webauthn_challenges WHERE expires_at < current_timestamp OR used_at IS NOT NULL")
+	if err != nil {
+		return err
+	}
+
+	var userID *int
+	if c.UserID != 0 {
+		userID = &c.UserID
+	}
+
+	return pg.con.QueryRow(`INSERT INTO webauthn_challenges(user_id, purpose, challenge_hash, expires_at)
+		VALUES($1, $2, $3, $4) RETURNING id, created_at`,
+		userID,
+		c.Purpose,
+		c.ChallengeHash,
+		c.ExpiresAt,
+	).Scan(&c.ID, &c.CreatedAt)
+}
+
+// UseWebAuthnChallenge mark challenge with ChallengeHash used and pull it,
+// return pgx.ErrNoRows if there is no such unused challenge
+func (pg *PGStorage) UseWebAuthnChallenge(c *WebAuthnChallenge) error {
+	return pg.con.QueryRow(`UPDATE webauthn_challenges SET used_at=current_timestamp
+		WHERE challenge_hash=$1 AND used_at IS NULL
+		RETURNING id, COALESCE(user_id, 0), purpose, created_at, expires_at`,
+		c.ChallengeHash,
+	).Scan(&c.ID, &c.UserID, &c.Purpose, &c.CreatedAt, &c.ExpiresAt)
+}
+
+// CreateWebAuthnCredential insert credential,
+// return ErrWebAuthnCredentialExists if it is registered already
+func (pg *PGStorage) CreateWebAuthnCredential(c *WebAuthnCredential) error {
+	err := pg.con.QueryRow(`INSERT INTO webauthn_credentials(user_id, credential_id, public_key, sign_count, aaguid, name)
+		VALUES($1, $2, $3, $4, $5, $6) RETURNING id, created_at`,
+		c.UserID,
+		c.CredentialID,
+		c.PublicKey,
+		int64(c.SignCount),
+		c.AAGUID,
+		c.Name,
+	).Scan(&c.ID, &c.CreatedAt)
+
+	if pgErr, ok := err.(pgx.PgError); ok && pgErr.Code == uniqueViolation {
+		return ErrWebAuthnCredentialExists
+	}
+	return err
+}
+
+// webauthnCredentialColumns are webauthn_credentials columns read by scanWebAuthnCredential
+const webauthnCredentialColumns = `id, user_id, credential_id, public_key, sign_count, aaguid, name, created_at, last_used_at`
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanWebAuthnCredential(row rowScanner, c *WebAuthnCredential) error {
+	var count int64
+	err := row.Scan(&c.ID, &c.UserID, &c.CredentialID, &c.PublicKey, &count, &c.AAGUID, &c.Name, &c.CreatedAt, &c.LastUsedAt)
+	c.SignCount = uint32(count)
+	return err
+}
+
+// GetWebAuthnCredential pull credential by CredentialID
+func (pg *PGStorage) GetWebAuthnCredential(c *WebAuthnCredential) error {
+	return scanWebAuthnCredential(pg.con.QueryRow("SELECT "+webauthnCredentialColumns+" FROM webauthn_credentials WHERE credential_id=$1",
+		c.CredentialID,
+	), c)
+}
+
+// GetWebAuthnCredentials pull all credentials of user
+func (pg *PGStorage) GetWebAuthnCredentials(userID int) ([]WebAuthnCredential, error) {
+	rows, err := pg.con.Query("SELECT "+webauthnCredentialColumns+" FROM webauthn_credentials WHERE user_id=$1 ORDER BY id",
+		userID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	creds := []WebAuthnCredential{}
+	for rows.Next() {
+		c := WebAuthnCredential{}
+		if err := scanWebAuthnCredential(rows, &c); err != nil {
+			return nil, err
+		}
+		creds = append(creds, c)
+	}
+	return creds, rows.Err()
+}
+
+// UpdateWebAuthnSignCount store new sign counter and last use time of credential
+func (pg *PGStorage) UpdateWebAuthnSignCount(c *WebAuthnCredential) error {
+	return pg.con.QueryRow(`UPDATE webauthn_credentials SET sign_count=$2, last_used_at=current_timestamp
+		WHERE id=$1 RETURNING last_used_at`,
+		c.ID,
+		int64(c.SignCount),
+	).Scan(&c.LastUsedAt)
+}
+
+// CreateOAuthState insert social login state, only hash of state is stored
+func (pg *PGStorage) CreateOAuthState(st *OAuthState) error {
+	return pg.con.QueryRow(`INSERT INTO oauth_states(provider, state_hash, nonce, code_verifier, tenant, expires_at)
+		VALUES($1, $2, $3, $4, $5, $6) RETURNING id, created_at`,
+		st.Provider,
+		st.StateHash,
+		st.Nonce,
+		st.CodeVerifier,
+		st.Tenant,
+		st.ExpiresAt,
+	).Scan(&st.ID, &st.CreatedAt)
+}
+
+// UseOAuthState mark state with StateHash used and pull it,
+// return pgx.ErrNoRows if there is no such unused state
+func (pg *PGStorage) UseOAuthState(st *OAuthState) error {
+	return pg.con.QueryRow(`UPDATE oauth_states SET used_at=current_timestamp
+		WHERE state_hash=$1 AND used_at IS NULL
+		RETURNING id, provider, nonce, code_verifier, tenant, created_at, expires_at`,
+		st.StateHash,
+	).Scan(&st.ID, &st.Provider, &st.Nonce, &st.CodeVerifier, &st.Tenant, &st.CreatedAt, &st.ExpiresAt)
+}
+
+// GetIdentity pull identity by Tenant, Provider and Subject
+func (pg *PGStorage) GetIdentity(id *Identity) error {
+	return pg.con.QueryRow(`SELECT id, user_id, email, created_at FROM identities WHERE provider=$1 AND subject=$2 AND tenant=$3`,
+		id.Provider,
+		id.Subject,
+		id.Tenant,
+	).Scan(&id.ID, &id.UserID, &id.Email, &id.CreatedAt)
+}
+
+// CreateIdentity link provider account to user
+func (pg *PGStorage) CreateIdentity(id *Identity) error {
+	return pg.con.QueryRow(`INSERT INTO identities(user_id, provider, subject, email, tenant)
+		VALUES($1, $2, $3, $4, $5) RETURNING id, created_at`,
+		id.UserID,
+		id.Provider,
+		id.Subject,
+		id.Email,
+		id.Tenant,
+	).Scan(&id.ID, &id.CreatedAt)
+}
+
+// CreateClient insert OpenID Connect client, ID is generated by caller
+func (pg *PGStorage) CreateClient(c *Client) error {
+	return pg.con.QueryRow(`INSERT INTO clients(id, secret_hash, name, redirect_uris)
+		VALUES($1, $2, $3, $4) RETURNING created_at`,
+		c.ID,
+		c.SecretHash,
+		c.Name,
+		c.RedirectURIs,
+	).Scan(&c.CreatedAt)
+}
+
+// GetClient pull client by ID
+func (pg *PGStorage) GetClient(c *Client) error {
+	return pg.con.QueryRow(`SELECT secret_hash, name, redirect_uris, created_at FROM clients WHERE id=$1`,
+		c.ID,
+	).Scan(&c.SecretHash, &c.Name, &c.RedirectURIs, &c.CreatedAt)
+}
+
+// CreateAuthorizationCode insert authorization code, only code hash is stored
+func (pg *PGStorage) CreateAuthorizationCode(ac *AuthorizationCode) error {
+	return pg.con.QueryRow(`INSERT INTO authorization_codes(code_hash, client_id, user_id, redirect_uri, scope, nonce, code_challenge, amr, expires_at)
+		VALUES($1, $2, $3, $4, $5, $6, $7, $8, $9) RETURNING id, created_at`,
+		ac.CodeHash,
+		ac.ClientID,
+		ac.UserID,
+		ac.RedirectURI,
+		ac.Scope,
+		ac.Nonce,
+		ac.CodeChallenge,
+		strings.Join(ac.AMR, ","),
+		ac.ExpiresAt,
+	).Scan(&ac.ID, &ac.CreatedAt)
+}
+
+// UseAuthorizationCode mark code with CodeHash used and pull it,
+// return pgx.ErrNoRows if there is no such unused code
+func (pg *PGStorage) UseAuthorizationCode(ac *AuthorizationCode) error {
+	var amr string
+	err := pg.con.QueryRow(`UPDATE authorization_codes SET used_at=current_timestamp
+		WHERE code_hash=$1 AND used_at IS NULL
+		RETURNING id, client_id, user_id, redirect_uri, scope, nonce, code_challenge, amr, created_at, expires_at`,
+		ac.CodeHash,
+	).Scan(&ac.ID, &ac.ClientID, &ac.UserID, &ac.RedirectURI, &ac.Scope, &ac.Nonce, &ac.CodeChallenge, &amr, &ac.CreatedAt, &ac.ExpiresAt)
+	if err != nil {
+		return err
+	}
+
+	if amr != "" {
+		ac.AMR = strings.Split(amr, ",")
+	}
+	return nil
+}
+
+// CreateServiceClient insert service client, ID is generated by caller
+func (pg *PGStorage) CreateServiceClient(c *ServiceClient) error {
+	return pg.con.QueryRow(`INSERT INTO service_clients(id, secret_hash, name, scopes)
+		VALUES($1, $2, $3, $4) RETURNING created_at`,
+		c.ID,
+		c.SecretHash,
+		c.Name,
+		c.Scopes,
+	).Scan(&c.CreatedAt)
+}
+
+// GetServiceClient pull service client by ID
+func (pg *PGStorage) GetServiceClient(c *ServiceClient) error {
+	return pg.con.QueryRow(`SELECT secret_hash, name, scopes, created_at FROM service_clients WHERE id=$1`,
+		c.ID,
+	).Scan(&c.SecretHash, &c.Name, &c.Scopes, &c.CreatedAt)
+}
+
+// CreateAPIKey insert API key, only hash of secret part is stored
+func (pg *PGStorage) CreateAPIKey(k *APIKey) error {
+	return pg.con.QueryRow(`INSERT INTO api_keys(user_id, name, prefix, key_hash, scopes, expires_at)
+		VALUES($1, $2, $3, $4, $5, $6) RETURNING id, created_at`,
+		k.UserID,
+		k.Name,
+		k.Prefix,
+		k.KeyHash,
+		k.Scopes,
+		k.ExpiresAt,
+	).Scan(&k.ID, &k.CreatedAt)
+}
+
+// apiKeyColumns are api_keys columns read by scanAPIKey
+const apiKeyColumns = `id, user_id, name, prefix, key_hash, scopes, expires_at, created_at, last_used_at, revoked_at`
+
+func scanAPIKey(row rowScanner, k *APIKey) error {
+	return row.Scan(&k.ID, &k.UserID, &k.Name, &k.Prefix, &k.KeyHash, &k.Scopes, &k.ExpiresAt, &k.CreatedAt, &k.LastUsedAt, &k.RevokedAt)
+}
+
+// GetAPIKeyByPrefix pull API key by Prefix
+func (pg *PGStorage) GetAPIKeyByPrefix(k *APIKey) error {
+	return scanAPIKey(pg.con.QueryRow("SELECT "+apiKeyColumns+" FROM api_keys WHERE prefix=$1",
+		k.Prefix,
+	), k)
+}
+
+// GetAPIKeys pull API keys of user which are not revoked
+func (pg *PGStorage) GetAPIKeys(userID int) ([]APIKey, error) {
+	rows, err := pg.con.Query("SELECT "+apiKeyColumns+" FROM api_keys WHERE user_id=$1 AND revoked_at IS NULL ORDER BY id",
+		userID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []APIKey{}
+	for rows.Next() {
+		k := APIKey{}
+		if err := scanAPIKey(rows, &k); err != nil {
+			return nil, err
+		}
+		keys = append(keys, k)
+	}
+	return keys, rows.Err()
+}
+
+// UpdateAPIKeyLastUsed set last use time of API key to now
+func (pg *PGStorage) UpdateAPIKeyLastUsed(k *APIKey) error {
+	return pg.con.QueryRow(`UPDATE api_keys SET last_used_at=current_timestamp WHERE id=$1 RETURNING last_used_at`,
+		k.ID,
+	).Scan(&k.LastUsedAt)
+}
+
+// RevokeAPIKey revoke API key with ID owned by UserID,
+// return pgx.ErrNoRows if user has no such active key
+func (pg *PGStorage) RevokeAPIKey(k *APIKey) error {
+	return pg.con.QueryRow(`UPDATE api_keys SET revoked_at=current_timestamp
+		WHERE id=$1 AND user_id=$2 AND revoked_at IS NULL RETURNING revoked_at`,
+		k.ID,
+		k.UserID,
+	).Scan(&k.RevokedAt)
+}
+
+// CreateRole insert role and link its permissions, permissions are created if missing
+func (pg *PGStorage) CreateRole(r *Role) error {
+	tx, err := pg.con.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRow("INSERT INTO roles(name, description) VALUES($1, $2) RETURNING id, created_at",
+		r.Name,
+		r.Description,
+	).Scan(&r.ID, &r.CreatedAt)
+	if err != nil {
+		return err
+	}
+
+	for _, p := range r.Permissions {
+		if _, err = tx.Exec("INSERT INTO permissions(name) VALUES($1) ON CONFLICT (name) DO NOTHING", p); err != nil {
+			return err
+		}
+		_, err = tx.Exec(`INSERT INTO role_permissions(role_id, permission_id)
+			SELECT $1, id FROM permissions WHERE name=$2 ON CONFLICT DO NOTHING`,
+			r.ID,
+			p,
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// GetRoles pull all roles with their permissions
+func (pg *PGStorage) GetRoles() ([]Role, error) {
+	rows, err := pg.con.Query(`SELECT r.id, r.name, r.description, r.created_at,
+		ARRAY(SELECT p.name FROM role_permissions rp JOIN permissions p ON p.id=rp.permission_id
+			WHERE rp.role_id=r.id ORDER BY p.name)
+		FROM roles r ORDER BY r.name`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	roles := []Role{}
+	for rows.Next() {
+		r := Role{}
+		if err := rows.Scan(&r.ID, &r.Name, &r.Description, &r.CreatedAt, &r.Permissions); err != nil {
+			return nil, err
+		}
+		roles = append(roles, r)
+	}
+	return roles, rows.Err()
+}
+
+// GetUserRoles fill Roles and Permissions of user with ID
+func (pg *PGStorage) GetUserRoles(u *User) error {
+	return pg.con.QueryRow("SELECT "+userRolesColumns+" FROM users WHERE id=$1",
+		u.ID,
+	).Scan(&u.Roles, &u.Permissions)
+}
+
+// AssignRole give role to user, return pgx.ErrNoRows if role does not exist
+func (pg *PGStorage) AssignRole(userID int, role string) error {
+	ct, err := pg.con.Exec(`INSERT INTO user_roles(user_id, role_id)
+		SELECT $1, id FROM roles WHERE name=$2 ON CONFLICT DO NOTHING`,
+		userID,
+		role,
+	)
+	if err != nil {
+		return err
+	}
+
+	if ct.RowsAffected() == 0 {
+		var exists bool
+		if err := pg.con.QueryRow("SELECT EXISTS(SELECT 1 FROM roles WHERE name=$1)", role).Scan(&exists); err != nil {
+			return err
+		}
+		if !exists {
+			return pgx.ErrNoRows
+		}
+	}
+	return nil
+}
+
+// UnassignRole take role from user, return pgx.ErrNoRows if user does not have it
+func (pg *PGStorage) UnassignRole(userID int, role string) error {
+	ct, err := pg.con.Exec(`DELETE FROM user_roles WHERE user_id=$1
+		AND role_id=(SELECT id FROM roles WHERE name=$2)`,
+		userID,
+		role,
+	)
+	if err != nil {
+		return err
+	}
+
+	if ct.RowsAffected() == 0 {
+		return pgx.ErrNoRows
+	}
+	return nil
+}
+
+// GetUsers pull users matching filter ordered by id
+func (pg *PGStorage) GetUsers(f *UserFilter) ([]User, error) {
+	where := []string{"id > $1", "tenant = $2"}
+	args := []interface{}{f.After, f.Tenant}
+	add := func(cond string, arg interface{}) {
+		args = append(args, arg)
+		where = append(where, fmt.Sprintf(cond, len(args)))
+	}
+
+	if f.Email != "" {
+		add(`email ILIKE '%%' || $%d || '%%' ESCAPE '\'`, likeEscaper.Replace(f.Email))
+	}
+	if f.CreatedAfter != nil {
+		add("created_at >= $%d", *f.CreatedAfter)
+	}
+	if f.CreatedBefore != nil {
+		add("created_at < $%d", *f.CreatedBefore)
+	}
+	switch f.Status {
+	case StatusActive:
+		where = append(where, "disabled_at IS NULL")
+	case StatusDisabled:
+		where = append(where, "disabled_at IS NOT NULL")
+	}
+	args = append(args, f.Limit)
+
+	rows, err := pg.con.Query(fmt.Sprintf("SELECT %s FROM users WHERE %s ORDER BY id LIMIT $%d",
+		userColumns, strings.Join(where, " AND "), len(args)),
+		args...,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := []User{}
+	for rows.Next() {
+		u := User{}
+		if err := rows.Scan(userFields(&u)...); err != nil {
+			return nil, err
+		}
+		users = append(users, u)
+	}
+	return users, rows.Err()
+}
+
+// likeEscaper escape LIKE wildcards, so user input is matched literally
+var likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
+// SetUserDisabled set or clear disabled_at of user
+func (pg *PGStorage) SetUserDisabled(u *User, disabled bool) error {
+	return pg.con.QueryRow(`UPDATE users SET disabled_at=CASE WHEN $2 THEN coalesce(disabled_at, current_timestamp) END
+		WHERE id=$1 RETURNING disabled_at`,
+		u.ID,
+		disabled,
+	).Scan(&u.DisabledAt)
+}
+
+// DeleteUser delete user, related rows are removed by foreign keys
+// return pgx.ErrNoRows if user does not exist
+func (pg *PGStorage) DeleteUser(u *User) error {
+	ct, err := pg.con.Exec("DELETE FROM users WHERE id=$1", u.ID)
+	if err != nil {
+		return err
+	}
+
+	if ct.RowsAffected() == 0 {
+		return pgx.ErrNoRows
+	}
+	return nil
+}
+
+// CreateAuditLog insert audit log entry
+func (pg *PGStorage) CreateAuditLog(e *AuditLog) error {
+	details, err := json.Marshal(e.Details)
+	if err != nil {
+		return err
+	}
+
+	return pg.con.QueryRow(`INSERT INTO audit_log(actor_id, action, target_id, details, ip)
+		VALUES($1, $2, $3, $4, $5) RETURNING id, created_at`,
+		e.ActorID,
+		e.Action,
+		e.TargetID,
+		string(details),
+		e.IP,
+	).Scan(&e.ID, &e.CreatedAt)
+}
+
+// RecordLoginFailure increase failed login counter of user and return new value in FailedLoginCount,
+// counter start again when previous failure was more than window before
+func (pg *PGStorage) RecordLoginFailure(u *User, at time.Time, window time.Duration) error {
+	return pg.con.QueryRow(`UPDATE users SET failed_login_count=CASE WHEN last_failed_login_at >= $3
+		THEN failed_login_count+1 ELSE 1 END, last_failed_login_at=$2 WHERE id=$1 RETURNING failed_login_count`,
+		u.ID,
+		at,
+		at.Add(-window),
+	).Scan(&u.FailedLoginCount)
+}
+
+// LockUser store LockedUntil of user
+func (pg *PGStorage) LockUser(u *User) error {
+	_, err := pg.con.Exec("UPDATE users SET locked_until=$2 WHERE id=$1",
+		u.ID,
+		u.LockedUntil,
+	)
+	return err
+}
+
+// ResetLoginFailures clear failed login counter and lock of user
+func (pg *PGStorage) ResetLoginFailures(u *User) error {
+	_, err := pg.con.Exec("UPDATE users SET failed_login_count=0, locked_until=NULL WHERE id=$1",
+		u.ID,
+	)
+	u.FailedLoginCount, u.LockedUntil = 0, nil
+	return err
+}
+
+// TakeRateLimit take token from bucket with key, row is locked so instances don't race for the same bucket
+func (pg *PGStorage) TakeRateLimit(key string, l RateLimit, now time.Time) (RateLimitResult, error) {
+	tx, err := pg.con.Begin()
+	if err != nil {
+		return RateLimitResult{}, err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("INSERT INTO rate_limits(key, tokens, updated_at) VALUES($1, $2, $3) ON CONFLICT (key) DO NOTHING",
+		key,
+		float64(l.Limit),
+		now,
+	)
+	if err != nil {
+		return RateLimitResult{}, err
+	}
+
+	b := rateBucket{}
+	err = tx.QueryRow("SELECT tokens, updated_at FROM rate_limits WHERE key=$1 FOR UPDATE",
+		key,
+	).Scan(&b.tokens, &b.updated)
+	if err != nil {
+		return RateLimitResult{}, err
+	}
+
+	res := b.take(l, now)
+	_, err = tx.Exec("UPDATE rate_limits SET tokens=$2, updated_at=$3, full_at=$4 WHERE key=$1",
+		key,
+		b.tokens,
+		b.updated,
+		b.full(l),
+	)
+	if err != nil {
+		return RateLimitResult{}, err
+	}
+
+	return res, tx.Commit()
+}
+
+// DeleteFullRateLimits delete buckets which are full again, they are the same as missing ones
+func (pg *PGStorage) DeleteFullRateLimits() error {
+	_, err := pg.con.Exec("DELETE FROM rate_limits WHERE full_at < current_timestamp")
+	return err
+}
+
+// CreateOrganization insert organization and make user with ownerID its owner
+func (pg *PGStorage) CreateOrganization(o *Organization, ownerID int) error {
+	tx, err := pg.con.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRow("INSERT INTO organizations(name, tenant) VALUES($1, $2) RETURNING id, created_at",
+		o.Name,
+		o.Tenant,
+	).Scan(&o.ID, &o.CreatedAt)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("INSERT INTO memberships(org_id, user_id, role) VALUES($1, $2, $3)",
+		o.ID,
+		ownerID,
+		OrgRoleOwner,
+	)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// GetOrganization pull organization by ID
+func (pg *PGStorage) GetOrganization(o *Organization) error {
+	return pg.con.QueryRow("SELECT name, tenant, created_at FROM organizations WHERE id=$1",
+		o.ID,
+	).Scan(&o.Name, &o.Tenant, &o.CreatedAt)
+}
+
+// GetOrganizations pull organizations user is member of with user role
+func (pg *PGStorage) GetOrganizations(userID int) ([]OrganizationMembership, error) {
+	rows, err := pg.con.Query(`SELECT o.id, o.name, o.created_at, m.role FROM organizations o
+		JOIN memberships m ON m.org_id=o.id WHERE m.user_id=$1 ORDER BY o.name, o.id`,
+		userID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	orgs := []OrganizationMembership{}
+	for rows.Next() {
+		o := OrganizationMembership{}
+		if err := rows.Scan(&o.ID, &o.Name, &o.CreatedAt, &o.Role); err != nil {
+			return nil, err
+		}
+		orgs = append(orgs, o)
+	}
+	return orgs, rows.Err()
+}
+
+// SetActiveOrganization store OrgID as active organization of user, 0 clear it
+func (pg *PGStorage) SetActiveOrganization(u *User) error {
+	_, err := pg.con.Exec("UPDATE users SET active_org_id=NULLIF($2, 0) WHERE id=$1",
+		u.ID,
+		u.OrgID,
+	)
+	return err
+}
+
+// GetMembership pull membership by OrgID and UserID
+func (pg *PGStorage) GetMembership(m *Membership) error {
+	return pg.con.QueryRow("SELECT role, created_at FROM memberships WHERE org_id=$1 AND user_id=$2",
+		m.OrgID,
+		m.UserID,
+	).Scan(&m.Role, &m.CreatedAt)
+}
+
+// GetMembers pull members of organization with their user data
+func (pg *PGStorage) GetMembers(orgID int) ([]Member, error) {
+	rows, err := pg.con.Query(`SELECT m.org_id, m.user_id, m.role, m.created_at, u.email, u.first_name, u.last_name
+		FROM memberships m JOIN users u ON u.id=m.user_id WHERE m.org_id=$1 ORDER BY m.created_at, m.user_id`,
+		orgID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	members := []Member{}
+	for rows.Next() {
+		m := Member{}
+		if err := rows.Scan(&m.OrgID, &m.UserID, &m.Role, &m.CreatedAt, &m.Email, &m.FirstName, &m.LastName); err != nil {
+			return nil, err
+		}
+		members = append(members, m)
+	}
+	return members, rows.Err()
+}
+
+// UpdateMembership store Role of membership
+func (pg *PGStorage) UpdateMembership(m *Membership) error {
+	_, err := pg.con.Exec("UPDATE memberships SET role=$3 WHERE org_id=$1 AND user_id=$2",
+		m.OrgID,
+		m.UserID,
+		m.Role,
+	)
+	return err
+}
+
+// DeleteMembership remove user from organization, return pgx.ErrNoRows if user is not member
+func (pg *PGStorage) DeleteMembership(m *Membership) error {
+	ct, err := pg.con.Exec("DELETE FROM memberships WHERE org_id=$1 AND user_id=$2",
+		m.OrgID,
+		m.UserID,
+	)
+	if err != nil {
+		return err
+	}
+
+	if ct.RowsAffected() == 0 {
+		return pgx.ErrNoRows
+	}
+	return nil
+}
+
+// CreateInvitation insert invitation, only hash of its token is stored
+func (pg *PGStorage) CreateInvitation(inv *Invitation) error {
+	return pg.con.QueryRow(`INSERT INTO invitations(org_id, email, role, token_hash, invited_by, expires_at)
+		VALUES($1, $2, $3, $4, $5, $6) RETURNING id, created_at`,
+		inv.OrgID,
+		inv.Email,
+		inv.Role,
+		inv.TokenHash,
+		inv.InvitedBy,
+		inv.ExpiresAt,
+	).Scan(&inv.ID, &inv.CreatedAt)
+}
+
+// invitationColumns are invitations columns read by scanInvitation
+const invitationColumns = `id, org_id, email, role, token_hash, invited_by, expires_at, created_at, accepted_at, revoked_at`
+
+func scanInvitation(row rowScanner, inv *Invitation) error {
+	return row.Scan(&inv.ID, &inv.OrgID, &inv.Email, &inv.Role, &inv.TokenHash, &inv.InvitedBy,
+		&inv.ExpiresAt, &inv.CreatedAt, &inv.AcceptedAt, &inv.RevokedAt)
+}
+
+// GetInvitation pull invitation by TokenHash
+func (pg *PGStorage) GetInvitation(inv *Invitation) error {
+	return scanInvitation(pg.con.QueryRow("SELECT "+invitationColumns+" FROM invitations WHERE token_hash=$1",
+		inv.TokenHash,
+	), inv)
+}
+
+// GetInvitations pull invitations of organization which can still be accepted
+func (pg *PGStorage) GetInvitations(orgID int) ([]Invitation, error) {
+	rows, err := pg.con.Query(`SELECT `+invitationColumns+` FROM invitations WHERE org_id=$1
+		AND accepted_at IS NULL AND revoked_at IS NULL AND expires_at > current_timestamp ORDER BY id`,
+		orgID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	invs := []Invitation{}
+	for rows.Next() {
+		inv := Invitation{}
+		if err := scanInvitation(rows, &inv); err != nil {
+			return nil, err
+		}
+		invs = append(invs, inv)
+	}
+	return invs, rows.Err()
+}
+
+// RevokeInvitation revoke invitation with ID of OrgID, return pgx.ErrNoRows if it is not pending
+func (pg *PGStorage) RevokeInvitation(inv *Invitation) error {
+	return pg.con.QueryRow(`UPDATE invitations SET revoked_at=current_timestamp
+		WHERE id=$1 AND org_id=$2 AND accepted_at IS NULL AND revoked_at IS NULL RETURNING revoked_at`,
+		inv.ID,
+		inv.OrgID,
+	).Scan(&inv.RevokedAt)
+}
+
+// AcceptInvitation mark invitation accepted and add user to organization,
+// return pgx.ErrNoRows if invitation is not pending anymore. Existing member keep current role
+func (pg *PGStorage) AcceptInvitation(inv *Invitation, userID int) error {
+	tx, err := pg.con.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRow(`UPDATE invitations SET accepted_at=current_timestamp
+		WHERE id=$1 AND accepted_at IS NULL AND revoked_at IS NULL AND expires_at > current_timestamp RETURNING accepted_at`,
+		inv.ID,
+	).Scan(&inv.AcceptedAt)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("INSERT INTO memberships(org_id, user_id, role) VALUES($1, $2, $3) ON CONFLICT DO NOTHING",
+		inv.OrgID,
+		userID,
+		inv.Role,
+	)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// CreateSession insert session, only hashes of session and CSRF tokens are stored,
+// sessions of token logins have no hashes
+func (pg *PGStorage) CreateSession(s *Session) error {
+	return pg.con.QueryRow(`INSERT INTO sessions(user_id, token_hash, csrf_hash, token_version, amr, user_agent, ip, expires_at)
+		VALUES($1, NULLIF($2, ''), $3, $4, $5, $6, $7, $8) RETURNING id, created_at, last_seen_at`,
+		s.UserID,
+		s.TokenHash,
+		s.CSRFHash,
+		s.TokenVersion,
+		strings.Join(s.AMR, ","),
+		s.UserAgent,
+		s.IP,
+		s.ExpiresAt,
+	).Scan(&s.ID, &s.CreatedAt, &s.LastSeenAt)
+}
+
+// sessionColumns are sessions columns read by scanSession
+const sessionColumns = `id, user_id, coalesce(token_hash, ''), csrf_hash, token_version, amr, user_agent, ip,
+	created_at, last_seen_at, expires_at, revoked_at`
+
+func scanSession(row rowScanner, s *Session) error {
+	var amr string
+	err := row.Scan(&s.ID, &s.UserID, &s.TokenHash, &s.CSRFHash, &s.TokenVersion, &amr, &s.UserAgent, &s.IP,
+		&s.CreatedAt, &s.LastSeenAt, &s.ExpiresAt, &s.RevokedAt)
+	if err != nil {
+		return err
+	}
+
+	if amr != "" {
+		s.AMR = strings.Split(amr, ",")
+	}
+	return nil
+}
+
+// GetSession pull session by TokenHash
+func (pg *PGStorage) GetSession(s *Session) error {
+	return scanSession(pg.con.QueryRow("SELECT "+sessionColumns+" FROM sessions WHERE token_hash=$1",
+		s.TokenHash,
+	), s)
+}
+
+// GetSessionByID pull session by ID
+func (pg *PGStorage) GetSessionByID(s *Session) error {
+	return scanSession(pg.con.QueryRow("SELECT "+sessionColumns+" FROM sessions WHERE id=$1",
+		s.ID,
+	), s)
+}
+
+// GetSessions pull sessions of user which are not revoked or expired, last used first
+func (pg *PGStorage) GetSessions(userID int) ([]Session, error) {
+	rows, err := pg.con.Query(`SELECT `+sessionColumns+` FROM sessions WHERE user_id=$1
+		AND revoked_at IS NULL AND expires_at > current_timestamp ORDER BY last_seen_at DESC, id DESC`,
+		userID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := []Session{}
+	for rows.Next() {
+		s := Session{}
+		if err := scanSession(rows, &s); err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, s)
+	}
+	return sessions, rows.Err()
+}
+
+// TouchSession store LastSeenAt and ExpiresAt of session
+func (pg *PGStorage) TouchSession(s *Session) error {
+	_, err := pg.con.Exec("UPDATE sessions SET last_seen_at=$2, expires_at=$3 WHERE id=$1",
+		s.ID,
+		s.LastSeenAt,
+		s.ExpiresAt,
+	)
+	return err
+}
+
+// RevokeSession revoke session, return pgx.ErrNoRows if it is revoked already
+func (pg *PGStorage) RevokeSession(s *Session) error {
+	return pg.con.QueryRow("UPDATE sessions SET revoked_at=current_timestamp WHERE id=$1 AND revoked_at IS NULL RETURNING revoked_at",
+		s.ID,
+	).Scan(&s.RevokedAt)
+}
@@ -0,0 +1,158 @@
+package user
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	v "github.com/webdeveloppro/validating"
+)
+
+// TenantHeader name tenant explicitly, it win over Host header
+const TenantHeader = "X-Tenant"
+
+// PasswordPolicy is allowed length of new passwords
+type PasswordPolicy struct {
+	MinLength int
+	MaxLength int
+	// MaxBytes is set from password hasher limit, bcrypt use only first 72 bytes. Zero is no limit
+	MaxBytes int
+}
+
+// limit cap policy by limit of password hasher
+func (p PasswordPolicy) limit(maxBytes int) PasswordPolicy {
+	p.MaxBytes = maxBytes
+	if maxBytes > 0 && p.MaxLength > maxBytes {
+		p.MaxLength = maxBytes
+	}
+	return p
+}
+
+// Tenant is product with own users, email can be registered once per tenant.
+// Requests are matched to tenant by X-Tenant header or Host, zero settings fall back to Config
+type Tenant struct {
+	ID    string
+	Hosts []string
+
+	// Keys and SigningKey are like Config ones, tenant with own keys can't use tokens of other tenants
+	Keys            []KeyConfig
+	SigningKey      string
+	AccessTokenTTL  time.Duration
+	RefreshTokenTTL time.Duration
+	PasswordPolicy  PasswordPolicy
+}
+
+// tenant is Tenant with ready to use tokens
+type tenant struct {
+	Tenant
+	tokens *Tokens
+}
+
+// newTenants build tenants from config, default tenant with empty ID use top level settings
+// and it serve requests which do not match any tenant
+func newTenants(c Config, defaults *Tokens, maxBytes int) (map[string]*tenant, map[string]string, error) {
+	tenants := map[string]*tenant{
+		"": {
+			Tenant: Tenant{RefreshTokenTTL: c.RefreshTokenTTL, PasswordPolicy: c.PasswordPolicy.limit(maxBytes)},
+			tokens: defaults,
+		},
+	}
+	hosts := map[string]string{}
+
+	for _, t := range c.Tenants {
+		if t.ID == "" {
+			return nil, nil, fmt.Errorf("user: tenant should have ID")
+		}
+		if _, ok := tenants[t.ID]; ok {
+			return nil, nil, fmt.Errorf("user: tenant %s is configured twice", t.ID)
+		}
+
+		tokens := defaults
+		if len(t.Keys) > 0 || t.AccessTokenTTL > 0 {
+			ks := defaults.Keys
+			if len(t.Keys) > 0 {
+				var err error
+				if ks, err = NewKeySetFromConfig(t.Keys, t.SigningKey); err != nil {
+					return nil, nil, fmt.Errorf("user: tenant %s: %v", t.ID, err)
+				}
+			}
+
+			cp := *defaults
+			cp.Keys = ks
+			if t.AccessTokenTTL > 0 {
+				cp.TTL = t.AccessTokenTTL
+			}
+			tokens = &cp
+		}
+
+		if t.RefreshTokenTTL <= 0 {
+			t.RefreshTokenTTL = c.RefreshTokenTTL
+		}
+		if t.PasswordPolicy.MinLength <= 0 {
+			t.PasswordPolicy.MinLength = c.PasswordPolicy.MinLength
+		}
+		if t.PasswordPolicy.MaxLength <= 0 {
+			t.PasswordPolicy.MaxLength = c.PasswordPolicy.MaxLength
+		}
+		t.PasswordPolicy = t.PasswordPolicy.limit(maxBytes)
+
+		tenants[t.ID] = &tenant{Tenant: t, tokens: tokens}
+		for _, host := range t.Hosts {
+			hosts[strings.ToLower(host)] = t.ID
+		}
+	}
+
+	return tenants, hosts, nil
+}
+
+// TenantFromContext return ID of tenant resolved by ResolveTenant middleware,
+// it is empty for default tenant
+func TenantFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(tenantContextKey).(string)
+	return id
+}
+
+// ResolveTenant is gorilla/mux middleware which find tenant of request and put it into context,
+// unknown X-Tenant is refused and unknown host use default tenant
+func (a *App) ResolveTenant(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(TenantHeader)
+		if id != "" {
+			if _, ok := a.tenants[id]; !ok {
+				respondWithError(w, r, http.StatusBadRequest, "unknown tenant")
+				return
+			}
+		} else {
+			host := strings.ToLower(r.Host)
+			if h, _, err := net.SplitHostPort(host); err == nil {
+				host = h
+			}
+			id = a.hosts[host]
+		}
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), tenantContextKey, id)))
+	})
+}
+
+// tenant return tenant of request
+func (a *App) tenant(r *http.Request) *tenant {
+	return a.tenantByID(TenantFromContext(r.Context()))
+}
+
+// tenantByID return tenant with id, users of removed tenants get default one
+func (a *App) tenantByID(id string) *tenant {
+	if t, ok := a.tenants[id]; ok {
+		return t
+	}
+	return a.tenants[""]
+}
+
+// passwordValidator check password is not empty and have length allowed by policy
+func passwordValidator(p PasswordPolicy) v.Validator {
+	return v.All(v.Nonzero("cannot be empty"),
+		v.Len(p.MinLength, p.MaxLength, fmt.Sprintf("length is not between %d and %d", p.MinLength, p.MaxLength)),
+		passwordSizeValidator(p.MaxBytes))
+}
@@ -0,0 +1,172 @@
+package user
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// setUpTenants return app with acme tenant which has own key, token lifetime and password policy
+// and beta tenant which share default settings
+func setUpTenants(t *testing.T) *App {
+	t.Parallel()
+	c := testConfig()
+	c.Tenants = []Tenant{
+		{
+			ID:             "acme",
+			Hosts:          []string{"acme.test"},
+			Keys:           []KeyConfig{{ID: "acme", Secret: []byte("a5d2c0f4e0b54a43b5f1d0e9c8b7a6f5e4d3c2b1a0f9e8d7c6b5a4f3e2d1c0b9")}},
+			AccessTokenTTL: 5 * time.Minute,
+			PasswordPolicy: PasswordPolicy{MinLength: 10},
+		},
+		{ID: "beta", Hosts: []string{"beta.test"}},
+	}
+
+	app, err := NewAppWithConfig(&FakeStorage{}, c)
+	if err != nil {
+		t.Fatalf("cannot create app: %v", err)
+	}
+	return &app
+}
+
+func TestTenantResolve(t *testing.T) {
+	a := setUpTenants(t)
+
+	tests := []struct {
+		name   string
+		url    string
+		header string
+		tenant string
+	}{
+		{"Default", "/login", "", ""},
+		{"Host", "http://acme.test/login", "", "acme"},
+		{"Host with port", "http://BETA.test:8080/login", "", "beta"},
+		{"Unknown host", "http://other.test/login", "", ""},
+		{"Header win over host", "http://acme.test/login", "beta", "beta"},
+	}
+
+	for _, test := range tests {
+		var got string
+		h := a.ResolveTenant(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			got = TenantFromContext(r.Context())
+		}))
+
+		req, _ := http.NewRequest("POST", test.url, nil)
+		if test.header != "" {
+			req.Header.Set(TenantHeader, test.header)
+		}
+		h.ServeHTTP(httptest.NewRecorder(), req)
+		if got != test.tenant {
+			t.Errorf("%s: expected tenant %q, got %q", test.name, test.tenant, got)
+		}
+	}
+
+	if code, _ := jsonRequest(a, "POST", "/login", "unknown", "", nil, nil); code != 400 {
+		t.Errorf("Expected unknown tenant to be refused, got %d", code)
+	}
+}
+
+func TestTenantRegisterSameEmail(t *testing.T) {
+	a := setUpTenants(t)
+	user := map[string]string{"email": "exist@user.com", "password": "acme-password"}
+
+	if code, _ := jsonRequest(a, "POST", "/register", "", "", user, nil); code != 400 {
+		t.Errorf("Expected email to be taken in default tenant, got %d", code)
+	}
+
+	var refused map[string]interface{}
+	if code, body := jsonRequest(a, "POST", "/register", "acme", "", map[string]string{"email": "exist@user.com", "password": "short1"}, &refused); code != 400 || refused["password"] == nil {
+		t.Errorf("Expected acme password policy to refuse short password, got %d %s", code, body)
+	}
+
+	var res map[string]interface{}
+	code, body := jsonRequest(a, "POST", "http://acme.test/register", "", "", user, &res)
+	if code != 201 {
+		t.Fatalf("Expected email to be registered in acme, got %d %s", code, body)
+	}
+	if res["expires_in"] != float64(300) {
+		t.Errorf("Expected acme access token lifetime, got %v", res["expires_in"])
+	}
+
+	c, err := a.tenantByID("acme").tokens.Parse(res["token"].(string))
+	if err != nil || c.Tenant != "acme" {
+		t.Fatalf("Expected acme token, got %+v %v", c, err)
+	}
+
+	if code, _ := jsonRequest(a, "POST", "/login", "acme", "", map[string]string{"email": "exist@user.com", "password": "123123"}, nil); code != 400 {
+		t.Errorf("Expected default tenant password to fail in acme, got %d", code)
+	}
+	if code, _ := jsonRequest(a, "POST", "/login", "acme", "", user, nil); code != 200 {
+		t.Errorf("Expected acme user to login, got %d", code)
+	}
+}
+
+func TestTenantTokenIsolation(t *testing.T) {
+	a := setUpTenants(t)
+	token, _ := loginTokens(t, a)
+
+	tests := []struct {
+		name   string
+		tenant string
+		code   int
+	}{
+		{"Same tenant", "", 200},
+		{"Tenant with own key", "acme", 401},
+		{"Tenant with shared key", "beta", 401},
+	}
+
+	for _, test := range tests {
+		if code, body := jsonRequest(a, "GET", "/profile", test.tenant, token, nil, nil); code != test.code {
+			t.Errorf("%s: expected %d, got %d %s", test.name, test.code, code, body)
+		}
+	}
+
+	_, refresh := loginTokens(t, a)
+	if code, _ := jsonRequest(a, "POST", "/token/refresh", "beta", "", map[string]string{"refresh_token": refresh}, nil); code != 401 {
+		t.Errorf("Expected refresh token to be refused in other tenant, got %d", code)
+	}
+}
+
+func TestTenantServiceToken(t *testing.T) {
+	a := setUpTenants(t)
+	c := &ServiceClient{Name: "billing worker", Scopes: []string{"users:read"}}
+	secret, err := a.RegisterServiceClient(c)
+	if err != nil {
+		t.Fatalf("cannot register service client: %v", err)
+	}
+
+	grant := url.Values{"grant_type": {"client_credentials"}}
+	code, res := postForm(a, "http://acme.test/oauth/token", c.ID, secret, grant)
+	if code != 200 || res["expires_in"] != float64(300) {
+		t.Fatalf("Expected acme service token, got %d %v", code, res)
+	}
+	token := res["access_token"].(string)
+
+	if _, res := postForm(a, "http://acme.test/oauth/introspect", c.ID, secret, url.Values{"token": {token}}); res["active"] != true {
+		t.Errorf("Expected token to be active in acme, got %v", res)
+	}
+	if _, res := postForm(a, "/oauth/introspect", c.ID, secret, url.Values{"token": {token}}); res["active"] != false {
+		t.Errorf("Expected acme token to be inactive in default tenant, got %v", res)
+	}
+}
+
+func TestTenantPasskeyLogin(t *testing.T) {
+	a := setUpTenants(t)
+	sa := newSoftAuthenticator(t)
+	if code, body := registerPasskey(t, a, sa, "none"); code != 201 {
+		t.Fatalf("Expected passkey registration to succeed, got %d %s", code, body)
+	}
+
+	// passkey of default tenant user must not login on acme host
+	assertion := sa.get(loginChallenge(t, a), 1)
+	var refused map[string]interface{}
+	if code, body := jsonRequest(a, "POST", "http://acme.test/webauthn/login/finish", "", "", assertion, &refused); code != 401 || refused["error"] != "passkey cannot be verified" {
+		t.Errorf("Expected passkey from other tenant to be refused, got %d %s", code, body)
+	}
+
+	if code, body := passkeyLogin(t, a, sa); code != 200 {
+		t.Errorf("Expected passkey login in own tenant to succeed, got %d %s", code, body)
+	}
+}
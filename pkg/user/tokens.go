@@ -0,0 +1,254 @@
+package user
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/pkg/errors"
+)
+
+// TokenError tell why token was rejected,
+// Status is http code handlers should respond with
+type TokenError struct {
+	Status int
+	Reason string
+}
+
+func (e *TokenError) Error() string {
+	return e.Reason
+}
+
+// Errors returned by Tokens.Parse
+// Token we can't trust respond with 401, token which is fine but issued
+// for someone else respond with 403
+var (
+	ErrTokenMalformed   = &TokenError{http.StatusUnauthorized, "token is malformed"}
+	ErrTokenSignature   = &TokenError{http.StatusUnauthorized, "token signature is invalid"}
+	ErrTokenExpired     = &TokenError{http.StatusUnauthorized, "token is expired"}
+	ErrTokenNotValidYet = &TokenError{http.StatusUnauthorized, "token is not valid yet"}
+	ErrTokenNoExpiry    = &TokenError{http.StatusUnauthorized, "token has no expiration time"}
+	ErrTokenIssuer      = &TokenError{http.StatusForbidden, "token issuer is not accepted"}
+	ErrTokenAudience    = &TokenError{http.StatusForbidden, "token audience is not accepted"}
+	ErrTokenUse         = &TokenError{http.StatusUnauthorized, "token is not access token"}
+)
+
+// Values of token_use claim, ID tokens for clients can be signed with the same keys
+// as access tokens, so Parse accept only tokens marked as access ones
+const (
+	TokenUseAccess = "access"
+	TokenUseID     = "id"
+)
+
+// tokenErrorStatus return http code for token validation error
+func tokenErrorStatus(err error) int {
+	if te, ok := errors.Cause(err).(*TokenError); ok {
+		return te.Status
+	}
+	return http.StatusUnauthorized
+}
+
+// Audience claim could be either string or array of strings
+type Audience []string
+
+// UnmarshalJSON accept both forms of aud claim
+func (a *Audience) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err == nil {
+		*a = Audience{s}
+		return nil
+	}
+
+	var list []string
+	if err := json.Unmarshal(b, &list); err != nil {
+		return err
+	}
+	*a = Audience(list)
+	return nil
+}
+
+// MarshalJSON write single audience as string, like most libraries expect
+func (a Audience) MarshalJSON() ([]byte, error) {
+	if len(a) == 1 {
+		return json.Marshal(a[0])
+	}
+	return json.Marshal([]string(a))
+}
+
+// Contains tell if audience list has aud
+func (a Audience) Contains(aud string) bool {
+	for _, v := range a {
+		if v == aud {
+			return true
+		}
+	}
+	return false
+}
+
+// Claims are fields we put into jwt tokens
+type Claims struct {
+	Subject   string   `json:"sub,omitempty"`
+	Issuer    string   `json:"iss,omitempty"`
+	Audience  Audience `json:"aud,omitempty"`
+	ExpiresAt int64    `json:"exp,omitempty"`
+	NotBefore int64    `json:"nbf,omitempty"`
+	IssuedAt  int64    `json:"iat,omitempty"`
+	ID        string   `json:"jti,omitempty"`
+
+	Email         string `json:"email"`
+	EmailVerified bool   `json:"email_verified"`
+	FirstName     string `json:"first_name"`
+	LastName      string `json:"last_name"`
+	// Version is user token version, logout from all devices increase it
+	Version int `json:"ver,omitempty"`
+	// AMR is authentication methods used to login, see RFC 8176
+	AMR []string `json:"amr,omitempty"`
+	// Scope is set for tokens issued to OpenID Connect clients, empty for our own logins
+	Scope string `json:"scope,omitempty"`
+	// ClientID is set for tokens issued to clients, for service tokens it is also subject
+	ClientID string `json:"client_id,omitempty"`
+	// Roles and Permissions of user, services can enforce RBAC from token alone
+	Roles       []string `json:"roles,omitempty"`
+	Permissions []string `json:"permissions,omitempty"`
+	// OrgID is active organization of user and OrgRole is user role in it
+	OrgID   int    `json:"org_id,omitempty"`
+	OrgRole string `json:"org_role,omitempty"`
+	// Tenant is ID of tenant user belong to
+	Tenant string `json:"tenant,omitempty"`
+	// SessionID is session of login, revoking session revoke its tokens
+	SessionID string `json:"sid,omitempty"`
+	// TokenUse is always TokenUseAccess for tokens made by NewClaims
+	TokenUse string `json:"token_use,omitempty"`
+}
+
+// Service tell if token was issued to service client and not to user
+func (c *Claims) Service() bool {
+	return c.ClientID != "" && c.Subject == c.ClientID
+}
+
+// Valid is required by jwt.Claims, real validation happen in Tokens.Parse
+func (c *Claims) Valid() error {
+	return nil
+}
+
+// Tokens sign and validate user jwt tokens
+type Tokens struct {
+	Keys     *KeySet
+	Issuer   string
+	Audience string
+	// TTL is lifetime of access tokens
+	TTL time.Duration
+	// Leeway is allowed clock skew between us and other services
+	Leeway time.Duration
+	// Revocations is checked after token validation if set
+	Revocations *Revocations
+
+	now func() time.Time
+}
+
+// NewTokens return Tokens using provided key set
+func NewTokens(keys *KeySet) *Tokens {
+	return &Tokens{
+		Keys:   keys,
+		TTL:    time.Hour,
+		Leeway: time.Minute,
+		now:    time.Now,
+	}
+}
+
+// NewClaims return claims with registered fields filled for subject
+func (t *Tokens) NewClaims(subject string) (*Claims, error) {
+	jti, err := randomString(16)
+	if err != nil {
+		return nil, err
+	}
+
+	now := t.now()
+	c := &Claims{
+		Subject:   subject,
+		Issuer:    t.Issuer,
+		IssuedAt:  now.Unix(),
+		NotBefore: now.Unix(),
+		ExpiresAt: now.Add(t.TTL).Unix(),
+		ID:        jti,
+		TokenUse:  TokenUseAccess,
+	}
+	if t.Audience != "" {
+		c.Audience = Audience{t.Audience}
+	}
+	return c, nil
+}
+
+// Sign claims with current signing key
+func (t *Tokens) Sign(c *Claims) (string, error) {
+	return t.Keys.Sign(c)
+}
+
+// Parse verify token signature and registered claims
+func (t *Tokens) Parse(tokenString string) (*Claims, error) {
+	c := &Claims{}
+	parser := &jwt.Parser{SkipClaimsValidation: true}
+
+	_, err := parser.ParseWithClaims(tokenString, c, t.Keys.Keyfunc)
+	if err != nil {
+		if ve, ok := err.(*jwt.ValidationError); ok && ve.Errors&jwt.ValidationErrorMalformed != 0 {
+			return nil, ErrTokenMalformed
+		}
+		return nil, ErrTokenSignature
+	}
+
+	if err := t.validate(c); err != nil {
+		return nil, err
+	}
+
+	if t.Revocations != nil {
+		revoked, err := t.Revocations.IsRevoked(c)
+		if err != nil {
+			return nil, err
+		}
+		if revoked {
+			return nil, ErrTokenRevoked
+		}
+	}
+
+	return c, nil
+}
+
+// validate check registered claims
+func (t *Tokens) validate(c *Claims) error {
+	now := t.now()
+	leeway := int64(t.Leeway / time.Second)
+
+	if c.ExpiresAt == 0 {
+		return ErrTokenNoExpiry
+	}
+	if now.Unix() > c.ExpiresAt+leeway {
+		return ErrTokenExpired
+	}
+	if now.Unix()+leeway < c.NotBefore || now.Unix()+leeway < c.IssuedAt {
+		return ErrTokenNotValidYet
+	}
+	if t.Issuer != "" && c.Issuer != t.Issuer {
+		return ErrTokenIssuer
+	}
+	if t.Audience != "" && !c.Audience.Contains(t.Audience) {
+		return ErrTokenAudience
+	}
+	if c.TokenUse != TokenUseAccess {
+		return ErrTokenUse
+	}
+
+	return nil
+}
+
+// randomString return url safe string made of n random bytes
+func randomString(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", errors.Wrapf(err, "user: cannot read random bytes")
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
@@ -0,0 +1,79 @@
+package user
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestTokensValidation(t *testing.T) {
+
+	ks, _ := NewKeySetFromConfig(testConfig().Keys, "")
+	other, _ := NewKeySetFromConfig([]KeyConfig{{ID: "test", Secret: []byte("other secret")}}, "")
+	now := time.Unix(1500000000, 0)
+
+	issuer := NewTokens(ks)
+	issuer.Issuer = "https://user.example.com"
+	issuer.Audience = "api"
+	issuer.now = func() time.Time { return now }
+
+	sign := func(tokens *Tokens, change func(c *Claims)) string {
+		c, _ := tokens.NewClaims("1")
+		c.Email = "new@mail.com"
+		if change != nil {
+			change(c)
+		}
+		s, _ := tokens.Sign(c)
+		return s
+	}
+
+	tests := []struct {
+		name  string
+		token string
+		at    time.Time
+		err   error
+	}{
+		{"Valid token", sign(issuer, nil), now, nil},
+		{"Valid within leeway", sign(issuer, nil), now.Add(time.Hour + 30*time.Second), nil},
+		{"Expired", sign(issuer, nil), now.Add(2 * time.Hour), ErrTokenExpired},
+		{"Not valid yet", sign(issuer, nil), now.Add(-time.Hour), ErrTokenNotValidYet},
+		{"Without exp", sign(issuer, func(c *Claims) { c.ExpiresAt = 0 }), now, ErrTokenNoExpiry},
+		{"Wrong issuer", sign(issuer, func(c *Claims) { c.Issuer = "https://evil.example.com" }), now, ErrTokenIssuer},
+		{"Wrong audience", sign(issuer, func(c *Claims) { c.Audience = Audience{"billing", "mail"} }), now, ErrTokenAudience},
+		{"One of audiences", sign(issuer, func(c *Claims) { c.Audience = Audience{"billing", "api"} }), now, nil},
+		{"Wrong signature", sign(NewTokens(other), nil), now, ErrTokenSignature},
+		{"Not access token", sign(issuer, func(c *Claims) { c.TokenUse = TokenUseID }), now, ErrTokenUse},
+		{"Malformed", "123123", now, ErrTokenMalformed},
+	}
+
+	for _, test := range tests {
+		verifier := NewTokens(ks)
+		verifier.Issuer = "https://user.example.com"
+		verifier.Audience = "api"
+		verifier.now = func() time.Time { return test.at }
+
+		_, err := verifier.Parse(test.token)
+		if err != test.err {
+			t.Errorf("%s: expected error %v, got: %v", test.name, test.err, err)
+		}
+	}
+}
+
+func TestTokenErrorStatus(t *testing.T) {
+
+	tests := []struct {
+		err  error
+		code int
+	}{
+		{ErrTokenExpired, http.StatusUnauthorized},
+		{ErrTokenMalformed, http.StatusUnauthorized},
+		{ErrTokenAudience, http.StatusForbidden},
+		{ErrTokenIssuer, http.StatusForbidden},
+	}
+
+	for _, test := range tests {
+		if code := tokenErrorStatus(test.err); code != test.code {
+			t.Errorf("%v: expected status %d, got: %d", test.err, test.code, code)
+		}
+	}
+}
@@ -1,27 +1,77 @@
 package user
 
 import (
-	"fmt"
+	"strconv"
 	"time"
 
-	jwt "github.com/dgrijalva/jwt-go"
 	"github.com/pkg/errors"
 )
 
-var hmacSecret = []byte("588b3236da217f94682121eeeb2732b204a083c5b8a417fe3e58c7072ef81b6b")
-
 // User information
 type User struct {
-	ID        int       `json:"id"`
-	Email     string    `json:"email"`
-	Password  string    `json:"password,omitempty"`
-	CreatedAt time.Time `json:"created_at,omitempty"`
-	LastLogin time.Time `json:"last_login,omitempty"`
+	ID          int       `json:"id"`
+	Email       string    `json:"email"`
+	Password    string    `json:"password,omitempty"`
+	FirstName   string    `json:"first_name"`
+	LastName    string    `json:"last_name"`
+	DisplayName string    `json:"display_name"`
+	AvatarURL   string    `json:"avatar_url"`
+	Locale      string    `json:"locale"`
+	Timezone    string    `json:"timezone"`
+	CreatedAt   time.Time `json:"created_at,omitempty"`
+	LastLogin   time.Time `json:"last_login,omitempty"`
+
+	// EmailVerifiedAt is empty until user follow verification link
+	EmailVerifiedAt *time.Time `json:"-"`
+
+	// TokenVersion is increased on logout from all devices
+	TokenVersion int `json:"-"`
+
+	// TOTPSecret is set on mfa setup, TOTPEnabledAt when user confirm it with first code
+	TOTPSecret    string     `json:"-"`
+	TOTPEnabledAt *time.Time `json:"-"`
+
+	// DisabledAt is set when admin disable account, disabled users cannot login
+	DisabledAt *time.Time `json:"-"`
+
+	// FailedLoginCount is wrong passwords since last login, account is locked until LockedUntil after too many
+	FailedLoginCount int        `json:"-"`
+	LockedUntil      *time.Time `json:"-"`
+
+	// PasswordResetAt is set when admin reset password, user cannot login until new password is chosen
+	PasswordResetAt *time.Time `json:"-"`
+
+	// AMR is authentication methods used for current login, it is put into amr claim
+	AMR []string `json:"-"`
+
+	// Roles and Permissions are loaded with user and put into token claims
+	Roles       []string `json:"-"`
+	Permissions []string `json:"-"`
+
+	// OrgID is active organization of user and OrgRole is user role in it,
+	// both are empty when user is not member of active organization anymore
+	OrgID   int    `json:"-"`
+	OrgRole string `json:"-"`
+
+	// Tenant is ID of tenant user registered in, empty for default tenant
+	Tenant string `json:"-"`
+
+	// SessionID is session of current login, it go to sid claim
+	SessionID int `json:"-"`
 }
 
+// ErrUserDisabled returned when token is requested for disabled account
+var ErrUserDisabled = errors.New("user: account is disabled")
+
+// ErrPasswordResetRequired returned when token is requested for account which password was reset by admin
+var ErrPasswordResetRequired = errors.New("user: password reset is required")
+
+// passwordResetRequired is error message for ErrPasswordResetRequired
+const passwordResetRequired = "password was reset, please choose new one with link we sent you"
+
 // GetToken will return X-Session token
-func (u *User) GetToken() (string, error) {
-	stringToken, err := u.generateToken()
+func (u *User) GetToken(t *Tokens) (string, error) {
+	stringToken, err := u.generateToken(t)
 	if err != nil {
 		return "", errors.Wrapf(err, "user: cannot generate jwt token")
 	}
@@ -30,40 +80,63 @@ func (u *User) GetToken() (string, error) {
 }
 
 // generateToken will generate token and return byte array
-func (u *User) generateToken() (string, error) {
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-		"email":      u.Email,
-		"first_name": "",
-		"last_name":  "",
-	})
-
-	// Sign and get the complete encoded token as a string using the secret
-	return token.SignedString(hmacSecret)
-}
+func (u *User) generateToken(t *Tokens) (string, error) {
+	c, err := u.newClaims(t)
+	if err != nil {
+		return "", err
+	}
 
-// InvalidToken will check if user have valid token
-func (u *User) InvalidToken(tokenString string) (bool, error) {
-	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-		// Don't forget to validate the alg is what you expect:
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("Unexpected signing method: %v", token.Header["alg"])
-		}
+	// Sign and get the complete encoded token as a string using current signing key
+	return t.Sign(c)
+}
 
-		// hmacSecret is a []byte containing your secret, e.g. []byte("my_secret_key")
-		return hmacSecret, nil
-	})
+// newClaims return access token claims filled with user data
+func (u *User) newClaims(t *Tokens) (*Claims, error) {
+	if u.DisabledAt != nil {
+		return nil, ErrUserDisabled
+	}
+	if u.PasswordResetAt != nil {
+		return nil, ErrPasswordResetRequired
+	}
 
+	c, err := t.NewClaims(strconv.Itoa(u.ID))
 	if err != nil {
-		return false, err
+		return nil, err
+	}
+
+	c.Email = u.Email
+	c.FirstName = u.FirstName
+	c.LastName = u.LastName
+	c.EmailVerified = u.EmailVerifiedAt != nil
+	c.Version = u.TokenVersion
+	c.Roles = u.Roles
+	c.Permissions = u.Permissions
+	c.OrgID = u.OrgID
+	c.OrgRole = u.OrgRole
+	c.Tenant = u.Tenant
+	if u.SessionID != 0 {
+		c.SessionID = strconv.Itoa(u.SessionID)
 	}
 
-	claims, ok := token.Claims.(jwt.MapClaims)
+	c.AMR = u.AMR
+	if len(c.AMR) == 0 {
+		c.AMR = []string{AMRPassword}
+	}
+	return c, nil
+}
 
-	if ok && token.Valid {
-		u.Email = claims["email"].(string)
-		return true, nil
+// InvalidToken will check if user have valid token
+// Returned error is *TokenError when token is rejected
+func (u *User) InvalidToken(t *Tokens, tokenString string) (bool, error) {
+	c, err := t.Parse(tokenString)
+	if err != nil {
+		return false, err
 	}
 
-	// Since we don't have any instruction for the token i assume if token is not empty its valid
-	return false, nil
+	u.ID, err = strconv.Atoi(c.Subject)
+	if err != nil {
+		return false, ErrTokenMalformed
+	}
+	u.Email = c.Email
+	return true, nil
 }
@@ -0,0 +1,111 @@
+package user
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/jackc/pgx"
+	v "github.com/webdeveloppro/validating"
+)
+
+// sendEmailVerification mail link which confirm user own email address
+// token keep email it was sent to, so link stop working if email is changed
+func (a *App) sendEmailVerification(u *User) {
+	token, err := a.newActionToken(u, PurposeEmailVerify, u.Email, a.Config.EmailVerifyTTL)
+	if err != nil {
+		log.Printf("cannot create email verification token for user %d: %v", u.ID, err)
+		return
+	}
+
+	err = a.Config.Mailer.Send(Message{
+		To:      u.Email,
+		Subject: "Confirm your email address",
+		Body: fmt.Sprintf("Please confirm your email address by following the link, it is valid for %s:\n%s\n\n"+
+			"If you did not create an account, just ignore this email.",
+			a.Config.EmailVerifyTTL, actionLink(a.Config.EmailVerifyURL, token)),
+	})
+	if err != nil {
+		log.Printf("cannot send email verification to user %d: %v", u.ID, err)
+	}
+}
+
+// verifyEmail confirm user email with token from GET query or POST body
+func (a *App) verifyEmail(w http.ResponseWriter, r *http.Request) {
+	token := r.URL.Query().Get("token")
+
+	if r.Method == "POST" && r.Body != nil {
+		var req struct {
+			Token string `json:"token"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err == nil && req.Token != "" {
+			token = req.Token
+		}
+	}
+
+	invalid := v.NewErrors("token", v.ErrInvalid, "verification link is invalid or expired").JSONErrors()
+
+	at, err := a.useActionToken(token, PurposeEmailVerify)
+	if err != nil {
+		if err != ErrActionTokenInvalid {
+			log.Printf("cannot use email verification token: %v", err)
+		}
+		respondWithJSON(w, r, http.StatusBadRequest, invalid)
+		return
+	}
+
+	u := User{ID: at.UserID}
+	if err := a.Storage.GetUserByID(&u); err != nil || u.Email != at.Data {
+		respondWithJSON(w, r, http.StatusBadRequest, invalid)
+		return
+	}
+
+	if u.EmailVerifiedAt == nil {
+		if err := a.Storage.SetEmailVerified(&u); err != nil {
+			log.Printf("cannot set email verified for user %d: %v", u.ID, err)
+			respondWithJSON(w, r, http.StatusInternalServerError,
+				v.NewErrors("__error__", v.ErrInvalid, "cannot verify email, please try again in few minutes").JSONErrors())
+			return
+		}
+	}
+
+	respondWithJSON(w, r, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// resendEmailVerification send new verification link
+// response is the same for unknown and verified emails, so it can't be used to find accounts
+func (a *App) resendEmailVerification(w http.ResponseWriter, r *http.Request) {
+	u := User{}
+
+	if r.Body == nil {
+		respondWithJSON(w, r, http.StatusBadRequest, []string{})
+		return
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&u); err != nil {
+		respondWithJSON(w, r, http.StatusBadRequest, []string{})
+		return
+	}
+
+	errs := v.Validate(v.Schema{
+		v.F("email", &u.Email): emailValidator(),
+	})
+
+	if len(errs) > 0 {
+		respondWithJSON(w, r, http.StatusBadRequest, errs.JSONErrors())
+		return
+	}
+
+	u.Tenant = TenantFromContext(r.Context())
+	err := a.Storage.GetUserByEmail(&u)
+	if err == nil && u.EmailVerifiedAt == nil {
+		a.sendEmailVerification(&u)
+	} else if err != nil && err != pgx.ErrNoRows {
+		log.Printf("cannot get user %s for email verification: %v", u.Email, err)
+	}
+
+	respondWithJSON(w, r, http.StatusOK, map[string]string{
+		"status": "if unverified account with such email exists, we sent verification link to it",
+	})
+}
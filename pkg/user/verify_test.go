@@ -0,0 +1,110 @@
+package user
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestRegisterSendVerification(t *testing.T) {
+	a := SetUp(t)
+
+	code, body := jsonRequest(a, "POST", "/register", "", "", map[string]string{"email": "new@user.com", "password": "123123123"}, nil)
+	if code != 201 {
+		t.Fatalf("Expected register to succeed, got %d %s", code, body)
+	}
+
+	mailedToken(t, a, "new@user.com")
+}
+
+func TestVerifyEmail(t *testing.T) {
+	a := SetUp(t)
+
+	tests := []struct {
+		name  string
+		email string
+		body  string
+		code  int
+	}{
+		{"Wrong email", "wrong", `{"email":["Wrong email"]}`, 400},
+		{"Unknown email", "new@user.com", `{"status":"if unverified account with such email exists, we sent verification link to it"}`, 200},
+		{"Existing email", "exist@user.com", `{"status":"if unverified account with such email exists, we sent verification link to it"}`, 200},
+	}
+
+	for _, test := range tests {
+		code, body := jsonRequest(a, "POST", "/verify-email/resend", "", "", map[string]string{"email": test.email}, nil)
+		if code != test.code || body != test.body {
+			t.Errorf("%s: expected %d %s, got %d %s", test.name, test.code, test.body, code, body)
+		}
+	}
+
+	token := mailedToken(t, a, "exist@user.com")
+
+	req, _ := http.NewRequest("GET", "/verify-email?token="+token, nil)
+	response := executeRequest(a, req)
+	if response.Code != 200 {
+		t.Fatalf("Expected email verification to succeed, got %d %s", response.Code, response.Body.String())
+	}
+
+	// token is single use
+	if code, body := jsonRequest(a, "POST", "/verify-email", "", "", map[string]string{"token": token}, nil); code != 400 || body != `{"token":["verification link is invalid or expired"]}` {
+		t.Errorf("Expected used token to be rejected, got %d %s", code, body)
+	}
+
+	access, _ := loginTokens(t, a)
+	c, err := a.Tokens.Parse(access)
+	if err != nil {
+		t.Fatalf("Expected valid token, got error: %v", err)
+	}
+	if !c.EmailVerified {
+		t.Errorf("Expected email_verified claim, got: %+v", c)
+	}
+
+	// verified user do not get new links
+	mails := len(a.Config.Mailer.(*MemoryMailer).Messages())
+	jsonRequest(a, "POST", "/verify-email/resend", "", "", map[string]string{"email": "exist@user.com"}, nil)
+	if got := len(a.Config.Mailer.(*MemoryMailer).Messages()); got != mails {
+		t.Errorf("Expected no mail for verified user, got %d mails", got-mails)
+	}
+}
+
+func TestVerifyEmailChanged(t *testing.T) {
+	a := SetUp(t)
+
+	// link was sent to address user do not have anymore
+	token, err := a.newActionToken(&User{ID: 1}, PurposeEmailVerify, "old@user.com", a.Config.EmailVerifyTTL)
+	if err != nil {
+		t.Fatalf("cannot create token: %v", err)
+	}
+
+	if code, body := jsonRequest(a, "POST", "/verify-email", "", "", map[string]string{"token": token}, nil); code != 400 {
+		t.Errorf("Expected token for old email to be rejected, got %d %s", code, body)
+	}
+}
+
+func TestRequireVerifiedEmail(t *testing.T) {
+	t.Parallel()
+
+	c := testConfig()
+	c.RequireVerifiedEmail = true
+	a, err := NewAppWithConfig(&FakeStorage{}, c)
+	if err != nil {
+		t.Fatalf("cannot create app: %v", err)
+	}
+
+	code, body := jsonRequest(&a, "POST", "/register", "", "", map[string]string{"email": "new@user.com", "password": "123123123"}, nil)
+	if code != 201 || body != `{"status":"we sent verification link to your email address"}` {
+		t.Errorf("Expected register without tokens, got %d %s", code, body)
+	}
+
+	code, body = jsonRequest(&a, "POST", "/login", "", "", map[string]string{"email": "exist@user.com", "password": "123123"}, nil)
+	if code != 403 || body != `{"__error__":["email address is not verified, please follow the link we sent you"]}` {
+		t.Errorf("Expected login to be refused, got %d %s", code, body)
+	}
+
+	jsonRequest(&a, "POST", "/verify-email/resend", "", "", map[string]string{"email": "exist@user.com"}, nil)
+	if code, body := jsonRequest(&a, "POST", "/verify-email", "", "", map[string]string{"token": mailedToken(t, &a, "exist@user.com")}, nil); code != 200 {
+		t.Fatalf("Expected email verification to succeed, got %d %s", code, body)
+	}
+
+	loginTokens(t, &a)
+}
@@ -0,0 +1,645 @@
+package user
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"log"
+	"math/big"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/jackc/pgx"
+	"github.com/pkg/errors"
+)
+
+// WebAuthn ceremony purposes of challenges
+const (
+	PurposeWebAuthnRegister = "webauthn_register"
+	PurposeWebAuthnLogin    = "webauthn_login"
+)
+
+// Authentication methods of passkey login, see RFC 8176
+const (
+	AMRHardwareKey = "hwk"
+	AMRUser        = "user"
+)
+
+// COSE algorithms we accept for credential keys
+const (
+	coseES256 = -7
+	coseRS256 = -257
+)
+
+// authenticator data flags
+const (
+	flagUserPresent  = 0x01
+	flagUserVerified = 0x04
+	flagAttestedData = 0x40
+)
+
+// ErrWebAuthn is returned when client response fail verification
+var ErrWebAuthn = errors.New("user: webauthn verification failed")
+
+// ErrWebAuthnCredentialExists returned by storage when credential is already registered
+var ErrWebAuthnCredentialExists = errors.New("user: webauthn credential already registered")
+
+// WebAuthnChallenge is random challenge we give to browser for one ceremony,
+// only sha256 hash of it is stored. UserID is empty for passkey login
+type WebAuthnChallenge struct {
+	ID            int
+	UserID        int
+	Purpose       string
+	ChallengeHash string
+	CreatedAt     time.Time
+	ExpiresAt     time.Time
+}
+
+// WebAuthnCredential is passkey or security key registered by user
+type WebAuthnCredential struct {
+	ID           int
+	UserID       int
+	CredentialID []byte
+	// PublicKey is COSE encoded credential public key
+	PublicKey  []byte
+	SignCount  uint32
+	AAGUID     []byte
+	Name       string
+	CreatedAt  time.Time
+	LastUsedAt *time.Time
+}
+
+// webauthnCredentialJSON is PublicKeyCredential serialized by browser,
+// binary fields are base64url encoded
+type webauthnCredentialJSON struct {
+	ID       string `json:"id"`
+	RawID    string `json:"rawId"`
+	Type     string `json:"type"`
+	Name     string `json:"name"`
+	Response struct {
+		ClientDataJSON    string `json:"clientDataJSON"`
+		AttestationObject string `json:"attestationObject"`
+		AuthenticatorData string `json:"authenticatorData"`
+		Signature         string `json:"signature"`
+		UserHandle        string `json:"userHandle"`
+	} `json:"response"`
+}
+
+type collectedClientData struct {
+	Type      string `json:"type"`
+	Challenge string `json:"challenge"`
+	Origin    string `json:"origin"`
+}
+
+type attestationObject struct {
+	Fmt      string          `cbor:"fmt"`
+	AttStmt  cbor.RawMessage `cbor:"attStmt"`
+	AuthData []byte          `cbor:"authData"`
+}
+
+type packedAttestation struct {
+	Alg int64    `cbor:"alg"`
+	Sig []byte   `cbor:"sig"`
+	X5C [][]byte `cbor:"x5c"`
+}
+
+// authenticatorData is parsed authData, credential fields are set only on registration
+type authenticatorData struct {
+	RPIDHash     []byte
+	Flags        byte
+	SignCount    uint32
+	AAGUID       []byte
+	CredentialID []byte
+	PublicKey    []byte
+}
+
+// webauthnUserHandle is user.id we give to authenticator, it come back on passkey login
+func webauthnUserHandle(userID int) []byte {
+	return []byte(strconv.Itoa(userID))
+}
+
+// decodeBase64URL accept base64url with and without padding
+func decodeBase64URL(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+}
+
+// newWebAuthnChallenge create and store challenge for ceremony
+func (a *App) newWebAuthnChallenge(userID int, purpose string) (string, error) {
+	challenge, err := randomString(32)
+	if err != nil {
+		return "", err
+	}
+
+	c := WebAuthnChallenge{
+		UserID:        userID,
+		Purpose:       purpose,
+		ChallengeHash: hashToken(challenge),
+		ExpiresAt:     time.Now().Add(a.Config.WebAuthnTimeout),
+	}
+	if err := a.Storage.CreateWebAuthnChallenge(&c); err != nil {
+		return "", errors.Wrapf(err, "user: cannot store webauthn challenge")
+	}
+	return challenge, nil
+}
+
+// verifyClientData check ceremony type, origin and consume challenge
+func (a *App) verifyClientData(raw []byte, typ, purpose string) (*WebAuthnChallenge, error) {
+	var cd collectedClientData
+	if err := json.Unmarshal(raw, &cd); err != nil {
+		return nil, errors.Wrapf(ErrWebAuthn, "cannot decode client data: %v", err)
+	}
+
+	if cd.Type != typ {
+		return nil, errors.Wrapf(ErrWebAuthn, "wrong client data type %q", cd.Type)
+	}
+
+	allowed := false
+	for _, o := range a.Config.WebAuthnOrigins {
+		if cd.Origin == o {
+			allowed = true
+		}
+	}
+	if !allowed {
+		return nil, errors.Wrapf(ErrWebAuthn, "origin %q is not allowed", cd.Origin)
+	}
+
+	c := WebAuthnChallenge{ChallengeHash: hashToken(strings.TrimRight(cd.Challenge, "="))}
+	if err := a.Storage.UseWebAuthnChallenge(&c); err != nil {
+		if err == pgx.ErrNoRows {
+			return nil, errors.Wrapf(ErrWebAuthn, "challenge is unknown or used")
+		}
+		return nil, err
+	}
+
+	if c.Purpose != purpose || time.Now().After(c.ExpiresAt) {
+		return nil, errors.Wrapf(ErrWebAuthn, "challenge is expired")
+	}
+	return &c, nil
+}
+
+// parseAuthenticatorData parse authData and check rp id hash and user presence
+func (a *App) parseAuthenticatorData(data []byte, attested bool) (*authenticatorData, error) {
+	if len(data) < 37 {
+		return nil, errors.Wrapf(ErrWebAuthn, "authenticator data is too short")
+	}
+
+	ad := &authenticatorData{
+		RPIDHash:  data[:32],
+		Flags:     data[32],
+		SignCount: binary.BigEndian.Uint32(data[33:37]),
+	}
+
+	rpIDHash := sha256.Sum256([]byte(a.Config.WebAuthnRPID))
+	if subtle.ConstantTimeCompare(ad.RPIDHash, rpIDHash[:]) != 1 {
+		return nil, errors.Wrapf(ErrWebAuthn, "rp id hash do not match")
+	}
+
+	if ad.Flags&flagUserPresent == 0 {
+		return nil, errors.Wrapf(ErrWebAuthn, "user is not present")
+	}
+
+	if !attested {
+		return ad, nil
+	}
+
+	if ad.Flags&flagAttestedData == 0 || len(data) < 55 {
+		return nil, errors.Wrapf(ErrWebAuthn, "no attested credential data")
+	}
+
+	ad.AAGUID = data[37:53]
+	idLen := int(binary.BigEndian.Uint16(data[53:55]))
+	if len(data) < 55+idLen {
+		return nil, errors.Wrapf(ErrWebAuthn, "credential id is too short")
+	}
+	ad.CredentialID = data[55 : 55+idLen]
+
+	// COSE key is followed by extensions, so we need exact length of it
+	var key cbor.RawMessage
+	if _, err := cbor.UnmarshalFirst(data[55+idLen:], &key); err != nil {
+		return nil, errors.Wrapf(ErrWebAuthn, "cannot decode credential public key: %v", err)
+	}
+	ad.PublicKey = key
+
+	return ad, nil
+}
+
+// parseCOSEKey return public key and COSE algorithm of credential
+func parseCOSEKey(data []byte) (crypto.PublicKey, int64, error) {
+	var m map[int64]interface{}
+	if err := cbor.Unmarshal(data, &m); err != nil {
+		return nil, 0, errors.Wrapf(ErrWebAuthn, "cannot decode public key: %v", err)
+	}
+
+	kty, _ := coseInt(m[1])
+	alg, _ := coseInt(m[3])
+
+	switch {
+	case kty == 2 && alg == coseES256:
+		crv, _ := coseInt(m[-1])
+		x, _ := m[-2].([]byte)
+		y, _ := m[-3].([]byte)
+		if crv != 1 || len(x) != 32 || len(y) != 32 {
+			return nil, 0, errors.Wrapf(ErrWebAuthn, "unsupported ec key")
+		}
+
+		key := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !key.Curve.IsOnCurve(key.X, key.Y) {
+			return nil, 0, errors.Wrapf(ErrWebAuthn, "ec point is not on curve")
+		}
+		return key, alg, nil
+
+	case kty == 3 && alg == coseRS256:
+		n, _ := m[-1].([]byte)
+		e, _ := m[-2].([]byte)
+		if len(n) < 256 || len(e) == 0 || len(e) > 4 {
+			return nil, 0, errors.Wrapf(ErrWebAuthn, "unsupported rsa key")
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, alg, nil
+	}
+
+	return nil, 0, errors.Wrapf(ErrWebAuthn, "unsupported key type %d with algorithm %d", kty, alg)
+}
+
+// coseInt convert cbor integer to int64
+func coseInt(v interface{}) (int64, bool) {
+	switch i := v.(type) {
+	case int64:
+		return i, true
+	case uint64:
+		return int64(i), true
+	}
+	return 0, false
+}
+
+// verifySignature check ES256 or RS256 signature of data
+func verifySignature(key crypto.PublicKey, alg int64, data, sig []byte) error {
+	digest := sha256.Sum256(data)
+
+	switch k := key.(type) {
+	case *ecdsa.PublicKey:
+		var es struct{ R, S *big.Int }
+		if alg != coseES256 {
+			return errors.Wrapf(ErrWebAuthn, "algorithm %d do not match key", alg)
+		}
+		if rest, err := asn1.Unmarshal(sig, &es); err != nil || len(rest) > 0 {
+			return errors.Wrapf(ErrWebAuthn, "malformed signature")
+		}
+		if !ecdsa.Verify(k, digest[:], es.R, es.S) {
+			return errors.Wrapf(ErrWebAuthn, "signature is invalid")
+		}
+		return nil
+
+	case *rsa.PublicKey:
+		if alg != coseRS256 {
+			return errors.Wrapf(ErrWebAuthn, "algorithm %d do not match key", alg)
+		}
+		if err := rsa.VerifyPKCS1v15(k, crypto.SHA256, digest[:], sig); err != nil {
+			return errors.Wrapf(ErrWebAuthn, "signature is invalid")
+		}
+		return nil
+	}
+
+	return errors.Wrapf(ErrWebAuthn, "unsupported key")
+}
+
+// verifyAttestation check attestation statement, we support "none" and "packed"
+// Certificates from packed x5c are checked for signature only, we don't keep
+// list of trusted authenticator vendors
+func verifyAttestation(att *attestationObject, ad *authenticatorData, clientDataHash []byte) error {
+	switch att.Fmt {
+	case "none":
+		return nil
+
+	case "packed":
+		var stmt packedAttestation
+		if err := cbor.Unmarshal(att.AttStmt, &stmt); err != nil {
+			return errors.Wrapf(ErrWebAuthn, "cannot decode packed attestation: %v", err)
+		}
+
+		signed := append(append([]byte{}, att.AuthData...), clientDataHash...)
+
+		// self attestation is signed by credential key itself
+		if len(stmt.X5C) == 0 {
+			key, alg, err := parseCOSEKey(ad.PublicKey)
+			if err != nil {
+				return err
+			}
+			if stmt.Alg != alg {
+				return errors.Wrapf(ErrWebAuthn, "attestation algorithm do not match credential")
+			}
+			return verifySignature(key, alg, signed, stmt.Sig)
+		}
+
+		cert, err := x509.ParseCertificate(stmt.X5C[0])
+		if err != nil {
+			return errors.Wrapf(ErrWebAuthn, "cannot parse attestation certificate: %v", err)
+		}
+		if cert.Version != 3 || cert.IsCA {
+			return errors.Wrapf(ErrWebAuthn, "wrong attestation certificate")
+		}
+		return verifySignature(cert.PublicKey, stmt.Alg, signed, stmt.Sig)
+	}
+
+	return errors.Wrapf(ErrWebAuthn, "unsupported attestation format %q", att.Fmt)
+}
+
+// webauthnRegisterBegin return options for navigator.credentials.create
+func (a *App) webauthnRegisterBegin(w http.ResponseWriter, r *http.Request) {
+	u, _ := UserFromContext(r.Context())
+
+	challenge, err := a.newWebAuthnChallenge(u.ID, PurposeWebAuthnRegister)
+	if err != nil {
+		log.Printf("cannot create webauthn challenge for user %d: %v", u.ID, err)
+		respondWithError(w, r, http.StatusInternalServerError, "cannot register passkey, please try again in few minutes")
+		return
+	}
+
+	creds, err := a.Storage.GetWebAuthnCredentials(u.ID)
+	if err != nil {
+		log.Printf("cannot get webauthn credentials of user %d: %v", u.ID, err)
+		respondWithError(w, r, http.StatusInternalServerError, "cannot register passkey, please try again in few minutes")
+		return
+	}
+
+	// don't let user register same authenticator twice
+	exclude := []map[string]string{}
+	for _, c := range creds {
+		exclude = append(exclude, map[string]string{
+			"type": "public-key",
+			"id":   base64.RawURLEncoding.EncodeToString(c.CredentialID),
+		})
+	}
+
+	name := u.DisplayName
+	if name == "" {
+		name = u.Email
+	}
+
+	respondWithJSON(w, r, http.StatusOK, map[string]interface{}{
+		"publicKey": map[string]interface{}{
+			"challenge": challenge,
+			"rp":        map[string]string{"id": a.Config.WebAuthnRPID, "name": a.Config.WebAuthnRPName},
+			"user": map[string]string{
+				"id":          base64.RawURLEncoding.EncodeToString(webauthnUserHandle(u.ID)),
+				"name":        u.Email,
+				"displayName": name,
+			},
+			"pubKeyCredParams": []map[string]interface{}{
+				{"type": "public-key", "alg": coseES256},
+				{"type": "public-key", "alg": coseRS256},
+			},
+			"timeout":            int(a.Config.WebAuthnTimeout / time.Millisecond),
+			"attestation":        "none",
+			"excludeCredentials": exclude,
+			"authenticatorSelection": map[string]string{
+				"residentKey":      "preferred",
+				"userVerification": "preferred",
+			},
+		},
+	})
+}
+
+// webauthnRegisterFinish verify attestation and store new credential
+func (a *App) webauthnRegisterFinish(w http.ResponseWriter, r *http.Request) {
+	u, _ := UserFromContext(r.Context())
+
+	var req webauthnCredentialJSON
+	if r.Body == nil {
+		respondWithJSON(w, r, http.StatusBadRequest, []string{})
+		return
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondWithJSON(w, r, http.StatusBadRequest, []string{})
+		return
+	}
+
+	cred, err := a.verifyRegistration(u, &req)
+	if err == nil {
+		err = a.Storage.CreateWebAuthnCredential(cred)
+	}
+
+	if err != nil {
+		switch errors.Cause(err) {
+		case ErrWebAuthn:
+			log.Printf("webauthn registration of user %d failed: %v", u.ID, err)
+			respondWithError(w, r, http.StatusBadRequest, "passkey cannot be verified")
+		case ErrWebAuthnCredentialExists:
+			respondWithError(w, r, http.StatusBadRequest, "passkey is already registered")
+		default:
+			log.Printf("cannot register webauthn credential for user %d: %v", u.ID, err)
+			respondWithError(w, r, http.StatusInternalServerError, "cannot register passkey, please try again in few minutes")
+		}
+		return
+	}
+
+	respondWithJSON(w, r, http.StatusCreated, map[string]interface{}{
+		"id":         base64.RawURLEncoding.EncodeToString(cred.CredentialID),
+		"name":       cred.Name,
+		"created_at": cred.CreatedAt,
+	})
+}
+
+// verifyRegistration run registration ceremony checks and return credential to store
+func (a *App) verifyRegistration(u *User, req *webauthnCredentialJSON) (*WebAuthnCredential, error) {
+	clientData, err := decodeBase64URL(req.Response.ClientDataJSON)
+	if err != nil {
+		return nil, errors.Wrapf(ErrWebAuthn, "cannot decode client data")
+	}
+
+	rawAtt, err := decodeBase64URL(req.Response.AttestationObject)
+	if err != nil {
+		return nil, errors.Wrapf(ErrWebAuthn, "cannot decode attestation object")
+	}
+
+	c, err := a.verifyClientData(clientData, "webauthn.create", PurposeWebAuthnRegister)
+	if err != nil {
+		return nil, err
+	}
+	if c.UserID != u.ID {
+		return nil, errors.Wrapf(ErrWebAuthn, "challenge was issued for other user")
+	}
+
+	var att attestationObject
+	if err := cbor.Unmarshal(rawAtt, &att); err != nil {
+		return nil, errors.Wrapf(ErrWebAuthn, "cannot decode attestation object: %v", err)
+	}
+
+	ad, err := a.parseAuthenticatorData(att.AuthData, true)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, _, err := parseCOSEKey(ad.PublicKey); err != nil {
+		return nil, err
+	}
+
+	clientDataHash := sha256.Sum256(clientData)
+	if err := verifyAttestation(&att, ad, clientDataHash[:]); err != nil {
+		return nil, err
+	}
+
+	name := truncate(strings.TrimSpace(req.Name), 100)
+
+	return &WebAuthnCredential{
+		UserID:       u.ID,
+		CredentialID: ad.CredentialID,
+		PublicKey:    ad.PublicKey,
+		SignCount:    ad.SignCount,
+		AAGUID:       ad.AAGUID,
+		Name:         name,
+	}, nil
+}
+
+// webauthnLoginBegin return options for navigator.credentials.get
+// allowCredentials is empty, so browser offer passkeys stored for our rp id
+func (a *App) webauthnLoginBegin(w http.ResponseWriter, r *http.Request) {
+	challenge, err := a.newWebAuthnChallenge(0, PurposeWebAuthnLogin)
+	if err != nil {
+		log.Printf("cannot create webauthn challenge: %v", err)
+		respondWithError(w, r, http.StatusInternalServerError, "cannot login, please try again in few minutes")
+		return
+	}
+
+	respondWithJSON(w, r, http.StatusOK, map[string]interface{}{
+		"publicKey": map[string]interface{}{
+			"challenge":        challenge,
+			"rpId":             a.Config.WebAuthnRPID,
+			"timeout":          int(a.Config.WebAuthnTimeout / time.Millisecond),
+			"userVerification": "preferred",
+			"allowCredentials": []string{},
+		},
+	})
+}
+
+// webauthnLoginFinish verify assertion and return same tokens as login
+func (a *App) webauthnLoginFinish(w http.ResponseWriter, r *http.Request) {
+	var req webauthnCredentialJSON
+	if r.Body == nil {
+		respondWithJSON(w, r, http.StatusBadRequest, []string{})
+		return
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondWithJSON(w, r, http.StatusBadRequest, []string{})
+		return
+	}
+
+	u, err := a.verifyAssertion(&req, TenantFromContext(r.Context()))
+	if err != nil {
+		if errors.Cause(err) == ErrWebAuthn || err == pgx.ErrNoRows {
+			log.Printf("webauthn login failed: %v", err)
+			respondWithError(w, r, http.StatusUnauthorized, "passkey cannot be verified")
+			return
+		}
+		log.Printf("cannot verify webauthn assertion: %v", err)
+		respondWithError(w, r, http.StatusInternalServerError, "cannot login, please try again in few minutes")
+		return
+	}
+
+	if a.Config.RequireVerifiedEmail && u.EmailVerifiedAt == nil {
+		respondWithError(w, r, http.StatusForbidden, "email address is not verified, please follow the link we sent you")
+		return
+	}
+
+	if err := a.Storage.UpdateLastLogin(u); err != nil {
+		log.Printf("cannot update last login for user %d: %v", u.ID, err)
+	}
+
+	a.respondWithTokens(w, r, http.StatusOK, u, "")
+}
+
+// verifyAssertion run authentication ceremony checks and return credential owner,
+// passkey of user from other tenant is refused like unknown one
+func (a *App) verifyAssertion(req *webauthnCredentialJSON, tenant string) (*User, error) {
+	credID, err := decodeBase64URL(req.RawID)
+	if err != nil || len(credID) == 0 {
+		return nil, errors.Wrapf(ErrWebAuthn, "cannot decode credential id")
+	}
+
+	clientData, err := decodeBase64URL(req.Response.ClientDataJSON)
+	if err != nil {
+		return nil, errors.Wrapf(ErrWebAuthn, "cannot decode client data")
+	}
+
+	authData, err := decodeBase64URL(req.Response.AuthenticatorData)
+	if err != nil {
+		return nil, errors.Wrapf(ErrWebAuthn, "cannot decode authenticator data")
+	}
+
+	sig, err := decodeBase64URL(req.Response.Signature)
+	if err != nil {
+		return nil, errors.Wrapf(ErrWebAuthn, "cannot decode signature")
+	}
+
+	if _, err := a.verifyClientData(clientData, "webauthn.get", PurposeWebAuthnLogin); err != nil {
+		return nil, err
+	}
+
+	cred := WebAuthnCredential{CredentialID: credID}
+	if err := a.Storage.GetWebAuthnCredential(&cred); err != nil {
+		if err == pgx.ErrNoRows {
+			return nil, errors.Wrapf(ErrWebAuthn, "unknown credential")
+		}
+		return nil, err
+	}
+
+	if req.Response.UserHandle != "" {
+		handle, err := decodeBase64URL(req.Response.UserHandle)
+		if err != nil || !bytes.Equal(handle, webauthnUserHandle(cred.UserID)) {
+			return nil, errors.Wrapf(ErrWebAuthn, "user handle do not match credential")
+		}
+	}
+
+	u := &User{ID: cred.UserID}
+	if err := a.Storage.GetUserByID(u); err != nil {
+		return nil, err
+	}
+	if u.Tenant != tenant {
+		return nil, errors.Wrapf(ErrWebAuthn, "credential %d belong to other tenant", cred.ID)
+	}
+
+	ad, err := a.parseAuthenticatorData(authData, false)
+	if err != nil {
+		return nil, err
+	}
+
+	key, alg, err := parseCOSEKey(cred.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	clientDataHash := sha256.Sum256(clientData)
+	if err := verifySignature(key, alg, append(append([]byte{}, authData...), clientDataHash[:]...), sig); err != nil {
+		return nil, err
+	}
+
+	// counter which do not grow means authenticator was probably cloned,
+	// authenticators without counter always send 0
+	if (ad.SignCount != 0 || cred.SignCount != 0) && ad.SignCount <= cred.SignCount {
+		return nil, errors.Wrapf(ErrWebAuthn, "sign counter of credential %d did not increase", cred.ID)
+	}
+
+	cred.SignCount = ad.SignCount
+	if err := a.Storage.UpdateWebAuthnSignCount(&cred); err != nil {
+		return nil, err
+	}
+
+	u.AMR = []string{AMRHardwareKey}
+	if ad.Flags&flagUserVerified != 0 {
+		u.AMR = append(u.AMR, AMRUser, AMRMFA)
+	}
+	return u, nil
+}
@@ -0,0 +1,292 @@
+package user
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+var b64 = base64.RawURLEncoding
+
+// softAuthenticator is software implementation of WebAuthn authenticator
+type softAuthenticator struct {
+	key    *ecdsa.PrivateKey
+	credID []byte
+	count  uint32
+	rpID   string
+	origin string
+}
+
+func newSoftAuthenticator(t *testing.T) *softAuthenticator {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("cannot generate key: %v", err)
+	}
+
+	credID := make([]byte, 16)
+	rand.Read(credID)
+
+	return &softAuthenticator{key: key, credID: credID, rpID: "localhost", origin: "http://localhost:3000"}
+}
+
+func (sa *softAuthenticator) clientData(typ, challenge string) []byte {
+	b, _ := json.Marshal(map[string]string{"type": typ, "challenge": challenge, "origin": sa.origin})
+	return b
+}
+
+func (sa *softAuthenticator) authData(attested bool) []byte {
+	rpIDHash := sha256.Sum256([]byte(sa.rpID))
+	data := append([]byte{}, rpIDHash[:]...)
+
+	flags := byte(flagUserPresent | flagUserVerified)
+	if attested {
+		flags |= flagAttestedData
+	}
+	data = append(data, flags)
+
+	count := make([]byte, 4)
+	binary.BigEndian.PutUint32(count, sa.count)
+	data = append(data, count...)
+
+	if attested {
+		data = append(data, make([]byte, 16)...)
+		idLen := make([]byte, 2)
+		binary.BigEndian.PutUint16(idLen, uint16(len(sa.credID)))
+		data = append(data, idLen...)
+		data = append(data, sa.credID...)
+
+		key, _ := cbor.Marshal(map[int]interface{}{
+			1:  2,
+			3:  coseES256,
+			-1: 1,
+			-2: sa.key.X.FillBytes(make([]byte, 32)),
+			-3: sa.key.Y.FillBytes(make([]byte, 32)),
+		})
+		data = append(data, key...)
+	}
+	return data
+}
+
+func (sa *softAuthenticator) sign(authData, clientData []byte) []byte {
+	hash := sha256.Sum256(clientData)
+	digest := sha256.Sum256(append(append([]byte{}, authData...), hash[:]...))
+	sig, _ := ecdsa.SignASN1(rand.Reader, sa.key, digest[:])
+	return sig
+}
+
+// create return response of navigator.credentials.create with given attestation format
+func (sa *softAuthenticator) create(challenge, format string) map[string]interface{} {
+	clientData := sa.clientData("webauthn.create", challenge)
+	authData := sa.authData(true)
+
+	stmt := map[string]interface{}{}
+	if format == "packed" {
+		stmt = map[string]interface{}{"alg": coseES256, "sig": sa.sign(authData, clientData)}
+	}
+
+	att, _ := cbor.Marshal(map[string]interface{}{"fmt": format, "attStmt": stmt, "authData": authData})
+
+	return map[string]interface{}{
+		"id":    b64.EncodeToString(sa.credID),
+		"rawId": b64.EncodeToString(sa.credID),
+		"type":  "public-key",
+		"name":  "test key",
+		"response": map[string]string{
+			"clientDataJSON":    b64.EncodeToString(clientData),
+			"attestationObject": b64.EncodeToString(att),
+		},
+	}
+}
+
+// get return response of navigator.credentials.get, counter is increased like real authenticators do
+func (sa *softAuthenticator) get(challenge string, userID int) map[string]interface{} {
+	sa.count++
+	clientData := sa.clientData("webauthn.get", challenge)
+	authData := sa.authData(false)
+
+	return map[string]interface{}{
+		"id":    b64.EncodeToString(sa.credID),
+		"rawId": b64.EncodeToString(sa.credID),
+		"type":  "public-key",
+		"response": map[string]string{
+			"clientDataJSON":    b64.EncodeToString(clientData),
+			"authenticatorData": b64.EncodeToString(authData),
+			"signature":         b64.EncodeToString(sa.sign(authData, clientData)),
+			"userHandle":        b64.EncodeToString(webauthnUserHandle(userID)),
+		},
+	}
+}
+
+// webauthnChallenge return challenge from begin response
+func webauthnChallenge(t *testing.T, code int, body string) string {
+	var res struct {
+		PublicKey struct {
+			Challenge string `json:"challenge"`
+		} `json:"publicKey"`
+	}
+	json.Unmarshal([]byte(body), &res)
+	if code != 200 || res.PublicKey.Challenge == "" {
+		t.Fatalf("Expected challenge, got %d %s", code, body)
+	}
+	return res.PublicKey.Challenge
+}
+
+func registerPasskey(t *testing.T, a *App, sa *softAuthenticator, format string) (int, string) {
+	token, _ := loginTokens(t, a)
+	code, body := jsonRequest(a, "POST", "/webauthn/register/begin", "", token, nil, nil)
+	challenge := webauthnChallenge(t, code, body)
+	return jsonRequest(a, "POST", "/webauthn/register/finish", "", token, sa.create(challenge, format), nil)
+}
+
+func loginChallenge(t *testing.T, a *App) string {
+	code, body := jsonRequest(a, "POST", "/webauthn/login/begin", "", "", nil, nil)
+	return webauthnChallenge(t, code, body)
+}
+
+func passkeyLogin(t *testing.T, a *App, sa *softAuthenticator) (int, string) {
+	challenge := loginChallenge(t, a)
+	return jsonRequest(a, "POST", "/webauthn/login/finish", "", "", sa.get(challenge, 1), nil)
+}
+
+func TestWebAuthnRegister(t *testing.T) {
+	a := SetUp(t)
+
+	for _, format := range []string{"none", "packed"} {
+		sa := newSoftAuthenticator(t)
+		if code, body := registerPasskey(t, a, sa, format); code != 201 {
+			t.Errorf("%s: expected passkey registration to succeed, got %d %s", format, code, body)
+		}
+
+		if code, body := registerPasskey(t, a, sa, format); code != 400 || body != `{"error":"passkey is already registered"}` {
+			t.Errorf("%s: expected duplicate passkey to be refused, got %d %s", format, code, body)
+		}
+	}
+
+	creds, _ := a.Storage.GetWebAuthnCredentials(1)
+	if len(creds) != 2 || creds[0].Name != "test key" {
+		t.Errorf("Expected 2 stored credentials, got %+v", creds)
+	}
+}
+
+func TestWebAuthnRegisterInvalid(t *testing.T) {
+	a := SetUp(t)
+
+	tests := []struct {
+		name   string
+		modify func(sa *softAuthenticator)
+	}{
+		{"Wrong origin", func(sa *softAuthenticator) { sa.origin = "http://evil.com" }},
+		{"Wrong rp id", func(sa *softAuthenticator) { sa.rpID = "evil.com" }},
+	}
+
+	for _, test := range tests {
+		sa := newSoftAuthenticator(t)
+		test.modify(sa)
+		if code, body := registerPasskey(t, a, sa, "none"); code != 400 || body != `{"error":"passkey cannot be verified"}` {
+			t.Errorf("%s: expected registration to fail, got %d %s", test.name, code, body)
+		}
+	}
+}
+
+func TestWebAuthnLogin(t *testing.T) {
+	a := SetUp(t)
+
+	sa := newSoftAuthenticator(t)
+	if code, body := registerPasskey(t, a, sa, "none"); code != 201 {
+		t.Fatalf("Expected passkey registration to succeed, got %d %s", code, body)
+	}
+
+	code, body := passkeyLogin(t, a, sa)
+	if code != 200 {
+		t.Fatalf("Expected passkey login to succeed, got %d %s", code, body)
+	}
+	checkAMR(t, a, body, []string{AMRHardwareKey, AMRUser, AMRMFA})
+
+	// challenge is single use
+	challenge := loginChallenge(t, a)
+	assertion := sa.get(challenge, 1)
+	if code, _ := jsonRequest(a, "POST", "/webauthn/login/finish", "", "", assertion, nil); code != 200 {
+		t.Errorf("Expected second login to succeed, got %d", code)
+	}
+	if code, _ := jsonRequest(a, "POST", "/webauthn/login/finish", "", "", assertion, nil); code != 401 {
+		t.Errorf("Expected replayed assertion to be rejected, got %d", code)
+	}
+}
+
+func TestWebAuthnLoginInvalid(t *testing.T) {
+	a := SetUp(t)
+
+	sa := newSoftAuthenticator(t)
+	if code, body := registerPasskey(t, a, sa, "none"); code != 201 {
+		t.Fatalf("Expected passkey registration to succeed, got %d %s", code, body)
+	}
+
+	// cloned authenticator send counter we saw already
+	passkeyLogin(t, a, sa)
+	sa.count--
+	if code, body := passkeyLogin(t, a, sa); code != 401 || body != `{"error":"passkey cannot be verified"}` {
+		t.Errorf("Expected cloned authenticator to be rejected, got %d %s", code, body)
+	}
+
+	// signature by other key
+	sa.count += 10
+	sa.key, _ = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if code, _ := passkeyLogin(t, a, sa); code != 401 {
+		t.Errorf("Expected wrong signature to be rejected, got %d", code)
+	}
+
+	// unknown credential
+	if code, _ := passkeyLogin(t, a, newSoftAuthenticator(t)); code != 401 {
+		t.Errorf("Expected unknown credential to be rejected, got %d", code)
+	}
+}
+
+func TestWebAuthnLongName(t *testing.T) {
+	a := SetUp(t)
+	sa := newSoftAuthenticator(t)
+	token, _ := loginTokens(t, a)
+
+	code, body := jsonRequest(a, "POST", "/webauthn/register/begin", "", token, nil, nil)
+	req := sa.create(webauthnChallenge(t, code, body), "none")
+	req["name"] = strings.Repeat("ключ", 30)
+	if code, body := jsonRequest(a, "POST", "/webauthn/register/finish", "", token, req, nil); code != 201 {
+		t.Fatalf("Expected passkey registration to succeed, got %d %s", code, body)
+	}
+
+	creds, _ := a.Storage.GetWebAuthnCredentials(1)
+	if len(creds) != 1 || !utf8.ValidString(creds[0].Name) || utf8.RuneCountInString(creds[0].Name) != 100 {
+		t.Errorf("Expected name cut to 100 characters, got %q", creds[0].Name)
+	}
+}
+
+func TestWebAuthnChallengePurge(t *testing.T) {
+	a := SetUp(t)
+	storage := a.Storage.(*FakeStorage)
+	storage.CreateWebAuthnChallenge(&WebAuthnChallenge{ChallengeHash: "expired", ExpiresAt: time.Now().Add(-time.Minute)})
+
+	loginChallenge(t, a)
+	if _, ok := storage.webauthnChallenges["expired"]; ok || len(storage.webauthnChallenges) != 1 {
+		t.Errorf("Expected expired challenges to be purged, got %d challenges", len(storage.webauthnChallenges))
+	}
+}
+
+func TestWebAuthnLoginBeginLimited(t *testing.T) {
+	a := SetUp(t)
+
+	for i := 0; i < a.Config.RateLimits["login"].Limit; i++ {
+		loginChallenge(t, a)
+	}
+	if code, _ := jsonRequest(a, "POST", "/webauthn/login/begin", "", "", nil, nil); code != 429 {
+		t.Errorf("Expected login begin to be rate limited, got %d", code)
+	}
+}
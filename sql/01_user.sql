@@ -1,12 +1,30 @@
-DROP TABLE IF EXISTS users;
+DROP TABLE IF EXISTS users CASCADE;
 
 CREATE TABLE users(
   id  serial PRIMARY KEY,
   email varchar(255) not null default '',
   password  varchar(255) not null default '',
+  first_name  varchar(100) not null default '',
+  last_name  varchar(100) not null default '',
+  display_name  varchar(100) not null default '',
+  avatar_url  varchar(255) not null default '',
+  locale  varchar(35) not null default '',
+  timezone  varchar(64) not null default '',
   created_at  timestamp with time zone  not null DEFAULT current_timestamp,
-  last_login  timestamp with time zone  not null DEFAULT current_timestamp
+  last_login  timestamp with time zone  not null DEFAULT current_timestamp,
+  token_version  integer not null DEFAULT 0,
+  email_verified_at  timestamp with time zone,
+  totp_secret  varchar(64) not null default '',
+  totp_enabled_at  timestamp with time zone,
+  totp_last_counter  bigint not null DEFAULT 0,
+  disabled_at  timestamp with time zone,
+  failed_login_count  integer not null DEFAULT 0,
+  last_failed_login_at  timestamp with time zone,
+  locked_until  timestamp with time zone,
+  password_reset_at  timestamp with time zone,
+  active_org_id  integer,
+  tenant  varchar(64) not null default ''
 );
 
 
-create unique index email on users(email);
+create unique index email on users(tenant, email);
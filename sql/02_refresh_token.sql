@@ -0,0 +1,19 @@
+DROP TABLE IF EXISTS refresh_tokens;
+
+CREATE TABLE refresh_tokens(
+  id  serial PRIMARY KEY,
+  user_id  integer not null REFERENCES users(id) ON DELETE CASCADE,
+  family_id  varchar(64) not null,
+  token_hash  varchar(64) not null,
+  amr  varchar(64) not null default '',
+  session_id  integer,
+  created_at  timestamp with time zone  not null DEFAULT current_timestamp,
+  expires_at  timestamp with time zone  not null,
+  used_at  timestamp with time zone,
+  revoked_at  timestamp with time zone
+);
+
+
+create unique index refresh_token_hash on refresh_tokens(token_hash);
+create index refresh_token_family on refresh_tokens(family_id);
+create index refresh_token_expires on refresh_tokens(expires_at);
@@ -0,0 +1,11 @@
+DROP TABLE IF EXISTS revoked_tokens;
+
+CREATE TABLE revoked_tokens(
+  jti  varchar(64) PRIMARY KEY,
+  user_id  integer not null REFERENCES users(id) ON DELETE CASCADE,
+  revoked_at  timestamp with time zone  not null DEFAULT current_timestamp,
+  expires_at  timestamp with time zone  not null
+);
+
+
+create index revoked_token_expires on revoked_tokens(expires_at);
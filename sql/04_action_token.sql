@@ -0,0 +1,16 @@
+DROP TABLE IF EXISTS action_tokens;
+
+CREATE TABLE action_tokens(
+  id  serial PRIMARY KEY,
+  user_id  integer not null REFERENCES users(id) ON DELETE CASCADE,
+  purpose  varchar(32) not null,
+  token_hash  varchar(64) not null,
+  data  varchar(255) not null default '',
+  created_at  timestamp with time zone  not null DEFAULT current_timestamp,
+  expires_at  timestamp with time zone  not null,
+  used_at  timestamp with time zone
+);
+
+
+create unique index action_token_hash on action_tokens(token_hash);
+create index action_token_expires on action_tokens(expires_at);
@@ -0,0 +1,12 @@
+DROP TABLE IF EXISTS recovery_codes;
+
+CREATE TABLE recovery_codes(
+  id  serial PRIMARY KEY,
+  user_id  integer not null REFERENCES users(id) ON DELETE CASCADE,
+  code_hash  varchar(64) not null,
+  created_at  timestamp with time zone  not null DEFAULT current_timestamp,
+  used_at  timestamp with time zone
+);
+
+
+create unique index recovery_code_hash on recovery_codes(user_id, code_hash);
@@ -0,0 +1,30 @@
+DROP TABLE IF EXISTS webauthn_challenges;
+DROP TABLE IF EXISTS webauthn_credentials;
+
+CREATE TABLE webauthn_challenges(
+  id  serial PRIMARY KEY,
+  user_id  integer REFERENCES users(id) ON DELETE CASCADE,
+  purpose  varchar(32) not null,
+  challenge_hash  varchar(64) not null,
+  created_at  timestamp with time zone  not null DEFAULT current_timestamp,
+  expires_at  timestamp with time zone  not null,
+  used_at  timestamp with time zone
+);
+
+CREATE TABLE webauthn_credentials(
+  id  serial PRIMARY KEY,
+  user_id  integer not null REFERENCES users(id) ON DELETE CASCADE,
+  credential_id  bytea not null,
+  public_key  bytea not null,
+  sign_count  bigint not null DEFAULT 0,
+  aaguid  bytea not null,
+  name  varchar(100) not null default '',
+  created_at  timestamp with time zone  not null DEFAULT current_timestamp,
+  last_used_at  timestamp with time zone
+);
+
+
+create unique index webauthn_challenge_hash on webauthn_challenges(challenge_hash);
+create index webauthn_challenge_expires on webauthn_challenges(expires_at);
+create unique index webauthn_credential_id on webauthn_credentials(credential_id);
+create index webauthn_credential_user on webauthn_credentials(user_id);
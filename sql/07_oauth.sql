@@ -0,0 +1,29 @@
+DROP TABLE IF EXISTS oauth_states;
+DROP TABLE IF EXISTS identities;
+
+CREATE TABLE oauth_states(
+  id  serial PRIMARY KEY,
+  provider  varchar(32) not null,
+  state_hash  varchar(64) not null,
+  nonce  varchar(64) not null,
+  code_verifier  varchar(64) not null,
+  tenant  varchar(64) not null default '',
+  created_at  timestamp with time zone  not null DEFAULT current_timestamp,
+  expires_at  timestamp with time zone  not null,
+  used_at  timestamp with time zone
+);
+
+CREATE TABLE identities(
+  id  serial PRIMARY KEY,
+  user_id  integer not null REFERENCES users(id) ON DELETE CASCADE,
+  provider  varchar(32) not null,
+  subject  varchar(255) not null,
+  email  varchar(255) not null default '',
+  tenant  varchar(64) not null default '',
+  created_at  timestamp with time zone  not null DEFAULT current_timestamp
+);
+
+
+create unique index oauth_state_hash on oauth_states(state_hash);
+create unique index identity_subject on identities(tenant, provider, subject);
+create index identity_user on identities(user_id);
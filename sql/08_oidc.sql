@@ -0,0 +1,28 @@
+DROP TABLE IF EXISTS authorization_codes;
+DROP TABLE IF EXISTS clients;
+
+CREATE TABLE clients(
+  id  varchar(64) PRIMARY KEY,
+  secret_hash  varchar(64) not null default '',
+  name  varchar(100) not null,
+  redirect_uris  text[] not null,
+  created_at  timestamp with time zone  not null DEFAULT current_timestamp
+);
+
+CREATE TABLE authorization_codes(
+  id  serial PRIMARY KEY,
+  code_hash  varchar(64) not null,
+  client_id  varchar(64) not null REFERENCES clients(id) ON DELETE CASCADE,
+  user_id  integer not null REFERENCES users(id) ON DELETE CASCADE,
+  redirect_uri  text not null,
+  scope  varchar(255) not null,
+  nonce  varchar(255) not null default '',
+  code_challenge  varchar(128) not null default '',
+  amr  varchar(64) not null default '',
+  created_at  timestamp with time zone  not null DEFAULT current_timestamp,
+  expires_at  timestamp with time zone  not null,
+  used_at  timestamp with time zone
+);
+
+
+create unique index authorization_code_hash on authorization_codes(code_hash);
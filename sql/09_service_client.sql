@@ -0,0 +1,9 @@
+DROP TABLE IF EXISTS service_clients;
+
+CREATE TABLE service_clients(
+  id  varchar(64) PRIMARY KEY,
+  secret_hash  varchar(64) not null,
+  name  varchar(100) not null,
+  scopes  text[] not null default '{}',
+  created_at  timestamp with time zone  not null DEFAULT current_timestamp
+);
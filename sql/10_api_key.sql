@@ -0,0 +1,18 @@
+DROP TABLE IF EXISTS api_keys;
+
+CREATE TABLE api_keys(
+  id  serial PRIMARY KEY,
+  user_id  integer not null REFERENCES users(id) ON DELETE CASCADE,
+  name  varchar(100) not null,
+  prefix  varchar(16) not null,
+  key_hash  varchar(64) not null,
+  scopes  text[] not null default '{}',
+  expires_at  timestamp with time zone,
+  created_at  timestamp with time zone  not null DEFAULT current_timestamp,
+  last_used_at  timestamp with time zone,
+  revoked_at  timestamp with time zone
+);
+
+
+create unique index api_key_prefix on api_keys(prefix);
+create index api_key_user on api_keys(user_id);
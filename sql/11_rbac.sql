@@ -0,0 +1,34 @@
+DROP TABLE IF EXISTS user_roles;
+DROP TABLE IF EXISTS role_permissions;
+DROP TABLE IF EXISTS permissions;
+DROP TABLE IF EXISTS roles;
+
+CREATE TABLE roles(
+  id  serial PRIMARY KEY,
+  name  varchar(100) not null,
+  description  varchar(255) not null default '',
+  created_at  timestamp with time zone  not null DEFAULT current_timestamp
+);
+
+create unique index role_name on roles(name);
+
+CREATE TABLE permissions(
+  id  serial PRIMARY KEY,
+  name  varchar(100) not null,
+  created_at  timestamp with time zone  not null DEFAULT current_timestamp
+);
+
+create unique index permission_name on permissions(name);
+
+CREATE TABLE role_permissions(
+  role_id  integer not null REFERENCES roles(id) ON DELETE CASCADE,
+  permission_id  integer not null REFERENCES permissions(id) ON DELETE CASCADE,
+  PRIMARY KEY (role_id, permission_id)
+);
+
+CREATE TABLE user_roles(
+  user_id  integer not null REFERENCES users(id) ON DELETE CASCADE,
+  role_id  integer not null REFERENCES roles(id) ON DELETE CASCADE,
+  created_at  timestamp with time zone  not null DEFAULT current_timestamp,
+  PRIMARY KEY (user_id, role_id)
+);
@@ -0,0 +1,14 @@
+DROP TABLE IF EXISTS audit_log;
+
+CREATE TABLE audit_log(
+  id  serial PRIMARY KEY,
+  actor_id  integer REFERENCES users(id) ON DELETE SET NULL,
+  action  varchar(64) not null,
+  target_id  integer,
+  details  jsonb not null default '{}',
+  ip  varchar(64) not null default '',
+  created_at  timestamp with time zone  not null DEFAULT current_timestamp
+);
+
+
+create index audit_log_target on audit_log(target_id, created_at);
@@ -0,0 +1,11 @@
+DROP TABLE IF EXISTS rate_limits;
+
+CREATE TABLE rate_limits(
+  key  varchar(255) PRIMARY KEY,
+  tokens  double precision not null,
+  updated_at  timestamp with time zone  not null,
+  full_at  timestamp with time zone  not null DEFAULT current_timestamp
+);
+
+
+create index rate_limit_full on rate_limits(full_at);
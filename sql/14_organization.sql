@@ -0,0 +1,37 @@
+DROP TABLE IF EXISTS invitations;
+DROP TABLE IF EXISTS memberships;
+DROP TABLE IF EXISTS organizations;
+
+CREATE TABLE organizations(
+  id  serial PRIMARY KEY,
+  name  varchar(100) not null,
+  tenant  varchar(64) not null default '',
+  created_at  timestamp with time zone  not null DEFAULT current_timestamp
+);
+
+CREATE TABLE memberships(
+  org_id  integer not null REFERENCES organizations(id) ON DELETE CASCADE,
+  user_id  integer not null REFERENCES users(id) ON DELETE CASCADE,
+  role  varchar(16) not null,
+  created_at  timestamp with time zone  not null DEFAULT current_timestamp,
+  PRIMARY KEY (org_id, user_id)
+);
+
+create index membership_user on memberships(user_id);
+
+CREATE TABLE invitations(
+  id  serial PRIMARY KEY,
+  org_id  integer not null REFERENCES organizations(id) ON DELETE CASCADE,
+  email  varchar(255) not null,
+  role  varchar(16) not null,
+  token_hash  varchar(64) not null,
+  invited_by  integer REFERENCES users(id) ON DELETE SET NULL,
+  expires_at  timestamp with time zone  not null,
+  created_at  timestamp with time zone  not null DEFAULT current_timestamp,
+  accepted_at  timestamp with time zone,
+  revoked_at  timestamp with time zone
+);
+
+
+create unique index invitation_token on invitations(token_hash);
+create index invitation_org on invitations(org_id);
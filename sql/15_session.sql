@@ -0,0 +1,20 @@
+DROP TABLE IF EXISTS sessions;
+
+CREATE TABLE sessions(
+  id  serial PRIMARY KEY,
+  user_id  integer not null REFERENCES users(id) ON DELETE CASCADE,
+  token_hash  varchar(64),
+  csrf_hash  varchar(64) not null,
+  token_version  integer not null DEFAULT 0,
+  amr  varchar(64) not null default '',
+  user_agent  varchar(255) not null default '',
+  ip  varchar(64) not null default '',
+  created_at  timestamp with time zone  not null DEFAULT current_timestamp,
+  last_seen_at  timestamp with time zone  not null DEFAULT current_timestamp,
+  expires_at  timestamp with time zone  not null,
+  revoked_at  timestamp with time zone
+);
+
+
+create unique index session_token_hash on sessions(token_hash);
+create index session_user on sessions(user_id);